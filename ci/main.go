@@ -1,3 +1,5 @@
+// Command dagger-ci runs merlin's CI pipeline. The pipeline itself lives in
+// the pipeline package, for tools that embed it.
 package main
 
 import (
@@ -5,64 +7,12 @@ import (
 	"fmt"
 	"os"
 
-	"dagger.io/dagger"
+	"dagger-ci/pipeline"
 )
 
 func main() {
-	ctx := context.Background()
-
-	// initialize Dagger client
-	client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
-	if err != nil {
-		panic(err)
-	}
-	defer client.Close()
-
-	// get reference to the local project
-	src := client.Host().Directory("/Users/a/code/merlin")
-
-	// get `rust` image
-	rust := client.Container().From("rust:latest")
-
-	// mount cloned repository into `rust` image
-	rust = rust.WithDirectory("/src", src).WithWorkdir("/src")
-
-	// define the application build
-	path := "target/release/merlin"
-	rust = rust.WithExec([]string{"cargo", "build", "--release"})
-
-	// get reference to build output directory in container
-	output := rust.Directory("/src/target/release")
-
-	// write contents of container build/ directory to the host
-	_, err = output.Export(ctx, "./build")
-	if err != nil {
-		panic(err)
+	if err := pipeline.Main(context.Background(), os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(pipeline.ExitCode(err))
 	}
-
-	// run tests
-	test := rust.WithExec([]string{"cargo", "test"})
-	out, err := test.Stdout(ctx)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Println("Tests output:", out)
-
-	// run clippy for linting
-	lint := rust.WithExec([]string{"cargo", "clippy", "--", "-D", "warnings"})
-	lintOut, err := lint.Stdout(ctx)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Println("Clippy output:", lintOut)
-
-	// check formatting
-	format := rust.WithExec([]string{"cargo", "fmt", "--check"})
-	fmtOut, err := format.Stdout(ctx)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Println("Format check output:", fmtOut)
-
-	fmt.Printf("Application built successfully at %s\n", path)
 }
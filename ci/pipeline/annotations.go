@@ -0,0 +1,180 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// -annotations settings
+const (
+	annotationsAuto = "auto"
+	annotationsOn   = "on"
+	annotationsOff  = "off"
+)
+
+// Diagnostic is a problem reported at a location in the sources. Col is 0
+// when the tool reports no column.
+type Diagnostic struct {
+	Level   string // "error" or "warning"
+	File    string
+	Line    int
+	Col     int
+	Message string
+}
+
+// resolveAnnotations decides whether to emit workflow commands. auto
+// enables them inside GitHub Actions, which sets GITHUB_ACTIONS=true.
+func resolveAnnotations(setting, githubActions string) (bool, error) {
+	switch setting {
+	case annotationsAuto:
+		return githubActions == "true", nil
+	case annotationsOn:
+		return true, nil
+	case annotationsOff:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid -annotations %q (valid: %s, %s, %s)", setting, annotationsAuto, annotationsOn, annotationsOff)
+}
+
+var (
+	// rustc and clippy start a diagnostic with `error[E0425]: message` or
+	// `warning: message`, and point at its primary span on a later line
+	// with `  --> src/main.rs:10:9`
+	diagnosticHeaderPattern   = regexp.MustCompile(`^(error|warning)(?:\[[A-Za-z0-9_:]+\])?: (.+)$`)
+	diagnosticLocationPattern = regexp.MustCompile(`^\s*--> (.+):(\d+):(\d+)$`)
+
+	// rustfmt prints `Diff in /src/src/main.rs:12:`, or
+	// `Diff in /src/src/main.rs at line 12:` before version 1.6
+	fmtDiffPattern = regexp.MustCompile(`^Diff in (.+?)(?::| at line )(\d+):$`)
+
+	// a failing test panics with `thread 'tests::parse' panicked at
+	// src/lib.rs:42:5:` followed by the message, or before Rust 1.73 with
+	// `thread 'tests::parse' panicked at 'message', src/lib.rs:42:5`
+	testPanicPattern    = regexp.MustCompile(`^thread '([^']+)' panicked at (.+):(\d+):(\d+):$`)
+	testPanicOldPattern = regexp.MustCompile(`^thread '([^']+)' panicked at '(.*)', (.+):(\d+):(\d+)$`)
+)
+
+// parseDiagnostics extracts the located errors and warnings from rustc or
+// clippy output. Summaries such as `error: could not compile` have no
+// location and are skipped.
+func parseDiagnostics(output string) []Diagnostic {
+	var (
+		diags   []Diagnostic
+		pending *Diagnostic
+	)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := diagnosticHeaderPattern.FindStringSubmatch(line); m != nil {
+			pending = &Diagnostic{Level: m[1], Message: m[2]}
+			continue
+		}
+		if m := diagnosticLocationPattern.FindStringSubmatch(line); m != nil && pending != nil {
+			pending.File = m[1]
+			pending.Line, _ = strconv.Atoi(m[2])
+			pending.Col, _ = strconv.Atoi(m[3])
+			diags = append(diags, *pending)
+			pending = nil
+		}
+	}
+	return diags
+}
+
+// parseFmtDiff returns one error per hunk of `cargo fmt --check` output.
+// rustfmt names files by absolute path, so root is stripped from them.
+func parseFmtDiff(output, root string) []Diagnostic {
+	var diags []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		m := fmtDiffPattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		file := strings.TrimPrefix(m[1], strings.TrimSuffix(root, "/")+"/")
+		diags = append(diags, Diagnostic{Level: "error", File: file, Line: n, Message: "code is not formatted, run cargo fmt"})
+	}
+	return diags
+}
+
+// parseTestFailures returns the location and message of every test panic
+// in cargo test output.
+func parseTestFailures(output string) []Diagnostic {
+	var diags []Diagnostic
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if m := testPanicPattern.FindStringSubmatch(line); m != nil {
+			msg := "test " + m[1] + " failed"
+			if i+1 < len(lines) {
+				if next := strings.TrimSpace(lines[i+1]); next != "" {
+					msg += ": " + next
+				}
+			}
+			diags = append(diags, testDiagnostic(m[2], m[3], m[4], msg))
+		} else if m := testPanicOldPattern.FindStringSubmatch(line); m != nil {
+			diags = append(diags, testDiagnostic(m[3], m[4], m[5], "test "+m[1]+" failed: "+m[2]))
+		}
+	}
+	return diags
+}
+
+func testDiagnostic(file, line, col, msg string) Diagnostic {
+	l, _ := strconv.Atoi(line)
+	c, _ := strconv.Atoi(col)
+	return Diagnostic{Level: "error", File: file, Line: l, Col: c, Message: msg}
+}
+
+// stageDiagnostics parses the output of a failed stage, or returns nil for
+// stages whose output has no known format.
+func stageDiagnostics(err error) (string, []Diagnostic) {
+	var stageErr *stageError
+	if !errors.As(err, &stageErr) {
+		return "", nil
+	}
+	// platform and matrix stages are named e.g. `build (linux/arm64)`
+	stage, _, _ := strings.Cut(stageErr.stage, " ")
+	switch stage {
+	case stageBuild, stageClippy, stageMSRV, stageMusl, stagePGO, stagePrefetch:
+		return stage, parseDiagnostics(stageErr.stderr)
+	case stageFmt:
+		return stage, parseFmtDiff(stageErr.stdout, "/src")
+	case stageTest:
+		return stage, parseTestFailures(stageErr.stdout)
+	case stageCoverageDiff:
+		return stage, parseUncoveredLines(stageErr.stderr)
+	}
+	return stage, nil
+}
+
+// writeAnnotations prints a workflow command for every diagnostic in the
+// output of a failed stage, so GitHub shows it inline on the diff. Paths
+// are relative to the project, which is subpath in the repository.
+func writeAnnotations(w io.Writer, err error, subpath string) {
+	stage, diags := stageDiagnostics(err)
+	for _, d := range diags {
+		file := d.File
+		if subpath != "" {
+			file = path.Join(subpath, file)
+		}
+		props := []string{"file=" + escapeProperty(file), "line=" + strconv.Itoa(d.Line)}
+		if d.Col > 0 {
+			props = append(props, "col="+strconv.Itoa(d.Col))
+		}
+		props = append(props, "title="+escapeProperty(stage))
+		fmt.Fprintf(w, "::%s %s::%s\n", d.Level, strings.Join(props, ","), escapeData(d.Message))
+	}
+}
+
+// escapeData escapes a workflow command message.
+func escapeData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeProperty escapes a workflow command property value.
+func escapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	output := `    Checking merlin v0.1.0 (/src)
+error[E0425]: cannot find value ` + "`cfg`" + ` in this scope
+  --> src/main.rs:10:9
+   |
+10 |     run(cfg);
+   |         ^^^ not found in this scope
+
+warning: unused variable: ` + "`x`" + `
+ --> src/lib.rs:3:9
+  |
+3 |     let x = 1;
+  |         ^ help: if this is intentional, prefix it with an underscore: ` + "`_x`" + `
+  |
+  = note: ` + "`#[warn(unused_variables)]`" + ` on by default
+
+error: this ` + "`if`" + ` has identical blocks
+   --> src/server/routes.rs:120:17
+    |
+   ::: src/server/mod.rs:4:1
+error: could not compile ` + "`merlin`" + ` (bin "merlin") due to 2 previous errors
+warning: build failed, waiting for other jobs to finish...
+`
+	want := []Diagnostic{
+		{Level: "error", File: "src/main.rs", Line: 10, Col: 9, Message: "cannot find value `cfg` in this scope"},
+		{Level: "warning", File: "src/lib.rs", Line: 3, Col: 9, Message: "unused variable: `x`"},
+		{Level: "error", File: "src/server/routes.rs", Line: 120, Col: 17, Message: "this `if` has identical blocks"},
+	}
+	if got := parseDiagnostics(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDiagnostics =\n%+v\nwant\n%+v", got, want)
+	}
+
+	if got := parseDiagnostics("error: could not find `Cargo.toml` in `/src`\n"); len(got) != 0 {
+		t.Errorf("parseDiagnostics(no locations) = %+v, want none", got)
+	}
+}
+
+func TestParseFmtDiff(t *testing.T) {
+	output := `Diff in /src/src/main.rs:12:
+ fn main() {
+-    let x=1;
++    let x = 1;
+Diff in /src/src/lib.rs at line 3:
+`
+	want := []Diagnostic{
+		{Level: "error", File: "src/main.rs", Line: 12, Message: "code is not formatted, run cargo fmt"},
+		{Level: "error", File: "src/lib.rs", Line: 3, Message: "code is not formatted, run cargo fmt"},
+	}
+	if got := parseFmtDiff(output, "/src"); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFmtDiff =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseTestFailures(t *testing.T) {
+	output := `running 2 tests
+test config::tests::parse ... FAILED
+
+failures:
+
+---- config::tests::parse stdout ----
+thread 'config::tests::parse' panicked at src/config.rs:42:5:
+assertion ` + "`left == right`" + ` failed
+  left: 1
+ right: 2
+thread 'old::style' panicked at 'called ` + "`Option::unwrap()`" + ` on a ` + "`None`" + ` value', src/old.rs:7:13
+`
+	want := []Diagnostic{
+		{Level: "error", File: "src/config.rs", Line: 42, Col: 5, Message: "test config::tests::parse failed: assertion `left == right` failed"},
+		{Level: "error", File: "src/old.rs", Line: 7, Col: 13, Message: "test old::style failed: called `Option::unwrap()` on a `None` value"},
+	}
+	if got := parseTestFailures(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTestFailures =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestWriteAnnotations(t *testing.T) {
+	err := &stageError{
+		stage:    stageClippy,
+		exitCode: 101,
+		stderr:   "error: useless use of `format!`, 100% sure\n  --> src/a,b.rs:5:13\n",
+	}
+	var b strings.Builder
+	writeAnnotations(&b, err, "services/merlin")
+	want := "::error file=services/merlin/src/a%2Cb.rs,line=5,col=13,title=clippy::useless use of `format!`, 100%25 sure\n"
+	if b.String() != want {
+		t.Errorf("writeAnnotations = %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	writeAnnotations(&b, &stageError{stage: stageAudit, exitCode: 1, stderr: "error: x\n --> y.rs:1:1\n"}, "")
+	if b.Len() != 0 {
+		t.Errorf("writeAnnotations(audit) = %q, want nothing", b.String())
+	}
+}
+
+func TestResolveAnnotations(t *testing.T) {
+	tests := []struct {
+		setting, env string
+		want         bool
+	}{
+		{annotationsAuto, "true", true},
+		{annotationsAuto, "", false},
+		{annotationsOn, "", true},
+		{annotationsOff, "true", false},
+	}
+	for _, tt := range tests {
+		got, err := resolveAnnotations(tt.setting, tt.env)
+		if err != nil || got != tt.want {
+			t.Errorf("resolveAnnotations(%q, %q) = %v, %v, want %v", tt.setting, tt.env, got, err, tt.want)
+		}
+	}
+	if _, err := resolveAnnotations("yes", ""); err == nil {
+		t.Error("resolveAnnotations accepted an invalid setting")
+	}
+}
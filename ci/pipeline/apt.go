@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageApt = "apt-packages"
+
+// apt's package cache and index, mounted as cache volumes. They are shared
+// by every toolchain and platform; apt locks them itself, and the LOCKED
+// sharing mode keeps concurrent installs from failing on that lock.
+const (
+	cacheAptArchives = "apt-archives"
+	cacheAptLists    = "apt-lists"
+	aptArchivesDir   = "/var/cache/apt"
+	aptListsDir      = "/var/lib/apt/lists"
+)
+
+// aptPackagePattern matches a Debian package name with an optional
+// architecture and version, e.g. libssl-dev:arm64 or
+// protobuf-compiler=3.21.12-3. The names end up in a shell command, so
+// nothing else is accepted.
+var aptPackagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*(:[a-z0-9-]+)?(=[A-Za-z0-9.+~:-]+)?$`)
+
+// parseAptPackages splits the -apt-packages values, each a list separated
+// by commas or spaces, and validates every name.
+func parseAptPackages(values []string) ([]string, error) {
+	var pkgs []string
+	for _, v := range values {
+		for _, name := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if !aptPackagePattern.MatchString(name) {
+				return nil, fmt.Errorf("invalid -apt-packages entry %q", name)
+			}
+			pkgs = append(pkgs, name)
+		}
+	}
+	return pkgs, nil
+}
+
+// aptInstallScript installs pkgs. The stock Debian images delete every
+// downloaded package after installing it, which would leave the cache
+// volume empty, so that hook is disabled first.
+func aptInstallScript(pkgs []string) string {
+	return strings.Join([]string{
+		"set -e",
+		"rm -f /etc/apt/apt.conf.d/docker-clean",
+		`echo 'Binary::apt::APT::Keep-Downloaded-Packages "true";' > /etc/apt/apt.conf.d/keep-cache`,
+		"apt-get update",
+		"DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends " + strings.Join(pkgs, " "),
+	}, "\n")
+}
+
+// withAptPackages installs the -apt-packages into ctr. It runs on the bare
+// base image, before the sources are mounted, so the engine reuses the
+// installed layer until the package list or the image changes.
+func withAptPackages(client *dagger.Client, ctr *dagger.Container, opts Options) *dagger.Container {
+	if len(opts.aptPackages) == 0 {
+		return ctr
+	}
+	if !opts.noCache {
+		locked := dagger.ContainerWithMountedCacheOpts{Sharing: dagger.Locked}
+		ctr = ctr.
+			WithMountedCache(aptArchivesDir, client.CacheVolume(cacheName(opts.cachePrefix, cacheAptArchives)), locked).
+			WithMountedCache(aptListsDir, client.CacheVolume(cacheName(opts.cachePrefix, cacheAptLists)), locked)
+	}
+	ctr = ctr.WithExec([]string{"sh", "-c", aptInstallScript(opts.aptPackages)})
+	if !opts.noCache {
+		ctr = ctr.WithoutMount(aptArchivesDir).WithoutMount(aptListsDir)
+	}
+	return ctr
+}
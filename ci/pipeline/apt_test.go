@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAptPackages(t *testing.T) {
+	got, err := parseAptPackages([]string{"libssl-dev,protobuf-compiler", "libpq-dev:arm64 clang=1:14.0-55.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"libssl-dev", "protobuf-compiler", "libpq-dev:arm64", "clang=1:14.0-55.7"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAptPackages = %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{"libssl-dev;rm -rf /", "$(id)", "-y"} {
+		if _, err := parseAptPackages([]string{bad}); err == nil {
+			t.Errorf("parseAptPackages(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestAptOptions(t *testing.T) {
+	opts, err := ParseOptions([]string{"-base-image=ghcr.io/awdemos/rust-builder:1.75", "-base-registry-anonymous", "-apt-packages=libssl-dev", "-apt-packages=protobuf-compiler"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.baseImage != "ghcr.io/awdemos/rust-builder:1.75" {
+		t.Errorf("baseImage = %q", opts.baseImage)
+	}
+	script := aptInstallScript(opts.aptPackages)
+	if !strings.HasSuffix(script, "apt-get install -y --no-install-recommends libssl-dev protobuf-compiler") {
+		t.Errorf("aptInstallScript =\n%s", script)
+	}
+}
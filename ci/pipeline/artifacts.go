@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// stageExport is the step exporting the artifacts the checks registered.
+const stageExport = "export"
+
+// artifact kinds
+const (
+	artifactBinary     = "binary"
+	artifactChecksums  = "checksums"
+	artifactReport     = "report"
+	artifactDocs       = "docs"
+	artifactArchive    = "archive"
+	artifactSignature  = "signature"
+	artifactProvenance = "provenance"
+	artifactSources    = "sources"
+)
+
+// Artifact is a file or directory a stage produced on the host.
+type Artifact struct {
+	Name string // the stage that produced it
+	Path string // host path
+	Kind string
+
+	// export writes a container artifact to Path; nil when the stage
+	// wrote Path itself
+	export func(ctx context.Context) error
+}
+
+// artifactRegistry collects the artifacts of a run. Stages, including the
+// concurrently running checks, register what they produced, and
+// exportArtifacts performs the pending container exports one at a time,
+// so no two of them write to the same host path. It is safe for
+// concurrent use.
+type artifactRegistry struct {
+	mu        sync.Mutex
+	artifacts []Artifact
+	done      map[string]bool // host paths that exist
+	conflicts []error
+}
+
+func newArtifactRegistry() *artifactRegistry {
+	return &artifactRegistry{done: make(map[string]bool)}
+}
+
+// registerPath records a host path the stage name already wrote.
+func (r *artifactRegistry) registerPath(name, kind, path string) {
+	r.register(Artifact{Name: name, Path: path, Kind: kind})
+}
+
+// registerFile records a container file for exportArtifacts to export to
+// path.
+func (r *artifactRegistry) registerFile(name, kind, path string, f *dagger.File) {
+	r.register(Artifact{Name: name, Path: path, Kind: kind, export: func(ctx context.Context) error {
+		_, err := f.Export(ctx, path)
+		return err
+	}})
+}
+
+// registerDirectory records a container directory for exportArtifacts to
+// export to path.
+func (r *artifactRegistry) registerDirectory(name, kind, path string, dir *dagger.Directory) {
+	r.register(Artifact{Name: name, Path: path, Kind: kind, export: func(ctx context.Context) error {
+		_, err := dir.Export(ctx, path)
+		return err
+	}})
+}
+
+// register adds a, ignoring a stage registering the same path twice. A
+// path another stage registered, or one overlapping another pending
+// export, is a conflict that exportArtifacts reports instead of letting
+// one export overwrite the other.
+func (r *artifactRegistry) register(a Artifact) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, other := range r.artifacts {
+		switch {
+		case filepath.Clean(other.Path) == filepath.Clean(a.Path):
+			if other.Name != a.Name {
+				r.conflicts = append(r.conflicts, fmt.Errorf("%s and %s both write %s", other.Name, a.Name, a.Path))
+			}
+			return
+		case a.export != nil && other.export != nil && !r.done[other.Path] && pathsOverlap(other.Path, a.Path):
+			r.conflicts = append(r.conflicts, fmt.Errorf("%s writes %s, which overlaps %s of %s", a.Name, a.Path, other.Path, other.Name))
+			return
+		}
+	}
+	r.artifacts = append(r.artifacts, a)
+	if a.export == nil {
+		r.done[a.Path] = true
+	}
+}
+
+// pathsOverlap reports whether one of two host paths lies inside the
+// other.
+func pathsOverlap(a, b string) bool {
+	inside := func(path, dir string) bool {
+		rel, err := filepath.Rel(dir, path)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+	}
+	return inside(a, b) || inside(b, a)
+}
+
+// pending reports whether any registered export has yet to run.
+func (r *artifactRegistry) pending() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range r.artifacts {
+		if !r.done[a.Path] {
+			return true
+		}
+	}
+	return len(r.conflicts) > 0
+}
+
+// exportArtifacts performs the pending exports and, when result is not
+// nil, records the host paths of every artifact on the host into it. A
+// failed export is reported along with any conflict and leaves its path
+// out of result.
+func (r *artifactRegistry) exportArtifacts(ctx context.Context, result *RunResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	errs := append([]error(nil), r.conflicts...)
+	r.conflicts = nil
+	// a failed export is dropped rather than retried by a later call
+	kept := r.artifacts[:0]
+	for _, a := range r.artifacts {
+		if !r.done[a.Path] {
+			if err := a.export(ctx); err != nil {
+				errs = append(errs, stageFailed(a.Name, fmt.Errorf("export %s: %w", a.Path, err)))
+				continue
+			}
+			r.done[a.Path] = true
+		}
+		kept = append(kept, a)
+	}
+	r.artifacts = kept
+	if result != nil {
+		result.Artifacts = r.pathsLocked()
+	}
+	return errors.Join(errs...)
+}
+
+// paths returns the host paths of the artifacts on the host, in the order
+// they were registered.
+func (r *artifactRegistry) paths() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pathsLocked()
+}
+
+func (r *artifactRegistry) pathsLocked() []string {
+	paths := []string{}
+	for _, a := range r.artifacts {
+		if r.done[a.Path] {
+			paths = append(paths, a.Path)
+		}
+	}
+	return paths
+}
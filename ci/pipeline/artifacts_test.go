@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestArtifactRegistry(t *testing.T) {
+	reg := newArtifactRegistry()
+	exports := 0
+	exported := func(ctx context.Context) error { exports++; return nil }
+
+	reg.registerPath(stageBuild, artifactBinary, "build/merlin")
+	reg.register(Artifact{Name: stageDocs, Path: "build/docs", Kind: artifactDocs, export: exported})
+	// a stage registering its path twice is exported once
+	reg.register(Artifact{Name: stageDocs, Path: "build/docs/", Kind: artifactDocs, export: exported})
+	if !reg.pending() {
+		t.Error("pending = false with an export registered")
+	}
+	if got, want := reg.paths(), []string{"build/merlin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paths before export = %q, want %q", got, want)
+	}
+
+	var result RunResult
+	if err := reg.exportArtifacts(context.Background(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if exports != 1 {
+		t.Errorf("exported %d times, want 1", exports)
+	}
+	if want := []string{"build/merlin", "build/docs"}; !reflect.DeepEqual(result.Artifacts, want) {
+		t.Errorf("result.Artifacts = %q, want %q", result.Artifacts, want)
+	}
+	if reg.pending() {
+		t.Error("pending = true after the export")
+	}
+}
+
+func TestArtifactRegistryConflicts(t *testing.T) {
+	reg := newArtifactRegistry()
+	noop := func(ctx context.Context) error { return nil }
+	reg.register(Artifact{Name: stageDocs, Path: "build/docs", export: noop})
+	reg.register(Artifact{Name: stageCoverage, Path: "build/docs"})
+	reg.register(Artifact{Name: stageMusl, Path: "build/docs/merlin", export: noop})
+
+	err := reg.exportArtifacts(context.Background(), nil)
+	if err == nil {
+		t.Fatal("exportArtifacts with conflicting paths succeeded, want error")
+	}
+	for _, want := range []string{"docs and coverage both write build/docs", "musl writes build/docs/merlin, which overlaps build/docs of docs"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+}
+
+func TestArtifactRegistryFailedExport(t *testing.T) {
+	reg := newArtifactRegistry()
+	reg.register(Artifact{Name: stageDocs, Path: "build/docs", export: func(ctx context.Context) error {
+		return errors.New("disk full")
+	}})
+
+	var result RunResult
+	if err := reg.exportArtifacts(context.Background(), &result); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("exportArtifacts = %v, want the export error", err)
+	}
+	if len(result.Artifacts) != 0 {
+		t.Errorf("result.Artifacts = %q, want the failed export left out", result.Artifacts)
+	}
+	if err := reg.exportArtifacts(context.Background(), &result); err != nil {
+		t.Errorf("second exportArtifacts = %v, want the failed export not retried", err)
+	}
+}
+
+func TestArtifactRegistryConcurrent(t *testing.T) {
+	reg := newArtifactRegistry()
+	var wg sync.WaitGroup
+	for _, name := range []string{stageTest, stageClippy, stageSBOM, stageDeny} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			reg.registerPath(name, artifactReport, "build/"+name)
+		}(name)
+	}
+	wg.Wait()
+	if got := len(reg.paths()); got != 4 {
+		t.Errorf("registered %d paths, want 4", got)
+	}
+}
@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageVerifyAssets = "verify-assets"
+
+// assetMarkerScript greps the binary, $0, for each marker passed as an
+// argument, so the markers never pass through the shell's parser. It
+// reports every marker on its own line and exits 1 if any is missing.
+const assetMarkerScript = `missing=0
+for m in "$@"; do
+	if grep -qaF -- "$m" "$0"; then
+		echo "found: $m"
+	else
+		echo "missing: $m"
+		missing=1
+	fi
+done
+exit $missing`
+
+// runVerifyAssets checks that the release binary embeds its static assets:
+// every -asset-markers string must occur in it, and the
+// -asset-verify-command must succeed. Both run in the runtime image the
+// binary ships in, where it is at runtimeBinaryPath.
+func runVerifyAssets(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options) (string, error) {
+	ctr := runtimeContainer(client, "", builtBinary(rust))
+	var summary []string
+
+	if len(opts.assetMarkers) > 0 {
+		out, err := execOutput(ctx, ctr.WithExec(append([]string{"sh", "-c", assetMarkerScript, runtimeBinaryPath}, opts.assetMarkers...)))
+		var execErr *dagger.ExecError
+		if errors.As(err, &execErr) && execErr.ExitCode == 1 {
+			missing := missingMarkers(execErr.Stdout)
+			return "", &stageError{
+				stage:    stageVerifyAssets,
+				exitCode: 1,
+				stderr:   fmt.Sprintf("%d of %d asset markers missing from the binary: %s", len(missing), len(opts.assetMarkers), strings.Join(missing, ", ")),
+				stdout:   execErr.Stdout,
+			}
+		} else if err != nil {
+			return "", stageFailed(stageVerifyAssets, err)
+		}
+		summary = append(summary, strings.TrimSpace(out), fmt.Sprintf("%d asset markers found", len(opts.assetMarkers)))
+	}
+
+	if opts.assetVerifyCommand != "" {
+		out, err := execOutput(ctx, ctr.WithExec([]string{"sh", "-c", opts.assetVerifyCommand}))
+		if err != nil {
+			return "", stageFailed(stageVerifyAssets, err)
+		}
+		if out != "" {
+			summary = append(summary, out)
+		}
+		summary = append(summary, fmt.Sprintf("%q passed", opts.assetVerifyCommand))
+	}
+	return strings.Join(summary, "\n"), nil
+}
+
+// missingMarkers returns the markers assetMarkerScript reported missing.
+func missingMarkers(out string) []string {
+	var missing []string
+	for _, line := range strings.Split(out, "\n") {
+		if m, ok := strings.CutPrefix(line, "missing: "); ok {
+			missing = append(missing, m)
+		}
+	}
+	return missing
+}
+
+// validateVerifyAssets checks that -verify-assets has something to verify
+// and, like -smoke, the host build to verify it in.
+func validateVerifyAssets(opts Options) error {
+	if !opts.verifyAssets {
+		return nil
+	}
+	if len(opts.assetMarkers) == 0 && strings.TrimSpace(opts.assetVerifyCommand) == "" {
+		return fmt.Errorf("-verify-assets needs -asset-markers or -asset-verify-command")
+	}
+	if !opts.enabled(stageBuild) || len(opts.platforms) > 0 {
+		return fmt.Errorf("-verify-assets requires the host build stage and does not support -platforms")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMissingMarkers(t *testing.T) {
+	out := "found: MERLIN_ASSETS_V1\nmissing: index.html\nfound: style.css\nmissing: logo, dark\n"
+	if got, want := missingMarkers(out), []string{"index.html", "logo, dark"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("missingMarkers = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyAssetsOptions(t *testing.T) {
+	opts, err := ParseOptions([]string{"-no-cache", "-asset-markers=MERLIN_ASSETS_V1, index.html"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.verifyAssets || !reflect.DeepEqual(opts.assetMarkers, []string{"MERLIN_ASSETS_V1", "index.html"}) {
+		t.Errorf("verifyAssets %v, markers %q", opts.verifyAssets, opts.assetMarkers)
+	}
+	if plan := formatPlan(opts); !strings.Contains(plan, stageVerifyAssets) {
+		t.Errorf("plan does not run %s:\n%s", stageVerifyAssets, plan)
+	}
+
+	for _, args := range [][]string{
+		{"-verify-assets"},
+		{"-asset-verify-command=merlin assets verify", "-skip-build"},
+		{"-asset-markers=x", "-platforms=linux/arm64"},
+	} {
+		if _, err := ParseOptions(append([]string{"-no-cache"}, args...), io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestVerifyAssetsFromConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "merlin-ci.yaml")
+	config := "assets:\n  markers: [MERLIN_ASSETS_V1]\n  command: merlin assets verify\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := ParseOptions([]string{"-no-cache", "-config=" + path}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.verifyAssets || opts.assetVerifyCommand != "merlin assets verify" || len(opts.assetMarkers) != 1 {
+		t.Errorf("verifyAssets %v, command %q, markers %q", opts.verifyAssets, opts.assetVerifyCommand, opts.assetMarkers)
+	}
+}
@@ -0,0 +1,238 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageAudit = "audit"
+	auditOut   = "./build/audit.json"
+)
+
+// severity levels accepted by -audit-severity, lowest first
+var severities = []string{"low", "medium", "high", "critical"}
+
+// auditReport is the subset of `cargo audit --json` the pipeline reads.
+type auditReport struct {
+	Vulnerabilities struct {
+		Found bool           `json:"found"`
+		Count int            `json:"count"`
+		List  []auditFinding `json:"list"`
+	} `json:"vulnerabilities"`
+	Warnings map[string][]auditFinding `json:"warnings"`
+}
+
+type auditFinding struct {
+	Kind     string `json:"kind"`
+	Advisory *struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		CVSS  string `json:"cvss"`
+	} `json:"advisory"`
+	Package struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"package"`
+}
+
+// severity ranks the finding from its CVSS vector, or returns "unknown"
+// when the advisory carries no score cargo-audit can express.
+func (f auditFinding) severity() string {
+	if f.Advisory == nil || f.Advisory.CVSS == "" {
+		return "unknown"
+	}
+	score, err := cvss3BaseScore(f.Advisory.CVSS)
+	if err != nil {
+		return "unknown"
+	}
+	return severityOf(score)
+}
+
+// parseAuditReport decodes the JSON printed by `cargo audit --json`.
+func parseAuditReport(data []byte) (auditReport, error) {
+	var report auditReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return auditReport{}, fmt.Errorf("parse cargo audit report: %w", err)
+	}
+	return report, nil
+}
+
+// blocking returns the vulnerabilities at or above the threshold severity.
+// Vulnerabilities without a usable CVSS score cannot be ranked and are
+// always blocking; warnings (unmaintained, unsound, yanked) never are.
+func (r auditReport) blocking(threshold string) []auditFinding {
+	min := severityRank(threshold)
+	var found []auditFinding
+	for _, v := range r.Vulnerabilities.List {
+		sev := v.severity()
+		if sev == "unknown" || severityRank(sev) >= min {
+			found = append(found, v)
+		}
+	}
+	return found
+}
+
+// summary describes each advisory on its own line.
+func (r auditReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d vulnerabilities found\n", len(r.Vulnerabilities.List))
+	for _, v := range r.Vulnerabilities.List {
+		fmt.Fprintf(&b, "  %s\t%s %s\t%s\n", advisoryID(v), v.Package.Name, v.Package.Version, v.severity())
+	}
+	for _, kind := range sortedKeys(r.Warnings) {
+		for _, w := range r.Warnings[kind] {
+			fmt.Fprintf(&b, "  %s\t%s %s\t%s (informational)\n", advisoryID(w), w.Package.Name, w.Package.Version, kind)
+		}
+	}
+	return b.String()
+}
+
+func advisoryID(f auditFinding) string {
+	if f.Advisory == nil {
+		return "-"
+	}
+	return f.Advisory.ID
+}
+
+// runAudit scans the dependency tree for RUSTSEC advisories, writes the raw
+// report to auditOut and fails if any vulnerability reaches the threshold.
+func runAudit(ctx context.Context, client *dagger.Client, rust *dagger.Container, threshold string) (string, error) {
+	// cargo audit exits non-zero when it finds vulnerabilities; the report
+	// is still printed, and the threshold below decides the outcome
+	stdout, err := withCargoTool(client, rust, "cargo-audit").
+		WithExec([]string{"cargo", "audit", "--json"}).
+		Stdout(ctx)
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) && strings.HasPrefix(strings.TrimSpace(execErr.Stdout), "{") {
+		stdout = execErr.Stdout
+	} else if err != nil {
+		return "", stageFailed(stageAudit, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(auditOut), 0o755); err != nil {
+		return "", fmt.Errorf("%s: %w", stageAudit, err)
+	}
+	if err := os.WriteFile(auditOut, []byte(stdout), 0o644); err != nil {
+		return "", fmt.Errorf("%s: %w", stageAudit, err)
+	}
+
+	report, err := parseAuditReport([]byte(stdout))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageAudit, err)
+	}
+	summary := report.summary()
+	if blocking := report.blocking(threshold); len(blocking) > 0 {
+		return "", &stageError{
+			stage:    stageAudit,
+			exitCode: 1,
+			stderr:   fmt.Sprintf("%d vulnerabilities at or above %s severity\n%s", len(blocking), threshold, summary),
+		}
+	}
+	return summary, nil
+}
+
+// severityOf maps a CVSS base score to its qualitative rating.
+func severityOf(score float64) string {
+	switch {
+	case score >= 9:
+		return "critical"
+	case score >= 7:
+		return "high"
+	case score >= 4:
+		return "medium"
+	case score > 0:
+		return "low"
+	default:
+		return "none"
+	}
+}
+
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// cvss3BaseScore computes the base score of a CVSS v3.x vector such as
+// `CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H`.
+func cvss3BaseScore(vector string) (float64, error) {
+	parts := strings.Split(vector, "/")
+	if len(parts) == 0 || !strings.HasPrefix(parts[0], "CVSS:3.") {
+		return 0, fmt.Errorf("unsupported CVSS vector %q", vector)
+	}
+	metrics := make(map[string]string)
+	for _, part := range parts[1:] {
+		key, value, ok := strings.Cut(part, ":")
+		if !ok {
+			return 0, fmt.Errorf("malformed CVSS metric %q", part)
+		}
+		metrics[key] = value
+	}
+
+	changed := metrics["S"] == "C"
+	weights := map[string]map[string]float64{
+		"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+		"AC": {"L": 0.77, "H": 0.44},
+		"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+		"UI": {"N": 0.85, "R": 0.62},
+		"C":  {"H": 0.56, "L": 0.22, "N": 0},
+		"I":  {"H": 0.56, "L": 0.22, "N": 0},
+		"A":  {"H": 0.56, "L": 0.22, "N": 0},
+	}
+	if changed {
+		weights["PR"] = map[string]float64{"N": 0.85, "L": 0.68, "H": 0.5}
+	}
+	w := make(map[string]float64, len(weights))
+	for key, values := range weights {
+		v, ok := values[metrics[key]]
+		if !ok {
+			return 0, fmt.Errorf("CVSS vector %q: missing or invalid %s", vector, key)
+		}
+		w[key] = v
+	}
+
+	iss := 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+	exploitability := 8.22 * w["AV"] * w["AC"] * w["PR"] * w["UI"]
+	if changed {
+		return roundUp(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+	return roundUp(math.Min(impact+exploitability, 10)), nil
+}
+
+// roundUp rounds to one decimal place as defined by the CVSS v3.1 spec.
+func roundUp(x float64) float64 {
+	i := int(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return (math.Floor(float64(i)/10000) + 1) / 10
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
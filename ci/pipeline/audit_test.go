@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCVSS3BaseScore(t *testing.T) {
+	tests := []struct {
+		vector string
+		want   float64
+	}{
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H", 9.8},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H", 10.0},
+		{"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:N/A:N", 5.5},
+		{"CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:N/I:N/A:L", 3.7},
+		{"CVSS:3.0/AV:N/AC:L/PR:L/UI:N/S:C/C:L/I:L/A:N", 6.4},
+		{"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N", 0},
+	}
+	for _, tt := range tests {
+		got, err := cvss3BaseScore(tt.vector)
+		if err != nil {
+			t.Errorf("cvss3BaseScore(%q): %v", tt.vector, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cvss3BaseScore(%q) = %v, want %v", tt.vector, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "CVSS:2.0/AV:N", "CVSS:3.1/AV:N/AC:L", "CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"} {
+		if _, err := cvss3BaseScore(bad); err == nil {
+			t.Errorf("cvss3BaseScore(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+const sampleAuditJSON = `{
+  "vulnerabilities": {
+    "found": true,
+    "count": 3,
+    "list": [
+      {"advisory": {"id": "RUSTSEC-2023-0001", "title": "remote crash", "cvss": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:H"}, "package": {"name": "hyper", "version": "0.14.1"}},
+      {"advisory": {"id": "RUSTSEC-2023-0002", "title": "timing leak", "cvss": "CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:N/I:N/A:L"}, "package": {"name": "ring", "version": "0.16.0"}},
+      {"advisory": {"id": "RUSTSEC-2023-0003", "title": "unscored", "cvss": null}, "package": {"name": "time", "version": "0.1.0"}}
+    ]
+  },
+  "warnings": {
+    "unmaintained": [
+      {"kind": "unmaintained", "advisory": {"id": "RUSTSEC-2021-0139", "title": "ansi_term is unmaintained", "cvss": null}, "package": {"name": "ansi_term", "version": "0.12.1"}}
+    ]
+  }
+}`
+
+func TestAuditReportBlocking(t *testing.T) {
+	report, err := parseAuditReport([]byte(sampleAuditJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(findings []auditFinding) string {
+		var out []string
+		for _, f := range findings {
+			out = append(out, advisoryID(f))
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := map[string]string{
+		"low":      "RUSTSEC-2023-0001,RUSTSEC-2023-0002,RUSTSEC-2023-0003",
+		"medium":   "RUSTSEC-2023-0001,RUSTSEC-2023-0003",
+		"high":     "RUSTSEC-2023-0001,RUSTSEC-2023-0003",
+		"critical": "RUSTSEC-2023-0003",
+	}
+	for threshold, want := range tests {
+		if got := ids(report.blocking(threshold)); got != want {
+			t.Errorf("blocking(%q) = %s, want %s", threshold, got, want)
+		}
+	}
+
+	summary := report.summary()
+	for _, want := range []string{"3 vulnerabilities found", "RUSTSEC-2023-0001\thyper 0.14.1\thigh", "ansi_term 0.12.1\tunmaintained (informational)"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary is missing %q:\n%s", want, summary)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// registryPasswordEnv holds the password used to push images.
+const registryPasswordEnv = "REGISTRY_PASSWORD"
+
+// baseRegistryPasswordEnv holds the password used to pull -base-image.
+const baseRegistryPasswordEnv = "BASE_REGISTRY_PASSWORD"
+
+// registryAuth is a set of registry credentials. The password only ever
+// reaches the engine as a Dagger secret, never as an exec argument or
+// environment variable.
+type registryAuth struct {
+	address  string
+	username string
+	password string
+}
+
+// complete reports whether all credentials are present.
+func (a registryAuth) complete() bool {
+	return a.address != "" && a.username != "" && a.password != ""
+}
+
+// apply authenticates ctr against the registry. The secret name is
+// derived from the address so different registries don't collide.
+func (a registryAuth) apply(client *dagger.Client, ctr *dagger.Container) *dagger.Container {
+	secret := client.SetSecret("registry-password-"+a.address, a.password)
+	return ctr.WithRegistryAuth(a.address, a.username, secret)
+}
+
+// pullAuth resolves the credentials for pulling image, which are for the
+// registry it lives on.
+func pullAuth(user, image string) registryAuth {
+	return registryAuth{address: registryHost(image), username: user, password: os.Getenv(baseRegistryPasswordEnv)}
+}
+
+// applyPull authenticates ctr's pulls from the registry. The secret is
+// named apart from apply's, as the publish registry may be the same one
+// with other credentials.
+func (a registryAuth) applyPull(client *dagger.Client, ctr *dagger.Container) *dagger.Container {
+	secret := client.SetSecret("base-registry-password-"+a.address, a.password)
+	return ctr.WithRegistryAuth(a.address, a.username, secret)
+}
+
+// pullBaseImage returns -base-image for platform, pulled with the pull
+// credentials when they are given. Every pull of -base-image goes through
+// it, so none misses the credentials.
+func pullBaseImage(client *dagger.Client, platform dagger.Platform, opts Options) *dagger.Container {
+	ctr := client.Container(dagger.ContainerOpts{Platform: platform})
+	if opts.baseRegistryAuth.complete() {
+		ctr = opts.baseRegistryAuth.applyPull(client, ctr)
+	}
+	return ctr.From(opts.baseImage)
+}
+
+// buildImage returns the image the build starts from: -base-image, or the
+// configured toolchain's image.
+func buildImage(opts Options) string {
+	if opts.baseImage != "" {
+		return opts.baseImage
+	}
+	return toolchainImage(opts.rustVersion)
+}
+
+// validateBaseAuth fails before any pull when the base image lives on a
+// registry other than Docker Hub, which is taken to be private, and no
+// pull credentials were given. -base-registry-anonymous pulls public
+// images from such registries without them.
+func validateBaseAuth(opts Options, anonymous bool) error {
+	auth := opts.baseRegistryAuth
+	given := auth.username != "" || auth.password != ""
+	if opts.baseImage == "" {
+		if given {
+			return fmt.Errorf("-base-registry-user and $%s require -base-image", baseRegistryPasswordEnv)
+		}
+		return nil
+	}
+	if given && !auth.complete() {
+		return fmt.Errorf("pulling %s requires both -base-registry-user and $%s", opts.baseImage, baseRegistryPasswordEnv)
+	}
+	if !given && !anonymous && auth.address != "docker.io" {
+		return fmt.Errorf("base image %s is on the private registry %s: set -base-registry-user and $%s, or -base-registry-anonymous if it is public", opts.baseImage, auth.address, baseRegistryPasswordEnv)
+	}
+	return nil
+}
+
+// registryHost returns the registry host of an image reference, following
+// the same rules as Docker: the first path component is a host only if it
+// looks like one, otherwise the image lives on Docker Hub.
+func registryHost(ref string) string {
+	first, _, found := strings.Cut(ref, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first
+	}
+	return "docker.io"
+}
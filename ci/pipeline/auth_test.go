@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"io"
+	"testing"
+)
+
+func TestRegistryHost(t *testing.T) {
+	tests := map[string]string{
+		"ghcr.io/awdemos/merlin:latest": "ghcr.io",
+		"localhost:5000/merlin":         "localhost:5000",
+		"localhost/merlin":              "localhost",
+		"awdemos/merlin:latest":         "docker.io",
+		"rust:1.75":                     "docker.io",
+		"registry.example.com/rust":     "registry.example.com",
+	}
+	for ref, want := range tests {
+		if got := registryHost(ref); got != want {
+			t.Errorf("registryHost(%q) = %q, want %q", ref, got, want)
+		}
+	}
+}
+
+func TestValidateBaseAuth(t *testing.T) {
+	t.Setenv(baseRegistryPasswordEnv, "")
+	for _, tt := range []struct {
+		name string
+		args []string
+		ok   bool
+	}{
+		{"toolchain image", nil, true},
+		{"docker hub base image", []string{"-base-image=awdemos/rust-builder:1.75"}, true},
+		{"private base image", []string{"-base-image=registry.example.com/rust:1.75"}, false},
+		{"public base image", []string{"-base-image=ghcr.io/awdemos/rust-builder:1.75", "-base-registry-anonymous"}, true},
+		{"user without password", []string{"-base-image=registry.example.com/rust:1.75", "-base-registry-user=ci"}, false},
+		{"user without base image", []string{"-base-registry-user=ci"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseOptions(tt.args, io.Discard)
+			if (err == nil) != tt.ok {
+				t.Errorf("ParseOptions(%v) error = %v, want ok %v", tt.args, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPullAuth(t *testing.T) {
+	t.Setenv(baseRegistryPasswordEnv, "s3cret")
+	opts, err := ParseOptions([]string{"-base-image=registry.example.com/team/rust:1.75", "-base-registry-user=ci"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := registryAuth{address: "registry.example.com", username: "ci", password: "s3cret"}
+	if opts.baseRegistryAuth != want {
+		t.Errorf("baseRegistryAuth = %+v, want %+v", opts.baseRegistryAuth, want)
+	}
+}
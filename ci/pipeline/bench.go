@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageBench      = "bench"
+	defaultBenchOut = "./build/bench"
+	benchDir        = "/bench"
+	// benchResultsFile is written to the bench output directory.
+	benchResultsFile = "results.json"
+	criterionDir     = "target/criterion"
+)
+
+// BenchResult is the time per iteration of one benchmark.
+type BenchResult struct {
+	Name    string  `json:"name"`
+	NsPerOp float64 `json:"ns_per_op"`
+}
+
+// libtest's bencher prints
+// `test parse::small ... bench:       1,234 ns/iter (+/- 56)`
+var libtestBenchPattern = regexp.MustCompile(`^test (\S+) \.\.\. bench:\s+([\d,.]+) ns/iter`)
+
+// criterion prints `parse/small  time:   [1.2 µs 1.3 µs 1.4 µs]`, moving
+// the name onto its own line above when it is too long to align
+var criterionBenchPattern = regexp.MustCompile(`^(.*?)\s*time:\s+\[\S+ \S+ (\S+) (\S+) \S+ \S+\]`)
+
+// criterionUnits gives criterion's time units in picoseconds, the smallest
+// it reports, so that converting to nanoseconds divides exactly.
+var criterionUnits = map[string]float64{
+	"ps": 1,
+	"ns": 1e3,
+	"µs": 1e6,
+	"us": 1e6,
+	"ms": 1e9,
+	"s":  1e12,
+}
+
+// parseBenchOutput extracts the results from cargo bench's output, for both
+// libtest and criterion benchmarks. Criterion results use the point
+// estimate, the middle of the three times it reports.
+func parseBenchOutput(output string) ([]BenchResult, error) {
+	var (
+		results []BenchResult
+		prev    string
+	)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := libtestBenchPattern.FindStringSubmatch(line); m != nil {
+			ns, err := strconv.ParseFloat(strings.ReplaceAll(m[2], ",", ""), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bench %s: %w", m[1], err)
+			}
+			results = append(results, BenchResult{Name: m[1], NsPerOp: ns})
+		} else if m := criterionBenchPattern.FindStringSubmatch(line); m != nil {
+			name := strings.TrimSpace(m[1])
+			if name == "" {
+				name = prev
+			}
+			if name == "" {
+				return nil, fmt.Errorf("criterion result without a benchmark name: %q", strings.TrimSpace(line))
+			}
+			value, err := strconv.ParseFloat(m[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bench %s: %w", name, err)
+			}
+			unit, ok := criterionUnits[m[3]]
+			if !ok {
+				return nil, fmt.Errorf("bench %s: unknown time unit %q", name, m[3])
+			}
+			results = append(results, BenchResult{Name: name, NsPerOp: value * unit / 1e3})
+		}
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			prev = trimmed
+		}
+	}
+	return results, nil
+}
+
+// runBench runs the benchmarks, exports criterion's HTML report to
+// opts.benchOut and writes the parsed results to results.json there. With a
+// baseline it prints each benchmark's change and fails when any slowed down
+// by more than opts.benchThreshold percent.
+func runBench(ctx context.Context, rust *dagger.Container, opts Options) (string, error) {
+	// read the baseline before anything is exported, as it may be the
+	// results file of an earlier run in the same output directory
+	var baseline []BenchResult
+	if opts.benchBaseline != "" {
+		var err error
+		if baseline, err = loadBenchBaseline(opts.benchBaseline); err != nil {
+			return "", fmt.Errorf("%s: baseline: %w", stageBench, err)
+		}
+	}
+
+	args := append(append([]string{"cargo", "bench"}, featureArgs(opts)...), lockArgs(opts)...)
+	ran, err := rust.WithExec(args).Sync(ctx)
+	if err != nil {
+		return "", stageFailed(stageBench, err)
+	}
+	output, stderr, err := execStreams(ctx, ran)
+	if err != nil {
+		return "", stageFailed(stageBench, err)
+	}
+	results, err := parseBenchOutput(output)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageBench, err)
+	}
+	if len(results) == 0 {
+		return "", fmt.Errorf("%s: no benchmark results in cargo bench output", stageBench)
+	}
+
+	// criterion writes its report into the target cache mount, which
+	// cannot be exported, so copy it out in a step chained on the run
+	report := ran.WithExec([]string{"sh", "-c", "mkdir -p " + benchDir + " && if [ -d " + criterionDir + " ]; then cp -r " + criterionDir + " " + benchDir + "/; fi"})
+	if _, err := report.Directory(benchDir).Export(ctx, opts.benchOut); err != nil {
+		return "", fmt.Errorf("%s: export report: %w", stageBench, err)
+	}
+
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageBench, err)
+	}
+	resultsPath := filepath.Join(opts.benchOut, benchResultsFile)
+	if err := writeReport(resultsPath, append(data, '\n')); err != nil {
+		return "", fmt.Errorf("%s: %w", stageBench, err)
+	}
+	summary := combineStreams(output, stderr) + "\n" +
+		fmt.Sprintf("%d benchmarks (results written to %s)", len(results), resultsPath)
+	if opts.benchBaseline == "" {
+		return summary, nil
+	}
+
+	printBenchDeltas(os.Stdout, baseline, results, opts.benchThreshold)
+	if regressions := compareBenches(baseline, results, opts.benchThreshold); len(regressions) > 0 {
+		return "", &stageError{stage: stageBench, exitCode: 1, stderr: formatRegressions(regressions, opts.benchThreshold)}
+	}
+	return summary + fmt.Sprintf(", none more than %g%% slower than %s", opts.benchThreshold, opts.benchBaseline), nil
+}
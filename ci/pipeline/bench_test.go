@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBenchOutput(t *testing.T) {
+	output := `running 2 tests
+test bench_decode ... bench:       1,234 ns/iter (+/- 56)
+test bench_encode ... bench:         987.50 ns/iter (+/- 12.25)
+
+test result: ok. 0 passed; 0 failed; 0 ignored; 2 measured; 0 filtered out
+
+parse/small             time:   [1.2000 µs 1.2500 µs 1.3000 µs]
+                        change: [-1.2000% +0.4000% +2.1000%] (p = 0.63 > 0.05)
+                        No change in performance detected.
+Found 3 outliers among 100 measurements (3.00%)
+parse/a_rather_long_benchmark_name
+                        time:   [2.0000 ms 2.5000 ms 3.0000 ms]
+lookup                  time:   [812.00 ps 815.00 ps 818.00 ps]
+`
+	got, err := parseBenchOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BenchResult{
+		{Name: "bench_decode", NsPerOp: 1234},
+		{Name: "bench_encode", NsPerOp: 987.5},
+		{Name: "parse/small", NsPerOp: 1250},
+		{Name: "parse/a_rather_long_benchmark_name", NsPerOp: 2.5e6},
+		{Name: "lookup", NsPerOp: 0.815},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBenchOutput =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseBenchOutputErrors(t *testing.T) {
+	if _, err := parseBenchOutput("parse  time:   [1.0 fs 2.0 fs 3.0 fs]\n"); err == nil {
+		t.Error("parseBenchOutput accepted an unknown unit")
+	}
+	if _, err := parseBenchOutput("   time:   [1.0 ns 2.0 ns 3.0 ns]\n"); err == nil {
+		t.Error("parseBenchOutput accepted a result without a name")
+	}
+
+	got, err := parseBenchOutput("running 0 tests\n")
+	if err != nil || len(got) != 0 {
+		t.Errorf("parseBenchOutput(no benches) = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// benchCachePrefixBase starts the throwaway cache prefix of -bench-cache.
+// Its volumes are left to the engine's cache garbage collection, like
+// those `clean` rotates away.
+const benchCachePrefixBase = "bench-cache"
+
+// benchCacheRunEnv differs between the two builds of -bench-cache, so the
+// engine runs the warm build again instead of answering it from its layer
+// cache, and only the cache volumes carry over.
+const benchCacheRunEnv = "MERLIN_BENCH_CACHE_RUN"
+
+// cacheBench is the outcome of -bench-cache.
+type cacheBench struct {
+	cold, warm time.Duration
+}
+
+// speedup is how many times faster the warm build was.
+func (b cacheBench) speedup() float64 {
+	if b.warm <= 0 {
+		return 0
+	}
+	return float64(b.cold) / float64(b.warm)
+}
+
+// String renders the comparison table.
+func (b cacheBench) String() string {
+	var s strings.Builder
+	w := tabwriter.NewWriter(&s, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BUILD\tCACHE\tDURATION")
+	fmt.Fprintf(w, "cold\tempty\t%s\n", b.cold.Round(time.Millisecond))
+	fmt.Fprintf(w, "warm\treused\t%s\n", b.warm.Round(time.Millisecond))
+	fmt.Fprintf(w, "speedup\t\t%.1fx\n", b.speedup())
+	w.Flush()
+	return s.String()
+}
+
+// benchCachePrefix returns a cache prefix no run has used before.
+func benchCachePrefix(now time.Time) string {
+	return cacheName(benchCachePrefixBase, strconv.FormatInt(now.UnixNano(), 36))
+}
+
+// runCacheBench implements -bench-cache: it runs the release build twice
+// under a throwaway cache prefix, first with empty cache volumes and then
+// with the volumes the first build filled, and prints both durations and
+// the speedup to w. The real caches are neither read nor written, and
+// nothing is exported.
+func runCacheBench(ctx context.Context, client *dagger.Client, opts Options, log *slog.Logger, w io.Writer) error {
+	opts.cachePrefix = benchCachePrefix(time.Now())
+	opts.gitRef = gitRefOrBranch(ctx, client, opts, log)
+	src := sourceDir(client, opts)
+	var bench cacheBench
+
+	for _, run := range []struct {
+		name string
+		took *time.Duration
+	}{{"cold", &bench.cold}, {"warm", &bench.warm}} {
+		rust := rustContainer(client, src, opts.rustVersion, "", opts).
+			WithEnvVariable(benchCacheRunEnv, opts.cachePrefix+"-"+run.name)
+		log.Info("cache benchmark build started", "build", run.name, "cache_prefix", opts.cachePrefix)
+		start := time.Now()
+		if _, err := syncWithRetry(ctx, build(rust, opts), opts); err != nil {
+			return stageFailed(fmt.Sprintf("%s (%s cache)", stageBuild, run.name), err)
+		}
+		*run.took = time.Since(start)
+		log.Info("cache benchmark build finished", "build", run.name, "duration", *run.took)
+	}
+
+	fmt.Fprint(w, bench.String())
+	return nil
+}
+
+// validateBenchCache rejects what -bench-cache cannot measure: builds
+// without cache volumes, and anything but the one host build it times.
+func validateBenchCache(opts Options) error {
+	if !opts.benchCache {
+		return nil
+	}
+	if opts.noCache {
+		return fmt.Errorf("-bench-cache measures the cache volumes, so it cannot be combined with -no-cache")
+	}
+	if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 || len(opts.platforms) > 0 {
+		return fmt.Errorf("-bench-cache times the host build, not -matrix, -feature-matrix or -platforms")
+	}
+	if opts.watch {
+		return fmt.Errorf("-bench-cache and -watch cannot be combined")
+	}
+	return nil
+}
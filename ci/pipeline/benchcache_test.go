@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheBenchTable(t *testing.T) {
+	b := cacheBench{cold: 90 * time.Second, warm: 20 * time.Second}
+	if got := b.speedup(); got != 4.5 {
+		t.Errorf("speedup = %v, want 4.5", got)
+	}
+	table := b.String()
+	for _, want := range []string{"cold     empty   1m30s", "warm     reused  20s", "speedup          4.5x"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("table missing %q:\n%s", want, table)
+		}
+	}
+	if got := (cacheBench{cold: time.Second}).speedup(); got != 0 {
+		t.Errorf("speedup without a warm build = %v, want 0", got)
+	}
+}
+
+func TestBenchCachePrefixIsThrowaway(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a, b := benchCachePrefix(now), benchCachePrefix(now.Add(time.Nanosecond))
+	if a == b || !strings.HasPrefix(a, benchCachePrefixBase+"-") {
+		t.Errorf("prefixes %q and %q", a, b)
+	}
+}
+
+func TestValidateBenchCache(t *testing.T) {
+	if _, err := ParseOptions([]string{"-bench-cache"}, io.Discard); err != nil {
+		t.Errorf("-bench-cache: %v", err)
+	}
+	for _, args := range [][]string{
+		{"-bench-cache", "-no-cache"},
+		{"-bench-cache", "-platforms=linux/arm64"},
+		{"-bench-cache", "-watch"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// defaultBenchThreshold is the slowdown, in percent, that fails the bench
+// stage when comparing against a baseline.
+const defaultBenchThreshold = 10
+
+// Regression is a benchmark that got slower than the threshold allows.
+type Regression struct {
+	Name         string
+	OldNsPerOp   float64
+	NewNsPerOp   float64
+	DeltaPercent float64
+}
+
+// benchDelta returns how much slower cur is than old, in percent, and
+// false when old has no usable time to compare against.
+func benchDelta(old, cur float64) (float64, bool) {
+	if old <= 0 {
+		return 0, false
+	}
+	return (cur - old) / old * 100, true
+}
+
+// compareBenches returns the benchmarks in cur that are slower than in old
+// by more than threshold percent, in cur's order. Benchmarks that were
+// added or removed since old have nothing to compare against and never
+// count as regressions.
+func compareBenches(old, cur []BenchResult, threshold float64) []Regression {
+	baseline := make(map[string]float64, len(old))
+	for _, b := range old {
+		baseline[b.Name] = b.NsPerOp
+	}
+
+	var regressions []Regression
+	for _, b := range cur {
+		prev, ok := baseline[b.Name]
+		if !ok {
+			continue
+		}
+		if delta, ok := benchDelta(prev, b.NsPerOp); ok && delta > threshold {
+			regressions = append(regressions, Regression{Name: b.Name, OldNsPerOp: prev, NewNsPerOp: b.NsPerOp, DeltaPercent: delta})
+		}
+	}
+	return regressions
+}
+
+// loadBenchBaseline reads results previously written by the bench stage.
+func loadBenchBaseline(path string) ([]BenchResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var results []BenchResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return results, nil
+}
+
+// printBenchDeltas prints one row per benchmark in either run: those in
+// cur in its order, then the removed ones sorted by name.
+func printBenchDeltas(w io.Writer, old, cur []BenchResult, threshold float64) {
+	baseline := make(map[string]float64, len(old))
+	for _, b := range old {
+		baseline[b.Name] = b.NsPerOp
+	}
+	seen := make(map[string]bool, len(cur))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BENCHMARK\tBASELINE\tCURRENT\tDELTA\tRESULT")
+	for _, b := range cur {
+		seen[b.Name] = true
+		prev, ok := baseline[b.Name]
+		if !ok {
+			fmt.Fprintf(tw, "%s\t-\t%s\t-\tnew\n", b.Name, formatNs(b.NsPerOp))
+			continue
+		}
+		delta, ok := benchDelta(prev, b.NsPerOp)
+		if !ok {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\tpass\n", b.Name, formatNs(prev), formatNs(b.NsPerOp))
+			continue
+		}
+		result := "pass"
+		if delta > threshold {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%+.1f%%\t%s\n", b.Name, formatNs(prev), formatNs(b.NsPerOp), delta, result)
+	}
+
+	var removed []string
+	for name := range baseline {
+		if !seen[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		fmt.Fprintf(tw, "%s\t%s\t-\t-\tremoved\n", name, formatNs(baseline[name]))
+	}
+	tw.Flush()
+}
+
+// formatRegressions lists regressions for the stage error.
+func formatRegressions(regressions []Regression, threshold float64) string {
+	lines := []string{fmt.Sprintf("%d benchmarks regressed by more than %g%%:", len(regressions), threshold)}
+	for _, r := range regressions {
+		lines = append(lines, fmt.Sprintf("  %s: %s -> %s (%+.1f%%)", r.Name, formatNs(r.OldNsPerOp), formatNs(r.NewNsPerOp), r.DeltaPercent))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatNs prints a time per iteration in the largest unit that keeps it
+// at or above one, as criterion does.
+func formatNs(ns float64) string {
+	switch {
+	case ns >= 1e9:
+		return fmt.Sprintf("%.2f s", ns/1e9)
+	case ns >= 1e6:
+		return fmt.Sprintf("%.2f ms", ns/1e6)
+	case ns >= 1e3:
+		return fmt.Sprintf("%.2f µs", ns/1e3)
+	}
+	return fmt.Sprintf("%.2f ns", ns)
+}
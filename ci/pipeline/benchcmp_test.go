@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareBenches(t *testing.T) {
+	old := []BenchResult{
+		{Name: "decode", NsPerOp: 1000},
+		{Name: "encode", NsPerOp: 2000},
+		{Name: "lookup", NsPerOp: 100},
+		{Name: "removed", NsPerOp: 50},
+		{Name: "zero", NsPerOp: 0},
+	}
+
+	tests := []struct {
+		name      string
+		cur       []BenchResult
+		threshold float64
+		want      []Regression
+	}{
+		{
+			name:      "within threshold",
+			cur:       []BenchResult{{Name: "decode", NsPerOp: 1100}, {Name: "encode", NsPerOp: 1500}},
+			threshold: 10,
+		},
+		{
+			name:      "slower than threshold",
+			cur:       []BenchResult{{Name: "decode", NsPerOp: 1250}, {Name: "encode", NsPerOp: 2100}, {Name: "lookup", NsPerOp: 150}},
+			threshold: 10,
+			want: []Regression{
+				{Name: "decode", OldNsPerOp: 1000, NewNsPerOp: 1250, DeltaPercent: 25},
+				{Name: "lookup", OldNsPerOp: 100, NewNsPerOp: 150, DeltaPercent: 50},
+			},
+		},
+		{
+			name:      "zero threshold fails any slowdown",
+			cur:       []BenchResult{{Name: "decode", NsPerOp: 1001}, {Name: "encode", NsPerOp: 2000}},
+			threshold: 0,
+			want:      []Regression{{Name: "decode", OldNsPerOp: 1000, NewNsPerOp: 1001, DeltaPercent: 0.1}},
+		},
+		{
+			name:      "added benchmark",
+			cur:       []BenchResult{{Name: "added", NsPerOp: 1e9}},
+			threshold: 10,
+		},
+		{
+			name:      "removed benchmarks",
+			cur:       nil,
+			threshold: 10,
+		},
+		{
+			name:      "zero baseline",
+			cur:       []BenchResult{{Name: "zero", NsPerOp: 10}},
+			threshold: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compareBenches(old, tt.cur, tt.threshold)
+			if len(got) != len(tt.want) {
+				t.Fatalf("compareBenches = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				g, w := got[i], tt.want[i]
+				if g.Name != w.Name || g.OldNsPerOp != w.OldNsPerOp || g.NewNsPerOp != w.NewNsPerOp || math.Abs(g.DeltaPercent-w.DeltaPercent) > 1e-9 {
+					t.Errorf("regression %d = %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+
+	if got := compareBenches(nil, old, 10); len(got) != 0 {
+		t.Errorf("compareBenches without a baseline = %v, want none", got)
+	}
+}
+
+func TestPrintBenchDeltas(t *testing.T) {
+	old := []BenchResult{{Name: "decode", NsPerOp: 1000}, {Name: "encode", NsPerOp: 2e6}, {Name: "gone", NsPerOp: 5}}
+	cur := []BenchResult{{Name: "encode", NsPerOp: 1.5e6}, {Name: "decode", NsPerOp: 1200}, {Name: "added", NsPerOp: 3e9}}
+
+	var b strings.Builder
+	printBenchDeltas(&b, old, cur, 10)
+	want := []string{
+		"BENCHMARK  BASELINE  CURRENT  DELTA   RESULT",
+		"encode     2.00 ms   1.50 ms  -25.0%  pass",
+		"decode     1.00 µs   1.20 µs  +20.0%  FAIL",
+		"added      -         3.00 s   -       new",
+		"gone       5.00 ns   -        -       removed",
+	}
+	if got := b.String(); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("printBenchDeltas =\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestLoadBenchBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), benchResultsFile)
+	if err := os.WriteFile(path, []byte(`[{"name": "decode", "ns_per_op": 1234.5}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadBenchBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []BenchResult{{Name: "decode", NsPerOp: 1234.5}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loadBenchBaseline = %v, want %v", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBenchBaseline(path); err == nil {
+		t.Error("loadBenchBaseline accepted invalid JSON")
+	}
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"dagger.io/dagger"
+)
+
+// Cache volumes are keyed purely by name: every run that asks for the same
+// name shares the same contents, across branches and invocations. The names
+// below are therefore the cache keys, prefixed with -cache-prefix so that
+// branches can opt into isolated caches instead of sharing one.
+const (
+	cacheCargoRegistry = "cargo-registry"
+	cacheCargoGit      = "cargo-git"
+	cacheCargoTarget   = "cargo-target"
+)
+
+// cached directories in the rust image
+const (
+	cargoRegistryDir = "/usr/local/cargo/registry"
+	cargoGitDir      = "/usr/local/cargo/git"
+	targetDir        = "/src/target"
+)
+
+// cacheName returns the volume name for a cache, namespaced by prefix.
+func cacheName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "-" + name
+}
+
+// lockfiles are hashed into the cache names, in this order
+var lockfiles = []string{"Cargo.toml", "Cargo.lock"}
+
+// cacheKey hashes the manifest and lockfile in dir, so that caches rotate
+// whenever the dependencies change. A missing Cargo.lock hashes as empty,
+// as cargo would generate one.
+func cacheKey(dir string) (string, error) {
+	h := sha256.New()
+	for _, name := range lockfiles {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) && name == "Cargo.lock" {
+			data = nil
+		} else if err != nil {
+			return "", err
+		}
+		// length-prefix each file so moving bytes between them changes the hash
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// keyedCache appends key to a cache name, or returns the name when there
+// is no key.
+func keyedCache(name, key string) string {
+	if key == "" {
+		return name
+	}
+	return name + "-" + key
+}
+
+// targetCacheKey keys the target cache of a container for version and
+// platform (the host's when empty) by everything that changes its artifacts.
+func targetCacheKey(version string, platform dagger.Platform, opts Options) string {
+	key := version
+	if platform != "" {
+		key += "-" + platformDir(platform)
+	}
+	if features := featureKey(opts); features != "" {
+		key += "-features-" + features
+	}
+	return keyedCache(key, opts.lockKey)
+}
+
+// withCaches mounts the crate registry and git dependency caches, so
+// dependencies are downloaded once rather than on every run, and the target
+// directory, so builds are incremental.
+//
+// The target cache is additionally keyed by toolchain, platform and feature
+// selection: artifacts from one compiler or architecture are useless to
+// another, and concurrent matrix or platform builds would otherwise fight
+// over the same directory.
+//
+// Every volume is also keyed by lockKey, the hash of Cargo.toml and
+// Cargo.lock, so a dependency change starts from fresh volumes instead of
+// building against stale crates, while unchanged lockfiles keep reusing
+// theirs. Sources fetched with -git-url have no key.
+//
+// A cache mount is not part of the container's filesystem, so anything
+// built into target/ must be copied elsewhere before it can be exported
+// (see runBuild).
+func withCaches(client *dagger.Client, rust *dagger.Container, prefix, lockKey, targetKey string) *dagger.Container {
+	return rust.
+		WithMountedCache(cargoRegistryDir, client.CacheVolume(cacheName(prefix, keyedCache(cacheCargoRegistry, lockKey)))).
+		WithMountedCache(cargoGitDir, client.CacheVolume(cacheName(prefix, keyedCache(cacheCargoGit, lockKey)))).
+		WithMountedCache(targetDir, client.CacheVolume(cacheName(prefix, cacheCargoTarget+"-"+targetKey)))
+}
+
+// cacheMount is a cache volume and where the pipeline mounts it.
+type cacheMount struct {
+	volume string
+	dir    string
+}
+
+// cacheMounts lists the cache volumes a run with opts mounts into its main
+// build containers.
+func cacheMounts(opts Options) []cacheMount {
+	mount := func(name, dir string) cacheMount {
+		return cacheMount{volume: cacheName(opts.cachePrefix, name), dir: dir}
+	}
+	mounts := []cacheMount{
+		mount(keyedCache(cacheCargoRegistry, opts.lockKey), cargoRegistryDir),
+		mount(keyedCache(cacheCargoGit, opts.lockKey), cargoGitDir),
+	}
+
+	if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 {
+		for _, entry := range matrixEntries(opts) {
+			mounts = append(mounts, mount(cacheCargoTarget+"-"+targetCacheKey(entry.toolchain, "", entry.opts), targetDir))
+		}
+	} else {
+		platforms := opts.platforms
+		if len(platforms) == 0 {
+			platforms = []dagger.Platform{""}
+		}
+		for _, p := range platforms {
+			mounts = append(mounts, mount(cacheCargoTarget+"-"+targetCacheKey(opts.rustVersion, p, opts), targetDir))
+		}
+	}
+	if opts.sccache && opts.sccacheBackend == sccacheLocal {
+		mounts = append(mounts, mount(cacheSccache, sccacheDir))
+	}
+	if opts.pgo {
+		mounts = append(mounts, mount(cachePGOProfile, pgoProfileDir))
+	}
+	return mounts
+}
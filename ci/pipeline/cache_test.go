@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	locked, err := cacheKey("pipeline/testdata/cargo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 12 {
+		t.Errorf("cacheKey = %q, want 12 hex digits", locked)
+	}
+	if again, _ := cacheKey("pipeline/testdata/cargo"); again != locked {
+		t.Errorf("cacheKey is not stable: %q then %q", locked, again)
+	}
+
+	unlocked, err := cacheKey("pipeline/testdata/cargo-unlocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked == locked {
+		t.Error("cacheKey ignores Cargo.lock")
+	}
+
+	// a lockfile change rotates the key, an identical copy keeps it
+	dir := t.TempDir()
+	for _, name := range lockfiles {
+		data, err := os.ReadFile(filepath.Join("pipeline/testdata/cargo", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if copied, _ := cacheKey(dir); copied != locked {
+		t.Errorf("cacheKey(copy) = %q, want %q", copied, locked)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "Cargo.lock"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n[[package]]\nname = \"ryu\"\nversion = \"1.0.16\"\n")
+	f.Close()
+	if bumped, _ := cacheKey(dir); bumped == locked {
+		t.Error("cacheKey unchanged after a Cargo.lock change")
+	}
+
+	if _, err := cacheKey(t.TempDir()); err == nil {
+		t.Error("cacheKey succeeded without a Cargo.toml")
+	}
+}
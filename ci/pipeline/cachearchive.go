@@ -0,0 +1,122 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"dagger.io/dagger"
+)
+
+// The Dagger SDK has no API to export or import the engine's layer cache,
+// which is only configurable when the engine is started. What carries the
+// incremental state between runs, though, is the cache volumes: the crate
+// registry, git checkouts and target directories. -cache-export and
+// -cache-import move those through a tarball, using cache volume mounts
+// (Container.WithMountedCache) in a helper container, and
+// File.Export / Host.File for the tarball itself.
+
+// cacheArchiveImage runs tar over the cache volumes.
+const cacheArchiveImage = "alpine:3.19"
+
+// cacheArchiveRoot is where the volumes are mounted in the helper
+// container, each in a directory named after the volume.
+const cacheArchiveRoot = "/caches"
+
+// cacheArchiveContainer mounts every cache volume of opts under
+// cacheArchiveRoot.
+func cacheArchiveContainer(client *dagger.Client, opts Options) *dagger.Container {
+	ctr := client.Container().From(cacheArchiveImage)
+	for _, m := range cacheMounts(opts) {
+		ctr = ctr.WithMountedCache(path.Join(cacheArchiveRoot, m.volume), client.CacheVolume(m.volume))
+	}
+	return ctr
+}
+
+// exportCaches writes the contents of the run's cache volumes to a gzipped
+// tarball at out and returns its size in bytes.
+func exportCaches(ctx context.Context, client *dagger.Client, opts Options) (int64, error) {
+	// the volumes are mounts, so they must be archived to a path outside
+	// them in the same container before the archive can be exported
+	archive := cacheArchiveContainer(client, opts).
+		WithExec([]string{"tar", "-czf", "/caches.tar.gz", "-C", cacheArchiveRoot, "."}).
+		File("/caches.tar.gz")
+	if _, err := archive.Export(ctx, opts.cacheExport); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(opts.cacheExport)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// importCaches restores a tarball written by exportCaches into the run's
+// cache volumes. Volumes no longer in use, e.g. of an older lockfile, are
+// skipped. The archive is checked first so a corrupt file cannot leave the
+// volumes half restored.
+func importCaches(ctx context.Context, client *dagger.Client, opts Options) error {
+	if err := checkCacheArchive(opts.cacheImport); err != nil {
+		return err
+	}
+	var members []string
+	for _, m := range cacheMounts(opts) {
+		members = append(members, "./"+m.volume)
+	}
+	// tar fails on members missing from an older archive, so extract each
+	// volume on its own and ignore the ones that are absent
+	script := `for m in "$@"; do tar -xzf /caches.tar.gz -C ` + cacheArchiveRoot + ` "$m" 2>/dev/null || echo "no $m in archive"; done`
+	_, err := cacheArchiveContainer(client, opts).
+		WithMountedFile("/caches.tar.gz", client.Host().File(opts.cacheImport)).
+		WithExec(append([]string{"sh", "-c", script, "sh"}, members...)).
+		Sync(ctx)
+	return err
+}
+
+// checkCacheArchive reads the whole archive at path, failing if it is not
+// a complete gzipped tarball.
+func checkCacheArchive(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		_, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		// reading the contents verifies the gzip checksum at the end
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+}
+
+// formatBytes prints a size in binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
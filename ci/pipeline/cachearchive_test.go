@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckCacheArchive(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	contents := bytes.Repeat([]byte("crate"), 1000)
+	tw.WriteHeader(&tar.Header{Name: "./cargo-registry/cache/itoa.crate", Mode: 0o644, Size: int64(len(contents))})
+	tw.Write(contents)
+	tw.Close()
+	gz.Close()
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	if err := checkCacheArchive(write("ok.tar.gz", buf.Bytes())); err != nil {
+		t.Errorf("valid archive: %v", err)
+	}
+	for name, data := range map[string][]byte{
+		"truncated.tar.gz": buf.Bytes()[:buf.Len()/2],
+		"plain.tar.gz":     []byte("not gzip at all"),
+	} {
+		if err := checkCacheArchive(write(name, data)); err == nil {
+			t.Errorf("%s: checkCacheArchive succeeded, want error", name)
+		}
+	}
+	if err := checkCacheArchive(filepath.Join(dir, "missing.tar.gz")); !os.IsNotExist(err) {
+		t.Errorf("missing archive: %v, want not-exist error", err)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		512:             "512 B",
+		2048:            "2.0 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 30:         "3.0 GiB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
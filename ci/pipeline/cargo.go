@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// cargoBuildArgs returns the build command for opts' cargo profile, with extra
+// arguments such as --target placed before the feature selection and the
+// -cargo-build-args after it.
+func cargoBuildArgs(opts Options, extra ...string) []string {
+	args := append(append([]string{"cargo", "build"}, profileArgs(opts)...), workspaceArgs(opts)...)
+	args = append(args, extra...)
+	args = append(append(args, featureArgs(opts)...), lockArgs(opts)...)
+	args = append(args, jobsArgs(opts)...)
+	return append(args, opts.cargoBuildArgs...)
+}
+
+// testTargets selects every test target but the doc examples, which run
+// as their own stage.
+var testTargets = []string{"--lib", "--bins", "--tests"}
+
+// cargoTestArgs returns the test command for opts, ending in the
+// -cargo-test-args. harness arguments are passed to the test binaries
+// after `--`, following any the -cargo-test-args pass them.
+func cargoTestArgs(opts Options, harness ...string) []string {
+	args := append(append([]string{"cargo", "test"}, workspaceArgs(opts)...), testTargets...)
+	args = append(append(args, featureArgs(opts)...), lockArgs(opts)...)
+	args = append(args, jobsArgs(opts)...)
+	harness = append(testThreadsArgs(opts), harness...)
+
+	extra := opts.cargoTestArgs
+	for i, arg := range extra {
+		if arg == "--" {
+			harness = append(append([]string(nil), extra[i+1:]...), harness...)
+			extra = extra[:i]
+			break
+		}
+	}
+	args = append(args, extra...)
+	if len(harness) > 0 {
+		args = append(append(args, "--"), harness...)
+	}
+	return args
+}
+
+// featureArgs selects the cargo features requested in opts.
+func featureArgs(opts Options) []string {
+	var args []string
+	if opts.noDefaultFeatures {
+		args = append(args, "--no-default-features")
+	}
+	if len(opts.features) > 0 {
+		args = append(args, "--features", strings.Join(opts.features, ","))
+	}
+	return args
+}
+
+// lockArgs makes cargo fail rather than update Cargo.lock when -locked is
+// set. It is passed to every cargo command the pipeline runs.
+func lockArgs(opts Options) []string {
+	if opts.locked {
+		return []string{"--locked"}
+	}
+	return nil
+}
+
+// splitArgs splits a flag value into arguments the way a POSIX shell
+// would, without expansions: whitespace separates arguments unless quoted
+// with ' or ", and a backslash escapes the next character outside single
+// quotes.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		quote   byte
+		escaped bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			cur.WriteByte(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteByte(c)
+			}
+		case c == '\\':
+			escaped, inArg = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				cur.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// featureKey identifies a feature selection in cache keys and labels, or
+// returns "" for the default features.
+func featureKey(opts Options) string {
+	key := strings.Join(opts.features, "+")
+	if opts.noDefaultFeatures {
+		key = "nodefault+" + key
+	}
+	return strings.TrimSuffix(key, "+")
+}
+
+// splitList splits a comma-separated list, dropping blanks and duplicates.
+func splitList(list string) []string {
+	var items []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || seen[item] {
+			continue
+		}
+		seen[item] = true
+		items = append(items, item)
+	}
+	return items
+}
+
+// parseFeatureMatrix splits a `;`-separated list of comma-separated
+// feature sets, e.g. `default;full;minimal,tls`. An empty set and a set
+// listed twice, in any order, are errors rather than entries to drop.
+func parseFeatureMatrix(list string) ([][]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	var sets [][]string
+	seen := make(map[string]bool)
+	for _, set := range strings.Split(list, ";") {
+		features := splitList(set)
+		if len(features) == 0 {
+			return nil, fmt.Errorf("feature-matrix: empty feature set in %q", list)
+		}
+		key := slices.Clone(features)
+		slices.Sort(key)
+		if seen[strings.Join(key, ",")] {
+			return nil, fmt.Errorf("feature-matrix: feature set %s listed twice", strings.Join(features, ","))
+		}
+		seen[strings.Join(key, ",")] = true
+		sets = append(sets, features)
+	}
+	return sets, nil
+}
@@ -0,0 +1,201 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestCargoArgsFeatures(t *testing.T) {
+	opts := Options{features: []string{"tls", "metrics"}, noDefaultFeatures: true}
+
+	wantBuild := []string{"cargo", "build", "--release", "--target", "aarch64-unknown-linux-gnu", "--no-default-features", "--features", "tls,metrics"}
+	if got := cargoBuildArgs(opts, "--target", "aarch64-unknown-linux-gnu"); !reflect.DeepEqual(got, wantBuild) {
+		t.Errorf("cargoBuildArgs = %q, want %q", got, wantBuild)
+	}
+
+	wantTest := []string{"cargo", "test", "--lib", "--bins", "--tests", "--no-default-features", "--features", "tls,metrics", "--", "--nocapture"}
+	if got := cargoTestArgs(opts, "--nocapture"); !reflect.DeepEqual(got, wantTest) {
+		t.Errorf("cargoTestArgs = %q, want %q", got, wantTest)
+	}
+
+	if got := cargoTestArgs(Options{}); !reflect.DeepEqual(got, []string{"cargo", "test", "--lib", "--bins", "--tests"}) {
+		t.Errorf("cargoTestArgs without options = %q", got)
+	}
+
+	wantDoc := []string{"cargo", "test", "--doc", "--no-default-features", "--features", "tls,metrics"}
+	if got := cargoDocTestArgs(opts); !reflect.DeepEqual(got, wantDoc) {
+		t.Errorf("cargoDocTestArgs = %q, want %q", got, wantDoc)
+	}
+}
+
+func TestFeatureKey(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, ""},
+		{Options{features: []string{"full"}}, "full"},
+		{Options{noDefaultFeatures: true}, "nodefault"},
+		{Options{features: []string{"a", "b"}, noDefaultFeatures: true}, "nodefault+a+b"},
+	}
+	for _, tt := range tests {
+		if got := featureKey(tt.opts); got != tt.want {
+			t.Errorf("featureKey(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestMatrixEntries(t *testing.T) {
+	opts := Options{
+		rustVersion:   "1.75",
+		matrix:        []string{"1.70", "stable"},
+		featureMatrix: [][]string{{"default"}, {"minimal", "tls"}},
+	}
+
+	var labels []string
+	for _, entry := range matrixEntries(opts) {
+		labels = append(labels, entry.label)
+		if !entry.opts.noDefaultFeatures {
+			t.Errorf("%s: feature sets must be exact", entry.label)
+		}
+	}
+	want := []string{
+		"rust 1.70, features default",
+		"rust 1.70, features minimal,tls",
+		"rust stable, features default",
+		"rust stable, features minimal,tls",
+	}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %q, want %q", labels, want)
+	}
+
+	entries := matrixEntries(Options{rustVersion: "1.75", featureMatrix: [][]string{{"full"}}})
+	if len(entries) != 1 || entries[0].toolchain != "1.75" || entries[0].label != "features full" {
+		t.Errorf("feature-only matrix = %+v", entries)
+	}
+}
+
+func TestValidateMatrix(t *testing.T) {
+	opts, err := ParseOptions([]string{"-matrix=1.75,stable"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{stageBuild: true, stageTest: true}; !reflect.DeepEqual(opts.stages, want) {
+		t.Errorf("stages = %v, want only build and test", opts.stages)
+	}
+	if _, err := ParseOptions([]string{"-feature-matrix=default;full", "-stages=build,test"}, io.Discard); err != nil {
+		t.Errorf("explicit build and test stages: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"-matrix=stable,beta", "-stages=build,clippy"},
+		{"-matrix=stable,beta", "-skip-test"},
+		{"-feature-matrix=full", "-tarball"},
+		{"-matrix=stable,beta", "-coverage"},
+		{"-matrix=stable,beta", "-udeps"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestTestArgs(t *testing.T) {
+	if got := testArgs(Options{testRunner: testRunnerCargo}); !reflect.DeepEqual(got, []string{"cargo", "test", "--lib", "--bins", "--tests"}) {
+		t.Errorf("testArgs(cargo) = %q", got)
+	}
+
+	opts := Options{testRunner: testRunnerNextest, features: []string{"tls"}}
+	want := []string{"cargo", "nextest", "run", "--profile", "ci", "--tool-config-file", "merlin-ci:" + nextestConfigPath, "--features", "tls"}
+	if got := testArgs(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("testArgs(nextest) = %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationArgs(t *testing.T) {
+	opts := Options{features: []string{"tls"}}
+	want := []string{"cargo", "test", "--lib", "--bins", "--tests", "--features", "tls,integration"}
+	if got := integrationArgs(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("integrationArgs = %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(opts.features, []string{"tls"}) {
+		t.Errorf("integrationArgs modified the selected features: %q", opts.features)
+	}
+}
+
+func TestDoctestsOption(t *testing.T) {
+	opts, err := ParseOptions(nil, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.doctests {
+		t.Error("doctests disabled by default")
+	}
+	if got, _ := checkArtifact(stageDoctest, Options{junit: true, junitOut: defaultJUnitOut}); got != "./build/junit-doctests.xml" {
+		t.Errorf("doctest report = %q", got)
+	}
+
+	opts, err = ParseOptions([]string{"-doctests=off"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range selectChecks(nil, opts, nil, nil) {
+		if c.name == stageDoctest {
+			t.Error("-doctests=off still selected the doctest stage")
+		}
+	}
+
+	if _, err := ParseOptions([]string{"-doctests=maybe"}, io.Discard); err == nil {
+		t.Error("-doctests=maybe succeeded, want error")
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  --locked   --offline ", []string{"--locked", "--offline"}},
+		{`--profile dist -- --skip "slow test"`, []string{"--profile", "dist", "--", "--skip", "slow test"}},
+		{`--config 'build.rustflags=["-C", "target-cpu=native"]'`, []string{"--config", `build.rustflags=["-C", "target-cpu=native"]`}},
+		{`a\ b "" c"d"e`, []string{"a b", "", "cde"}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.in)
+		if err != nil {
+			t.Errorf("splitArgs(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{`"open`, `'open`, `trailing\`} {
+		if _, err := splitArgs(in); err == nil {
+			t.Errorf("splitArgs(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestExtraCargoArgs(t *testing.T) {
+	opts, err := ParseOptions([]string{"-locked", "-cargo-build-args=--profile dist", `-cargo-test-args=--release -- --skip "slow test"`}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBuild := []string{"cargo", "build", "--release", "--target", "x86_64-unknown-linux-musl", "--locked", "--profile", "dist"}
+	if got := cargoBuildArgs(opts, "--target", "x86_64-unknown-linux-musl"); !reflect.DeepEqual(got, wantBuild) {
+		t.Errorf("cargoBuildArgs = %q, want %q", got, wantBuild)
+	}
+	// the harness arguments of -cargo-test-args and the pipeline's share
+	// one `--`
+	wantTest := []string{"cargo", "test", "--lib", "--bins", "--tests", "--locked", "--release", "--", "--skip", "slow test", "--format", "json"}
+	if got := cargoTestArgs(opts, "--format", "json"); !reflect.DeepEqual(got, wantTest) {
+		t.Errorf("cargoTestArgs = %q, want %q", got, wantTest)
+	}
+
+	if _, err := ParseOptions([]string{`-cargo-build-args="--offline`}, io.Discard); err == nil {
+		t.Error("unterminated quote in -cargo-build-args succeeded, want error")
+	}
+}
@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rustcGroup is the group policy entries use for the compiler's own lints,
+// such as unused_variables.
+const rustcGroup = "rustc"
+
+// Lint is one lint warning from cargo's JSON output.
+type Lint struct {
+	Name  string // without the clippy:: prefix, e.g. needless_return
+	Group string // e.g. style, or "" when clippy did not say
+	Diagnostic
+	Rendered string // as cargo would have printed it
+}
+
+// lintGroupPattern matches the note rustc attaches to the first warning of
+// every lint enabled by a group on the command line:
+// "`-W clippy::needless-return` implied by `-W clippy::style`".
+var lintGroupPattern = regexp.MustCompile("^`-[WD] ((?:clippy::)?[a-z0-9_-]+)` implied by `-[WD] clippy::([a-z_]+)`")
+
+// cargoMessage is the subset of a cargo --message-format=json line
+// describing a diagnostic.
+type cargoMessage struct {
+	Reason  string `json:"reason"`
+	Message struct {
+		Message string `json:"message"`
+		Level   string `json:"level"`
+		Code    *struct {
+			Code string `json:"code"`
+		} `json:"code"`
+		Spans []struct {
+			FileName    string `json:"file_name"`
+			LineStart   int    `json:"line_start"`
+			ColumnStart int    `json:"column_start"`
+			IsPrimary   bool   `json:"is_primary"`
+		} `json:"spans"`
+		Children []struct {
+			Message string `json:"message"`
+		} `json:"children"`
+		Rendered string `json:"rendered"`
+	} `json:"message"`
+}
+
+// normalizeLint returns a lint name without its clippy:: prefix and with
+// the underscores rustc prints in notes as dashes restored.
+func normalizeLint(name string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(name, "clippy::"), "-", "_")
+}
+
+// parseWarnings extracts the lint warnings from the JSON messages cargo
+// build and cargo clippy print with --message-format=json. rustc only
+// names a lint's group on its first warning, so the group is filled in on
+// every later one, and warnings reported once per target (the library and
+// its binary) are kept once.
+func parseWarnings(output string) ([]Lint, error) {
+	var (
+		lints  []Lint
+		groups = map[string]string{}
+		seen   = map[string]bool{}
+	)
+	sc := bufio.NewScanner(strings.NewReader(output))
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var msg cargoMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			return nil, fmt.Errorf("parse cargo messages: %w", err)
+		}
+		m := msg.Message
+		if msg.Reason != "compiler-message" || m.Level != "warning" || m.Code == nil {
+			continue
+		}
+
+		lint := Lint{Name: normalizeLint(m.Code.Code), Rendered: m.Rendered}
+		if !strings.HasPrefix(m.Code.Code, "clippy::") {
+			groups[lint.Name] = rustcGroup
+		}
+		for _, child := range m.Children {
+			if g := lintGroupPattern.FindStringSubmatch(child.Message); g != nil {
+				groups[normalizeLint(g[1])] = g[2]
+			}
+		}
+		lint.Diagnostic = Diagnostic{Level: m.Level, Message: m.Message}
+		for _, span := range m.Spans {
+			if span.IsPrimary {
+				lint.File, lint.Line, lint.Col = span.FileName, span.LineStart, span.ColumnStart
+				break
+			}
+		}
+
+		key := fmt.Sprintf("%s %s:%d:%d", lint.Name, lint.File, lint.Line, lint.Col)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		lints = append(lints, lint)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("parse cargo messages: %w", err)
+	}
+	for i := range lints {
+		lints[i].Group = groups[lints[i].Name]
+	}
+	return lints, nil
+}
@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// cargoRegistryTokenEnv holds the token for the private cargo registry.
+const cargoRegistryTokenEnv = "CARGO_REGISTRY_TOKEN"
+
+// defaultCargoRegistryName is the registry name dependencies use, as in
+// `internal-crate = { version = "1", registry = "private" }`.
+const defaultCargoRegistryName = "private"
+
+// cargo reads its configuration and credentials from CARGO_HOME, which the
+// rust images set to /usr/local/cargo.
+const (
+	cargoConfigPath      = "/usr/local/cargo/config.toml"
+	cargoCredentialsPath = "/usr/local/cargo/credentials.toml"
+)
+
+// cargoRegistryNamePattern matches the registry names cargo accepts.
+var cargoRegistryNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// cargoRegistry is a private registry and the token to read from it. The
+// token only ever reaches the engine as a Dagger secret.
+type cargoRegistry struct {
+	name  string
+	index string
+	token string
+}
+
+// validateCargoRegistry checks the private registry flags.
+func validateCargoRegistry(r cargoRegistry) error {
+	if r.index == "" {
+		return nil
+	}
+	if !cargoRegistryNamePattern.MatchString(r.name) {
+		return fmt.Errorf("invalid -registry-name %q: use letters, digits, - and _", r.name)
+	}
+	u, err := url.Parse(strings.TrimPrefix(r.index, "sparse+"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid -registry-index %q: want an index URL such as sparse+https://crates.example.com/index/", r.index)
+	}
+	if r.token == "" {
+		return fmt.Errorf("-registry-index requires a token in $%s", cargoRegistryTokenEnv)
+	}
+	return nil
+}
+
+// cargoRegistryConfig returns the cargo config.toml declaring the registry.
+func cargoRegistryConfig(r cargoRegistry) string {
+	return fmt.Sprintf("[registries.%s]\nindex = %s\n", r.name, strconv.Quote(r.index))
+}
+
+// cargoRegistryCredentials returns the credentials.toml holding the token.
+func cargoRegistryCredentials(r cargoRegistry) string {
+	return fmt.Sprintf("[registries.%s]\ntoken = %s\n", r.name, strconv.Quote(r.token))
+}
+
+// withCargoRegistry declares the private registry in rust's cargo config
+// and mounts its credentials as a secret, so they are neither part of any
+// layer nor visible in exec arguments or the environment.
+func withCargoRegistry(client *dagger.Client, rust *dagger.Container, r cargoRegistry) *dagger.Container {
+	credentials := client.SetSecret("cargo-registry-credentials-"+r.name, cargoRegistryCredentials(r))
+	return rust.
+		WithNewFile(cargoConfigPath, dagger.ContainerWithNewFileOpts{Contents: cargoRegistryConfig(r)}).
+		WithMountedSecret(cargoCredentialsPath, credentials)
+}
+
+// checkCargoRegistries fails when the project's Cargo.toml fetches
+// dependencies from a registry the pipeline has no credentials for, which
+// cargo would otherwise only report after resolving the whole graph.
+func checkCargoRegistries(ctx context.Context, src *dagger.Directory, r cargoRegistry) error {
+	manifest, err := readManifest(ctx, src)
+	if err != nil {
+		return err
+	}
+	return missingCargoRegistries(manifest.registries(), r)
+}
+
+// missingCargoRegistries reports the referenced registries that are not
+// the configured one, or all of them when none is configured.
+func missingCargoRegistries(referenced []string, r cargoRegistry) error {
+	var missing []string
+	for _, name := range referenced {
+		if r.index == "" || name != r.name {
+			missing = append(missing, name)
+		}
+	}
+	switch {
+	case len(missing) == 0:
+		return nil
+	case r.index == "":
+		return fmt.Errorf("Cargo.toml depends on private registry %s: set -registry-index and $%s",
+			strings.Join(missing, ", "), cargoRegistryTokenEnv)
+	default:
+		return fmt.Errorf("Cargo.toml depends on registry %s, but only -registry-name %s is configured",
+			strings.Join(missing, ", "), r.name)
+	}
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCargoRegistry(t *testing.T) {
+	valid := cargoRegistry{name: "private", index: "sparse+https://crates.example.com/index/", token: "s3cret"}
+	tests := []struct {
+		name    string
+		change  func(r *cargoRegistry)
+		wantErr string
+	}{
+		{"sparse index", func(r *cargoRegistry) {}, ""},
+		{"git index", func(r *cargoRegistry) { r.index = "https://git.example.com/crates-index.git" }, ""},
+		{"not configured", func(r *cargoRegistry) { *r = cargoRegistry{name: defaultCargoRegistryName} }, ""},
+		{"no token", func(r *cargoRegistry) { r.token = "" }, cargoRegistryTokenEnv},
+		{"relative index", func(r *cargoRegistry) { r.index = "crates/index" }, "invalid -registry-index"},
+		{"bad name", func(r *cargoRegistry) { r.name = "my registry" }, "invalid -registry-name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid
+			tt.change(&r)
+			err := validateCargoRegistry(r)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateCargoRegistry = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateCargoRegistry = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCargoRegistryFiles(t *testing.T) {
+	r := cargoRegistry{name: "private", index: "sparse+https://crates.example.com/index/", token: `tok"en`}
+	if got, want := cargoRegistryConfig(r), "[registries.private]\nindex = \"sparse+https://crates.example.com/index/\"\n"; got != want {
+		t.Errorf("cargoRegistryConfig =\n%s\nwant\n%s", got, want)
+	}
+	if got := cargoRegistryConfig(r); strings.Contains(got, "tok") {
+		t.Errorf("cargoRegistryConfig leaks the token:\n%s", got)
+	}
+	if got, want := cargoRegistryCredentials(r), "[registries.private]\ntoken = \"tok\\\"en\"\n"; got != want {
+		t.Errorf("cargoRegistryCredentials =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMissingCargoRegistries(t *testing.T) {
+	configured := cargoRegistry{name: "private", index: "sparse+https://crates.example.com/index/", token: "s3cret"}
+
+	if err := missingCargoRegistries(nil, cargoRegistry{}); err != nil {
+		t.Errorf("no private dependencies: %v", err)
+	}
+	if err := missingCargoRegistries([]string{"private"}, configured); err != nil {
+		t.Errorf("configured registry: %v", err)
+	}
+
+	err := missingCargoRegistries([]string{"private"}, cargoRegistry{name: "private"})
+	if err == nil || !strings.Contains(err.Error(), cargoRegistryTokenEnv) {
+		t.Errorf("unconfigured registry: %v, want an error naming $%s", err, cargoRegistryTokenEnv)
+	}
+	err = missingCargoRegistries([]string{"mirror", "private"}, configured)
+	if err == nil || !strings.Contains(err.Error(), "mirror") {
+		t.Errorf("other registry: %v, want an error naming it", err)
+	}
+}
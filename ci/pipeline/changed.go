@@ -0,0 +1,203 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// defaultBaseRef is what -only-changed diffs against.
+const defaultBaseRef = "origin/main"
+
+// workspaceFiles are the files outside any member that change how every
+// member builds. A diff touching one runs everything.
+var workspaceFiles = []string{"Cargo.toml", "Cargo.lock", "rust-toolchain", "rust-toolchain.toml", ".cargo/config", ".cargo/config.toml"}
+
+// member is a workspace member as -only-changed sees it.
+type member struct {
+	name string
+	dir  string   // relative to the project root, "" for a root package
+	deps []string // the other members it depends on
+}
+
+// parseMembers reads the members and the dependencies between them from
+// `cargo metadata --no-deps` run in /src.
+func parseMembers(metadata string) ([]member, error) {
+	var m struct {
+		Packages []struct {
+			Name         string `json:"name"`
+			ManifestPath string `json:"manifest_path"`
+			Dependencies []struct {
+				Name string `json:"name"`
+			} `json:"dependencies"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal([]byte(metadata), &m); err != nil {
+		return nil, fmt.Errorf("parse cargo metadata: %w", err)
+	}
+	names := make(map[string]bool, len(m.Packages))
+	for _, p := range m.Packages {
+		names[p.Name] = true
+	}
+	var members []member
+	for _, p := range m.Packages {
+		dir := strings.TrimPrefix(strings.TrimPrefix(path.Dir(p.ManifestPath), "/src"), "/")
+		mem := member{name: p.Name, dir: dir}
+		for _, d := range p.Dependencies {
+			if names[d.Name] && d.Name != p.Name {
+				mem.deps = append(mem.deps, d.Name)
+			}
+		}
+		members = append(members, mem)
+	}
+	return members, nil
+}
+
+// affectedMembers maps the changed files, relative to the project root, to
+// the members they belong to and every member depending on those. A file
+// belongs to the member in the innermost directory containing it. all is
+// set when a workspace-wide file changed, and files outside every member,
+// such as docs, affect nothing.
+func affectedMembers(members []member, changed []string) (affected []string, all bool) {
+	hit := map[string]bool{}
+	for _, file := range changed {
+		for _, f := range workspaceFiles {
+			if file == f {
+				return nil, true
+			}
+		}
+		owner, depth := "", -1
+		for _, m := range members {
+			if m.dir != "" && file != m.dir && !strings.HasPrefix(file, m.dir+"/") {
+				continue
+			}
+			if d := len(m.dir); d > depth {
+				owner, depth = m.name, d
+			}
+		}
+		if owner != "" {
+			hit[owner] = true
+		}
+	}
+
+	// walk the reverse dependencies, so a changed library also retests
+	// what uses it
+	dependents := map[string][]string{}
+	for _, m := range members {
+		for _, d := range m.deps {
+			dependents[d] = append(dependents[d], m.name)
+		}
+	}
+	queue := sortedKeys(hit)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[name] {
+			if !hit[d] {
+				hit[d] = true
+				queue = append(queue, d)
+			}
+		}
+	}
+	return sortedKeys(hit), false
+}
+
+// gitDiff runs `git diff` with args in the host checkout at source and
+// returns its output. The diff runs in a git container, as withSubmodules
+// does, so the host needs no git. Only the history is needed, so the
+// upload leaves out the build output but not .git.
+func gitDiff(ctx context.Context, client *dagger.Client, source string, args ...string) (string, error) {
+	excludes := sourceDefaultExcludes(Options{source: source, submodules: true})
+	return client.Container().
+		From(gitImage).
+		WithDirectory("/src", client.Host().Directory(source, dagger.HostDirectoryOpts{Exclude: excludes})).
+		WithWorkdir("/src").
+		WithExec(
+			append([]string{"git", "-c", "safe.directory=*", "diff"}, args...),
+			dagger.ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		Stdout(ctx)
+}
+
+// diffFiles lists the files changed on HEAD since it forked from base
+// in the host source, relative to it.
+func diffFiles(ctx context.Context, client *dagger.Client, source, base string) ([]string, error) {
+	out, err := gitDiff(ctx, client, source, "--name-only", "--relative", base+"...HEAD")
+	if err != nil {
+		return nil, stageFailed("git diff", err)
+	}
+	return strings.Fields(out), nil
+}
+
+// onlyChanged restricts the build and test stages of opts to the members
+// changed since opts.baseRef. When the diff cannot be computed, e.g. in a
+// shallow clone without the base, it warns and leaves opts unchanged so
+// the full run goes ahead.
+func onlyChanged(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options, log *slog.Logger) Options {
+	files, err := diffFiles(ctx, client, opts.source, opts.baseRef)
+	if err != nil {
+		log.Warn("cannot diff against the base, running every member", "base", opts.baseRef, "error", err)
+		return opts
+	}
+	metadata, err := cargoMetadata(ctx, rust)
+	if err == nil {
+		var members []member
+		if members, err = parseMembers(metadata); err == nil {
+			affected, all := affectedMembers(members, files)
+			return restrictToMembers(opts, affected, all, log)
+		}
+	}
+	log.Warn("cannot map changes to members, running every member", "error", err)
+	return opts
+}
+
+// restrictToMembers applies the outcome of affectedMembers to opts.
+func restrictToMembers(opts Options, affected []string, all bool, log *slog.Logger) Options {
+	switch {
+	case all:
+		log.Info("workspace files changed, running every member", "base", opts.baseRef)
+	case len(affected) == 0:
+		log.Info("no workspace member changed, skipping build and test", "base", opts.baseRef)
+		// copied, so a -watch rerun starts from the stages asked for
+		stages := make(map[string]bool, len(opts.stages))
+		for s, on := range opts.stages {
+			stages[s] = on
+		}
+		stages[stageBuild], stages[stageTest] = false, false
+		opts.stages = stages
+	default:
+		log.Info("running changed members", "base", opts.baseRef, "packages", strings.Join(affected, ","))
+		opts.packages = affected
+	}
+	return opts
+}
+
+// validateOnlyChanged rejects the flags a partial build cannot serve.
+func validateOnlyChanged(opts Options) error {
+	if !opts.onlyChanged {
+		return nil
+	}
+	if opts.gitURL != "" {
+		return fmt.Errorf("-only-changed requires a host -source, not -git-url")
+	}
+	if len(opts.packages) > 0 || opts.workspace {
+		return fmt.Errorf("-only-changed selects the members itself and cannot be combined with -package or -workspace")
+	}
+	if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 {
+		return fmt.Errorf("-only-changed cannot be combined with a matrix")
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{{"-publish", opts.publish}, {"-release", opts.release}, {"-tarball", opts.tarball}, {"-smoke", opts.smoke}} {
+		if f.set {
+			return fmt.Errorf("-only-changed cannot be combined with %s, which need the full build", f.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+// a workspace with a root binary, a library and a crate using it
+const workspaceMetadata = `{"packages":[
+{"name":"merlin","manifest_path":"/src/Cargo.toml","dependencies":[{"name":"merlin-core"},{"name":"serde"}]},
+{"name":"merlin-core","manifest_path":"/src/crates/core/Cargo.toml","dependencies":[{"name":"serde"}]},
+{"name":"merlin-cli","manifest_path":"/src/crates/cli/Cargo.toml","dependencies":[{"name":"merlin-core"}]},
+{"name":"merlin-bench","manifest_path":"/src/crates/bench/Cargo.toml","dependencies":[]}
+]}`
+
+func TestParseMembers(t *testing.T) {
+	members, err := parseMembers(workspaceMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []member{
+		{name: "merlin", dir: "", deps: []string{"merlin-core"}},
+		{name: "merlin-core", dir: "crates/core"},
+		{name: "merlin-cli", dir: "crates/cli", deps: []string{"merlin-core"}},
+		{name: "merlin-bench", dir: "crates/bench"},
+	}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("parseMembers =\n%v\nwant\n%v", members, want)
+	}
+	if _, err := parseMembers("not json"); err == nil {
+		t.Error("parseMembers accepted malformed metadata")
+	}
+}
+
+func TestAffectedMembers(t *testing.T) {
+	members, err := parseMembers(workspaceMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name     string
+		changed  []string
+		affected []string
+		all      bool
+	}{
+		{"leaf crate", []string{"crates/bench/src/main.rs"}, []string{"merlin-bench"}, false},
+		{"library and its dependents", []string{"crates/core/src/lib.rs"}, []string{"merlin", "merlin-cli", "merlin-core"}, false},
+		{"root package", []string{"src/main.rs"}, []string{"merlin"}, false},
+		{"member manifest", []string{"crates/cli/Cargo.toml"}, []string{"merlin-cli"}, false},
+		{"prefix is not a parent", []string{"crates/cli-old/notes.md"}, []string{"merlin"}, false},
+		{"lockfile", []string{"crates/bench/src/main.rs", "Cargo.lock"}, nil, true},
+		{"toolchain", []string{"rust-toolchain.toml"}, nil, true},
+		{"nothing", nil, []string{}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			affected, all := affectedMembers(members, tt.changed)
+			if all != tt.all || !reflect.DeepEqual(affected, tt.affected) {
+				t.Errorf("affectedMembers(%v) = %v, %v; want %v, %v", tt.changed, affected, all, tt.affected, tt.all)
+			}
+		})
+	}
+}
+
+func TestAffectedMembersOutsideEveryMember(t *testing.T) {
+	// in a virtual workspace docs belong to no member
+	members := []member{{name: "core", dir: "crates/core"}}
+	if affected, all := affectedMembers(members, []string{"README.md", "docs/guide.md"}); len(affected) != 0 || all {
+		t.Errorf("got %v, %v; want nothing", affected, all)
+	}
+}
+
+func TestRestrictToMembers(t *testing.T) {
+	log := newLogger(io.Discard, logFormatText, logNormal)
+	base := Options{stages: map[string]bool{stageBuild: true, stageTest: true, stageFmt: true}}
+
+	if opts := restrictToMembers(base, []string{"merlin-core"}, false, log); !reflect.DeepEqual(opts.packages, []string{"merlin-core"}) {
+		t.Errorf("packages = %v", opts.packages)
+	}
+	if opts := restrictToMembers(base, nil, true, log); opts.packages != nil || !opts.enabled(stageBuild) {
+		t.Errorf("workspace change narrowed the run: %+v", opts.packages)
+	}
+
+	opts := restrictToMembers(base, []string{}, false, log)
+	if opts.enabled(stageBuild) || opts.enabled(stageTest) || !opts.enabled(stageFmt) {
+		t.Errorf("stages = %v, want only fmt", opts.stages)
+	}
+	if !base.enabled(stageBuild) {
+		t.Error("restrictToMembers changed the caller's stages")
+	}
+}
+
+func TestOnlyChangedRejectsFullBuildFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-only-changed", "-package=merlin"},
+		{"-only-changed", "-workspace"},
+		{"-only-changed", "-tarball"},
+		{"-only-changed", "-git-url=https://github.com/awdemos/merlin.git"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+	opts, err := ParseOptions([]string{"-only-changed"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.baseRef != defaultBaseRef {
+		t.Errorf("baseRef = %q, want %q", opts.baseRef, defaultBaseRef)
+	}
+}
@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// checklist statuses
+const (
+	checkOK   = "ok"
+	checkFail = "FAIL"
+	checkSkip = "skip"
+)
+
+// precondition is a requirement of a feature, recorded by ParseOptions.
+type precondition struct {
+	name    string
+	enabled bool
+	err     error
+}
+
+// require records the precondition name of a feature and returns err, or
+// nil with -check, which reports it in the checklist instead.
+func (o *Options) require(name string, enabled bool, err error) error {
+	o.preconditions = append(o.preconditions, precondition{name: name, enabled: enabled, err: err})
+	if o.check {
+		return nil
+	}
+	return err
+}
+
+// checkItem is one line of the -check checklist.
+type checkItem struct {
+	name, status, detail string
+}
+
+// imageRefPattern is the reference grammar of the Docker distribution
+// library: an optional registry host with port, slash-separated
+// lowercase path components, and an optional tag and digest.
+var imageRefPattern = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[\w][\w.-]{0,127})?(?:@sha256:[a-f0-9]{64})?$`)
+
+// validateImageRef rejects malformed image references before a pull or
+// push would.
+func validateImageRef(ref string) error {
+	if !imageRefPattern.MatchString(ref) {
+		return fmt.Errorf("malformed image reference %q", ref)
+	}
+	return nil
+}
+
+// checklist validates opts without connecting to Dagger: the config file,
+// the image references, the preconditions of the enabled features and
+// the requested workspace packages.
+func checklist(opts Options) []checkItem {
+	var items []checkItem
+	add := func(name string, err error, ok string) {
+		if err != nil {
+			items = append(items, checkItem{name, checkFail, err.Error()})
+		} else {
+			items = append(items, checkItem{name, checkOK, ok})
+		}
+	}
+
+	// ParseOptions fails on a config file that does not parse
+	if opts.configFile != "" {
+		add("config", nil, opts.configFile+" parsed")
+	} else {
+		add("config", nil, "no config file, flags and defaults only")
+	}
+
+	image := buildImage(opts)
+	add("base image", validateImageRef(image), image)
+	if opts.publish {
+		add("image ref", validateImageRef(opts.imageRef), opts.imageRef)
+	}
+
+	for _, p := range opts.preconditions {
+		if !p.enabled {
+			items = append(items, checkItem{p.name, checkSkip, "not enabled"})
+			continue
+		}
+		add(p.name, p.err, "configured")
+	}
+
+	requested := append(append([]string(nil), opts.packages...), opts.exclude...)
+	switch {
+	case len(requested) == 0:
+		items = append(items, checkItem{"packages", checkSkip, "no -package or -exclude"})
+	case opts.gitURL != "":
+		items = append(items, checkItem{"packages", checkSkip, "-git-url sources are only checked out in the engine"})
+	default:
+		members, err := hostMembers(opts.source)
+		if err == nil {
+			err = unknownPackages(requested, members)
+		}
+		add("packages", err, strings.Join(requested, ", ")+" found")
+	}
+	return items
+}
+
+// formatChecklist renders items as a table ending in a count of failures.
+func formatChecklist(items []checkItem) string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	failed := 0
+	for _, item := range items {
+		if item.status == checkFail {
+			failed++
+		}
+		fmt.Fprintf(tw, "[%s]\t%s\t%s\n", item.status, item.name, item.detail)
+	}
+	tw.Flush()
+	if failed > 0 {
+		fmt.Fprintf(&b, "%d of %d checks failed\n", failed, len(items))
+	} else {
+		b.WriteString("all checks passed\n")
+	}
+	return b.String()
+}
+
+// runCheck prints the checklist of opts to w and fails if any item did.
+func runCheck(w io.Writer, opts Options) error {
+	items := checklist(opts)
+	fmt.Fprint(w, formatChecklist(items))
+	for _, item := range items {
+		if item.status == checkFail {
+			return fmt.Errorf("check failed")
+		}
+	}
+	return nil
+}
+
+// hostMembers returns the names of the crates in the Cargo workspace at
+// source on the host, read from the manifests without running cargo: the
+// root package and the packages of every workspace member.
+func hostMembers(source string) ([]string, error) {
+	root, err := readHostManifest(filepath.Join(source, "Cargo.toml"))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	if root.Package.Name != "" {
+		seen[root.Package.Name] = true
+	}
+
+	excluded := make(map[string]bool)
+	for _, dir := range root.Workspace.Exclude {
+		excluded[filepath.Clean(filepath.Join(source, dir))] = true
+	}
+	for _, pattern := range root.Workspace.Members {
+		dirs, err := filepath.Glob(filepath.Join(source, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("workspace member %q: %w", pattern, err)
+		}
+		for _, dir := range dirs {
+			if excluded[filepath.Clean(dir)] {
+				continue
+			}
+			m, err := readHostManifest(filepath.Join(dir, "Cargo.toml"))
+			if os.IsNotExist(err) {
+				continue // a glob also matches directories that are not crates
+			}
+			if err != nil {
+				return nil, err
+			}
+			if m.Package.Name != "" {
+				seen[m.Package.Name] = true
+			}
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
+func readHostManifest(path string) (cargoManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cargoManifest{}, err
+	}
+	m, err := parseManifest(data)
+	if err != nil {
+		return cargoManifest{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
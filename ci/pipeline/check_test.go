@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckReportsMissingCredentials(t *testing.T) {
+	t.Setenv(registryPasswordEnv, "")
+	t.Setenv(cosignKeyEnv, "")
+
+	args := []string{"-check", "-publish", "-image-ref=ghcr.io/awdemos/merlin:latest", "-sign"}
+	if _, err := ParseOptions(args[1:], io.Discard); err == nil {
+		t.Fatal("publish without credentials succeeded without -check, want error")
+	}
+	opts, err := ParseOptions(args, io.Discard)
+	if err != nil {
+		t.Fatalf("ParseOptions with -check: %v", err)
+	}
+
+	status := make(map[string]string)
+	for _, item := range checklist(opts) {
+		status[item.name] = item.status
+	}
+	want := map[string]string{
+		"config":          checkOK,
+		"base image":      checkOK,
+		"image ref":       checkOK,
+		"release":         checkSkip,
+		"cargo registry":  checkSkip,
+		"base image pull": checkSkip,
+		"publish":         checkFail,
+		"sign":            checkFail,
+		"s3 upload":       checkSkip,
+		"packages":        checkSkip,
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("checklist statuses = %v, want %v", status, want)
+	}
+
+	var out strings.Builder
+	if err := runCheck(&out, opts); err == nil {
+		t.Error("runCheck with failed items succeeded, want error")
+	}
+	if !strings.Contains(out.String(), "2 of 10 checks failed") {
+		t.Errorf("checklist output:\n%s", out.String())
+	}
+}
+
+func TestCheckReportsMissingConfig(t *testing.T) {
+	// there is no merlin-ci.yaml in ci/, so the default is missing
+	opts, err := ParseOptions([]string{"-check"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.configFile != "" {
+		t.Errorf("configFile = %q for a missing default config file", opts.configFile)
+	}
+	if item := checklist(opts)[0]; item.name != "config" || !strings.HasPrefix(item.detail, "no config file") {
+		t.Errorf("config item = %+v, want no config file", item)
+	}
+
+	path := filepath.Join(t.TempDir(), "merlin-ci.yaml")
+	if err := os.WriteFile(path, []byte("stages: [build]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err = ParseOptions([]string{"-check", "-config=" + path}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item := checklist(opts)[0]; item.detail != path+" parsed" {
+		t.Errorf("config item = %+v, want %s parsed", item, path)
+	}
+}
+
+func TestValidateImageRef(t *testing.T) {
+	for _, ref := range []string{
+		"rust:1.75",
+		"ghcr.io/awdemos/merlin:latest",
+		"localhost:5000/merlin",
+		"registry.example.com/team/rust-base:1.75-slim",
+		"rust@sha256:" + strings.Repeat("a", 64),
+	} {
+		if err := validateImageRef(ref); err != nil {
+			t.Errorf("validateImageRef(%q): %v", ref, err)
+		}
+	}
+	for _, ref := range []string{"", "Rust:1.75", "ghcr.io/awdemos/merlin:", "rust:1.75 ", "ghcr.io//merlin"} {
+		if err := validateImageRef(ref); err == nil {
+			t.Errorf("validateImageRef(%q) succeeded, want error", ref)
+		}
+	}
+}
+
+func TestHostMembers(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, contents string) {
+		t.Helper()
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Cargo.toml", "[package]\nname = \"merlin\"\n\n[workspace]\nmembers = [\"crates/*\"]\nexclude = [\"crates/scratch\"]\n")
+	write("crates/router/Cargo.toml", "[package]\nname = \"merlin-router\"\n")
+	write("crates/scratch/Cargo.toml", "[package]\nname = \"scratch\"\n")
+	write("crates/docs/README.md", "not a crate\n")
+
+	got, err := hostMembers(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"merlin", "merlin-router"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hostMembers = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checksumsFile is the name of the checksum list written next to artifacts.
+const checksumsFile = "SHA256SUMS"
+
+// writeChecksums writes a SHA256SUMS file into dir covering every regular
+// file directly inside it, in the format `sha256sum -c` reads.
+func writeChecksums(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && entry.Name() != checksumsFile {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		sum, err := sha256File(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, name)
+	}
+	return os.WriteFile(filepath.Join(dir, checksumsFile), []byte(b.String()), 0o644)
+}
+
+// sha256File returns the hex-encoded SHA-256 digest of a file.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,41 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteChecksums(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"merlin", "empty.txt"} {
+		data, err := os.ReadFile(filepath.Join("pipeline", "testdata", "artifacts", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// subdirectories and a previous checksum file are not artifacts
+	if err := os.Mkdir(filepath.Join(dir, "linux-arm64"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, checksumsFile), []byte("stale\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeChecksums(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, checksumsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  empty.txt\n" +
+		"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  merlin\n"
+	if string(got) != want {
+		t.Errorf("SHA256SUMS =\n%s\nwant\n%s", got, want)
+	}
+}
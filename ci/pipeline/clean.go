@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheEpochFile records the cache epoch set by `merlin-ci clean`. Dagger
+// offers no way to delete cache volumes, so cleaning rotates their names
+// instead: every run prefixes its volumes with the epoch, new volumes start
+// empty, and the old ones are left to the engine's cache garbage collection.
+const cacheEpochFile = ".merlin-ci-cache-epoch"
+
+// cacheVolumes are the base names of the volumes the pipeline mounts, for
+// reporting what a clean rotated.
+var cacheVolumes = []string{cacheCargoRegistry + "-*", cacheCargoGit + "-*", cacheCargoTarget + "-*", cacheSccache, cachePGOProfile, cacheAptArchives, cacheAptLists}
+
+// readCacheEpoch returns the epoch recorded in path, or "" if caches were
+// never cleaned.
+func readCacheEpoch(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// rotatedPrefix combines the configured cache prefix with the cache epoch.
+func rotatedPrefix(prefix, epoch string) string {
+	if epoch == "" {
+		return prefix
+	}
+	return cacheName(prefix, epoch)
+}
+
+// runClean implements `merlin-ci clean`: it removes the build output and
+// rotates the cache volumes, or only one of them with -output-only or
+// -caches-only.
+func runClean(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("merlin-ci clean", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cachesOnly := fs.Bool("caches-only", false, "only rotate the cache volumes")
+	outputOnly := fs.Bool("output-only", false, "only remove the "+buildDir+" output directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *cachesOnly && *outputOnly {
+		return fmt.Errorf("-caches-only and -output-only cannot be combined")
+	}
+
+	if !*cachesOnly {
+		if err := cleanOutput(buildDir, stdout); err != nil {
+			return err
+		}
+	}
+	if !*outputOnly {
+		if err := rotateCaches(cacheEpochFile, time.Now(), stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanOutput removes the build output directory dir.
+func cleanOutput(dir string, stdout io.Writer) error {
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(stdout, "%s: already clean\n", dir)
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("remove %s: %w", dir, err)
+	}
+	fmt.Fprintf(stdout, "removed %s\n", dir)
+	return nil
+}
+
+// rotateCaches records a new cache epoch derived from now in path, so
+// later runs mount fresh volumes. The epoch has nanoseconds, and moves a
+// nanosecond past the recorded one when the clock has not, so two cleans
+// never share an epoch.
+func rotateCaches(path string, now time.Time, stdout io.Writer) error {
+	previous, err := readCacheEpoch(path)
+	if err != nil {
+		return fmt.Errorf("rotate caches: %w", err)
+	}
+	epoch := cacheEpoch(now)
+	if epoch <= previous {
+		if last, ok := parseCacheEpoch(previous); ok {
+			epoch = cacheEpoch(last.Add(time.Nanosecond))
+		}
+	}
+	if err := os.WriteFile(path, []byte(epoch+"\n"), 0o644); err != nil {
+		return fmt.Errorf("rotate caches: %w", err)
+	}
+	fmt.Fprintf(stdout, "rotated cache volumes %s: later runs use names prefixed with %s; the old volumes are released to the engine's garbage collection\n",
+		strings.Join(cacheVolumes, ", "), epoch)
+	return nil
+}
+
+// cacheEpoch names the epoch starting at t, e.g.
+// epoch20240301123000000000000. The fixed width keeps later epochs
+// sorting after earlier ones.
+func cacheEpoch(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("epoch%s%09d", t.Format("20060102150405"), t.Nanosecond())
+}
+
+// parseCacheEpoch returns the time a cacheEpoch name starts at, also
+// reading the whole seconds of epochs recorded before they had nanoseconds.
+func parseCacheEpoch(epoch string) (time.Time, bool) {
+	digits, ok := strings.CutPrefix(epoch, "epoch")
+	if !ok || len(digits) < 14 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102150405", digits[:14])
+	if err != nil {
+		return time.Time{}, false
+	}
+	if nanos := digits[14:]; nanos != "" {
+		n, err := strconv.Atoi(nanos)
+		if err != nil || len(nanos) != 9 {
+			return time.Time{}, false
+		}
+		t = t.Add(time.Duration(n))
+	}
+	return t, true
+}
@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanOutput(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "build")
+	if err := os.MkdirAll(filepath.Join(dir, "linux-amd64"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanOutput(dir, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s still exists: %v", dir, err)
+	}
+	if err := cleanOutput(dir, io.Discard); err != nil {
+		t.Errorf("cleaning a missing directory: %v", err)
+	}
+}
+
+func TestRotateCaches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), cacheEpochFile)
+
+	epoch, err := readCacheEpoch(path)
+	if err != nil || epoch != "" {
+		t.Fatalf("readCacheEpoch before clean = %q, %v", epoch, err)
+	}
+
+	if err := rotateCaches(path, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if epoch, err = readCacheEpoch(path); err != nil || epoch != "epoch20240301123000000000000" {
+		t.Fatalf("readCacheEpoch after clean = %q, %v", epoch, err)
+	}
+
+	if got := cacheName(rotatedPrefix("main", epoch), cacheCargoGit); got != "main-epoch20240301123000000000000-cargo-git" {
+		t.Errorf("rotated volume = %q", got)
+	}
+	if got := cacheName(rotatedPrefix("", ""), cacheCargoGit); got != cacheCargoGit {
+		t.Errorf("unrotated volume = %q", got)
+	}
+
+	// a second clean in the same instant, or after the clock went back,
+	// still gets fresh volumes
+	for _, now := range []time.Time{
+		time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if err := rotateCaches(path, now, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		next, err := readCacheEpoch(path)
+		if err != nil || next <= epoch {
+			t.Errorf("rotateCaches(%s) after %s recorded %q, %v", now, epoch, next, err)
+		}
+		epoch = next
+	}
+}
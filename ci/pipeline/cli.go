@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"dagger.io/dagger"
+)
+
+// Main runs the merlin CI command line with args, which exclude the
+// program name, connecting to Dagger for the run.
+func Main(ctx context.Context, args []string) (err error) {
+	if len(args) > 0 && args[0] == "clean" {
+		err := runClean(args[1:], os.Stdout, os.Stderr)
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	opts, err := ParseOptions(args, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.dryRun {
+		fmt.Print(formatPlan(opts))
+		return nil
+	}
+	if opts.check {
+		return runCheck(os.Stdout, opts)
+	}
+
+	// the log file is closed last, and on a panic or a second Ctrl-C too,
+	// so it holds everything up to the end
+	var logOut *logFile
+	if opts.logFile != "" {
+		if logOut, err = openLogFile(opts.logFile, opts.logFormat); err != nil {
+			return fmt.Errorf("open log file: %w", err)
+		}
+		defer logOut.Close()
+		// the caller prints the error once Main returned, which is too
+		// late for the log file, so it is copied there first
+		defer func() {
+			if err != nil {
+				fmt.Fprintln(logOut.stream("stderr"), err)
+			}
+		}()
+		if err := logOut.teeStdout(); err != nil {
+			return fmt.Errorf("open log file: %w", err)
+		}
+	}
+
+	// cancel the run on Ctrl-C, so the deferred Close below still runs
+	var closeLog func()
+	if logOut != nil {
+		closeLog = func() { logOut.Close() }
+	}
+	ctx, stop := withSignals(ctx, closeLog)
+	defer stop()
+
+	p := New(opts)
+	if logOut != nil {
+		p.Log = slog.New(teeHandler{p.Log.Handler(), logOut.handler()})
+	}
+	if opts.lockKey != "" {
+		p.Log.Debug("cache key", "lockfile_hash", opts.lockKey)
+	}
+
+	tracer, shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return fmt.Errorf("set up tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			p.Log.Warn("flush traces", "error", err)
+		}
+	}()
+	p.Tracer = tracer
+
+	daggerLog, closeDaggerLog, err := openLogOutput(opts.daggerLog)
+	if err != nil {
+		return fmt.Errorf("open dagger log: %w", err)
+	}
+	defer closeDaggerLog()
+
+	if logOut != nil {
+		daggerLog = io.MultiWriter(daggerLog, logOut.stream("dagger"))
+	}
+
+	// initialize Dagger client
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(daggerLog))
+	if err != nil {
+		return fmt.Errorf("connect to dagger: %w", err)
+	}
+	defer client.Close()
+
+	if opts.benchCache {
+		return runCacheBench(ctx, client, opts, p.Log, os.Stdout)
+	}
+	if opts.watch {
+		return p.Watch(ctx, client)
+	}
+	_, err = p.Run(ctx, client)
+	return err
+}
@@ -0,0 +1,205 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"dagger.io/dagger"
+)
+
+// clippy's lint groups. Those in clippy::all are enabled by default.
+var (
+	defaultClippyGroups = []string{"correctness", "suspicious", "style", "complexity", "perf"}
+	optInClippyGroups   = []string{"pedantic", "nursery", "cargo", "restriction"}
+)
+
+// clippyPolicy decides which clippy warnings fail the stage. Entries name
+// a lint group or a single lint, and a lint entry wins over its group's.
+// Warnings neither denied nor allowed count towards maxWarnings.
+type clippyPolicy struct {
+	deny        []string
+	allow       []string
+	maxWarnings int
+}
+
+// rule returns how the policy treats lint: "deny", "allow" or "" when it
+// counts towards the warning budget.
+func (p clippyPolicy) rule(lint Lint) string {
+	for _, name := range []string{lint.Name, lint.Group} {
+		if name == "" {
+			continue
+		}
+		for _, d := range p.deny {
+			if normalizeLint(d) == name {
+				return "deny"
+			}
+		}
+		for _, a := range p.allow {
+			if normalizeLint(a) == name {
+				return "allow"
+			}
+		}
+	}
+	return ""
+}
+
+// LintCount is the number of warnings of one lint and their verdict.
+type LintCount struct {
+	Name  string
+	Group string
+	Count int
+	Rule  string // "deny", "allow" or "" for the budget
+}
+
+// PolicyResult is the outcome of evaluating clippy's warnings.
+type PolicyResult struct {
+	Counts   []LintCount // by descending count, then name
+	Denied   []Lint      // warnings of denied lints
+	Budgeted []Lint      // warnings counting towards the budget
+	Failures []string    // why the stage fails, empty when it passes
+}
+
+// failing returns the warnings that fail the stage: the denied ones, and
+// the budgeted ones once there are too many.
+func (r PolicyResult) failing(maxWarnings int) []Lint {
+	if len(r.Budgeted) > maxWarnings {
+		return append(append([]Lint(nil), r.Denied...), r.Budgeted...)
+	}
+	return r.Denied
+}
+
+// evaluate applies the policy to the warnings of one clippy run.
+func (p clippyPolicy) evaluate(lints []Lint) PolicyResult {
+	var res PolicyResult
+	counts := map[string]*LintCount{}
+	for _, lint := range lints {
+		rule := p.rule(lint)
+		c, ok := counts[lint.Name]
+		if !ok {
+			c = &LintCount{Name: lint.Name, Group: lint.Group, Rule: rule}
+			counts[lint.Name] = c
+		}
+		c.Count++
+		switch rule {
+		case "deny":
+			res.Denied = append(res.Denied, lint)
+		case "":
+			res.Budgeted = append(res.Budgeted, lint)
+		}
+	}
+	for _, name := range sortedKeys(counts) {
+		res.Counts = append(res.Counts, *counts[name])
+	}
+	sort.SliceStable(res.Counts, func(i, j int) bool { return res.Counts[i].Count > res.Counts[j].Count })
+
+	for _, c := range res.Counts {
+		if c.Rule == "deny" {
+			res.Failures = append(res.Failures, fmt.Sprintf("%d warning(s) of denied lint %s", c.Count, lintLabel(c.Name, c.Group)))
+		}
+	}
+	if len(res.Budgeted) > p.maxWarnings {
+		res.Failures = append(res.Failures, fmt.Sprintf("%d warning(s) exceed the budget of %d", len(res.Budgeted), p.maxWarnings))
+	}
+	return res
+}
+
+// lintLabel names a lint with its group, e.g. needless_return (style).
+func lintLabel(name, group string) string {
+	if group == "" {
+		return name
+	}
+	return name + " (" + group + ")"
+}
+
+// formatLintCounts renders the per-lint summary table.
+func formatLintCounts(res PolicyResult, maxWarnings int) string {
+	if len(res.Counts) == 0 {
+		return "no clippy warnings\n"
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LINT\tGROUP\tCOUNT\tPOLICY")
+	for _, c := range res.Counts {
+		rule := c.Rule
+		if rule == "" {
+			rule = "budget"
+		}
+		group := c.Group
+		if group == "" {
+			group = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", c.Name, group, c.Count, rule)
+	}
+	w.Flush()
+	fmt.Fprintf(&b, "%d of %d budgeted warning(s)\n", len(res.Budgeted), maxWarnings)
+	return b.String()
+}
+
+// clippyPolicyArgs runs clippy with JSON output and every group the policy
+// may name enabled as a warning, so that no lint fails the build on its
+// own and rustc notes each lint's group. cargoArgs are passed to cargo.
+func clippyPolicyArgs(p clippyPolicy, cargoArgs ...string) []string {
+	args := append(append([]string{"cargo", "clippy", "--message-format=json"}, cargoArgs...), "--")
+	groups := append([]string(nil), defaultClippyGroups...)
+	for _, g := range optInClippyGroups {
+		for _, name := range append(append([]string(nil), p.deny...), p.allow...) {
+			if normalizeLint(name) == g {
+				groups = append(groups, g)
+				break
+			}
+		}
+	}
+	for _, g := range groups {
+		args = append(args, "-W", "clippy::"+g)
+	}
+	return args
+}
+
+// validateClippyPolicy rejects a lint or group that is both denied and
+// allowed, and a negative budget.
+func validateClippyPolicy(p clippyPolicy) error {
+	if p.maxWarnings < 0 {
+		return fmt.Errorf("-clippy-max-warnings must not be negative, got %d", p.maxWarnings)
+	}
+	for _, d := range p.deny {
+		for _, a := range p.allow {
+			if normalizeLint(d) == normalizeLint(a) {
+				return fmt.Errorf("%s is both in -clippy-deny and -clippy-allow", d)
+			}
+		}
+	}
+	return nil
+}
+
+// runClippyPolicy lints the project and fails when the warnings break the
+// policy. Compiler errors fail it as before.
+func runClippyPolicy(ctx context.Context, rust *dagger.Container, p clippyPolicy, cargoArgs ...string) (string, error) {
+	out, cargoStderr, err := execStreams(ctx, rust.WithExec(clippyPolicyArgs(p, cargoArgs...)))
+	if err != nil {
+		return "", stageFailed(stageClippy, err)
+	}
+	lints, err := parseWarnings(out)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageClippy, err)
+	}
+
+	res := p.evaluate(lints)
+	summary := formatLintCounts(res, p.maxWarnings)
+	if len(res.Failures) == 0 {
+		// stdout is clippy's JSON messages, summarized above
+		return combineStreams(summary, cargoStderr), nil
+	}
+
+	// the failing warnings come first, rendered as clippy prints them, so
+	// they also turn into annotations
+	var stderr strings.Builder
+	for _, lint := range res.failing(p.maxWarnings) {
+		stderr.WriteString(lint.Rendered)
+	}
+	stderr.WriteString(summary)
+	stderr.WriteString(strings.Join(res.Failures, "\n"))
+	return "", &stageError{stage: stageClippy, exitCode: 1, stderr: stderr.String()}
+}
@@ -0,0 +1,134 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readClippyFixture(t *testing.T) []Lint {
+	t.Helper()
+	data, err := os.ReadFile("pipeline/testdata/clippy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lints, err := parseWarnings(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lints
+}
+
+func TestParseClippyJSON(t *testing.T) {
+	lints := readClippyFixture(t)
+
+	type summary struct {
+		name, group, file string
+		line, col         int
+	}
+	var got []summary
+	for _, l := range lints {
+		got = append(got, summary{l.Name, l.Group, l.File, l.Line, l.Col})
+	}
+	want := []summary{
+		{"needless_return", "style", "src/lib.rs", 12, 5},
+		{"needless_return", "style", "src/router.rs", 40, 9},
+		{"absurd_extreme_comparisons", "correctness", "src/metrics/mod.rs", 7, 8},
+		{"unused_variables", rustcGroup, "src/main.rs", 3, 9},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseWarnings =\n%v\nwant\n%v", got, want)
+	}
+	if !strings.HasPrefix(lints[0].Rendered, "warning: unneeded `return` statement") {
+		t.Errorf("Rendered = %q", lints[0].Rendered)
+	}
+
+	if _, err := parseWarnings("{not json\n"); err == nil {
+		t.Error("parseWarnings accepted malformed output")
+	}
+}
+
+func TestClippyPolicyEvaluate(t *testing.T) {
+	lints := readClippyFixture(t)
+
+	tests := []struct {
+		name     string
+		policy   clippyPolicy
+		budgeted int
+		failures int
+	}{
+		{"budget too small", clippyPolicy{maxWarnings: 3}, 4, 1},
+		{"budget", clippyPolicy{maxWarnings: 4}, 4, 0},
+		{"deny group", clippyPolicy{deny: []string{"correctness"}, maxWarnings: 10}, 3, 1},
+		{"allow group", clippyPolicy{allow: []string{"style", "rustc"}, maxWarnings: 1}, 1, 0},
+		// a lint entry overrides its group's
+		{"allow lint in denied group", clippyPolicy{deny: []string{"style"}, allow: []string{"clippy::needless_return"}, maxWarnings: 2}, 2, 0},
+		{"deny and budget", clippyPolicy{deny: []string{"needless_return"}}, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.policy.evaluate(lints)
+			if len(res.Budgeted) != tt.budgeted {
+				t.Errorf("budgeted = %d, want %d", len(res.Budgeted), tt.budgeted)
+			}
+			if len(res.Failures) != tt.failures {
+				t.Errorf("failures = %q, want %d", res.Failures, tt.failures)
+			}
+		})
+	}
+}
+
+func TestFormatLintCounts(t *testing.T) {
+	p := clippyPolicy{deny: []string{"correctness"}, maxWarnings: 5}
+	got := formatLintCounts(p.evaluate(readClippyFixture(t)), p.maxWarnings)
+	want := `LINT                        GROUP        COUNT  POLICY
+needless_return             style        2      budget
+absurd_extreme_comparisons  correctness  1      deny
+unused_variables            rustc        1      budget
+3 of 5 budgeted warning(s)
+`
+	if got != want {
+		t.Errorf("formatLintCounts =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestClippyPolicyArgs(t *testing.T) {
+	got := clippyPolicyArgs(clippyPolicy{allow: []string{"pedantic"}})
+	want := []string{"cargo", "clippy", "--message-format=json", "--",
+		"-W", "clippy::correctness", "-W", "clippy::suspicious", "-W", "clippy::style", "-W", "clippy::complexity", "-W", "clippy::perf",
+		"-W", "clippy::pedantic"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("clippyPolicyArgs = %v, want %v", got, want)
+	}
+}
+
+func TestClippyPolicyOptions(t *testing.T) {
+	opts, err := ParseOptions(nil, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.clippyPolicy != nil {
+		t.Error("clippy policy set without any policy flag")
+	}
+
+	opts, err = ParseOptions([]string{"-clippy-deny=correctness,suspicious", "-clippy-max-warnings=20"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &clippyPolicy{deny: []string{"correctness", "suspicious"}, maxWarnings: 20}
+	if !reflect.DeepEqual(opts.clippyPolicy, want) {
+		t.Errorf("clippyPolicy = %+v, want %+v", opts.clippyPolicy, want)
+	}
+
+	for _, args := range [][]string{
+		{"-clippy-max-warnings=-1"},
+		{"-clippy-deny=style", "-clippy-allow=style"},
+		{"-clippy-deny=correctness", "-clippy-fix"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%v) succeeded, want error", args)
+		}
+	}
+}
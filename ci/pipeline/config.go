@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPath is read when present; -config names another file.
+const defaultConfigPath = "merlin-ci.yaml"
+
+// Config is the file form of the pipeline configuration. Every field is
+// optional: a zero value leaves the built-in default (or the command line
+// flag, which always wins) in place.
+type Config struct {
+	// RustVersion is the toolchain image tag, as -rust-version.
+	RustVersion string `yaml:"rust_version"`
+	// BaseImage replaces the rust:<version> image entirely, as -base-image.
+	BaseImage string `yaml:"base_image"`
+	// AptPackages are installed into the build image, as -apt-packages.
+	AptPackages []string `yaml:"apt_packages"`
+	// Stages lists the stages to run, as -stages.
+	Stages []string `yaml:"stages"`
+	// Platforms lists the platforms to build for, as -platforms.
+	Platforms []string `yaml:"platforms"`
+
+	Cache struct {
+		// Prefix namespaces the cache volumes, as -cache-prefix.
+		Prefix string `yaml:"prefix"`
+		// Disabled turns off the caches, as -no-cache.
+		Disabled bool `yaml:"disabled"`
+	} `yaml:"cache"`
+
+	Publish struct {
+		Enabled      bool   `yaml:"enabled"`
+		ImageRef     string `yaml:"image_ref"`
+		RegistryUser string `yaml:"registry_user"`
+		RegistryAddr string `yaml:"registry_addr"`
+	} `yaml:"publish"`
+
+	// Assets configures -verify-assets.
+	Assets struct {
+		// Markers must occur in the binary, as -asset-markers.
+		Markers []string `yaml:"markers"`
+		// Command must succeed in the runtime image, as -asset-verify-command.
+		Command string `yaml:"command"`
+	} `yaml:"assets"`
+
+	// Hooks are shell commands run in the build container around the
+	// build and test stages; see runHooks.
+	Hooks struct {
+		PreBuild  []string `yaml:"pre_build"`
+		PostBuild []string `yaml:"post_build"`
+		PreTest   []string `yaml:"pre_test"`
+		PostTest  []string `yaml:"post_test"`
+	} `yaml:"hooks"`
+}
+
+// loadConfig reads and parses a config file. Unknown keys are rejected so
+// that typos don't silently fall back to defaults.
+func loadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// flagValues returns the configured settings keyed by the flag they
+// correspond to, in the flag's string syntax. Unset fields are omitted.
+func (c Config) flagValues() map[string]string {
+	values := make(map[string]string)
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	setBool := func(name string, value bool) {
+		if value {
+			values[name] = strconv.FormatBool(value)
+		}
+	}
+
+	set("rust-version", c.RustVersion)
+	set("base-image", c.BaseImage)
+	set("apt-packages", strings.Join(c.AptPackages, ","))
+	set("stages", strings.Join(c.Stages, ","))
+	set("platforms", strings.Join(c.Platforms, ","))
+	set("cache-prefix", c.Cache.Prefix)
+	setBool("no-cache", c.Cache.Disabled)
+	setBool("publish", c.Publish.Enabled)
+	set("image-ref", c.Publish.ImageRef)
+	set("registry-user", c.Publish.RegistryUser)
+	set("registry-addr", c.Publish.RegistryAddr)
+	set("asset-markers", strings.Join(c.Assets.Markers, ","))
+	set("asset-verify-command", c.Assets.Command)
+	return values
+}
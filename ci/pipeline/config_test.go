@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig("pipeline/testdata/merlin-ci.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.RustVersion != "1.77" || cfg.BaseImage != "registry.example.com/rust-builder:1.77" {
+		t.Errorf("toolchain = %q / %q", cfg.RustVersion, cfg.BaseImage)
+	}
+	if !reflect.DeepEqual(cfg.Stages, []string{"build", "test"}) {
+		t.Errorf("Stages = %v", cfg.Stages)
+	}
+	if !reflect.DeepEqual(cfg.Platforms, []string{"linux/amd64", "linux/arm64"}) {
+		t.Errorf("Platforms = %v", cfg.Platforms)
+	}
+	if cfg.Cache.Prefix != "release" || cfg.Cache.Disabled {
+		t.Errorf("Cache = %+v", cfg.Cache)
+	}
+	if !cfg.Publish.Enabled || cfg.Publish.ImageRef != "ghcr.io/awdemos/merlin:latest" || cfg.Publish.RegistryUser != "ci" {
+		t.Errorf("Publish = %+v", cfg.Publish)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := loadConfig(filepath.Join(dir, "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v, want not-exist error", err)
+	}
+
+	typo := filepath.Join(dir, "typo.yaml")
+	if err := os.WriteFile(typo, []byte("rust_verison: \"1.75\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(typo); err == nil {
+		t.Error("unknown key was accepted")
+	}
+
+	empty := filepath.Join(dir, "empty.yaml")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := loadConfig(empty); err != nil || !reflect.DeepEqual(cfg, Config{}) {
+		t.Errorf("empty file: got (%+v, %v), want zero config", cfg, err)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "merlin-ci.yaml")
+	config := "rust_version: \"1.77\"\nstages: [build, test]\ncache:\n  prefix: from-config\nplatforms: [linux/arm64]\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := ParseOptions([]string{"-config=" + path, "-cache-prefix=from-flag"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.rustVersion != "1.77" {
+		t.Errorf("rustVersion = %q, want the config value", opts.rustVersion)
+	}
+	if opts.cachePrefix != "from-flag" {
+		t.Errorf("cachePrefix = %q, want the flag value", opts.cachePrefix)
+	}
+	if !opts.enabled(stageTest) || opts.enabled(stageClippy) {
+		t.Errorf("stages = %v, want the config value", opts.stages)
+	}
+	if !reflect.DeepEqual(opts.platforms, []dagger.Platform{"linux/arm64"}) {
+		t.Errorf("platforms = %v, want the config value", opts.platforms)
+	}
+
+	t.Setenv(rustVersionEnv, "1.80")
+	opts, err = ParseOptions([]string{"-config=" + path}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.rustVersion != "1.80" {
+		t.Errorf("rustVersion = %q, want the environment to override the config", opts.rustVersion)
+	}
+
+	if _, err := ParseOptions([]string{"-config=" + filepath.Join(t.TempDir(), "nope.yaml")}, io.Discard); err == nil {
+		t.Error("an explicitly requested missing config file was ignored")
+	}
+}
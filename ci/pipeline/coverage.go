@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageCoverage      = "coverage"
+	defaultCoverageOut = "./build/lcov.info"
+	coverageDir        = "/coverage"
+)
+
+// tarpaulin ends its report with a line like
+// `54.12% coverage, 1234/2280 lines covered`
+var coverageSummaryPattern = regexp.MustCompile(`(\d+(?:\.\d+)?)% coverage, \d+/\d+ lines covered`)
+
+// parseCoveragePercent extracts the total coverage from tarpaulin's output.
+// When the summary appears more than once the last one wins, as it is the
+// final total.
+func parseCoveragePercent(output string) (float64, error) {
+	matches := coverageSummaryPattern.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no coverage summary in tarpaulin output")
+	}
+	return strconv.ParseFloat(matches[len(matches)-1][1], 64)
+}
+
+// runCoverage measures test coverage with cargo-tarpaulin, exports the lcov
+// report to out and fails if total coverage is below min percent.
+//
+// Tarpaulin traces the test binaries with ptrace and disables ASLR, which
+// the default container sandbox forbids. Dagger has no per-capability
+// switch, so the exec runs with InsecureRootCapabilities, the equivalent of
+// `docker run --privileged`; the engine must allow insecure entitlements.
+func runCoverage(ctx context.Context, client *dagger.Client, rust *dagger.Container, out string, min float64) (string, error) {
+	ctr, err := withCargoTool(client, rust, "cargo-tarpaulin").
+		WithExec(
+			[]string{"cargo", "tarpaulin", "--out", "Lcov", "--output-dir", coverageDir, "--skip-clean"},
+			dagger.ContainerWithExecOpts{InsecureRootCapabilities: true},
+		).
+		Sync(ctx)
+	if err != nil {
+		return "", stageFailed(stageCoverage, err)
+	}
+
+	if _, err := ctr.File(coverageDir+"/lcov.info").Export(ctx, out); err != nil {
+		return "", fmt.Errorf("%s: export lcov report: %w", stageCoverage, err)
+	}
+
+	stdout, stderr, err := execStreams(ctx, ctr)
+	if err != nil {
+		return "", stageFailed(stageCoverage, err)
+	}
+	percent, err := parseCoveragePercent(stdout)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageCoverage, err)
+	}
+
+	output := combineStreams(stdout, stderr)
+	summary := fmt.Sprintf("%.2f%% coverage (lcov report written to %s)", percent, out)
+	if percent < min {
+		return "", &stageError{
+			stage:    stageCoverage,
+			exitCode: 1,
+			stderr:   fmt.Sprintf("%s, below the %.2f%% minimum", summary, min),
+			stdout:   output,
+		}
+	}
+	return output + "\n" + summary, nil
+}
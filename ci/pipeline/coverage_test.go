@@ -0,0 +1,23 @@
+package pipeline
+
+import "testing"
+
+func TestParseCoveragePercent(t *testing.T) {
+	output := `|| Tested/Total Lines:
+|| src/lib.rs: 40/50 +0.00%
+|| src/server.rs: 14/50 +0.00%
+||
+54.00% coverage, 54/100 lines covered, +0.00% change in coverage
+`
+	got, err := parseCoveragePercent(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 54 {
+		t.Errorf("parseCoveragePercent = %v, want 54", got)
+	}
+
+	if _, err := parseCoveragePercent("error: no tests found"); err == nil {
+		t.Error("parseCoveragePercent succeeded without a summary")
+	}
+}
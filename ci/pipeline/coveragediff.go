@@ -0,0 +1,303 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageCoverageDiff = "coverage-diff"
+
+// lcovReport holds the hit count of every instrumented line, by file and
+// line number.
+type lcovReport map[string]map[int]int
+
+// parseLcov decodes the SF/DA records of an lcov tracefile. Files are named
+// relative to root, the directory the report was produced in, so reports
+// from different checkouts compare.
+func parseLcov(data, root string) (lcovReport, error) {
+	report := make(lcovReport)
+	var file string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			file = strings.TrimPrefix(strings.TrimPrefix(line, "SF:"), strings.TrimSuffix(root, "/")+"/")
+			if report[file] == nil {
+				report[file] = make(map[int]int)
+			}
+		case strings.HasPrefix(line, "DA:"):
+			// DA:<line>,<hits>[,<checksum>]
+			fields := strings.Split(strings.TrimPrefix(line, "DA:"), ",")
+			if file == "" || len(fields) < 2 {
+				return nil, fmt.Errorf("lcov line %d: malformed %q", n, line)
+			}
+			num, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("lcov line %d: %w", n, err)
+			}
+			hits, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("lcov line %d: %w", n, err)
+			}
+			report[file][num] += hits
+		case line == "end_of_record":
+			file = ""
+		}
+	}
+	return report, scanner.Err()
+}
+
+// percent returns the share of instrumented lines the report covers.
+func (r lcovReport) percent() float64 {
+	var covered, total int
+	for _, lines := range r {
+		for _, hits := range lines {
+			total++
+			if hits > 0 {
+				covered++
+			}
+		}
+	}
+	return percentOf(covered, total)
+}
+
+func percentOf(covered, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(covered) / float64(total) * 100
+}
+
+var (
+	// `+++ b/src/lib.rs`, or `+++ /dev/null` for a deleted file
+	diffFilePattern = regexp.MustCompile(`^\+\+\+ (?:b/)?(.+)$`)
+	// `@@ -10,2 +12,3 @@`; an omitted count means one line
+	diffHunkPattern = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+)
+
+// parseDiffLines returns the added or modified lines of every file in a
+// `git diff -U0`, by file.
+func parseDiffLines(diff string) map[string][]int {
+	changed := make(map[string][]int)
+	var file string
+	for _, line := range strings.Split(diff, "\n") {
+		if m := diffFilePattern.FindStringSubmatch(line); m != nil {
+			file = m[1]
+			if file == "/dev/null" {
+				file = ""
+			}
+			continue
+		}
+		m := diffHunkPattern.FindStringSubmatch(line)
+		if m == nil || file == "" {
+			continue
+		}
+		start, _ := strconv.Atoi(m[1])
+		count := 1
+		if m[2] != "" {
+			count, _ = strconv.Atoi(m[2])
+		}
+		for i := 0; i < count; i++ {
+			changed[file] = append(changed[file], start+i)
+		}
+	}
+	return changed
+}
+
+// patchReport is the coverage of the changed lines.
+type patchReport struct {
+	covered, total int
+	// uncovered lists the instrumented changed lines no test ran, by file
+	uncovered map[string][]int
+}
+
+// patchCoverage intersects the changed lines with report. Changed lines
+// the report does not instrument, such as comments, are not counted.
+func patchCoverage(report lcovReport, changed map[string][]int) patchReport {
+	p := patchReport{uncovered: make(map[string][]int)}
+	for file, lines := range changed {
+		for _, line := range lines {
+			hits, ok := report[file][line]
+			if !ok {
+				continue
+			}
+			p.total++
+			if hits > 0 {
+				p.covered++
+			} else {
+				p.uncovered[file] = append(p.uncovered[file], line)
+			}
+		}
+	}
+	for _, lines := range p.uncovered {
+		sort.Ints(lines)
+	}
+	return p
+}
+
+func (p patchReport) percent() float64 {
+	return percentOf(p.covered, p.total)
+}
+
+func (p patchReport) String() string {
+	if p.total == 0 {
+		return "no instrumented lines changed"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%.2f%% patch coverage, %d/%d changed lines covered", p.percent(), p.covered, p.total)
+	if len(p.uncovered) > 0 {
+		b.WriteString("\nuncovered changed lines:")
+		for _, file := range sortedKeys(p.uncovered) {
+			for _, r := range lineRanges(p.uncovered[file]) {
+				fmt.Fprintf(&b, "\n  %s:%s", file, r)
+			}
+		}
+	}
+	return b.String()
+}
+
+// lineRanges collapses sorted line numbers into ranges such as 12-14.
+func lineRanges(lines []int) []string {
+	var ranges []string
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(lines[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	return ranges
+}
+
+// uncoveredLinePattern matches a range listed by patchReport.String.
+var uncoveredLinePattern = regexp.MustCompile(`^  (\S+):(\d+)(?:-(\d+))?$`)
+
+// parseUncoveredLines turns the uncovered ranges of a patch coverage
+// summary into one warning each, so they are annotated on the diff.
+func parseUncoveredLines(output string) []Diagnostic {
+	var diags []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		m := uncoveredLinePattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		msg := "changed line is not covered by tests"
+		if m[3] != "" {
+			msg = fmt.Sprintf("changed lines %s-%s are not covered by tests", m[2], m[3])
+		}
+		diags = append(diags, Diagnostic{Level: "warning", File: m[1], Line: n, Message: msg})
+	}
+	return diags
+}
+
+// loadLcov reads an lcov report from a file or an http(s) URL, such as one
+// a base branch run uploaded.
+func loadLcov(ctx context.Context, location string) (lcovReport, error) {
+	var data []byte
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetch %s: %s", location, resp.Status)
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(location); err != nil {
+			return nil, err
+		}
+	}
+	return parseLcov(string(data), "/src")
+}
+
+// diffLines runs `git diff -U0` of the host checkout at source against
+// base, with paths relative to source like the lcov report's.
+func diffLines(ctx context.Context, client *dagger.Client, source, base string) (map[string][]int, error) {
+	out, err := gitDiff(ctx, client, source, "-U0", "--no-color", "--relative", base+"...HEAD")
+	if err != nil {
+		return nil, stageFailed(stageCoverageDiff, err)
+	}
+	return parseDiffLines(out), nil
+}
+
+// runCoverageDiff measures coverage like runCoverage, then fails unless
+// the lines changed since opts.baseRef are covered to at least
+// opts.coveragePatchMin percent. With opts.coverageBase the total is also
+// compared with the base branch's.
+func runCoverageDiff(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options) (string, error) {
+	// read the base before anything is exported, as it may be the lcov
+	// report of an earlier run at the same path
+	var base lcovReport
+	if opts.coverageBase != "" {
+		var err error
+		if base, err = loadLcov(ctx, opts.coverageBase); err != nil {
+			return "", fmt.Errorf("%s: base report: %w", stageCoverageDiff, err)
+		}
+	}
+
+	summary, err := runCoverage(ctx, client, rust, opts.coverageOut, opts.coverageMin)
+	if err != nil {
+		return "", err
+	}
+	current, err := loadLcov(ctx, opts.coverageOut)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageCoverageDiff, err)
+	}
+	changed, err := diffLines(ctx, client, opts.source, opts.baseRef)
+	if err != nil {
+		return "", err
+	}
+
+	patch := patchCoverage(current, changed)
+	if base != nil {
+		now, was := current.percent(), base.percent()
+		summary += fmt.Sprintf("\n%.2f%% total coverage, %+.2f%% against %s", now, now-was, opts.baseRef)
+	}
+	summary += "\n" + patch.String()
+	if patch.total > 0 && patch.percent() < opts.coveragePatchMin {
+		return "", &stageError{
+			stage:    stageCoverageDiff,
+			exitCode: 1,
+			stderr:   fmt.Sprintf("%s\npatch coverage is below the %.2f%% minimum", summary, opts.coveragePatchMin),
+		}
+	}
+	return summary, nil
+}
+
+// validateCoverageDiff checks the -coverage-diff settings. The diff is
+// taken of the host checkout, so a -git-url source cannot be diffed.
+func validateCoverageDiff(opts Options) error {
+	if opts.coveragePatchMin < 0 || opts.coveragePatchMin > 100 {
+		return fmt.Errorf("-coverage-patch-min must be between 0 and 100, got %v", opts.coveragePatchMin)
+	}
+	if opts.coverageDiff && opts.gitURL != "" {
+		return fmt.Errorf("-coverage-diff requires a host -source, not -git-url")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testLcov = `TN:
+SF:/src/src/lib.rs
+DA:10,3
+DA:11,0
+DA:12,0
+DA:13,0
+DA:20,1
+end_of_record
+SF:/src/src/main.rs
+DA:5,1,abc123
+DA:6,0
+end_of_record
+`
+
+func TestParseLcov(t *testing.T) {
+	report, err := parseLcov(testLcov, "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := lcovReport{
+		"src/lib.rs":  {10: 3, 11: 0, 12: 0, 13: 0, 20: 1},
+		"src/main.rs": {5: 1, 6: 0},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("parseLcov = %v, want %v", report, want)
+	}
+	if got := report.percent(); got < 42.8 || got > 42.9 {
+		t.Errorf("percent = %v, want 3/7", got)
+	}
+
+	if _, err := parseLcov("SF:src/lib.rs\nDA:x,1\n", "/src"); err == nil {
+		t.Error("parseLcov of a malformed DA line succeeded, want error")
+	}
+}
+
+const testDiff = `diff --git a/src/lib.rs b/src/lib.rs
+index 1111111..2222222 100644
+--- a/src/lib.rs
++++ b/src/lib.rs
+@@ -9,0 +10,4 @@ impl Router {
++    let a = 1;
++    let b = 2;
++    let c = 3;
++    // a comment
+@@ -30 +34 @@ fn route() {
+-    old();
++    new();
+@@ -40,2 +44,0 @@ fn gone() {
+diff --git a/src/old.rs b/src/old.rs
+deleted file mode 100644
+--- a/src/old.rs
++++ /dev/null
+@@ -1,3 +0,0 @@
+diff --git a/src/main.rs b/src/main.rs
+--- a/src/main.rs
++++ b/src/main.rs
+@@ -6 +6 @@ fn main() {
+`
+
+func TestParseDiffLines(t *testing.T) {
+	got := parseDiffLines(testDiff)
+	want := map[string][]int{
+		"src/lib.rs":  {10, 11, 12, 13, 34},
+		"src/main.rs": {6},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDiffLines = %v, want %v", got, want)
+	}
+}
+
+func TestPatchCoverage(t *testing.T) {
+	report, err := parseLcov(testLcov, "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := patchCoverage(report, parseDiffLines(testDiff))
+	// lib.rs:10 is covered, lib.rs:11-13 and main.rs:6 are not, and the
+	// report does not instrument lib.rs:34
+	if p.covered != 1 || p.total != 5 {
+		t.Errorf("patchCoverage = %d/%d, want 1/5", p.covered, p.total)
+	}
+
+	summary := p.String()
+	for _, want := range []string{"20.00% patch coverage, 1/5 changed lines covered", "  src/lib.rs:11-13", "  src/main.rs:6"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary %q does not contain %q", summary, want)
+		}
+	}
+
+	diags := parseUncoveredLines(summary)
+	wantDiags := []Diagnostic{
+		{Level: "warning", File: "src/lib.rs", Line: 11, Message: "changed lines 11-13 are not covered by tests"},
+		{Level: "warning", File: "src/main.rs", Line: 6, Message: "changed line is not covered by tests"},
+	}
+	if !reflect.DeepEqual(diags, wantDiags) {
+		t.Errorf("parseUncoveredLines = %+v, want %+v", diags, wantDiags)
+	}
+
+	if got := patchCoverage(report, map[string][]int{"README.md": {1}}).String(); got != "no instrumented lines changed" {
+		t.Errorf("summary without instrumented changes = %q", got)
+	}
+}
+
+func TestLineRanges(t *testing.T) {
+	got := lineRanges([]int{1, 2, 3, 5, 7, 8})
+	if want := []string{"1-3", "5", "7-8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lineRanges = %q, want %q", got, want)
+	}
+}
+
+func TestCoverageDiffOptions(t *testing.T) {
+	opts, err := ParseOptions([]string{"-coverage-patch-min=80"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.coverageDiff || !opts.coverage {
+		t.Errorf("-coverage-patch-min: coverageDiff, coverage = %v, %v, want both", opts.coverageDiff, opts.coverage)
+	}
+
+	for _, args := range [][]string{
+		{"-coverage-patch-min=101"},
+		{"-coverage-diff", "-git-url=https://github.com/awdemos/merlin.git"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
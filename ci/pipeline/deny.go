@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageDeny = "deny"
+	denyOut   = "./build/deny.txt"
+)
+
+// denyCategories are the checks cargo deny runs, each of which can be
+// downgraded to a warning with -deny-allow-<category>.
+var denyCategories = []string{"advisories", "bans", "licenses", "sources"}
+
+// denySummaryPattern matches the per-check results cargo deny prints last,
+// e.g. `advisories ok, bans FAILED, licenses ok, sources ok`.
+var denySummaryPattern = regexp.MustCompile(`\b(advisories|bans|licenses|sources) (ok|FAILED)\b`)
+
+// parseDenySummary returns the result of every check found in cargo deny's
+// output, true meaning it failed.
+func parseDenySummary(output string) map[string]bool {
+	results := make(map[string]bool)
+	for _, m := range denySummaryPattern.FindAllStringSubmatch(output, -1) {
+		results[m[1]] = m[2] == "FAILED"
+	}
+	return results
+}
+
+// denyBlocking returns the failed checks that were not downgraded to
+// warnings, sorted.
+func denyBlocking(results map[string]bool, allowed map[string]bool) []string {
+	var blocking []string
+	for _, category := range sortedKeys(results) {
+		if results[category] && !allowed[category] {
+			blocking = append(blocking, category)
+		}
+	}
+	return blocking
+}
+
+// runDeny checks licenses, bans, advisories and sources with cargo deny
+// against the project's deny.toml and writes the full report to denyOut.
+func runDeny(ctx context.Context, client *dagger.Client, rust *dagger.Container, allowed map[string]bool) (string, error) {
+	// cargo deny reports on stderr and exits non-zero when any check fails;
+	// the summary below decides which failures count
+	output, err := withCargoTool(client, rust, "cargo-deny").
+		WithExec([]string{"cargo", "deny", "--color", "never", "check"}).
+		Stderr(ctx)
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		output = execErr.Stderr
+	} else if err != nil {
+		return "", stageFailed(stageDeny, err)
+	}
+
+	if err := writeReport(denyOut, []byte(output)); err != nil {
+		return "", fmt.Errorf("%s: %w", stageDeny, err)
+	}
+
+	results := parseDenySummary(output)
+	if len(results) == 0 {
+		if err != nil {
+			// cargo deny failed before running any check, e.g. on a bad config
+			return "", stageFailed(stageDeny, err)
+		}
+		return "", fmt.Errorf("%s: no check results in cargo deny output", stageDeny)
+	}
+
+	if blocking := denyBlocking(results, allowed); len(blocking) > 0 {
+		return "", &stageError{
+			stage:    stageDeny,
+			exitCode: 1,
+			stderr:   fmt.Sprintf("%s failed (report written to %s)", strings.Join(blocking, ", "), denyOut),
+		}
+	}
+
+	var parts []string
+	for _, category := range sortedKeys(results) {
+		result := "ok"
+		if results[category] {
+			result = "failed (allowed)"
+		}
+		parts = append(parts, category+" "+result)
+	}
+	return fmt.Sprintf("%s (report written to %s)", strings.Join(parts, ", "), denyOut), nil
+}
@@ -0,0 +1,49 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+const denyOutput = `error[rejected]: failed to satisfy license requirements
+   ┌─ openssl-sys 0.9.98 (registry+https://github.com/rust-lang/crates.io-index):4:12
+   │
+ 4 │ license = "OpenSSL"
+   │            ━━━━━━━ rejected: license is not explicitly allowed
+
+warning[duplicate]: found 2 duplicate entries for crate 'syn'
+
+advisories ok, bans ok, licenses FAILED, sources ok
+`
+
+func TestParseDenySummary(t *testing.T) {
+	got := parseDenySummary(denyOutput)
+	want := map[string]bool{"advisories": false, "bans": false, "licenses": true, "sources": false}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDenySummary = %v, want %v", got, want)
+	}
+}
+
+func TestDenyBlocking(t *testing.T) {
+	results := map[string]bool{"advisories": true, "bans": false, "licenses": true, "sources": true}
+
+	if got, want := denyBlocking(results, nil), []string{"advisories", "licenses", "sources"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("denyBlocking = %q, want %q", got, want)
+	}
+	allowed := map[string]bool{"licenses": true, "sources": true}
+	if got, want := denyBlocking(results, allowed), []string{"advisories"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("denyBlocking with allowed = %q, want %q", got, want)
+	}
+}
+
+func TestDenyAllowFlags(t *testing.T) {
+	opts, err := ParseOptions([]string{"-deny", "-deny-allow-licenses"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"advisories": false, "bans": false, "licenses": true, "sources": false}
+	if !reflect.DeepEqual(opts.denyAllow, want) {
+		t.Errorf("denyAllow = %v, want %v", opts.denyAllow, want)
+	}
+}
@@ -0,0 +1,35 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageDocs      = "docs"
+	defaultDocsOut = "./build/docs"
+	docsDir        = "/docs"
+)
+
+// runDoc builds the rustdoc HTML for the workspace's own crates and
+// registers it for export to opts.docsOut. It runs in the build container,
+// so it reuses the cached target directory; the output is copied out of
+// target/ because the cache mount itself cannot be exported. With
+// opts.docsStrict any rustdoc warning fails the stage.
+func runDoc(ctx context.Context, rust *dagger.Container, opts Options, reg *artifactRegistry) (string, error) {
+	if opts.docsStrict {
+		rust = rust.WithEnvVariable("RUSTDOCFLAGS", "-D warnings")
+	}
+	docs := rust.
+		WithExec(append(append(append([]string{"cargo", "doc", "--no-deps"}, profileArgs(opts)...), featureArgs(opts)...), lockArgs(opts)...)).
+		WithExec([]string{"cp", "-r", targetDir + "/doc", docsDir})
+
+	docs, err := docs.Sync(ctx)
+	if err != nil {
+		return "", stageFailed(stageDocs, err)
+	}
+	reg.registerDirectory(stageDocs, artifactDocs, opts.docsOut, docs.Directory(docsDir))
+	return fmt.Sprintf("API docs written to %s", opts.docsOut), nil
+}
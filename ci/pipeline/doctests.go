@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageDoctest = "doctest"
+
+// -doctests settings
+const (
+	doctestsOn  = "on"
+	doctestsOff = "off"
+)
+
+// parseDoctests reads the -doctests flag.
+func parseDoctests(setting string) (bool, error) {
+	switch setting {
+	case doctestsOn:
+		return true, nil
+	case doctestsOff:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid -doctests %q (valid: %s, %s)", setting, doctestsOn, doctestsOff)
+}
+
+// cargoDocTestArgs returns the command running only the doc examples, with
+// harness arguments passed to rustdoc's test runner after `--`.
+func cargoDocTestArgs(opts Options, harness ...string) []string {
+	args := append(append([]string{"cargo", "test", "--doc"}, workspaceArgs(opts)...), featureArgs(opts)...)
+	args = append(append(args, lockArgs(opts)...), jobsArgs(opts)...)
+	harness = append(testThreadsArgs(opts), harness...)
+	if len(harness) > 0 {
+		args = append(append(args, "--"), harness...)
+	}
+	return args
+}
+
+// docTestJUnitOut is where the doctests' JUnit report is written: next to
+// the test stage's, e.g. build/junit-doctests.xml.
+func docTestJUnitOut(opts Options) string {
+	return strings.TrimSuffix(opts.junitOut, ".xml") + "-doctests.xml"
+}
+
+// docTestReport converts the doctests' libtest JSON into a JUnit report.
+// Its suites are named doctests, numbered when a workspace has several, as
+// they would otherwise be unnamed.
+func docTestReport(stdout string) (junitTestsuites, error) {
+	report, err := cargoJSONToJUnit(strings.NewReader(stdout))
+	for i := range report.Suites {
+		report.Suites[i].Name = stageDoctest + "s"
+		if len(report.Suites) > 1 {
+			report.Suites[i].Name += fmt.Sprintf(" #%d", i+1)
+		}
+	}
+	return report, err
+}
+
+// runDocTests runs the doc examples and returns their output, or with
+// opts.junit writes their JUnit report, the suites named doctests.
+func runDocTests(ctx context.Context, rust *dagger.Container, opts Options) (string, error) {
+	if !opts.junit {
+		out, err := execOutput(ctx, rust.WithExec(cargoDocTestArgs(opts)))
+		if err != nil {
+			return "", stageFailed(stageDoctest, err)
+		}
+		return out, nil
+	}
+
+	out := docTestJUnitOut(opts)
+	stdout, stderr, err := execStreams(ctx, rust.
+		WithEnvVariable("RUSTC_BOOTSTRAP", "1").
+		WithExec(cargoDocTestArgs(opts, "-Z", "unstable-options", "--format", "json", "--report-time")))
+
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		stdout, stderr = execErr.Stdout, execErr.Stderr
+	} else if err != nil {
+		return "", stageFailed(stageDoctest, err)
+	}
+
+	report, convErr := docTestReport(stdout)
+	if convErr == nil {
+		convErr = writeJUnit(report, out)
+	}
+	if err != nil {
+		return "", stageFailed(stageDoctest, err)
+	}
+	if convErr != nil {
+		return "", fmt.Errorf("%s: junit report: %w", stageDoctest, convErr)
+	}
+
+	// stdout is the JSON event stream, so cargo's stderr goes ahead of
+	// the summary in its place
+	summary := fmt.Sprintf("%d doctests, %d failed, %d ignored (JUnit report written to %s)",
+		report.Tests, report.Failures, report.Skipped, out)
+	return combineStreams(summary, stderr), nil
+}
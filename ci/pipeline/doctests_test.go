@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCargoDocTestArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		harness []string
+		want    []string
+	}{
+		{nil, nil, []string{"cargo", "test", "--doc"}},
+		{[]string{"-locked"}, nil, []string{"cargo", "test", "--doc", "--locked"}},
+		{[]string{"-features=tls,metrics"}, nil, []string{"cargo", "test", "--doc", "--features", "tls,metrics"}},
+		{
+			[]string{"-locked", "-features=tls", "-test-threads=2"},
+			[]string{"--format", "json"},
+			[]string{"cargo", "test", "--doc", "--features", "tls", "--locked", "--", "--test-threads", "2", "--format", "json"},
+		},
+	} {
+		opts, err := ParseOptions(tc.args, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cargoDocTestArgs(opts, tc.harness...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("cargoDocTestArgs(%q, %q) = %q, want %q", tc.args, tc.harness, got, tc.want)
+		}
+	}
+}
+
+func TestDocTestReport(t *testing.T) {
+	report, err := docTestReport(sampleCargoJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, suite := range report.Suites {
+		names = append(names, suite.Name)
+	}
+	if want := []string{"doctests #1", "doctests #2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("suite names = %q, want %q", names, want)
+	}
+	if report.Tests != 4 || report.Failures != 1 {
+		t.Errorf("totals = %d tests, %d failures; want 4, 1", report.Tests, report.Failures)
+	}
+
+	single := `{ "type": "suite", "event": "started", "test_count": 1 }
+{ "type": "test", "name": "src/lib.rs - route (line 12)", "event": "ok" }
+{ "type": "suite", "event": "ok", "passed": 1, "failed": 0, "ignored": 0, "measured": 0, "filtered_out": 0, "exec_time": 0.2 }
+`
+	report, err = docTestReport(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Suites) != 1 || report.Suites[0].Name != "doctests" {
+		t.Fatalf("single suite = %+v, want one named doctests", report.Suites)
+	}
+	data, err := report.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `name="doctests"`) {
+		t.Errorf("report does not name the suite doctests:\n%s", data)
+	}
+}
@@ -0,0 +1,142 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// envNamePattern matches the variable names -env and -secret-env accept.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envVar is a variable set in the rust container.
+type envVar struct {
+	name  string
+	value string
+}
+
+// listFlag collects every value of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseEnvAssignment parses a KEY=VALUE pair. The value may be empty or
+// contain further '=' signs.
+func parseEnvAssignment(s string) (envVar, error) {
+	name, value, found := strings.Cut(s, "=")
+	if !found {
+		return envVar{}, fmt.Errorf("%q is not KEY=VALUE", s)
+	}
+	if !envNamePattern.MatchString(name) {
+		return envVar{}, fmt.Errorf("%q: invalid variable name %q", s, name)
+	}
+	return envVar{name: name, value: value}, nil
+}
+
+// parseEnvFile parses KEY=VALUE lines. Blank lines and lines starting with
+// # are skipped, and a value wrapped in matching quotes is unquoted.
+func parseEnvFile(data []byte) ([]envVar, error) {
+	var vars []envVar
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v, err := parseEnvAssignment(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(v.value) >= 2 && (v.value[0] == '"' || v.value[0] == '\'') && v.value[len(v.value)-1] == v.value[0] {
+			v.value = v.value[1 : len(v.value)-1]
+		}
+		vars = append(vars, v)
+	}
+	return vars, scanner.Err()
+}
+
+// resolveEnv combines the -env-file, -env and -secret-env settings. -env
+// overrides the file, and a variable may not be both plain and secret.
+// Secret values are read from the process environment.
+func resolveEnv(envFile string, assignments, secretNames []string) (plain, secret []envVar, err error) {
+	if envFile != "" {
+		data, err := os.ReadFile(envFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-env-file: %w", err)
+		}
+		if plain, err = parseEnvFile(data); err != nil {
+			return nil, nil, fmt.Errorf("-env-file %s: %w", envFile, err)
+		}
+	}
+	for _, a := range assignments {
+		v, err := parseEnvAssignment(a)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-env: %w", err)
+		}
+		plain = append(plain, v)
+	}
+	plain = dedupeEnv(plain)
+
+	isPlain := make(map[string]bool, len(plain))
+	for _, v := range plain {
+		isPlain[v.name] = true
+	}
+	seen := make(map[string]bool)
+	for _, name := range secretNames {
+		if !envNamePattern.MatchString(name) {
+			return nil, nil, fmt.Errorf("-secret-env: invalid variable name %q", name)
+		}
+		if isPlain[name] {
+			return nil, nil, fmt.Errorf("-secret-env %s is also set with -env or -env-file", name)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("-secret-env %s: $%s is not set", name, name)
+		}
+		secret = append(secret, envVar{name: name, value: value})
+	}
+	return plain, secret, nil
+}
+
+// dedupeEnv keeps the last setting of every variable, at the position of
+// its first.
+func dedupeEnv(vars []envVar) []envVar {
+	index := make(map[string]int, len(vars))
+	var out []envVar
+	for _, v := range vars {
+		if i, ok := index[v.name]; ok {
+			out[i] = v
+			continue
+		}
+		index[v.name] = len(out)
+		out = append(out, v)
+	}
+	return out
+}
+
+// withEnv sets the plain variables on rust and injects the secret ones as
+// Dagger secrets, which keeps them out of the container's config and the
+// engine's logs.
+func withEnv(client *dagger.Client, rust *dagger.Container, plain, secret []envVar) *dagger.Container {
+	for _, v := range plain {
+		rust = rust.WithEnvVariable(v.name, v.value)
+	}
+	for _, v := range secret {
+		rust = rust.WithSecretVariable(v.name, client.SetSecret("env-"+v.name, v.value))
+	}
+	return rust
+}
@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvAssignment(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    envVar
+		wantErr bool
+	}{
+		{in: "RUSTFLAGS=-C target-cpu=native", want: envVar{"RUSTFLAGS", "-C target-cpu=native"}},
+		{in: "EMPTY=", want: envVar{"EMPTY", ""}},
+		{in: "_private1=x", want: envVar{"_private1", "x"}},
+		{in: "RUSTFLAGS", wantErr: true},
+		{in: "=value", wantErr: true},
+		{in: "1ST=value", wantErr: true},
+		{in: "MY-VAR=value", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseEnvAssignment(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseEnvAssignment(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseEnvAssignment(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	data := `# build settings
+RUSTFLAGS="-D warnings"
+
+MERLIN_FEATURE_X=on
+GREETING='hello world'
+QUOTE="unbalanced'
+`
+	got, err := parseEnvFile([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []envVar{
+		{"RUSTFLAGS", "-D warnings"},
+		{"MERLIN_FEATURE_X", "on"},
+		{"GREETING", "hello world"},
+		{"QUOTE", `"unbalanced'`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEnvFile = %v, want %v", got, want)
+	}
+
+	_, err = parseEnvFile([]byte("A=1\nnot an assignment\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("parseEnvFile(malformed) = %v, want an error on line 2", err)
+	}
+}
+
+func TestEnvOptions(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "ci.env")
+	if err := os.WriteFile(envFile, []byte("RUSTFLAGS=-D warnings\nRUST_LOG=info\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MERLIN_API_KEY", "s3cret")
+
+	opts, err := ParseOptions([]string{
+		"-env-file=" + envFile, "-env=RUST_LOG=debug", "-env=CARGO_TERM_COLOR=never",
+		"-secret-env=MERLIN_API_KEY",
+	}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPlain := []envVar{{"RUSTFLAGS", "-D warnings"}, {"RUST_LOG", "debug"}, {"CARGO_TERM_COLOR", "never"}}
+	if !reflect.DeepEqual(opts.env, wantPlain) {
+		t.Errorf("env = %v, want %v", opts.env, wantPlain)
+	}
+	if want := []envVar{{"MERLIN_API_KEY", "s3cret"}}; !reflect.DeepEqual(opts.secretEnv, want) {
+		t.Errorf("secretEnv = %v, want %v", opts.secretEnv, want)
+	}
+	if plan := formatPlan(opts); strings.Contains(plan, "s3cret") {
+		t.Errorf("formatPlan shows a secret value:\n%s", plan)
+	}
+
+	for _, args := range [][]string{
+		{"-env=RUSTFLAGS"},
+		{"-env-file=" + filepath.Join(t.TempDir(), "missing.env")},
+		{"-secret-env=MERLIN_CI_UNSET_SECRET"},
+		{"-secret-env=MERLIN_API_KEY", "-env=MERLIN_API_KEY=plain"},
+		{"-secret-env=BAD-NAME"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
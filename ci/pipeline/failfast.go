@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// cancelledError reports a stage stopped by -fail-fast because a stage
+// running alongside it failed first.
+type cancelledError struct {
+	stage string
+	// failed is the stage whose failure cancelled this one
+	failed string
+}
+
+func (e *cancelledError) Error() string {
+	return fmt.Sprintf("%s cancelled: %s failed and -fail-fast is set", e.stage, e.failed)
+}
+
+// failFastCause is the cause a concurrent group's context is cancelled
+// with when one of its stages fails under -fail-fast.
+type failFastCause struct {
+	stage string
+}
+
+func (c *failFastCause) Error() string {
+	return c.stage + " failed"
+}
+
+// withFailFast makes the groups started by concurrent cancel their
+// remaining stages as soon as one of them fails.
+func (t *stageRecorder) withFailFast(enabled bool) *stageRecorder {
+	t.failFast = enabled
+	return t
+}
+
+// concurrent returns the context for a group of stages run side by side,
+// and a function each stage reports its measured error to. Under
+// -fail-fast the first failure cancels the context for the others;
+// otherwise the report does nothing and every stage runs to the end.
+// release frees the context once the whole group has finished.
+func (t *stageRecorder) concurrent(ctx context.Context) (group context.Context, report func(stage string, err error), release func()) {
+	if !t.failFast {
+		return ctx, func(string, error) {}, func() {}
+	}
+	group, cancel := context.WithCancelCause(ctx)
+	report = func(stage string, err error) {
+		var cancelledErr *cancelledError
+		if err != nil && !errors.As(err, &cancelledErr) {
+			// only the first cause sticks, so later failures keep it
+			cancel(&failFastCause{stage: stage})
+		}
+	}
+	return group, report, func() { cancel(nil) }
+}
+
+// failedFast returns the cancelledError for a stage whose context was
+// cancelled under -fail-fast, or nil when it stopped for another reason.
+func failedFast(ctx context.Context, stage string) error {
+	var cause *failFastCause
+	if ctx.Err() == nil || !errors.As(context.Cause(ctx), &cause) {
+		return nil
+	}
+	return &cancelledError{stage: stage, failed: cause.stage}
+}
@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func failFastChecks() []check {
+	return []check{
+		{name: stageClippy, run: func(context.Context, *dagger.Container) (string, error) {
+			return "", errors.New("clippy: warnings")
+		}},
+		{name: stageTest, run: func(ctx context.Context, _ *dagger.Container) (string, error) {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(time.Second):
+				return "ok", nil
+			}
+		}},
+		{name: stageFmt, run: func(context.Context, *dagger.Container) (string, error) { return "ok", nil }},
+	}
+}
+
+func TestRunChecksFailFastCancelsSiblings(t *testing.T) {
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal)).withFailFast(true)
+	results := runChecks(context.Background(), nil, failFastChecks(), rec)
+
+	var cancelledErr *cancelledError
+	if results[0].err == nil || errors.As(results[0].err, &cancelledErr) {
+		t.Errorf("clippy: got %v, want its own failure", results[0].err)
+	}
+	if !errors.As(results[1].err, &cancelledErr) || cancelledErr.stage != stageTest || cancelledErr.failed != stageClippy {
+		t.Errorf("test: got %v, want cancelled by clippy", results[1].err)
+	}
+	if want := "test cancelled: clippy failed and -fail-fast is set"; results[1].err.Error() != want {
+		t.Errorf("error %q, want %q", results[1].err, want)
+	}
+
+	result := newRunResult(rec.snapshot(), time.Second, "", errors.Join(results[0].err, results[1].err))
+	if result.Status != statusFailed {
+		t.Errorf("run status %q, want %q", result.Status, statusFailed)
+	}
+	statuses := map[string]string{}
+	for _, s := range result.Stages {
+		statuses[s.Name] = s.Status
+	}
+	// fmt may finish before or after clippy fails, but never hangs on it
+	if statuses[stageClippy] != statusFailed || statuses[stageTest] != statusCancelled {
+		t.Errorf("stage statuses %v", statuses)
+	}
+	if !strings.Contains(formatTimings(rec.snapshot(), time.Second), "CANCELLED") {
+		t.Error("timings do not mark the cancelled stage")
+	}
+}
+
+func TestRunChecksKeepsGoingByDefault(t *testing.T) {
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal))
+	results := runChecks(context.Background(), nil, failFastChecks(), rec)
+
+	if results[0].err == nil {
+		t.Error("clippy should fail")
+	}
+	if results[1].err != nil || results[1].output != "ok" {
+		t.Errorf("test: got %q, %v, want it to run to the end", results[1].output, results[1].err)
+	}
+	for _, s := range rec.snapshot() {
+		if s.Cancelled {
+			t.Errorf("%s marked cancelled without -fail-fast", s.Name)
+		}
+	}
+}
+
+func TestMeasureStageIgnoresOtherCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal))
+	err := rec.measureStage(ctx, stageBuild, func(ctx context.Context) error { return ctx.Err() })
+	var cancelledErr *cancelledError
+	if !errors.Is(err, context.Canceled) || errors.As(err, &cancelledErr) {
+		t.Errorf("got %v, want the plain cancellation", err)
+	}
+}
+
+func TestFailFastFlag(t *testing.T) {
+	opts, err := ParseOptions([]string{"-fail-fast"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.failFast {
+		t.Error("-fail-fast not set")
+	}
+	if !strings.Contains(formatPlan(opts), "fail fast") {
+		t.Error("plan does not mention -fail-fast")
+	}
+}
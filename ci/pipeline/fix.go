@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const defaultFixOut = "./build/fixed"
+
+// containerSources returns the project sources in ctr, which may have
+// been modified there, without the build output.
+func containerSources(ctr *dagger.Container) *dagger.Directory {
+	return ctr.Directory("/src").WithoutDirectory("target")
+}
+
+// fixTarget returns where fixed sources are exported: the working tree
+// itself only when explicitly requested with -fix-inplace.
+func fixTarget(opts Options) string {
+	if opts.fixInplace {
+		return opts.source
+	}
+	return opts.fixOut
+}
+
+// validateFix checks that the fix modes can run and will not overwrite the
+// working tree by accident.
+func validateFix(opts Options) error {
+	if !opts.clippyFix && !opts.fmtFix {
+		if opts.fixInplace {
+			return fmt.Errorf("-fix-inplace requires -clippy-fix or -fmt-fix")
+		}
+		return nil
+	}
+	// both would export to the same place, each without the other's changes
+	if opts.clippyFix && opts.fmtFix {
+		return fmt.Errorf("-clippy-fix and -fmt-fix cannot be combined; run them one after the other")
+	}
+	if opts.clippyFix && !opts.enabled(stageClippy) {
+		return fmt.Errorf("-clippy-fix requires the clippy stage")
+	}
+	if opts.fmtFix && !opts.enabled(stageFmt) {
+		return fmt.Errorf("-fmt-fix requires the fmt stage")
+	}
+	if opts.fixInplace {
+		return nil
+	}
+	out, err := filepath.Abs(opts.fixOut)
+	if err != nil {
+		return fmt.Errorf("resolve -fix-out: %w", err)
+	}
+	src, err := filepath.Abs(opts.source)
+	if err != nil {
+		return fmt.Errorf("resolve -source: %w", err)
+	}
+	if out == src {
+		return fmt.Errorf("-fix-out %s is the project working tree; pass -fix-inplace to overwrite it", opts.fixOut)
+	}
+	return nil
+}
+
+// runClippyFix applies clippy's suggestions and exports the fixed sources
+// for review instead of failing on warnings.
+func runClippyFix(ctx context.Context, rust *dagger.Container, opts Options) (string, error) {
+	fixed := rust.WithExec([]string{"cargo", "clippy", "--fix", "--allow-dirty", "--allow-staged"})
+	out, err := execOutput(ctx, fixed)
+	if err != nil {
+		return "", stageFailed(stageClippy, err)
+	}
+
+	summary, err := exportFixed(ctx, rust, fixed, opts)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageClippy, err)
+	}
+	return out + summary, nil
+}
+
+// runFmtFix formats the sources and exports them instead of failing when
+// they are not formatted.
+func runFmtFix(ctx context.Context, rust *dagger.Container, opts Options) (string, error) {
+	fixed, err := rust.WithExec([]string{"cargo", "fmt"}).Sync(ctx)
+	if err != nil {
+		return "", stageFailed(stageFmt, err)
+	}
+
+	summary, err := exportFixed(ctx, rust, fixed, opts)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageFmt, err)
+	}
+	return summary, nil
+}
+
+// exportFixed exports the sources of fixed to the fix target and
+// summarizes which files differ from the sources of original.
+func exportFixed(ctx context.Context, original, fixed *dagger.Container, opts Options) (string, error) {
+	// diff copies of the sources before and after, since the target may
+	// be the working tree itself, which holds much more than the upload
+	tmp, err := os.MkdirTemp("", "merlin-ci-fix-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	before, after := filepath.Join(tmp, "before"), filepath.Join(tmp, "after")
+	if _, err := containerSources(original).Export(ctx, before); err != nil {
+		return "", fmt.Errorf("export original sources: %w", err)
+	}
+	if _, err := containerSources(fixed).Export(ctx, after); err != nil {
+		return "", fmt.Errorf("export fixed sources: %w", err)
+	}
+	changed, err := changedFiles(before, after)
+	if err != nil {
+		return "", fmt.Errorf("diff fixed sources: %w", err)
+	}
+
+	dest := fixTarget(opts)
+	if _, err := containerSources(fixed).Export(ctx, dest); err != nil {
+		return "", fmt.Errorf("export fixed sources: %w", err)
+	}
+	// the count goes last, where the summary of a check's output is read
+	var b strings.Builder
+	for _, file := range changed {
+		fmt.Fprintf(&b, "\nchanged: %s", file)
+	}
+	fmt.Fprintf(&b, "\n%d files changed, sources exported to %s", len(changed), dest)
+	return b.String(), nil
+}
+
+// changedFiles returns the slash-separated paths of regular files under
+// after that are missing from before or differ from it, sorted.
+func changedFiles(before, after string) ([]string, error) {
+	var changed []string
+	err := filepath.WalkDir(after, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(after, path)
+		if err != nil {
+			return err
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		want, err := os.ReadFile(filepath.Join(before, rel))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || !bytes.Equal(got, want) {
+			changed = append(changed, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(changed)
+	return changed, err
+}
@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTreeAt(t, dir, files)
+	return dir
+}
+
+func writeTreeAt(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	before := writeTree(t, map[string]string{
+		"Cargo.toml":    "[package]\n",
+		"src/lib.rs":    "fn a(){}\n",
+		"src/main.rs":   "fn main() {}\n",
+		"src/router.rs": "pub fn route(){}\n",
+	})
+	after := writeTree(t, map[string]string{
+		"Cargo.toml":    "[package]\n",
+		"src/lib.rs":    "fn a() {}\n",
+		"src/main.rs":   "fn main() {}\n",
+		"src/router.rs": "pub fn route() {}\n",
+		"src/new.rs":    "\n",
+	})
+
+	got, err := changedFiles(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"src/lib.rs", "src/new.rs", "src/router.rs"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changedFiles = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,175 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// FlakyTest is a test that failed and then passed when rerun.
+type FlakyTest struct {
+	Name    string `json:"name"`
+	Retries int    `json:"retries"` // reruns it took to pass
+}
+
+var (
+	// libtest prints one `test tests::parse ... FAILED` line per failing test
+	failedTestPattern = regexp.MustCompile(`(?m)^test (\S+) \.\.\. FAILED\r?$`)
+	// nextest prints `TRY 2 PASS [   0.010s] merlin tests::parse` for a
+	// test that passed on its second try, and with status-level flaky also
+	// `FLAKY 2/3 [   0.010s] merlin tests::parse`
+	nextestFlakyPattern = regexp.MustCompile(`(?m)^\s*(?:FLAKY (\d+)/\d+|TRY (\d+) PASS) \[[^\]]*\] (?:\S+ )?(\S+)\r?$`)
+)
+
+// failedTests returns the tests libtest reported as failed, in order and
+// without duplicates. Output without any, e.g. from a test binary that
+// did not compile, returns none, so the failure is never retried.
+func failedTests(stdout string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range failedTestPattern.FindAllStringSubmatch(stdout, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// nextestFlaky returns the tests nextest reported as flaky on stderr, in
+// the order they first passed on a retry.
+func nextestFlaky(stderr string) []FlakyTest {
+	var flaky []FlakyTest
+	seen := make(map[string]bool)
+	for _, m := range nextestFlakyPattern.FindAllStringSubmatch(stderr, -1) {
+		try, _ := strconv.Atoi(m[1] + m[2])
+		if try < 2 || seen[m[3]] {
+			continue
+		}
+		seen[m[3]] = true
+		flaky = append(flaky, FlakyTest{Name: m[3], Retries: try - 1})
+	}
+	return flaky
+}
+
+// junitFlaky returns the tests a nextest JUnit report records failed
+// attempts for. They passed in the end, or they would be failures.
+func junitFlaky(report junitTestsuites) []FlakyTest {
+	var flaky []FlakyTest
+	for _, suite := range report.Suites {
+		for _, tc := range suite.Cases {
+			if len(tc.Flaky) > 0 && tc.Failure == nil {
+				flaky = append(flaky, FlakyTest{Name: tc.Name, Retries: len(tc.Flaky)})
+			}
+		}
+	}
+	return flaky
+}
+
+// retryTestArgs reruns exactly the given tests.
+func retryTestArgs(opts Options, tests []string) []string {
+	return cargoTestArgs(opts, append([]string{"--exact"}, tests...)...)
+}
+
+// retryFailedTests reruns the tests failed reports as failing, up to
+// opts.flakyRetries times, each time only those still failing. It returns
+// the tests that passed on a rerun and, when some never did, the last
+// rerun's failure. A failure naming no tests, such as a compile error, is
+// returned as is.
+func retryFailedTests(ctx context.Context, rust *dagger.Container, opts Options, failed error) ([]FlakyTest, error) {
+	var execErr *dagger.ExecError
+	if !errors.As(failed, &execErr) {
+		return nil, stageFailed(stageTest, failed)
+	}
+	failing := failedTests(execErr.Stdout)
+	if len(failing) == 0 {
+		return nil, stageFailed(stageTest, failed)
+	}
+
+	var flaky []FlakyTest
+	for retry := 1; retry <= opts.flakyRetries && len(failing) > 0; retry++ {
+		// a distinct variable per attempt, so the engine never answers a
+		// rerun from its cache
+		_, err := rust.
+			WithEnvVariable("MERLIN_TEST_RETRY", strconv.Itoa(retry)).
+			WithExec(retryTestArgs(opts, failing)).
+			Sync(ctx)
+		still := map[string]bool{}
+		if err != nil {
+			if !errors.As(err, &execErr) {
+				return flaky, stageFailed(stageTest, err)
+			}
+			names := failedTests(execErr.Stdout)
+			if len(names) == 0 {
+				return flaky, stageFailed(stageTest, err)
+			}
+			for _, name := range names {
+				still[name] = true
+			}
+			failed = err
+		}
+		var next []string
+		for _, name := range failing {
+			if still[name] {
+				next = append(next, name)
+			} else {
+				flaky = append(flaky, FlakyTest{Name: name, Retries: retry})
+			}
+		}
+		failing = next
+	}
+	if len(failing) > 0 {
+		return flaky, stageFailed(stageTest, failed)
+	}
+	return flaky, nil
+}
+
+// formatFlaky lists the flaky tests for the test stage's output.
+func formatFlaky(flaky []FlakyTest) string {
+	parts := make([]string, len(flaky))
+	for i, f := range flaky {
+		parts[i] = fmt.Sprintf("%s (%d %s)", f.Name, f.Retries, plural(f.Retries, "retry", "retries"))
+	}
+	return fmt.Sprintf("%d flaky %s passed on retry: %s", len(flaky), plural(len(flaky), "test", "tests"), strings.Join(parts, ", "))
+}
+
+// plural picks the word for n.
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// recordFlaky adds tests to the run's flaky tests.
+func (t *stageRecorder) recordFlaky(tests ...FlakyTest) {
+	if t == nil || len(tests) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flaky = append(t.flaky, tests...)
+}
+
+// flakyTests returns a copy of the recorded flaky tests.
+func (t *stageRecorder) flakyTests() []FlakyTest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]FlakyTest(nil), t.flaky...)
+}
+
+// validateFlakyRetries checks that the test runner can rerun failures.
+func validateFlakyRetries(opts Options) error {
+	if opts.flakyRetries < 0 {
+		return fmt.Errorf("-flaky-retries must not be negative, got %d", opts.flakyRetries)
+	}
+	if opts.flakyRetries > 0 && opts.junit && opts.testRunner == testRunnerCargo {
+		return fmt.Errorf("-flaky-retries with -junit requires -test-runner=%s", testRunnerNextest)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestFailedTests(t *testing.T) {
+	stdout := `running 3 tests
+test routing::tests::epsilon ... ok
+test server::tests::health ... FAILED
+test metrics::tests::redis_timeout ... FAILED
+
+failures:
+
+---- server::tests::health stdout ----
+thread 'server::tests::health' panicked at src/server.rs:10:5:
+test server::tests::health ... FAILED
+`
+	want := []string{"server::tests::health", "metrics::tests::redis_timeout"}
+	if got := failedTests(stdout); !reflect.DeepEqual(got, want) {
+		t.Errorf("failedTests = %v, want %v", got, want)
+	}
+
+	// a test binary that does not compile reports no tests, so it is never retried
+	compile := "error[E0425]: cannot find value `x` in this scope\nerror: could not compile `merlin` (lib test) due to 1 previous error\n"
+	if got := failedTests(compile); len(got) != 0 {
+		t.Errorf("failedTests(compile error) = %v, want none", got)
+	}
+}
+
+func TestNextestFlaky(t *testing.T) {
+	stderr := `    Starting 3 tests across 1 binary
+        PASS [   0.004s] merlin routing::tests::epsilon
+   TRY 1 FAIL [   0.010s] merlin metrics::tests::redis_timeout
+  TRY 2 PASS [   0.011s] merlin metrics::tests::redis_timeout
+       FLAKY 2/3 [   0.011s] merlin metrics::tests::redis_timeout
+       FLAKY 3/3 [   0.020s] merlin server::tests::health
+     Summary [   0.030s] 3 tests run: 3 passed (2 flaky), 0 skipped
+`
+	want := []FlakyTest{{"metrics::tests::redis_timeout", 1}, {"server::tests::health", 2}}
+	if got := nextestFlaky(stderr); !reflect.DeepEqual(got, want) {
+		t.Errorf("nextestFlaky = %v, want %v", got, want)
+	}
+
+	// without status-level flaky only the passing retry shows it
+	tryOnly := `        PASS [   0.004s] merlin::integration api::health
+   TRY 1 FAIL [   0.010s] merlin::integration api::login
+   TRY 2 FAIL [   0.012s] merlin::integration api::login
+   TRY 3 PASS [   0.011s] merlin::integration api::login
+`
+	if got, want := nextestFlaky(tryOnly), []FlakyTest{{"api::login", 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nextestFlaky(TRY lines) = %v, want %v", got, want)
+	}
+}
+
+func TestNextestOutcomeFailedRun(t *testing.T) {
+	// one test passed on a retry, another failed every try
+	stderr := `    Starting 3 tests across 1 binary
+   TRY 1 FAIL [   0.010s] merlin metrics::tests::redis_timeout
+   TRY 2 PASS [   0.011s] merlin metrics::tests::redis_timeout
+   TRY 1 FAIL [   0.003s] merlin server::tests::health
+   TRY 2 FAIL [   0.003s] merlin server::tests::health
+   TRY 3 FAIL [   0.003s] merlin server::tests::health
+     Summary [   0.030s] 3 tests run: 2 passed (1 flaky), 1 failed, 0 skipped
+        FAIL [   0.003s] merlin server::tests::health
+error: test run failed
+`
+	out, flaky, err := nextestOutcome("", "", &dagger.ExecError{ExitCode: 100, Stderr: stderr})
+	if want := []FlakyTest{{"metrics::tests::redis_timeout", 1}}; !reflect.DeepEqual(flaky, want) {
+		t.Errorf("flaky = %v, want %v", flaky, want)
+	}
+	var stageErr *stageError
+	if !errors.As(err, &stageErr) || stageErr.exitCode != 100 || stageErr.stderr != stderr || out != "" {
+		t.Errorf("nextestOutcome = %q, %v, want the failed test stage", out, err)
+	}
+
+	out, flaky, err = nextestOutcome("test output", "        FLAKY 2/2 [   0.011s] merlin routing::tests::epsilon\n", nil)
+	if err != nil || out != "FLAKY 2/2 [   0.011s] merlin routing::tests::epsilon\ntest output" || len(flaky) != 1 {
+		t.Errorf("nextestOutcome(passed) = %q, %v, %v", out, flaky, err)
+	}
+}
+
+func TestJUnitFlaky(t *testing.T) {
+	report, err := parseJUnit([]byte(`<testsuites tests="3" failures="1">
+<testsuite name="merlin" tests="3" failures="1">
+<testcase name="routing::tests::epsilon" classname="merlin"/>
+<testcase name="metrics::tests::redis_timeout" classname="merlin"><flakyFailure message="timeout"/><flakyFailure message="timeout"/></testcase>
+<testcase name="server::tests::health" classname="merlin"><failure message="panicked"/><flakyFailure message="panicked"/></testcase>
+</testsuite>
+</testsuites>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FlakyTest{{"metrics::tests::redis_timeout", 2}}
+	if got := junitFlaky(report); !reflect.DeepEqual(got, want) {
+		t.Errorf("junitFlaky = %v, want %v", got, want)
+	}
+}
+
+func TestFlakyRetryArgs(t *testing.T) {
+	opts := Options{flakyRetries: 2, testRunner: testRunnerNextest}
+	if args := strings.Join(nextestArgs(opts), " "); !strings.Contains(args, "--retries 2") {
+		t.Errorf("nextestArgs = %s, want --retries 2", args)
+	}
+	if args := strings.Join(nextestArgs(Options{}), " "); strings.Contains(args, "--retries") {
+		t.Errorf("nextestArgs without retries = %s", args)
+	}
+
+	got := retryTestArgs(Options{}, []string{"a::b", "c::d"})
+	want := append(cargoTestArgs(Options{}), "--", "--exact", "a::b", "c::d")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("retryTestArgs = %v, want %v", got, want)
+	}
+}
+
+func TestFormatFlaky(t *testing.T) {
+	got := formatFlaky([]FlakyTest{{"a", 1}, {"b", 2}})
+	if want := "2 flaky tests passed on retry: a (1 retry), b (2 retries)"; got != want {
+		t.Errorf("formatFlaky = %q, want %q", got, want)
+	}
+}
+
+func TestRecordFlaky(t *testing.T) {
+	var none *stageRecorder
+	none.recordFlaky(FlakyTest{"a", 1}) // listing checks passes no recorder
+
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal))
+	rec.recordFlaky(FlakyTest{"a", 1})
+	rec.recordFlaky()
+	result := newRunResult(nil, 0, "", nil)
+	result.FlakyTests = rec.flakyTests()
+	if !reflect.DeepEqual(result.FlakyTests, []FlakyTest{{"a", 1}}) {
+		t.Errorf("FlakyTests = %v", result.FlakyTests)
+	}
+}
+
+func TestFlakyRetriesOptions(t *testing.T) {
+	for _, args := range [][]string{{"-flaky-retries=-1"}, {"-flaky-retries=2", "-junit"}} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+	if _, err := ParseOptions([]string{"-flaky-retries=2", "-junit", "-test-runner=nextest"}, io.Discard); err != nil {
+		t.Error(err)
+	}
+}
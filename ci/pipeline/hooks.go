@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+)
+
+// hook phases, as named under `hooks:` in the config file
+const (
+	hookPreBuild  = "pre_build"
+	hookPostBuild = "post_build"
+	hookPreTest   = "pre_test"
+	hookPostTest  = "post_test"
+)
+
+// Hook is a shell command the config file runs at a point in the pipeline.
+type Hook struct {
+	Phase   string
+	Index   int // position within the phase, from 1
+	Command string
+}
+
+// name identifies the hook in stage names and errors.
+func (h Hook) name() string {
+	return fmt.Sprintf("%s hook %d", h.Phase, h.Index)
+}
+
+// hooks returns the hooks configured for phase, in the order listed.
+func (c Config) hooks(phase string) []Hook {
+	var commands []string
+	switch phase {
+	case hookPreBuild:
+		commands = c.Hooks.PreBuild
+	case hookPostBuild:
+		commands = c.Hooks.PostBuild
+	case hookPreTest:
+		commands = c.Hooks.PreTest
+	case hookPostTest:
+		commands = c.Hooks.PostTest
+	}
+	hooks := make([]Hook, len(commands))
+	for i, command := range commands {
+		hooks[i] = Hook{Phase: phase, Index: i + 1, Command: command}
+	}
+	return hooks
+}
+
+// hasBuildHooks reports whether any build phase hook is configured.
+func (c Config) hasBuildHooks() bool {
+	return len(c.Hooks.PreBuild) > 0 || len(c.Hooks.PostBuild) > 0
+}
+
+// runHooks runs the hooks configured for phase in ctr, one after the
+// other, and returns the container with their changes, so that e.g. code a
+// pre_build hook generates is part of the build. The first failing hook
+// fails the phase and the remaining hooks do not run.
+func runHooks(ctx context.Context, ctr *dagger.Container, phase string, cfg Config) (*dagger.Container, error) {
+	err := runHookSteps(cfg.hooks(phase), func(h Hook) error {
+		next, err := ctr.WithExec([]string{"sh", "-c", h.Command}).Sync(ctx)
+		if err != nil {
+			return err
+		}
+		ctr = next
+		return nil
+	})
+	return ctr, err
+}
+
+// runHookSteps calls exec for each hook in order, stopping at the first
+// failure, which it reports as a failure of that hook.
+func runHookSteps(hooks []Hook, exec func(Hook) error) error {
+	for _, h := range hooks {
+		if err := exec(h); err != nil {
+			return stageFailed(fmt.Sprintf("%s (%s)", h.name(), h.Command), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "merlin-ci.yaml")
+	data := `hooks:
+  pre_build:
+    - ./scripts/codegen.sh
+    - cargo run -p xtask -- bundle-assets
+  post_test:
+    - test -f target/report.txt
+`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Hook{
+		{Phase: hookPreBuild, Index: 1, Command: "./scripts/codegen.sh"},
+		{Phase: hookPreBuild, Index: 2, Command: "cargo run -p xtask -- bundle-assets"},
+	}
+	if got := cfg.hooks(hookPreBuild); !reflect.DeepEqual(got, want) {
+		t.Errorf("pre_build hooks = %v, want %v", got, want)
+	}
+	if got := cfg.hooks(hookPostBuild); len(got) != 0 {
+		t.Errorf("post_build hooks = %v, want none", got)
+	}
+	if !cfg.hasBuildHooks() {
+		t.Error("hasBuildHooks = false with pre_build hooks")
+	}
+
+	if err := os.WriteFile(path, []byte("hooks:\n  pre_biuld: [make]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Error("unknown hook phase was accepted")
+	}
+}
+
+func TestRunHookSteps(t *testing.T) {
+	var cfg Config
+	cfg.Hooks.PreTest = []string{"first", "second", "third"}
+
+	var ran []string
+	err := runHookSteps(cfg.hooks(hookPreTest), func(h Hook) error {
+		ran = append(ran, h.Command)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first", "second", "third"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+
+	// a failure stops the phase and names the hook that failed
+	ran = nil
+	boom := errors.New("exit status 2")
+	err = runHookSteps(cfg.hooks(hookPreTest), func(h Hook) error {
+		ran = append(ran, h.Command)
+		if h.Command == "second" {
+			return boom
+		}
+		return nil
+	})
+	if want := []string{"first", "second"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	if !errors.Is(err, boom) || !strings.Contains(err.Error(), "pre_test hook 2 (second)") {
+		t.Errorf("err = %v, want the failure of pre_test hook 2", err)
+	}
+}
+
+func TestBuildHooksRejectMatrix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "merlin-ci.yaml")
+	if err := os.WriteFile(path, []byte("hooks:\n  pre_build: [make codegen]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseOptions([]string{"-config=" + path}, io.Discard); err != nil {
+		t.Errorf("build hooks: %v", err)
+	}
+	if _, err := ParseOptions([]string{"-config=" + path, "-matrix=stable,beta"}, io.Discard); err == nil {
+		t.Error("build hooks with -matrix succeeded, want error")
+	}
+}
@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFile lists further -source paths to leave out of the build
+// context, one .dockerignore-style pattern per line.
+const ignoreFile = ".daggerignore"
+
+// defaultExcludes keeps cargo's output, the git history and the pipeline's
+// own exports out of the build context. They are large, and stale build
+// output would otherwise leak into the container.
+var defaultExcludes = []string{"target", ".git", "build"}
+
+// parseIgnoreFile returns the patterns in an ignore file. Blank lines and
+// lines starting with # are skipped.
+func parseIgnoreFile(data []byte) []string {
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// validatePathPattern rejects patterns that could never match inside
+// -source: absolute ones, those climbing out of it, and malformed globs.
+func validatePathPattern(flag, pattern string) error {
+	clean := path.Clean(strings.TrimPrefix(pattern, "!"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("-%s entry %q must be relative to -source", flag, pattern)
+	}
+	if _, err := path.Match(clean, ""); err != nil {
+		return fmt.Errorf("-%s entry %q: %w", flag, pattern, err)
+	}
+	return nil
+}
+
+// loadSourceFilter assembles the patterns excluded from the -source upload:
+// the defaults, then the -source ignore file, then the -exclude-paths, with
+// the -include-paths re-included last so they win over all of them.
+func loadSourceFilter(opts *Options, excludes, includes []string) error {
+	if opts.gitURL != "" {
+		if len(excludes) > 0 || len(includes) > 0 {
+			return fmt.Errorf("-exclude-paths and -include-paths apply to -source, not -git-url")
+		}
+		return nil
+	}
+
+	patterns := sourceDefaultExcludes(*opts)
+	data, err := os.ReadFile(filepath.Join(opts.source, ignoreFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read %s: %w", ignoreFile, err)
+	}
+	for _, p := range parseIgnoreFile(data) {
+		if err := validatePathPattern(ignoreFile, p); err != nil {
+			return err
+		}
+		patterns = append(patterns, p)
+	}
+	for _, p := range excludes {
+		if err := validatePathPattern("exclude-paths", p); err != nil {
+			return err
+		}
+		patterns = append(patterns, p)
+	}
+	for _, p := range includes {
+		if strings.HasPrefix(p, "!") {
+			return fmt.Errorf("-include-paths entry %q must not start with !", p)
+		}
+		if err := validatePathPattern("include-paths", p); err != nil {
+			return err
+		}
+		patterns = append(patterns, "!"+p)
+	}
+	opts.sourceExcludes = patterns
+	return nil
+}
+
+// sourceDefaultExcludes returns defaultExcludes, keeping .git for
+// -submodules, which needs it, and adding the build directory the pipeline
+// exports to and the -skip-unchanged record when they lie inside -source,
+// as they do for the default ../ source.
+func sourceDefaultExcludes(opts Options) []string {
+	var patterns []string
+	for _, p := range defaultExcludes {
+		if p == ".git" && opts.submodules {
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	if rel, ok := sourcePath(opts.source, buildDir); ok && rel != "build" {
+		patterns = append(patterns, rel)
+	}
+	if rel, ok := sourcePath(opts.source, resultCacheFile); ok {
+		patterns = append(patterns, rel)
+	}
+	return patterns
+}
+
+// sourcePath returns the slash-separated path of dir inside source, and
+// false when dir is source itself or lies outside it.
+func sourcePath(source, dir string) (string, bool) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return "", false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(source, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// sourceExcluded reports whether patterns leave the slash-separated -source
+// path rel out of the upload, applying them as the engine does: the last
+// matching pattern wins, one starting with ! re-includes, and a pattern
+// matching a directory covers everything below it.
+func sourceExcluded(rel string, patterns []string) bool {
+	excluded := false
+	for _, p := range patterns {
+		include := strings.HasPrefix(p, "!")
+		if matchSourcePattern(path.Clean(strings.TrimPrefix(p, "!")), rel) {
+			excluded = !include
+		}
+	}
+	return excluded
+}
+
+// sourceDirExcluded reports whether the directory rel and everything below
+// it are left out of the upload, so a walk of -source can skip it: it is
+// excluded and no ! pattern re-includes a path inside it.
+func sourceDirExcluded(rel string, patterns []string) bool {
+	if !sourceExcluded(rel, patterns) {
+		return false
+	}
+	for _, p := range patterns {
+		if include, ok := strings.CutPrefix(p, "!"); ok {
+			include = path.Clean(include)
+			if strings.HasPrefix(include, rel+"/") || strings.HasPrefix(include, "**") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchSourcePattern reports whether pattern matches rel or one of the
+// directories it lies in. ** matches any number of directories.
+func matchSourcePattern(pattern, rel string) bool {
+	for dir := rel; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if matchSegments(strings.Split(pattern, "/"), strings.Split(dir, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], segments[0])
+	return err == nil && ok && matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnoreFile(t *testing.T) {
+	got := parseIgnoreFile([]byte("# editor junk\n*.swp\n\n  .idea  \n!keep.swp\n"))
+	want := []string{"*.swp", ".idea", "!keep.swp"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIgnoreFile = %q, want %q", got, want)
+	}
+}
+
+func TestLoadSourceFilter(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ignoreFile), []byte("*.swp\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := ParseOptions([]string{"-no-cache", "-source=" + dir, "-exclude-paths=docs,*.log", "-exclude-paths=bench", "-include-paths=build/fixtures"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"target", ".git", "build", "*.swp", "docs", "*.log", "bench", "!build/fixtures"}
+	if !reflect.DeepEqual(opts.sourceExcludes, want) {
+		t.Errorf("sourceExcludes = %q, want %q", opts.sourceExcludes, want)
+	}
+	if plan := formatPlan(opts); !strings.Contains(plan, "*.swp docs *.log bench !build/fixtures") {
+		t.Errorf("plan does not list the added patterns:\n%s", plan)
+	}
+}
+
+func TestSourceDefaultExcludes(t *testing.T) {
+	// the default source is the repository root, which holds ci/build and
+	// the -skip-unchanged record
+	if got, want := sourceDefaultExcludes(Options{source: defaultSource}), []string{"target", ".git", "build", "ci/build", "ci/" + resultCacheFile}; !reflect.DeepEqual(got, want) {
+		t.Errorf("default source: got %q, want %q", got, want)
+	}
+	// -submodules runs git against the upload
+	if got, want := sourceDefaultExcludes(Options{source: "pipeline/testdata/cargo", submodules: true}), []string{"target", "build"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-submodules: got %q, want %q", got, want)
+	}
+}
+
+func TestLoadSourceFilterRejects(t *testing.T) {
+	for _, args := range [][]string{
+		{"-exclude-paths=/etc"},
+		{"-exclude-paths=../secrets"},
+		{"-exclude-paths=src/[a"},
+		{"-include-paths=!target"},
+		{"-git-url=https://github.com/awdemos/merlin.git", "-exclude-paths=docs"},
+	} {
+		if _, err := ParseOptions(append([]string{"-no-cache"}, args...), io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestSourceExcluded(t *testing.T) {
+	patterns := []string{"target", "build", "*.log", "docs/**/*.png", "fixtures", "!fixtures/keep"}
+	for rel, want := range map[string]bool{
+		"target/release/merlin": true,
+		"src/target.rs":         false,
+		"crates/core/target":    false,
+		"server.log":            true,
+		"logs/server.log":       false,
+		"docs/img/a/logo.png":   true,
+		"docs/logo.png":         true,
+		"docs/guide.md":         false,
+		"fixtures/big.bin":      true,
+		"fixtures/keep/a.json":  false,
+		"src/main.rs":           false,
+	} {
+		if got := sourceExcluded(rel, patterns); got != want {
+			t.Errorf("sourceExcluded(%q) = %v, want %v", rel, got, want)
+		}
+	}
+	if sourceDirExcluded("fixtures", patterns) {
+		t.Error("fixtures skipped although fixtures/keep is re-included")
+	}
+	if !sourceDirExcluded("target", patterns) {
+		t.Error("target not skipped")
+	}
+}
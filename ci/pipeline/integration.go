@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+)
+
+const stageIntegration = "integration"
+
+// integration test database, reachable from the tests as host db
+const (
+	postgresImage    = "postgres:16"
+	postgresHost     = "db"
+	postgresPort     = 5432
+	postgresUser     = "merlin"
+	postgresPassword = "merlin"
+	postgresDB       = "merlin"
+)
+
+// integrationFeature enables the integration tests in the crate.
+const integrationFeature = "integration"
+
+// databaseURL is the DATABASE_URL the integration tests connect to.
+var databaseURL = fmt.Sprintf("postgres://%s:%s@%s:%d/%s", postgresUser, postgresPassword, postgresHost, postgresPort, postgresDB)
+
+// postgresService returns the database the integration tests run against.
+func postgresService(client *dagger.Client) *dagger.Service {
+	return client.Container().From(postgresImage).
+		WithEnvVariable("POSTGRES_USER", postgresUser).
+		WithEnvVariable("POSTGRES_PASSWORD", postgresPassword).
+		WithEnvVariable("POSTGRES_DB", postgresDB).
+		WithExposedPort(postgresPort).
+		AsService()
+}
+
+// integrationArgs returns the test command with the integration feature
+// added to the selected ones.
+func integrationArgs(opts Options) []string {
+	opts.features = append(append([]string(nil), opts.features...), integrationFeature)
+	return cargoTestArgs(opts)
+}
+
+// runIntegrationTests runs the integration tests against a Postgres
+// service bound to the test container. The service is started explicitly
+// first so that a database that fails to come up is reported as such
+// rather than as failing tests.
+func runIntegrationTests(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options) (string, error) {
+	svc, err := postgresService(client).Start(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s service failed to start: %w", stageIntegration, postgresImage, err)
+	}
+	// stop the service even when the run is being cancelled
+	defer svc.Stop(context.Background())
+
+	out, err := rust.
+		WithServiceBinding(postgresHost, svc).
+		WithEnvVariable("DATABASE_URL", databaseURL).
+		WithExec(integrationArgs(opts)).
+		Stdout(ctx)
+	if err != nil {
+		return "", stageFailed(stageIntegration, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+
+	"dagger.io/dagger"
+)
+
+// jobsArgs bounds cargo's parallel compiler processes. Without -jobs cargo
+// runs one per CPU the container sees.
+func jobsArgs(opts Options) []string {
+	if opts.jobs == 0 {
+		return nil
+	}
+	return []string{"--jobs", strconv.Itoa(opts.jobs)}
+}
+
+// testThreadsArgs bounds the threads a test binary runs its tests on, for
+// libtest and nextest alike. Without -test-threads each uses one per CPU.
+func testThreadsArgs(opts Options) []string {
+	if opts.testThreads == 0 {
+		return nil
+	}
+	return []string{"--test-threads", strconv.Itoa(opts.testThreads)}
+}
+
+// withJobs sets CARGO_BUILD_JOBS, so the cargo commands not given --jobs,
+// such as clippy and doc, are bounded too.
+func withJobs(rust *dagger.Container, opts Options) *dagger.Container {
+	if opts.jobs == 0 {
+		return rust
+	}
+	return rust.WithEnvVariable("CARGO_BUILD_JOBS", strconv.Itoa(opts.jobs))
+}
+
+// countOrCPUs renders a -jobs or -test-threads value for the plan.
+func countOrCPUs(n int) string {
+	if n == 0 {
+		return "one per CPU"
+	}
+	return strconv.Itoa(n)
+}
+
+// validateJobs rejects negative limits; zero leaves the defaults.
+func validateJobs(opts Options) error {
+	if opts.jobs < 0 {
+		return fmt.Errorf("-jobs must not be negative, got %d", opts.jobs)
+	}
+	if opts.testThreads < 0 {
+		return fmt.Errorf("-test-threads must not be negative, got %d", opts.testThreads)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestJobsArgs(t *testing.T) {
+	opts, err := ParseOptions([]string{"-jobs=4", "-test-threads=2"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := cargoBuildArgs(opts)
+	if want := []string{"--jobs", "4"}; !reflect.DeepEqual(got[len(got)-2:], want) {
+		t.Errorf("cargoBuildArgs = %q, want a trailing %q", got, want)
+	}
+	got = cargoTestArgs(opts)
+	want := []string{"--jobs", "4", "--", "--test-threads", "2"}
+	if !reflect.DeepEqual(got[len(got)-len(want):], want) {
+		t.Errorf("cargoTestArgs = %q, want a trailing %q", got, want)
+	}
+
+	opts.testRunner = testRunnerNextest
+	got = nextestArgs(opts)
+	if !containsSeq(got, "--build-jobs", "4") || !containsSeq(got, "--test-threads", "2") {
+		t.Errorf("nextestArgs = %q, want --build-jobs 4 and --test-threads 2", got)
+	}
+
+	opts, err = ParseOptions(nil, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := jobsArgs(opts); got != nil {
+		t.Errorf("jobsArgs by default = %q, want none", got)
+	}
+
+	for _, args := range [][]string{{"-jobs=-1"}, {"-test-threads=-2"}} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func containsSeq(args []string, flag, value string) bool {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag && args[i+1] == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// defaultJUnitOut is where the JUnit report is written on the host.
+const defaultJUnitOut = "./build/junit.xml"
+
+// testEvent is one line of libtest's `--format json` output.
+type testEvent struct {
+	Type     string  `json:"type"`
+	Event    string  `json:"event"`
+	Name     string  `json:"name"`
+	Stdout   string  `json:"stdout"`
+	ExecTime float64 `json:"exec_time"`
+}
+
+type junitTestsuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestsuite `xml:"testsuite"`
+}
+
+type junitTestsuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestcase `xml:"testcase"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+	// Flaky holds the failed tries of a test nextest retried
+	Flaky     []junitFailure `xml:"flakyFailure"`
+	Skipped   *struct{}      `xml:"skipped"`
+	SystemOut string         `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// cargoJSONToJUnit converts the JSON event stream printed by
+// `cargo test -- -Z unstable-options --format json` into a JUnit report.
+// Each test binary cargo runs becomes one testsuite. Lines that are not
+// libtest events, such as output printed by the tests themselves, are
+// ignored.
+func cargoJSONToJUnit(r io.Reader) (junitTestsuites, error) {
+	var report junitTestsuites
+	var suite *junitTestsuite
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		var ev testEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			continue
+		}
+
+		switch ev.Type {
+		case "suite":
+			if ev.Event == "started" {
+				report.Suites = append(report.Suites, junitTestsuite{
+					Name: fmt.Sprintf("cargo test #%d", len(report.Suites)+1),
+				})
+				suite = &report.Suites[len(report.Suites)-1]
+			} else if suite != nil {
+				suite.Time = formatSeconds(ev.ExecTime)
+			}
+		case "test":
+			if suite == nil || ev.Event == "started" || ev.Event == "timeout" {
+				continue
+			}
+			tc := junitTestcase{Time: formatSeconds(ev.ExecTime)}
+			tc.Classname, tc.Name = splitTestName(ev.Name)
+			switch ev.Event {
+			case "failed":
+				tc.Failure = &junitFailure{Message: "test failed", Body: ev.Stdout}
+				suite.Failures++
+				report.Failures++
+			case "ignored":
+				tc.Skipped = &struct{}{}
+				suite.Skipped++
+				report.Skipped++
+			default:
+				tc.SystemOut = ev.Stdout
+			}
+			suite.Tests++
+			report.Tests++
+			suite.Cases = append(suite.Cases, tc)
+		}
+	}
+	return report, scanner.Err()
+}
+
+// parseJUnit reads a JUnit report written by another tool, such as
+// nextest. Totals are recounted from the test cases because reporters
+// disagree on which summary attributes they set.
+func parseJUnit(data []byte) (junitTestsuites, error) {
+	var report junitTestsuites
+	if err := xml.Unmarshal(data, &report); err != nil {
+		return junitTestsuites{}, err
+	}
+	report.Tests, report.Failures, report.Skipped = 0, 0, 0
+	for _, suite := range report.Suites {
+		for _, tc := range suite.Cases {
+			report.Tests++
+			if tc.Failure != nil {
+				report.Failures++
+			}
+			if tc.Skipped != nil {
+				report.Skipped++
+			}
+		}
+	}
+	return report, nil
+}
+
+// marshal renders the report as an XML document.
+func (r junitTestsuites) marshal() ([]byte, error) {
+	out, err := xml.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+// splitTestName splits a libtest name like `routing::tests::picks_best`
+// into its module path and test function.
+func splitTestName(name string) (classname, test string) {
+	if i := strings.LastIndex(name, "::"); i >= 0 {
+		return name[:i], name[i+2:]
+	}
+	return "", name
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
+
+// runJUnitTests runs the test suite with libtest's JSON formatter and writes
+// the converted JUnit report to opts.junitOut, even when tests fail. The
+// formatter is unstable, so RUSTC_BOOTSTRAP is set to allow it on a stable
+// toolchain.
+func runJUnitTests(ctx context.Context, rust *dagger.Container, opts Options) (string, error) {
+	out := opts.junitOut
+	stdout, stderr, err := execStreams(ctx, rust.
+		WithEnvVariable("RUSTC_BOOTSTRAP", "1").
+		WithExec(cargoTestArgs(opts, "-Z", "unstable-options", "--format", "json", "--report-time")))
+
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		stdout, stderr = execErr.Stdout, execErr.Stderr
+	} else if err != nil {
+		return "", stageFailed(stageTest, err)
+	}
+
+	report, convErr := cargoJSONToJUnit(strings.NewReader(stdout))
+	if convErr == nil {
+		convErr = writeJUnit(report, out)
+	}
+	if err != nil {
+		return "", stageFailed(stageTest, err)
+	}
+	if convErr != nil {
+		return "", fmt.Errorf("%s: junit report: %w", stageTest, convErr)
+	}
+
+	// stdout is the JSON event stream, so cargo's stderr goes ahead of
+	// the summary in its place
+	summary := fmt.Sprintf("%d tests, %d failed, %d ignored (JUnit report written to %s)",
+		report.Tests, report.Failures, report.Skipped, out)
+	return combineStreams(summary, stderr), nil
+}
+
+// writeJUnit writes the report to path, creating parent directories.
+func writeJUnit(report junitTestsuites, path string) error {
+	data, err := report.marshal()
+	if err != nil {
+		return err
+	}
+	return writeReport(path, data)
+}
+
+// writeReport writes data to path, creating parent directories.
+func writeReport(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,101 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+const sampleCargoJSON = `{ "type": "suite", "event": "started", "test_count": 3 }
+{ "type": "test", "event": "started", "name": "routing::tests::picks_best" }
+{ "type": "test", "name": "routing::tests::picks_best", "event": "ok", "exec_time": 0.0125 }
+{ "type": "test", "event": "started", "name": "routing::tests::falls_back" }
+{ "type": "test", "name": "routing::tests::falls_back", "event": "failed", "exec_time": 0.5, "stdout": "thread 'routing::tests::falls_back' panicked at src/routing/mod.rs:10:5\n" }
+{ "type": "test", "event": "started", "name": "slow" }
+{ "type": "test", "name": "slow", "event": "ignored" }
+{ "type": "suite", "event": "failed", "passed": 1, "failed": 1, "ignored": 1, "measured": 0, "filtered_out": 0, "exec_time": 0.52 }
+some stray output
+{ "type": "suite", "event": "started", "test_count": 1 }
+{ "type": "test", "event": "started", "name": "it_works" }
+{ "type": "test", "name": "it_works", "event": "ok" }
+{ "type": "suite", "event": "ok", "passed": 1, "failed": 0, "ignored": 0, "measured": 0, "filtered_out": 0, "exec_time": 0.001 }
+`
+
+func TestCargoJSONToJUnit(t *testing.T) {
+	report, err := cargoJSONToJUnit(strings.NewReader(sampleCargoJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Tests != 4 || report.Failures != 1 || report.Skipped != 1 {
+		t.Errorf("totals = %d tests, %d failures, %d skipped; want 4, 1, 1", report.Tests, report.Failures, report.Skipped)
+	}
+	if len(report.Suites) != 2 {
+		t.Fatalf("got %d suites, want 2", len(report.Suites))
+	}
+
+	first := report.Suites[0]
+	if first.Tests != 3 || first.Time != "0.520" {
+		t.Errorf("first suite = %d tests in %s, want 3 in 0.520", first.Tests, first.Time)
+	}
+	pass, fail, skip := first.Cases[0], first.Cases[1], first.Cases[2]
+	if pass.Classname != "routing::tests" || pass.Name != "picks_best" || pass.Time != "0.013" {
+		t.Errorf("passing case = %+v", pass)
+	}
+	if fail.Failure == nil || !strings.Contains(fail.Failure.Body, "panicked") {
+		t.Errorf("failing case has no failure body: %+v", fail)
+	}
+	if skip.Skipped == nil || skip.Classname != "" || skip.Name != "slow" {
+		t.Errorf("ignored case = %+v", skip)
+	}
+}
+
+func TestJUnitMarshal(t *testing.T) {
+	report, err := cargoJSONToJUnit(strings.NewReader(sampleCargoJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := report.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xml := string(data)
+	for _, want := range []string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<testsuites tests="4" failures="1" skipped="1">`,
+		`<testcase name="falls_back" classname="routing::tests" time="0.500">`,
+		`<failure message="test failed">`,
+		`<skipped></skipped>`,
+	} {
+		if !strings.Contains(xml, want) {
+			t.Errorf("report is missing %q:\n%s", want, xml)
+		}
+	}
+}
+
+func TestParseJUnitNextest(t *testing.T) {
+	const report = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="nextest-run" tests="3" failures="1" errors="0" uuid="0b6c7f5e" timestamp="2024-01-02T03:04:05.000+00:00" time="0.042">
+    <testsuite name="merlin" tests="3" disabled="1" errors="0" failures="1">
+        <testcase name="routing::tests::picks_best" classname="merlin" timestamp="2024-01-02T03:04:05.000+00:00" time="0.010">
+        </testcase>
+        <testcase name="routing::tests::falls_back" classname="merlin" timestamp="2024-01-02T03:04:05.000+00:00" time="0.020">
+            <failure type="test failure">thread panicked</failure>
+        </testcase>
+        <testcase name="routing::tests::slow" classname="merlin" timestamp="2024-01-02T03:04:05.000+00:00" time="0.000">
+            <skipped/>
+        </testcase>
+    </testsuite>
+</testsuites>
+`
+	got, err := parseJUnit([]byte(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Tests != 3 || got.Failures != 1 || got.Skipped != 1 {
+		t.Errorf("tests, failures, skipped = %d, %d, %d, want 3, 1, 1", got.Tests, got.Failures, got.Skipped)
+	}
+	if len(got.Suites) != 1 || got.Suites[0].Cases[1].Failure == nil {
+		t.Errorf("suites = %+v, want one suite with a failing second case", got.Suites)
+	}
+}
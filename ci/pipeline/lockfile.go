@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/BurntSushi/toml"
+)
+
+const stageVerifyLock = "verify-lock"
+
+// lockPackage is one [[package]] entry of Cargo.lock.
+type lockPackage struct {
+	Name    string `toml:"name"`
+	Version string `toml:"version"`
+}
+
+// parseLockfile returns the versions of every package in a Cargo.lock,
+// keyed by name. A crate may be locked at several versions.
+func parseLockfile(data string) (map[string][]string, error) {
+	var lock struct {
+		Package []lockPackage `toml:"package"`
+	}
+	if _, err := toml.Decode(data, &lock); err != nil {
+		return nil, fmt.Errorf("parse Cargo.lock: %w", err)
+	}
+	versions := make(map[string][]string)
+	for _, p := range lock.Package {
+		versions[p.Name] = append(versions[p.Name], p.Version)
+	}
+	for _, v := range versions {
+		sort.Strings(v)
+	}
+	return versions, nil
+}
+
+// diffLockfiles describes how the packages locked in updated differ from
+// those in committed, one line per crate: `+ name 1.0.0` for an added
+// crate, `- name 1.0.0` for a removed one and `~ name 1.0.0 -> 1.1.0` for
+// one locked at other versions.
+func diffLockfiles(committed, updated map[string][]string) []string {
+	names := make(map[string]bool)
+	for name := range committed {
+		names[name] = true
+	}
+	for name := range updated {
+		names[name] = true
+	}
+
+	var diff []string
+	for _, name := range sortedKeys(names) {
+		old, cur := strings.Join(committed[name], ", "), strings.Join(updated[name], ", ")
+		switch {
+		case old == cur:
+		case old == "":
+			diff = append(diff, fmt.Sprintf("+ %s %s", name, cur))
+		case cur == "":
+			diff = append(diff, fmt.Sprintf("- %s %s", name, old))
+		default:
+			diff = append(diff, fmt.Sprintf("~ %s %s -> %s", name, old, cur))
+		}
+	}
+	return diff
+}
+
+// runVerifyLock fails when the Cargo.lock in src is missing or out of date
+// with the manifests. `cargo update --workspace` only resolves what the
+// manifests changed, without upgrading anything else, so any difference in
+// the lockfile it leaves behind is a change the committed one lacks. The
+// committed lockfile is read from src, as the build in rust may already
+// have rewritten its copy.
+func runVerifyLock(ctx context.Context, src *dagger.Directory, rust *dagger.Container) (string, error) {
+	entries, err := src.Entries(ctx)
+	if err != nil {
+		return "", stageFailed(stageVerifyLock, err)
+	}
+	found := false
+	for _, e := range entries {
+		found = found || e == "Cargo.lock"
+	}
+	if !found {
+		return "", &stageError{stage: stageVerifyLock, exitCode: 1, stderr: "Cargo.lock is not committed"}
+	}
+
+	committed, err := src.File("Cargo.lock").Contents(ctx)
+	if err != nil {
+		return "", stageFailed(stageVerifyLock, err)
+	}
+	updated, err := rust.
+		WithExec([]string{"cargo", "update", "--workspace"}).
+		File("Cargo.lock").
+		Contents(ctx)
+	if err != nil {
+		return "", stageFailed(stageVerifyLock, err)
+	}
+	if committed == updated {
+		return "Cargo.lock is up to date", nil
+	}
+
+	before, err := parseLockfile(committed)
+	if err != nil {
+		return "", fmt.Errorf("%s: committed %w", stageVerifyLock, err)
+	}
+	after, err := parseLockfile(updated)
+	if err != nil {
+		return "", fmt.Errorf("%s: updated %w", stageVerifyLock, err)
+	}
+	msg := "Cargo.lock is out of date with Cargo.toml; run `cargo update --workspace` and commit the result"
+	if diff := diffLockfiles(before, after); len(diff) > 0 {
+		msg += ":\n" + strings.Join(diff, "\n")
+	}
+	return "", &stageError{stage: stageVerifyLock, exitCode: 1, stderr: msg}
+}
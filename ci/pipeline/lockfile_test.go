@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffLockfiles(t *testing.T) {
+	committed, err := parseLockfile(`version = 3
+
+[[package]]
+name = "merlin"
+version = "0.1.0"
+
+[[package]]
+name = "serde"
+version = "1.0.195"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+
+[[package]]
+name = "syn"
+version = "1.0.109"
+
+[[package]]
+name = "syn"
+version = "2.0.48"
+
+[[package]]
+name = "thiserror"
+version = "1.0.56"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.0.109", "2.0.48"}; !reflect.DeepEqual(committed["syn"], want) {
+		t.Errorf("syn versions = %q, want %q", committed["syn"], want)
+	}
+
+	updated := map[string][]string{
+		"merlin": {"0.1.0"},
+		"serde":  {"1.0.196"},
+		"syn":    {"2.0.48"},
+		"tokio":  {"1.36.0"},
+	}
+	want := []string{
+		"~ serde 1.0.195 -> 1.0.196",
+		"~ syn 1.0.109, 2.0.48 -> 2.0.48",
+		"- thiserror 1.0.56",
+		"+ tokio 1.36.0",
+	}
+	if got := diffLockfiles(committed, updated); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffLockfiles =\n%q\nwant\n%q", got, want)
+	}
+	if got := diffLockfiles(committed, committed); got != nil {
+		t.Errorf("diffLockfiles(same) = %q", got)
+	}
+
+	if _, err := parseLockfile("[[package]\n"); err == nil {
+		t.Error("parseLockfile accepted malformed TOML")
+	}
+}
@@ -0,0 +1,215 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artifactLog is the kind of the -log-file artifact.
+const artifactLog = "log"
+
+// logFile is the -log-file: a copy of everything the pipeline logs and
+// prints, plus Dagger's progress output with the container commands'
+// stdout and stderr. In JSON mode every line is a JSON object, so the
+// printed output is wrapped as records of its own. It is safe for
+// concurrent use.
+type logFile struct {
+	mu      sync.Mutex
+	f       *os.File
+	json    bool
+	streams []*logStream
+	closers []func() error // see teeStdout
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// openLogFile creates the -log-file at path, writing in format.
+func openLogFile(path, format string) (*logFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{f: f, json: format == logFormatJSON}, nil
+}
+
+// handler returns the slog handler writing the pipeline's events to the
+// file. The file gets every event, debug ones included, whatever the
+// console's level.
+func (l *logFile) handler() slog.Handler {
+	opts := &slog.HandlerOptions{Level: logVerbose.slogLevel()}
+	w := lockedWriter{l}
+	if l.json {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// stream returns a writer copying output to the file line by line, as is
+// in text mode and as {"time", "level", "msg", "stream", "line"} records
+// in JSON mode.
+func (l *logFile) stream(name string) io.Writer {
+	s := &logStream{file: l, name: name}
+	l.mu.Lock()
+	l.streams = append(l.streams, s)
+	l.mu.Unlock()
+	return s
+}
+
+// writeLine writes one line of stream to the file.
+func (l *logFile) writeLine(stream, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	if !l.json {
+		l.f.WriteString(line + "\n")
+		return
+	}
+	data, _ := json.Marshal(struct {
+		Time   time.Time `json:"time"`
+		Level  string    `json:"level"`
+		Msg    string    `json:"msg"`
+		Stream string    `json:"stream"`
+		Line   string    `json:"line"`
+	}{time.Now(), slog.LevelInfo.String(), "output", stream, line})
+	l.f.Write(append(data, '\n'))
+}
+
+// teeStdout copies what the process prints to stdout into the file as the
+// stream "stdout", by swapping os.Stdout for a pipe. Close undoes it.
+func (l *logFile) teeStdout() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(io.MultiWriter(stdout, l.stream("stdout")), r)
+	}()
+	l.closers = append(l.closers, func() error {
+		os.Stdout = stdout
+		err := w.Close()
+		<-done
+		return errors.Join(err, r.Close())
+	})
+	return nil
+}
+
+// Close drains the tee'd stdout, writes the streams' unterminated last
+// lines and closes the file. It is safe to call more than once, and from
+// the signal handler while the run is still returning.
+func (l *logFile) Close() error {
+	l.closeOnce.Do(func() {
+		var errs []error
+		for _, c := range l.closers {
+			errs = append(errs, c())
+		}
+
+		l.mu.Lock()
+		streams := l.streams
+		l.mu.Unlock()
+		for _, s := range streams {
+			s.flush()
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		errs = append(errs, l.f.Close())
+		l.f = nil
+		l.closeErr = errors.Join(errs...)
+	})
+	return l.closeErr
+}
+
+// logStream splits what is written to it into lines for its logFile.
+type logStream struct {
+	file *logFile
+	name string
+
+	mu      sync.Mutex
+	partial string
+}
+
+func (s *logStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines := strings.Split(s.partial+string(p), "\n")
+	s.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		s.file.writeLine(s.name, strings.TrimSuffix(line, "\r"))
+	}
+	return len(p), nil
+}
+
+// flush writes the last line when it was not terminated.
+func (s *logStream) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.partial != "" {
+		s.file.writeLine(s.name, s.partial)
+		s.partial = ""
+	}
+}
+
+// lockedWriter serializes the slog handler's writes with the streams'.
+type lockedWriter struct{ l *logFile }
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.l.mu.Lock()
+	defer w.l.mu.Unlock()
+	if w.l.f == nil {
+		return len(p), nil
+	}
+	return w.l.f.Write(p)
+}
+
+// teeHandler sends every record to each of its handlers, so the events
+// reach both the console and the -log-file at their own levels.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
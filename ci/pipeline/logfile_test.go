@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFileText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ci.log")
+	l, err := openLogFile(path, logFormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	console := newLogger(io.Discard, logFormatText, logQuiet)
+	log := slog.New(teeHandler{console.Handler(), l.handler()})
+
+	log.Debug("cache key", "lockfile_hash", "abc123")
+	dagger := l.stream("dagger")
+	fmt.Fprint(dagger, "#5 cargo build\n#5 error: could not comp")
+	fmt.Fprint(dagger, "ile `merlin`")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	// debug events reach the file even when the console is quiet
+	for _, want := range []string{"msg=\"cache key\" lockfile_hash=abc123\n", "#5 cargo build\n", "#5 error: could not compile `merlin`\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log file missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestLogFileJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ci.jsonl")
+	l, err := openLogFile(path, logFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(l.handler()).Info("stage started", "stage", stageBuild)
+	fmt.Fprintln(l.stream("dagger"), "Compiling merlin v0.1.0")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), data)
+	}
+	var event, output map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil || event["msg"] != "stage started" {
+		t.Errorf("event line %s (%v)", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &output); err != nil || output["stream"] != "dagger" || output["line"] != "Compiling merlin v0.1.0" {
+		t.Errorf("output line %s (%v)", lines[1], err)
+	}
+}
+
+func TestLogFileTeesStdout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ci.log")
+	l, err := openLogFile(path, logFormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keep the test's own output clean
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devnull.Close()
+	stdout := os.Stdout
+	os.Stdout = devnull
+	defer func() { os.Stdout = stdout }()
+
+	if err := l.teeStdout(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("STAGE  DURATION  RESULT")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "STAGE  DURATION  RESULT\n" {
+		t.Errorf("log file = %q", data)
+	}
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// log formats accepted by -log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is how much the pipeline prints, set with -quiet and -verbose.
+type logLevel int
+
+const (
+	// logQuiet prints only failures and the final summary table.
+	logQuiet logLevel = iota
+	// logNormal adds lifecycle events and a one-line summary per check.
+	logNormal
+	// logVerbose adds debug events and the full output of every check.
+	logVerbose
+)
+
+// slogLevel returns the lowest event level logged at l.
+func (l logLevel) slogLevel() slog.Level {
+	switch l {
+	case logQuiet:
+		return slog.LevelWarn
+	case logVerbose:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// newLogger returns the logger for pipeline lifecycle events at level. In
+// JSON mode it writes one object per line. These events go to their own
+// writer so they never mix with the container output printed on stdout.
+func newLogger(w io.Writer, format string, level logLevel) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level.slogLevel()}
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// printCheckOutput prints the output of a passed check as level allows:
+// nothing when quiet, its last line (where cargo and the pipeline put
+// their summaries) normally, and all of it when verbose.
+func printCheckOutput(w io.Writer, level logLevel, label, output string) {
+	switch level {
+	case logQuiet:
+	case logVerbose:
+		fmt.Fprintf(w, "%s: %s\n", label, output)
+	default:
+		fmt.Fprintf(w, "%s: %s\n", label, lastLine(output))
+	}
+}
+
+// lastLine returns the last non-blank line of s, trimmed.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimRight(s, " \t\r\n"), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// validateLogFormat rejects unknown -log-format values.
+func validateLogFormat(format string) error {
+	if format != logFormatText && format != logFormatJSON {
+		return fmt.Errorf("invalid -log-format %q (valid: %s, %s)", format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// openLogOutput returns the writer for Dagger's own progress log: nowhere
+// for "", stderr for "-", otherwise the named file, truncated. The returned
+// close function is a no-op for stderr.
+func openLogOutput(path string) (io.Writer, func() error, error) {
+	if path == "" {
+		return io.Discard, func() error { return nil }, nil
+	}
+	if path == "-" {
+		return os.Stderr, func() error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
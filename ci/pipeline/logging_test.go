@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStageEventsAsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	rec := newStageRecorder(newLogger(&buf, logFormatJSON, logNormal))
+
+	_ = rec.measure("build", func() error { return nil })
+	_ = rec.measure("fmt", func() error { return errors.New("not formatted") })
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d events, want 4:\n%s", len(lines), buf.String())
+	}
+
+	var events []map[string]any
+	for _, line := range lines {
+		var ev map[string]any
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("event is not JSON: %q: %v", line, err)
+		}
+		events = append(events, ev)
+	}
+
+	if events[0]["msg"] != "stage started" || events[0]["stage"] != "build" {
+		t.Errorf("first event = %v", events[0])
+	}
+	if events[1]["status"] != "passed" || events[1]["duration"] == nil {
+		t.Errorf("build finished event = %v", events[1])
+	}
+	if events[3]["status"] != "failed" || events[3]["error"] != "not formatted" || events[3]["level"] != "ERROR" {
+		t.Errorf("fmt finished event = %v", events[3])
+	}
+}
+
+func TestValidateLogFormat(t *testing.T) {
+	for _, ok := range []string{logFormatText, logFormatJSON} {
+		if err := validateLogFormat(ok); err != nil {
+			t.Errorf("validateLogFormat(%q): %v", ok, err)
+		}
+	}
+	if err := validateLogFormat("xml"); err == nil {
+		t.Error("validateLogFormat accepted xml")
+	}
+}
+
+func TestPrintCheckOutput(t *testing.T) {
+	const output = "running 2 tests\ntest a ... ok\ntest b ... ok\n\ntest result: ok. 2 passed; 0 failed\n\n"
+	for level, want := range map[logLevel]string{
+		logQuiet:   "",
+		logNormal:  "Tests output: test result: ok. 2 passed; 0 failed\n",
+		logVerbose: "Tests output: " + output + "\n",
+	} {
+		var b strings.Builder
+		printCheckOutput(&b, level, "Tests output", output)
+		if b.String() != want {
+			t.Errorf("level %d printed %q, want %q", level, b.String(), want)
+		}
+	}
+}
+
+func TestQuietDropsDaggerLog(t *testing.T) {
+	opts, err := ParseOptions([]string{"-q"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.logLevel != logQuiet || opts.daggerLog != "" {
+		t.Errorf("logLevel, daggerLog = %d, %q, want quiet without a Dagger log", opts.logLevel, opts.daggerLog)
+	}
+
+	opts, err = ParseOptions([]string{"-quiet", "-dagger-log=dagger.log"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.daggerLog != "dagger.log" {
+		t.Errorf("daggerLog = %q, want the explicit file kept", opts.daggerLog)
+	}
+
+	if _, err := ParseOptions([]string{"-q", "-v"}, io.Discard); err == nil {
+		t.Error("-q with -v succeeded, want error")
+	}
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+	"github.com/BurntSushi/toml"
+)
+
+// cargoManifest is the subset of Cargo.toml the pipeline reads.
+type cargoManifest struct {
+	Package struct {
+		Name    string `toml:"name"`
+		Version string `toml:"version"`
+		// RustVersion is a version string, or a table when inherited
+		// with `rust-version.workspace = true`.
+		RustVersion any `toml:"rust-version"`
+	} `toml:"package"`
+	cargoDependencies
+	Target    map[string]cargoDependencies `toml:"target"`
+	Workspace struct {
+		Package struct {
+			RustVersion string `toml:"rust-version"`
+		} `toml:"package"`
+		Members      []string       `toml:"members"`
+		Exclude      []string       `toml:"exclude"`
+		Dependencies map[string]any `toml:"dependencies"`
+	} `toml:"workspace"`
+	// Profile holds the [profile.*] tables by profile name.
+	Profile map[string]any `toml:"profile"`
+}
+
+// cargoDependencies are the dependency tables of a manifest or of one of
+// its [target.*] sections. A dependency is a version string or a table.
+type cargoDependencies struct {
+	Dependencies      map[string]any `toml:"dependencies"`
+	DevDependencies   map[string]any `toml:"dev-dependencies"`
+	BuildDependencies map[string]any `toml:"build-dependencies"`
+}
+
+// rustVersion returns the minimum supported Rust version the manifest
+// declares, following workspace inheritance, or "" if there is none.
+func (m cargoManifest) rustVersion() string {
+	if version, ok := m.Package.RustVersion.(string); ok {
+		return version
+	}
+	return m.Workspace.Package.RustVersion
+}
+
+// registries returns the alternate registries dependencies are fetched
+// from, sorted. crates.io dependencies name no registry and are omitted.
+func (m cargoManifest) registries() []string {
+	seen := make(map[string]bool)
+	collect := func(deps map[string]any) {
+		for _, dep := range deps {
+			if table, ok := dep.(map[string]any); ok {
+				if name, ok := table["registry"].(string); ok {
+					seen[name] = true
+				}
+			}
+		}
+	}
+	sections := []cargoDependencies{m.cargoDependencies}
+	for _, target := range m.Target {
+		sections = append(sections, target)
+	}
+	for _, s := range sections {
+		collect(s.Dependencies)
+		collect(s.DevDependencies)
+		collect(s.BuildDependencies)
+	}
+	collect(m.Workspace.Dependencies)
+	return sortedKeys(seen)
+}
+
+// parseManifest decodes a Cargo.toml.
+func parseManifest(data []byte) (cargoManifest, error) {
+	var m cargoManifest
+	if err := toml.Unmarshal(data, &m); err != nil {
+		return cargoManifest{}, fmt.Errorf("parse Cargo.toml: %w", err)
+	}
+	return m, nil
+}
+
+// readManifest reads the root Cargo.toml of the project sources.
+func readManifest(ctx context.Context, src *dagger.Directory) (cargoManifest, error) {
+	contents, err := src.File("Cargo.toml").Contents(ctx)
+	if err != nil {
+		return cargoManifest{}, fmt.Errorf("read Cargo.toml: %w", err)
+	}
+	return parseManifest([]byte(contents))
+}
@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"dagger.io/dagger"
+)
+
+// matrixEntry is one toolchain and feature combination of the matrix.
+type matrixEntry struct {
+	label     string
+	toolchain string
+	opts      Options
+}
+
+// matrixEntries expands the toolchain and feature matrices into their
+// cross product. Either matrix may be empty, in which case the configured
+// toolchain or feature selection is used for every entry.
+func matrixEntries(opts Options) []matrixEntry {
+	toolchains := opts.matrix
+	if len(toolchains) == 0 {
+		toolchains = []string{opts.rustVersion}
+	}
+
+	var entries []matrixEntry
+	for _, toolchain := range toolchains {
+		if len(opts.featureMatrix) == 0 {
+			entries = append(entries, matrixEntry{label: "rust " + toolchain, toolchain: toolchain, opts: opts})
+			continue
+		}
+		for _, features := range opts.featureMatrix {
+			// each set is exact, so defaults only apply when listed
+			entryOpts := opts
+			entryOpts.features = features
+			entryOpts.noDefaultFeatures = true
+
+			label := "features " + strings.Join(features, ",")
+			if len(opts.matrix) > 0 {
+				label = "rust " + toolchain + ", " + label
+			}
+			entries = append(entries, matrixEntry{label: label, toolchain: toolchain, opts: entryOpts})
+		}
+	}
+	return entries
+}
+
+// runMatrix builds and tests every matrix entry concurrently, each in its
+// own container, prints a pass/fail table and fails if any entry failed.
+func runMatrix(ctx context.Context, client *dagger.Client, src *dagger.Directory, opts Options, rec *stageRecorder) error {
+	entries := matrixEntries(opts)
+	results := make(map[string]error, len(entries))
+
+	ctx, report, release := rec.concurrent(ctx)
+	defer release()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, entry := range entries {
+		wg.Add(1)
+		go func(entry matrixEntry) {
+			defer wg.Done()
+			name := "build+test (" + entry.label + ")"
+			err := rec.measureStage(ctx, name, func(ctx context.Context) error {
+				rust := withTestRunner(client, rustContainer(client, src, entry.toolchain, "", entry.opts), entry.opts)
+				return buildAndTest(ctx, rust, entry)
+			})
+			report(name, err)
+
+			mu.Lock()
+			results[entry.label] = err
+			mu.Unlock()
+		}(entry)
+	}
+	wg.Wait()
+
+	printMatrix(os.Stdout, entries, results)
+
+	var errs []error
+	for _, entry := range entries {
+		if err := results[entry.label]; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// buildAndTest compiles and tests one matrix entry. Failures are labeled
+// with the entry so the aggregated error says which one broke.
+func buildAndTest(ctx context.Context, rust *dagger.Container, entry matrixEntry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: panic: %v", entry.label, r)
+		}
+	}()
+
+	built, err := syncWithRetry(ctx, build(rust, entry.opts), entry.opts)
+	if err != nil {
+		return stageFailed(fmt.Sprintf("%s (%s)", stageBuild, entry.label), err)
+	}
+	if _, err := built.WithExec(testArgs(entry.opts)).Sync(ctx); err != nil {
+		return stageFailed(fmt.Sprintf("%s (%s)", stageTest, entry.label), err)
+	}
+	if entry.opts.doctests {
+		if _, err := built.WithExec(cargoDocTestArgs(entry.opts)).Sync(ctx); err != nil {
+			return stageFailed(fmt.Sprintf("%s (%s)", stageDoctest, entry.label), err)
+		}
+	}
+	return nil
+}
+
+// validateMatrix rejects what -matrix and -feature-matrix would otherwise
+// leave out without a word: they build and test every entry and do nothing
+// else. Without a stage selection the stages become build and test; any
+// other selection, check, export or publishing step is an error.
+func validateMatrix(opts *Options, stagesSet bool) error {
+	if len(opts.matrix) == 0 && len(opts.featureMatrix) == 0 {
+		return nil
+	}
+	matrixStages := map[string]bool{stageBuild: true, stageTest: true}
+	if stagesSet && !reflect.DeepEqual(opts.stages, matrixStages) {
+		return fmt.Errorf("-matrix and -feature-matrix always run the build and test stages, and only those; drop -stages and the -skip flags")
+	}
+	opts.stages = matrixStages
+
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"-platforms", len(opts.platforms) > 0},
+		{"-publish", opts.publish},
+		{"-release", opts.release},
+		{"-tarball", opts.tarball},
+		{"-provenance", opts.provenance},
+		{"-strip", opts.strip},
+		{"-pgo", opts.pgo},
+		{"-bench", opts.bench},
+	} {
+		if f.set {
+			return fmt.Errorf("-matrix and -feature-matrix do not support %s", f.name)
+		}
+	}
+	for _, c := range selectChecks(nil, *opts, nil, nil) {
+		if c.name != stageTest && c.name != stageDoctest {
+			return fmt.Errorf("-matrix and -feature-matrix do not support the %s check", c.name)
+		}
+	}
+	return nil
+}
+
+// printMatrix prints one row per entry in matrix order.
+func printMatrix(out io.Writer, entries []matrixEntry, results map[string]error) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MATRIX ENTRY\tRESULT")
+	for _, entry := range entries {
+		result := "pass"
+		var cancelledErr *cancelledError
+		switch err := results[entry.label]; {
+		case errors.As(err, &cancelledErr):
+			result = "CANCELLED"
+		case err != nil:
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", entry.label, result)
+	}
+	w.Flush()
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"dagger.io/dagger"
+)
+
+const stageMSRV = "msrv"
+
+// runMSRV builds the project on its minimum supported Rust version: the
+// explicit version if given, or the manifest's rust-version otherwise.
+func runMSRV(ctx context.Context, client *dagger.Client, rust *dagger.Container, version string, opts Options) (string, error) {
+	src := containerSources(rust)
+	version, err := msrvVersion(version, func() (cargoManifest, error) { return readManifest(ctx, src) })
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageMSRV, err)
+	}
+
+	msrv := rustContainer(client, src, version, "", opts)
+	if _, err := msrv.WithExec(cargoBuildArgs(opts)).Sync(ctx); err != nil {
+		var execErr *dagger.ExecError
+		if errors.As(err, &execErr) {
+			return "", &stageError{
+				stage:    stageMSRV,
+				exitCode: execErr.ExitCode,
+				stderr:   fmt.Sprintf("MSRV broken: the project no longer builds on Rust %s\n%s", version, execErr.Stderr),
+			}
+		}
+		return "", stageFailed(stageMSRV, err)
+	}
+	return fmt.Sprintf("builds on MSRV %s", version), nil
+}
+
+// msrvVersion returns the version to check: explicit when set, without
+// reading the manifest, and the manifest's rust-version otherwise.
+func msrvVersion(explicit string, manifest func() (cargoManifest, error)) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+	m, err := manifest()
+	if err != nil {
+		return "", err
+	}
+	version := m.rustVersion()
+	if version == "" {
+		return "", fmt.Errorf("Cargo.toml does not set rust-version; pass -msrv-version")
+	}
+	if err := validateRustVersion(version); err != nil {
+		return "", fmt.Errorf("Cargo.toml rust-version: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,48 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fixtureManifest reads a Cargo manifest from the testdata directory.
+func fixtureManifest(path string) func() (cargoManifest, error) {
+	return func() (cargoManifest, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cargoManifest{}, err
+		}
+		return parseManifest(data)
+	}
+}
+
+func TestMSRVVersion(t *testing.T) {
+	got, err := msrvVersion("", fixtureManifest("pipeline/testdata/msrv/Cargo.toml"))
+	if err != nil || got != "1.70" {
+		t.Errorf("msrvVersion = %q, %v, want 1.70", got, err)
+	}
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"pipeline/testdata/cargo/Cargo.toml", "does not set rust-version; pass -msrv-version"},
+		{"pipeline/testdata/msrv/Cargo-invalid.toml", "Cargo.toml rust-version:"},
+	} {
+		if _, err := msrvVersion("", fixtureManifest(tc.path)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("msrvVersion(%s) error = %v, want %q", tc.path, err, tc.want)
+		}
+	}
+
+	// -msrv-version wins without the manifest being read at all
+	for _, path := range []string{"pipeline/testdata/msrv/Cargo.toml", "pipeline/testdata/cargo/Cargo.toml"} {
+		if got, err := msrvVersion("1.74", fixtureManifest(path)); err != nil || got != "1.74" {
+			t.Errorf("msrvVersion(1.74, %s) = %q, %v, want 1.74", path, got, err)
+		}
+	}
+	unread := func() (cargoManifest, error) { return cargoManifest{}, errors.New("manifest read") }
+	if got, err := msrvVersion("1.74", unread); err != nil || got != "1.74" {
+		t.Errorf("msrvVersion(1.74) = %q, %v, want 1.74 without reading Cargo.toml", got, err)
+	}
+}
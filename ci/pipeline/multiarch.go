@@ -0,0 +1,142 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// craneImage inspects published manifests. The image has no shell, so its
+// entrypoint, crane, runs the commands.
+const craneImage = "gcr.io/go-containerregistry/crane:v0.19.1"
+
+// platformBinary returns the binary runPlatformBuilds exported for p.
+func platformBinary(client *dagger.Client, p dagger.Platform) *dagger.File {
+	return client.Host().File(filepath.Join(buildDir, platformDir(p), "merlin"))
+}
+
+// archTag returns the per-platform tag a platform image of ref is pushed
+// to before the manifest list, e.g. ghcr.io/awdemos/merlin:latest-linux-arm64.
+func archTag(ref string, p dagger.Platform) string {
+	repo, tag := ref, "latest"
+	// a colon after the last slash starts the tag; one before it is a port
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repo, tag = ref[:i], ref[i+1:]
+	}
+	return repo + ":" + tag + "-" + platformDir(p)
+}
+
+// manifestList is the part of an OCI image index or Docker manifest list
+// the verification reads.
+type manifestList struct {
+	Manifests []struct {
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// manifestPlatforms returns the platforms in a manifest list, as os/arch
+// or os/arch/variant.
+func manifestPlatforms(data string) ([]string, error) {
+	var list manifestList
+	if err := json.Unmarshal([]byte(data), &list); err != nil {
+		return nil, fmt.Errorf("parse manifest list: %w", err)
+	}
+	var platforms []string
+	for _, m := range list.Manifests {
+		p := m.Platform.OS + "/" + m.Platform.Architecture
+		if m.Platform.Variant != "" {
+			p += "/" + m.Platform.Variant
+		}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// missingPlatforms returns the requested platforms a manifest list lacks.
+func missingPlatforms(requested []dagger.Platform, found []string) []string {
+	present := make(map[string]bool, len(found))
+	for _, p := range found {
+		present[p] = true
+	}
+	var missing []string
+	for _, p := range requested {
+		if !present[string(p)] {
+			missing = append(missing, string(p))
+		}
+	}
+	return missing
+}
+
+// publishMultiArch publishes one runtime image per platform in
+// opts.platforms, from the binaries runPlatformBuilds exported, each to
+// its archTag, then the manifest list combining them to opts.imageRef. It
+// returns the manifest list's reference including its digest once
+// verifyManifest found every platform in it.
+func publishMultiArch(ctx context.Context, client *dagger.Client, sbom *dagger.File, opts Options) (string, error) {
+	images := make([]*dagger.Container, len(opts.platforms))
+	errs := make([]error, len(opts.platforms))
+	var wg sync.WaitGroup
+	for i, p := range opts.platforms {
+		images[i] = opts.registryAuth.apply(client, runtimeImageFor(client, p, platformBinary(client, p), sbom))
+		wg.Add(1)
+		go func(i int, p dagger.Platform) {
+			defer wg.Done()
+			if _, err := images[i].Publish(ctx, archTag(opts.imageRef, p)); err != nil {
+				errs[i] = stageFailed(fmt.Sprintf("%s (%s)", stagePublish, p), err)
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+
+	digest, err := opts.registryAuth.apply(client, client.Container()).
+		Publish(ctx, opts.imageRef, dagger.ContainerPublishOpts{PlatformVariants: images})
+	if err != nil {
+		return "", stageFailed(stagePublish, err)
+	}
+	if err := verifyManifest(ctx, client, digest, opts); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// verifyManifest fetches the manifest list at ref with crane, which reads
+// the same Docker config as cosign, and fails unless it has an image for
+// every platform in opts.platforms.
+func verifyManifest(ctx context.Context, client *dagger.Client, ref string, opts Options) error {
+	config := client.SetSecret("crane-docker-config", dockerConfig(opts.registryAuth))
+	out, err := client.Container().
+		From(craneImage).
+		WithEnvVariable("DOCKER_CONFIG", "/docker-config").
+		WithMountedSecret("/docker-config/config.json", config).
+		WithExec([]string{"manifest", ref}).
+		Stdout(ctx)
+	if err != nil {
+		return stageFailed(stagePublish+" (verify)", err)
+	}
+	found, err := manifestPlatforms(out)
+	if err != nil {
+		return fmt.Errorf("%s: %w", stagePublish, err)
+	}
+	if missing := missingPlatforms(opts.platforms, found); len(missing) > 0 {
+		return &stageError{
+			stage:    stagePublish,
+			exitCode: 1,
+			stderr:   fmt.Sprintf("manifest list %s lacks %s (has %s)", ref, strings.Join(missing, ", "), strings.Join(found, ", ")),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestArchTag(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"ghcr.io/awdemos/merlin:v1.2.0", "ghcr.io/awdemos/merlin:v1.2.0-linux-arm64"},
+		{"ghcr.io/awdemos/merlin", "ghcr.io/awdemos/merlin:latest-linux-arm64"},
+		{"localhost:5000/merlin", "localhost:5000/merlin:latest-linux-arm64"},
+		{"localhost:5000/merlin:dev", "localhost:5000/merlin:dev-linux-arm64"},
+	}
+	for _, tt := range tests {
+		if got := archTag(tt.ref, "linux/arm64"); got != tt.want {
+			t.Errorf("archTag(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestManifestPlatforms(t *testing.T) {
+	const index = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {"digest": "sha256:aaa", "platform": {"architecture": "amd64", "os": "linux"}},
+    {"digest": "sha256:bbb", "platform": {"architecture": "arm", "os": "linux", "variant": "v7"}}
+  ]
+}`
+	found, err := manifestPlatforms(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"linux/amd64", "linux/arm/v7"}; !reflect.DeepEqual(found, want) {
+		t.Errorf("manifestPlatforms = %q, want %q", found, want)
+	}
+
+	requested := []dagger.Platform{"linux/amd64", "linux/arm64", "linux/arm/v7"}
+	if got, want := missingPlatforms(requested, found), []string{"linux/arm64"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("missingPlatforms = %q, want %q", got, want)
+	}
+
+	if _, err := manifestPlatforms("not json"); err == nil {
+		t.Error("manifestPlatforms of garbage succeeded, want error")
+	}
+}
+
+func TestPublishPlatforms(t *testing.T) {
+	t.Setenv(registryPasswordEnv, "hunter2")
+	opts, err := ParseOptions([]string{"-publish", "-image-ref=ghcr.io/awdemos/merlin:latest", "-registry-user=ci", "-platforms=linux/amd64,linux/arm64"}, io.Discard)
+	if err != nil {
+		t.Fatalf("-publish with -platforms: %v", err)
+	}
+	if len(opts.platforms) != 2 {
+		t.Errorf("platforms = %v", opts.platforms)
+	}
+}
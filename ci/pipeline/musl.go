@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageMusl  = "musl"
+	muslTarget = "x86_64-unknown-linux-musl"
+)
+
+// muslPlatform is the platform the musl target produces binaries for. The
+// build runs there so that musl-gcc links for the right architecture on any
+// host.
+const muslPlatform dagger.Platform = "linux/amd64"
+
+// muslOut is where the static binary is exported.
+var muslOut = filepath.Join(buildDir, muslTarget)
+
+// isStaticBinary reports whether `file` describes a statically linked
+// executable. Static PIE binaries, which rustc produces for musl by
+// default, are reported as "static-pie linked".
+func isStaticBinary(fileOutput string) bool {
+	if strings.Contains(fileOutput, "dynamically linked") {
+		return false
+	}
+	return strings.Contains(fileOutput, "statically linked") || strings.Contains(fileOutput, "static-pie linked")
+}
+
+// runMuslBuild builds a fully static binary for the musl target, checks
+// that it has no dynamic dependencies and registers it for export to
+// muslOut.
+func runMuslBuild(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options, reg *artifactRegistry) (string, error) {
+	built, err := syncWithRetry(ctx, rustContainer(client, containerSources(rust), opts.rustVersion, muslPlatform, opts).
+		WithExec([]string{"sh", "-c", "apt-get update && apt-get install -y --no-install-recommends musl-tools file && rm -rf /var/lib/apt/lists/*"}).
+		WithExec([]string{"rustup", "target", "add", muslTarget}).
+		WithExec(cargoBuildArgs(opts, "--target", muslTarget)).
+		WithExec([]string{"install", "-D", binaryPath(opts, muslTarget), "/musl/merlin"}), opts)
+	if err != nil {
+		return "", stageFailed(stageMusl, err)
+	}
+
+	described, err := execOutput(ctx, built.WithExec([]string{"file", "/musl/merlin"}))
+	if err != nil {
+		return "", stageFailed(stageMusl, err)
+	}
+	if !isStaticBinary(described) {
+		return "", &stageError{stage: stageMusl, exitCode: 1, stderr: "binary is not statically linked: " + strings.TrimSpace(described)}
+	}
+
+	reg.registerFile(stageMusl, artifactBinary, filepath.Join(muslOut, "merlin"), built.File("/musl/merlin"))
+	return fmt.Sprintf("%s\nstatic binary exported to %s", described, filepath.Join(muslOut, "merlin")), nil
+}
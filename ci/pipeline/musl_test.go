@@ -0,0 +1,23 @@
+package pipeline
+
+import "testing"
+
+func TestIsStaticBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want bool
+	}{
+		{"static", "/musl/merlin: ELF 64-bit LSB executable, x86-64, version 1 (SYSV), statically linked, stripped", true},
+		{"static pie", "/musl/merlin: ELF 64-bit LSB pie executable, x86-64, version 1 (SYSV), static-pie linked, not stripped", true},
+		{"dynamic", "/musl/merlin: ELF 64-bit LSB pie executable, x86-64, version 1 (SYSV), dynamically linked, interpreter /lib64/ld-linux-x86-64.so.2", false},
+		{"not elf", "/musl/merlin: ASCII text", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStaticBinary(tt.file); got != tt.want {
+				t.Errorf("isStaticBinary(%q) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
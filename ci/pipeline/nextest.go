@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// test runners selectable with -test-runner
+const (
+	testRunnerCargo   = "cargo"
+	testRunnerNextest = "nextest"
+)
+
+// nextestConfigPath holds the pipeline's nextest profile. It is passed as a
+// tool config so a .config/nextest.toml in the project still applies.
+const nextestConfigPath = "/merlin-ci/nextest.toml"
+
+// nextestConfig defines the ci profile: run every test rather than stop at
+// the first failure, and write a JUnit report to nextestJUnitPath.
+const nextestConfig = `[profile.ci]
+fail-fast = false
+
+[profile.ci.junit]
+path = "junit.xml"
+`
+
+// nextestJUnitPath is where the ci profile's report lands, relative to /src.
+const nextestJUnitPath = "target/nextest/ci/junit.xml"
+
+// nextestReportMarker precedes the JUnit report nextestRun prints to
+// stdout when the tests fail.
+const nextestReportMarker = "--- merlin nextest junit report ---"
+
+// validateTestRunner checks the -test-runner flag.
+func validateTestRunner(runner string) error {
+	switch runner {
+	case testRunnerCargo, testRunnerNextest:
+		return nil
+	}
+	return fmt.Errorf("invalid -test-runner %q (valid: %s, %s)", runner, testRunnerCargo, testRunnerNextest)
+}
+
+// withTestRunner installs the selected test runner into rust when it does
+// not ship with cargo.
+func withTestRunner(client *dagger.Client, rust *dagger.Container, opts Options) *dagger.Container {
+	if opts.testRunner != testRunnerNextest {
+		return rust
+	}
+	return withCargoTool(client, rust, "cargo-nextest").
+		WithNewFile(nextestConfigPath, dagger.ContainerWithNewFileOpts{Contents: nextestConfig})
+}
+
+// testArgs returns the command that runs the test suite with the selected
+// runner.
+func testArgs(opts Options) []string {
+	if opts.testRunner == testRunnerNextest {
+		return nextestArgs(opts)
+	}
+	return cargoTestArgs(opts)
+}
+
+// nextestArgs returns the nextest command for opts using the ci profile.
+func nextestArgs(opts Options) []string {
+	args := []string{"cargo", "nextest", "run", "--profile", "ci", "--tool-config-file", "merlin-ci:" + nextestConfigPath}
+	args = append(args, workspaceArgs(opts)...)
+	args = append(append(args, featureArgs(opts)...), lockArgs(opts)...)
+	// nextest names cargo's --jobs --build-jobs
+	if opts.jobs > 0 {
+		args = append(args, "--build-jobs", strconv.Itoa(opts.jobs))
+	}
+	args = append(args, testThreadsArgs(opts)...)
+	// nextest only retries tests that ran, never a failed build
+	if opts.flakyRetries > 0 {
+		args = append(args, "--retries", strconv.Itoa(opts.flakyRetries))
+	}
+	return append(args, opts.cargoTestArgs...)
+}
+
+// runNextestJUnit runs the tests with nextest and copies its JUnit report
+// to opts.junitOut, including when tests fail. It also returns the tests
+// the report shows passed on a retry.
+func runNextestJUnit(ctx context.Context, rust *dagger.Container, opts Options) (string, []FlakyTest, error) {
+	data, output, err := nextestRun(ctx, rust, opts, stageTest)
+	if data == "" {
+		return "", nil, err
+	}
+	report, reportErr := parseJUnit([]byte(data))
+	if reportErr == nil {
+		reportErr = writeReport(opts.junitOut, []byte(data))
+	}
+	flaky := junitFlaky(report)
+	if err != nil {
+		return "", flaky, err
+	}
+	if reportErr != nil {
+		return "", nil, fmt.Errorf("%s: junit report: %w", stageTest, reportErr)
+	}
+
+	return output + "\n" + fmt.Sprintf("%d tests, %d failed, %d ignored (JUnit report written to %s)",
+		report.Tests, report.Failures, report.Skipped, opts.junitOut), flaky, nil
+}
+
+// nextestRun runs nextest with the ci profile and extra arguments, and
+// returns the JUnit report it wrote. The report is also returned when tests
+// fail, alongside the stage error for stage.
+func nextestRun(ctx context.Context, rust *dagger.Container, opts Options, stage string, extra ...string) (string, string, error) {
+	// the report is written into the target cache mount, which cannot be
+	// read back directly, so copy it out. A failing exec leaves no
+	// container to read it from, so then it is printed after
+	// nextestReportMarker instead. Exiting with nextest's status keeps the
+	// engine from caching a failed run as a successful one.
+	script := `mkdir -p /nextest; "$@"; status=$?; cp ` + nextestJUnitPath + ` /nextest/junit.xml 2>/dev/null
+if [ $status -ne 0 ]; then echo '` + nextestReportMarker + `'; cat /nextest/junit.xml 2>/dev/null; fi
+exit $status`
+	args := append(nextestArgs(opts), extra...)
+	ran, err := rust.WithExec(append([]string{"sh", "-c", script, "sh"}, args...)).Sync(ctx)
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		stdout, report, _ := strings.Cut(execErr.Stdout, nextestReportMarker)
+		return strings.TrimSpace(report), "", &stageError{
+			stage:    stage,
+			exitCode: execErr.ExitCode,
+			stderr:   execErr.Stderr,
+			stdout:   strings.TrimSpace(stdout),
+			killed:   oomKilled(execErr.ExitCode, execErr.Stderr),
+		}
+	} else if err != nil {
+		return "", "", stageFailed(stage, err)
+	}
+	output, err := execOutput(ctx, ran)
+	if err != nil {
+		return "", "", stageFailed(stage, err)
+	}
+
+	data, err := ran.File("/nextest/junit.xml").Contents(ctx)
+	if err == nil && data == "" {
+		err = fmt.Errorf("%s is empty", nextestJUnitPath)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("%s: junit report: %w", stage, err)
+	}
+	return data, output, nil
+}
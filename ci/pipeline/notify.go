@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds the webhook request so a slow endpoint cannot hold
+// up the end of the run.
+const notifyTimeout = 10 * time.Second
+
+// buildNotification renders result as a webhook payload. The text field
+// is what Slack incoming webhooks display; the other fields are for
+// generic webhook consumers.
+func buildNotification(result RunResult) []byte {
+	type stage struct {
+		Name            string  `json:"name"`
+		Status          string  `json:"status"`
+		DurationSeconds float64 `json:"duration_seconds"`
+	}
+	payload := struct {
+		Text            string  `json:"text"`
+		Status          string  `json:"status"`
+		Ref             string  `json:"ref,omitempty"`
+		DurationSeconds float64 `json:"duration_seconds"`
+		Stages          []stage `json:"stages"`
+		Error           string  `json:"error,omitempty"`
+	}{
+		Status:          result.Status,
+		Ref:             result.Ref,
+		DurationSeconds: result.Duration.Seconds(),
+		Stages:          []stage{},
+		Error:           result.Error,
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "merlin CI %s", result.Status)
+	if result.Ref != "" {
+		fmt.Fprintf(&text, " on %s", result.Ref)
+	}
+	fmt.Fprintf(&text, " in %s", result.Duration.Round(time.Second))
+	for _, s := range result.Stages {
+		payload.Stages = append(payload.Stages, stage{Name: s.Name, Status: s.Status, DurationSeconds: s.Duration.Seconds()})
+		fmt.Fprintf(&text, "\n• %s: %s (%s)", s.Name, s.Status, s.Duration.Round(time.Millisecond))
+	}
+	payload.Text = text.String()
+
+	// the payload only holds strings and numbers, so this cannot fail
+	data, _ := json.Marshal(payload)
+	return data
+}
+
+// validateWebhook checks that the -notify-webhook URL can be posted to.
+func validateWebhook(webhook string) error {
+	if webhook == "" {
+		return nil
+	}
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -notify-webhook %q: expected an http(s) URL", webhook)
+	}
+	return nil
+}
+
+// notify POSTs the run result to a webhook.
+func notify(ctx context.Context, webhook string, result RunResult) error {
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(buildNotification(result)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: notifyTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// buildRef describes the git ref being built: the ref of -git-url, or the
+// branch or commit checked out in the -source directory.
+func buildRef(opts Options) string {
+	if opts.gitURL != "" {
+		return opts.gitURL + "@" + opts.gitRef
+	}
+	head, err := os.ReadFile(filepath.Join(opts.source, ".git", "HEAD"))
+	if err != nil {
+		return ""
+	}
+	return parseGitHead(string(head))
+}
+
+// parseGitHead returns the branch named by a .git/HEAD file, or the commit
+// it holds when HEAD is detached.
+func parseGitHead(head string) string {
+	head = strings.TrimSpace(head)
+	if ref, ok := strings.CutPrefix(head, "ref: "); ok {
+		return strings.TrimPrefix(ref, "refs/heads/")
+	}
+	return head
+}
@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildNotification(t *testing.T) {
+	result := newRunResult([]stageTiming{
+		{Name: stageBuild, Duration: 90 * time.Second},
+		{Name: stageTest, Duration: 1500 * time.Millisecond, Failed: true},
+	}, 2*time.Minute, "main", errors.New("test failed with exit code 101"))
+
+	var got map[string]any
+	if err := json.Unmarshal(buildNotification(result), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"text":             "merlin CI failed on main in 2m0s\n• build: passed (1m30s)\n• test: failed (1.5s)",
+		"status":           "failed",
+		"ref":              "main",
+		"duration_seconds": 120.0,
+		"stages": []any{
+			map[string]any{"name": "build", "status": "passed", "duration_seconds": 90.0},
+			map[string]any{"name": "test", "status": "failed", "duration_seconds": 1.5},
+		},
+		"error": "test failed with exit code 101",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildNotification =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer srv.Close()
+
+	if err := notify(context.Background(), srv.URL, RunResult{Status: statusPassed}); err != nil {
+		t.Fatal(err)
+	}
+	if body["status"] != statusPassed {
+		t.Errorf("posted status = %v, want %s", body["status"], statusPassed)
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if err := notify(context.Background(), srv.URL, RunResult{Status: statusPassed}); err == nil {
+		t.Error("notify succeeded against a failing webhook")
+	}
+}
+
+func TestParseGitHead(t *testing.T) {
+	if got := parseGitHead("ref: refs/heads/feature/tls\n"); got != "feature/tls" {
+		t.Errorf("parseGitHead(branch) = %q", got)
+	}
+	const commit = "4d89438a1f6f0d3c1e9c9d7b3f0c8e2a5b6d7e8f"
+	if got := parseGitHead(commit + "\n"); got != commit {
+		t.Errorf("parseGitHead(detached) = %q", got)
+	}
+}
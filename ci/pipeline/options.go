@@ -0,0 +1,838 @@
+package pipeline
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// stage names in the order the pipeline runs them
+const (
+	stageBuild  = "build"
+	stageTest   = "test"
+	stageClippy = "clippy"
+	stageFmt    = "fmt"
+)
+
+var allStages = []string{stageBuild, stageTest, stageClippy, stageFmt}
+
+// defaultSource is the project root relative to the ci directory, where
+// the pipeline is run from.
+const defaultSource = ".."
+
+// defaultRustVersion is the toolchain image tag used when none is configured.
+const defaultRustVersion = "1.75"
+
+// rustVersionEnv overrides the default toolchain; -rust-version wins over it.
+const rustVersionEnv = "MERLIN_RUST_VERSION"
+
+var rustVersionPattern = regexp.MustCompile(`^\d+\.\d+(\.\d+)?$`)
+
+// Options holds the resolved configuration. Command line flags take
+// precedence over the environment, which takes precedence over the config
+// file, which takes precedence over the built-in defaults. Options are only
+// built by ParseOptions, so a Pipeline never runs an unvalidated one.
+type Options struct {
+	dryRun bool
+	check  bool
+	// benchCache times a cold and a warm build instead of running the
+	// pipeline; see runCacheBench
+	benchCache bool
+	// preconditions are the requirements of the enabled features, such
+	// as their credentials, which -check lists rather than failing on
+	preconditions []precondition
+	watch         bool
+	logLevel      logLevel
+	stages        map[string]bool
+	source        string
+	gitURL        string
+	gitRef        string
+	gitSubpath    string
+	submodules    bool
+	// sourceExcludes are the patterns left out of the -source upload; see
+	// loadSourceFilter
+	sourceExcludes []string
+	rustVersion    string
+	baseImage      string
+	// baseRegistryAuth pulls baseImage when complete
+	baseRegistryAuth registryAuth
+	aptPackages      []string
+	config           Config
+	// configFile is the config file read, or "" when there was none
+	configFile  string
+	cachePrefix string
+	lockKey     string
+	cacheExport string
+	cacheImport string
+	noCache     bool
+	matrix      []string
+	platforms   []dagger.Platform
+
+	features          []string
+	noDefaultFeatures bool
+	featureMatrix     [][]string
+
+	testRunner string
+	shards     int
+	doctests   bool
+	// flakyRetries reruns failing tests before the test stage fails
+	flakyRetries int
+
+	// zero leaves cargo and the test harness one job or thread per CPU
+	jobs        int
+	testThreads int
+	// cpu and memory bound jobs and testThreads; see applyResourceLimits
+	cpu    int
+	memory int64
+
+	// profile is the cargo profile the binary is built with
+	profile string
+
+	// appended to the cargo build and test commands
+	cargoBuildArgs []string
+	cargoTestArgs  []string
+	locked         bool
+	prefetch       bool
+	verifyLock     bool
+
+	// workspace members to build and test; see workspaceArgs
+	packages  []string
+	workspace bool
+	exclude   []string
+	// onlyChanged narrows packages to the members changed since baseRef
+	onlyChanged bool
+	baseRef     string
+	junit       bool
+	junitOut    string
+
+	sccache         bool
+	sccacheBackend  string
+	sccacheBucket   string
+	sccacheRegion   string
+	sccacheEndpoint string
+
+	integration bool
+	musl        bool
+
+	msrv        bool
+	msrvVersion string
+
+	udeps       bool
+	udepsStrict bool
+
+	sanitizer string
+
+	sbom       bool
+	sbomOut    string
+	sbomFormat string
+
+	deny      bool
+	denyAllow map[string]bool
+
+	audit         bool
+	auditSeverity string
+
+	pgo         bool
+	pgoWorkload string
+	pgoRefresh  bool
+
+	bench          bool
+	benchOut       string
+	benchBaseline  string
+	benchThreshold float64
+
+	coverage    bool
+	coverageOut string
+	coverageMin float64
+
+	// coverageDiff gates the coverage of the lines changed since baseRef
+	coverageDiff     bool
+	coverageBase     string
+	coveragePatchMin float64
+
+	smoke     bool
+	smokeArgs []string
+
+	// verifyAssets checks the release binary for its embedded assets; see
+	// runVerifyAssets
+	verifyAssets       bool
+	assetMarkers       []string
+	assetVerifyCommand string
+
+	docs       bool
+	docsOut    string
+	docsStrict bool
+
+	logFormat   string
+	annotations bool
+	daggerLog   string
+	logFile     string
+
+	retries      int
+	retryBackoff time.Duration
+
+	// zero disables either deadline
+	timeout      time.Duration
+	stageTimeout time.Duration
+	// failFast cancels the concurrent stages left once one fails
+	failFast bool
+	// skipUnchanged skips the stages whose inputs match their last passing
+	// run, unless force is set; see resultCache
+	skipUnchanged bool
+	force         bool
+
+	clippyFix bool
+	// clippyPolicy replaces -D warnings when set
+	clippyPolicy *clippyPolicy
+	fmtFix       bool
+	fixOut       string
+	fixInplace   bool
+
+	strip bool
+
+	// warningsReport writes warnings.json; maxWarnings < 0 is no budget
+	warningsReport bool
+	maxWarnings    int
+	checksums      bool
+	tarball        bool
+
+	notifyWebhook string
+	summaryOut    string
+
+	release     bool
+	releaseTag  string
+	githubRepo  string
+	githubToken string
+
+	cargoRegistry cargoRegistry
+
+	env       []envVar
+	secretEnv []envVar
+
+	publish      bool
+	imageRef     string
+	registryAuth registryAuth
+
+	provenance    bool
+	provenanceOut string
+
+	sign        bool
+	signKeyless bool
+
+	s3Bucket   string
+	s3Prefix   string
+	s3Endpoint string
+	s3Region   string
+}
+
+// enabled reports whether the named stage was selected.
+func (o Options) enabled(stage string) bool {
+	return o.stages[stage]
+}
+
+// ParseOptions parses the command line arguments, without the program
+// name. It validates everything up front so a typo fails before any
+// container work starts.
+func ParseOptions(args []string, output io.Writer) (Options, error) {
+	var (
+		opts                                   Options
+		configPath                             string
+		stages, matrix, platforms              string
+		features, featureMatrix, smokeArgs     string
+		assetMarkers, memory                   string
+		registryUser, registryAddr             string
+		baseRegistryUser                       string
+		baseRegistryAnonymous                  bool
+		skipBuild, skipTest, skipLint, skipFmt bool
+		quiet, verbose                         bool
+		envFile, annotations, doctests         string
+		cargoBuildArgs, cargoTestArgs          string
+		env, secretEnv, packages, exclude      listFlag
+		aptPackages                            listFlag
+		excludePaths, includePaths             listFlag
+	)
+
+	fs := flag.NewFlagSet("merlin-ci", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	fs.StringVar(&configPath, "config", defaultConfigPath, "pipeline config file; a missing default file is ignored")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "print the resolved plan and exit without connecting to Dagger")
+	fs.BoolVar(&opts.benchCache, "bench-cache", false, "build twice, with empty and then with reused throwaway caches, print the durations and speedup and exit (the real caches are untouched)")
+	fs.BoolVar(&opts.check, "check", false, "check the flags, config file, credentials and packages, print a checklist and exit without building")
+	fs.BoolVar(&opts.watch, "watch", false, "rerun the pipeline whenever a .rs file, Cargo.toml or Cargo.lock under -source changes")
+	fs.StringVar(&opts.source, "source", defaultSource, "host directory of the project to build")
+	fs.Var(&excludePaths, "exclude-paths", "-source paths to leave out of the build context, comma-separated .dockerignore patterns (repeatable; target, .git and build always are)")
+	fs.Var(&includePaths, "include-paths", "-source paths to upload even though an exclude pattern or "+ignoreFile+" matches them, comma-separated (repeatable)")
+	fs.StringVar(&opts.gitURL, "git-url", "", "build this git repository instead of the -source directory")
+	fs.StringVar(&opts.gitRef, "git-ref", defaultGitRef, "branch, tag or commit of -git-url to build")
+	fs.StringVar(&opts.gitSubpath, "git-subpath", "", "directory of the project within -git-url, for monorepos")
+	fs.BoolVar(&opts.submodules, "submodules", false, "check out the git submodules of the -source working tree before building (-git-url always does)")
+	fs.StringVar(&stages, "stages", strings.Join(allStages, ","), "comma-separated list of stages to run ("+strings.Join(allStages, ", ")+")")
+	fs.BoolVar(&skipBuild, "skip-build", false, "skip the release build and export")
+	fs.BoolVar(&skipTest, "skip-test", false, "skip cargo test")
+	fs.BoolVar(&skipLint, "skip-lint", false, "skip cargo clippy")
+	fs.BoolVar(&skipFmt, "skip-fmt", false, "skip the cargo fmt check")
+	fs.BoolVar(&quiet, "quiet", false, "print only failures and the final summary, without Dagger's progress output")
+	fs.BoolVar(&quiet, "q", false, "shorthand for -quiet")
+	fs.BoolVar(&verbose, "verbose", false, "print debug events and the full output of every stage")
+	fs.BoolVar(&verbose, "v", false, "shorthand for -verbose")
+	fs.StringVar(&opts.logFormat, "log-format", logFormatText, "format of pipeline log events on stderr (text|json)")
+	fs.StringVar(&annotations, "annotations", annotationsAuto, "print GitHub Actions annotations for build, clippy, fmt and test failures (auto|on|off; auto when $GITHUB_ACTIONS is true)")
+	fs.StringVar(&opts.daggerLog, "dagger-log", "-", "file for Dagger's progress output, or - for stderr")
+	fs.StringVar(&opts.logFile, "log-file", "", "also write the pipeline's events, its printed output and Dagger's progress output, with every container command's stdout and stderr, to this file (JSON lines with -log-format=json)")
+	fs.StringVar(&opts.rustVersion, "rust-version", defaultRustVersion, "rust toolchain image tag (overrides $"+rustVersionEnv+")")
+	fs.StringVar(&opts.baseImage, "base-image", "", "image to build in instead of rust:<rust-version>, e.g. one with native libraries installed")
+	fs.StringVar(&baseRegistryUser, "base-registry-user", "", "username for the registry of -base-image (password from $"+baseRegistryPasswordEnv+")")
+	fs.BoolVar(&baseRegistryAnonymous, "base-registry-anonymous", false, "pull a -base-image outside Docker Hub without credentials, as it is public")
+	fs.Var(&aptPackages, "apt-packages", "Debian packages to install into the build image, comma-separated (repeatable)")
+	fs.StringVar(&opts.cachePrefix, "cache-prefix", "", "prefix for cache volume names, to isolate caches per branch")
+	fs.BoolVar(&opts.noCache, "no-cache", false, "do not mount the cargo registry and target caches")
+	fs.StringVar(&opts.cacheExport, "cache-export", "", "write the cache volumes to this tarball at the end of the run, e.g. to keep as a CI artifact")
+	fs.StringVar(&opts.cacheImport, "cache-import", "", "restore the cache volumes from a -cache-export tarball before the run; a missing or corrupt file means a cold cache")
+	fs.StringVar(&matrix, "matrix", "", "comma-separated toolchains to build and test against concurrently, e.g. 1.70,1.75,stable")
+	fs.StringVar(&platforms, "platforms", "", "comma-separated platforms to build release binaries for, e.g. linux/amd64,linux/arm64")
+	fs.StringVar(&features, "features", "", "comma-separated cargo features to build and test with")
+	fs.BoolVar(&opts.noDefaultFeatures, "no-default-features", false, "build and test without the default features")
+	fs.StringVar(&featureMatrix, "feature-matrix", "", "semicolon-separated feature sets to build and test concurrently, e.g. default;full;minimal (each set is exact: default features apply only when listed)")
+	fs.Var(&env, "env", "KEY=VALUE to set in the build container; repeatable, overrides -env-file")
+	fs.StringVar(&envFile, "env-file", "", "file of KEY=VALUE lines to set in the build container")
+	fs.Var(&secretEnv, "secret-env", "name of a variable to pass from the environment into the build container as a secret; repeatable")
+	fs.StringVar(&opts.cargoRegistry.index, "registry-index", "", "index URL of a private cargo registry, e.g. sparse+https://crates.example.com/index/ (token from $"+cargoRegistryTokenEnv+")")
+	fs.StringVar(&opts.cargoRegistry.name, "registry-name", defaultCargoRegistryName, "name Cargo.toml uses for the -registry-index registry")
+	fs.StringVar(&opts.testRunner, "test-runner", testRunnerCargo, "test runner (cargo|nextest); either way doctests run as their own stage")
+	fs.Var(&packages, "package", "workspace member to build and test, passed to cargo as -p (repeatable)")
+	fs.BoolVar(&opts.workspace, "workspace", false, "build and test every workspace member instead of the default members")
+	fs.Var(&exclude, "exclude", "workspace member to leave out with -workspace (repeatable)")
+	fs.BoolVar(&opts.onlyChanged, "only-changed", false, "build and test only the workspace members changed since -base-ref, and their dependents")
+	fs.StringVar(&opts.baseRef, "base-ref", defaultBaseRef, "git ref -only-changed and -coverage-diff diff HEAD against")
+	fs.StringVar(&cargoBuildArgs, "cargo-build-args", "", "extra arguments for cargo build, split like a shell would, e.g. '--timings'")
+	fs.StringVar(&opts.profile, "profile", defaultProfile, "cargo profile to build with, e.g. dist for a [profile.dist] in Cargo.toml; the binary is read from target/<profile>/ (target/debug/ for dev)")
+	fs.StringVar(&cargoTestArgs, "cargo-test-args", "", "extra arguments for the test command, split like a shell would, e.g. '-- --skip \"slow test\"'")
+	fs.BoolVar(&opts.locked, "locked", false, "pass --locked to every cargo command, failing when Cargo.lock is out of date")
+	fs.BoolVar(&opts.verifyLock, "verify-lock", false, "fail when Cargo.lock is missing or would change, listing the dependencies that differ")
+	fs.BoolVar(&opts.prefetch, "prefetch", false, "download the dependencies and compile the tests in a prefetch stage before the build")
+	fs.StringVar(&doctests, "doctests", doctestsOn, "run the doc examples as a separate doctest stage alongside the tests (on|off)")
+	fs.IntVar(&opts.shards, "shards", 1, "split the tests across this many parallel containers (uses nextest)")
+	fs.IntVar(&opts.jobs, "jobs", 0, "parallel jobs for cargo, passed as --jobs and $CARGO_BUILD_JOBS (default: one per CPU); concurrent checks each run their own cargo")
+	fs.IntVar(&opts.cpu, "cpu", 0, "CPUs the build may use: sets -jobs and -test-threads unless given (the engine cannot pin CPUs)")
+	fs.StringVar(&memory, "memory", "", "memory the build may use, e.g. 8g: caps -jobs at one per 2 GiB unless -jobs is given, and reports the build's peak use (the engine cannot enforce it)")
+	fs.IntVar(&opts.testThreads, "test-threads", 0, "threads each test binary runs its tests on, passed as --test-threads (default: one per CPU)")
+	fs.IntVar(&opts.flakyRetries, "flaky-retries", 0, "rerun failing tests up to this many times before the test stage fails, reporting those that pass as flaky")
+	fs.BoolVar(&opts.junit, "junit", false, "write a JUnit report of the test run")
+	fs.StringVar(&opts.junitOut, "junit-out", defaultJUnitOut, "host path of the JUnit report (implies -junit)")
+	fs.BoolVar(&opts.audit, "audit", false, "scan dependencies for RUSTSEC advisories with cargo audit")
+	fs.StringVar(&opts.auditSeverity, "audit-severity", "low", "lowest advisory severity that fails the audit ("+strings.Join(severities, "|")+")")
+	fs.BoolVar(&opts.sccache, "sccache", false, "compile through sccache, sharing a compiler cache across branches and toolchains")
+	fs.StringVar(&opts.sccacheBackend, "sccache-backend", sccacheLocal, "sccache storage (local|s3|redis); s3 reads AWS credentials and redis reads $"+sccacheRedisEnv+" from the environment")
+	fs.StringVar(&opts.sccacheBucket, "sccache-bucket", "", "S3 bucket for -sccache-backend=s3")
+	fs.StringVar(&opts.sccacheRegion, "sccache-region", "", "S3 region for -sccache-backend=s3")
+	fs.StringVar(&opts.sccacheEndpoint, "sccache-endpoint", "", "S3-compatible endpoint for -sccache-backend=s3")
+	fs.BoolVar(&opts.musl, "musl", false, "also build a statically linked "+muslTarget+" binary and check it has no dynamic dependencies")
+	fs.BoolVar(&opts.integration, "integration", false, "run the integration tests (feature "+integrationFeature+") against a "+postgresImage+" service")
+	fs.BoolVar(&opts.msrv, "msrv", false, "check that the project builds on the rust-version declared in Cargo.toml")
+	fs.StringVar(&opts.msrvVersion, "msrv-version", "", "minimum supported Rust version to check instead of Cargo.toml's (implies -msrv)")
+	fs.BoolVar(&opts.udeps, "udeps", false, "list unused dependencies with cargo udeps on a nightly toolchain")
+	fs.BoolVar(&opts.udepsStrict, "udeps-strict", false, "fail the udeps stage on any unused dependency (implies -udeps)")
+	fs.StringVar(&opts.sanitizer, "sanitizer", "", "also run the tests under a sanitizer on a nightly toolchain: "+strings.Join(sanitizers, ", "))
+	fs.BoolVar(&opts.sbom, "sbom", false, "generate an SBOM of the crate dependencies (attached to the image with -publish)")
+	fs.StringVar(&opts.sbomOut, "sbom-out", "", "host path of the SBOM (default ./build/sbom.cdx.json or ./build/sbom.spdx.json)")
+	fs.StringVar(&opts.sbomFormat, "sbom-format", "cyclonedx-json", "SBOM format (cyclonedx-json|spdx-json)")
+	fs.BoolVar(&opts.deny, "deny", false, "check licenses, bans, advisories and sources with cargo deny")
+	denyAllow := make(map[string]*bool)
+	for _, category := range denyCategories {
+		denyAllow[category] = fs.Bool("deny-allow-"+category, false, "report cargo deny "+category+" failures as warnings")
+	}
+
+	fs.BoolVar(&opts.coverage, "coverage", false, "measure test coverage with cargo-tarpaulin (needs an engine that allows privileged execs)")
+	fs.StringVar(&opts.coverageOut, "coverage-out", defaultCoverageOut, "host path of the lcov report")
+	fs.Float64Var(&opts.coverageMin, "coverage-min", 0, "minimum total coverage percentage")
+	fs.BoolVar(&opts.coverageDiff, "coverage-diff", false, "measure the coverage of the lines changed since -base-ref (implies -coverage)")
+	fs.StringVar(&opts.coverageBase, "coverage-base", "", "lcov report of the base branch, a path or http(s) URL, to compare the total against (implies -coverage-diff)")
+	fs.Float64Var(&opts.coveragePatchMin, "coverage-patch-min", 0, "minimum coverage percentage of the changed lines (implies -coverage-diff)")
+	fs.BoolVar(&opts.pgo, "pgo", false, "also build a profile-guided optimized binary into ./build/pgo (slow: profiles, then rebuilds)")
+	fs.StringVar(&opts.pgoWorkload, "pgo-workload", defaultPGOWorkload, "shell command profiling the instrumented binary, which is $MERLIN_BIN (implies -pgo)")
+	fs.BoolVar(&opts.pgoRefresh, "pgo-refresh", false, "profile the workload again instead of reusing the cached profile (implies -pgo)")
+	fs.BoolVar(&opts.bench, "bench", false, "run cargo bench after the checks and export the results (slow, so never part of the default run)")
+	fs.StringVar(&opts.benchOut, "bench-out", defaultBenchOut, "host directory for the criterion report and results.json (implies -bench)")
+	fs.StringVar(&opts.benchBaseline, "bench-baseline", "", "results.json of an earlier bench run to compare against, failing on regressions (implies -bench)")
+	fs.Float64Var(&opts.benchThreshold, "bench-threshold", defaultBenchThreshold, "percentage a benchmark may slow down against -bench-baseline before the stage fails")
+	fs.BoolVar(&opts.smoke, "smoke", false, "run the release binary in the runtime image after the build")
+	fs.StringVar(&smokeArgs, "smoke-args", defaultSmokeArgs, "space-separated arguments the smoke test runs the binary with")
+	fs.BoolVar(&opts.verifyAssets, "verify-assets", false, "after the build, check in the runtime image that the binary embeds its static assets")
+	fs.StringVar(&assetMarkers, "asset-markers", "", "comma-separated strings that must occur in the release binary (implies -verify-assets)")
+	fs.StringVar(&opts.assetVerifyCommand, "asset-verify-command", "", "shell command run in the runtime image that must succeed, e.g. 'merlin assets verify' (implies -verify-assets)")
+	fs.BoolVar(&opts.docs, "docs", false, "build rustdoc HTML and export it")
+	fs.StringVar(&opts.docsOut, "docs-out", defaultDocsOut, "host directory for the rustdoc HTML")
+	fs.BoolVar(&opts.docsStrict, "docs-strict", false, "fail the docs stage on any rustdoc warning")
+	fs.IntVar(&opts.retries, "retries", 2, "times to retry image pulls and dependency downloads that fail with network errors")
+	fs.DurationVar(&opts.retryBackoff, "retry-backoff", 5*time.Second, "wait before the first retry, doubled for each further retry")
+	fs.DurationVar(&opts.timeout, "timeout", 0, "cancel the run and exit 124 after this long, e.g. 20m (each rerun with -watch)")
+	fs.DurationVar(&opts.stageTimeout, "stage-timeout", 0, "cancel any single stage that runs longer than this and exit 124")
+	fs.BoolVar(&opts.skipUnchanged, "skip-unchanged", false, "skip build, test, clippy and fmt when their sources and settings match their last passing run, as recorded in "+resultCacheFile)
+	fs.BoolVar(&opts.force, "force", false, "with -skip-unchanged, run every stage anyway and refresh the record")
+	fs.BoolVar(&opts.failFast, "fail-fast", false, "cancel the concurrent checks, matrix entries or platform builds still running once one fails, instead of reporting every failure")
+	var clippyDeny, clippyAllow string
+	policy := clippyPolicy{}
+	fs.StringVar(&clippyDeny, "clippy-deny", "", "comma-separated clippy lint groups or lints that fail the clippy stage, e.g. correctness,clippy::unwrap_used")
+	fs.StringVar(&clippyAllow, "clippy-allow", "", "comma-separated clippy lint groups or lints whose warnings are only counted")
+	fs.IntVar(&policy.maxWarnings, "clippy-max-warnings", 0, "number of warnings neither denied nor allowed that clippy may report before failing")
+	fs.BoolVar(&opts.clippyFix, "clippy-fix", false, "apply clippy's suggested fixes and export the fixed sources instead of failing on warnings")
+	fs.BoolVar(&opts.fmtFix, "fmt-fix", false, "run cargo fmt and export the formatted sources instead of failing on unformatted code")
+	fs.StringVar(&opts.fixOut, "fix-out", defaultFixOut, "host directory the fixed or formatted sources are exported to")
+	fs.BoolVar(&opts.fixInplace, "fix-inplace", false, "export fixed or formatted sources over the -source working tree instead of -fix-out")
+	fs.BoolVar(&opts.strip, "strip", false, "strip debug symbols from the exported binaries and report the size saved")
+	fs.BoolVar(&opts.warningsReport, "warnings-report", false, "count the build's compiler warnings by lint and export them as "+warningsFile)
+	fs.IntVar(&opts.maxWarnings, "max-warnings", -1, "number of compiler warnings the build may report before failing (implies -warnings-report)")
+	fs.BoolVar(&opts.checksums, "checksums", false, "write a SHA256SUMS file next to the exported binaries")
+	fs.BoolVar(&opts.tarball, "tarball", false, "package the release binaries with README and LICENSE into merlin-<version>-<platform>.tar.gz")
+	fs.StringVar(&opts.summaryOut, "summary-out", "", "host path to write a JSON summary of the run to, including when it fails")
+	fs.StringVar(&opts.notifyWebhook, "notify-webhook", "", "URL to POST a JSON summary of the run to, e.g. a Slack incoming webhook")
+	fs.BoolVar(&opts.release, "release", false, "create a GitHub release of the packaged binaries and their SHA256SUMS (implies -tarball)")
+	fs.StringVar(&opts.releaseTag, "release-tag", "", "tag to release (default: the tag a GitHub Actions tag build is building)")
+	fs.StringVar(&opts.githubRepo, "github-repo", "", "owner/name of the repository to release to, token from $"+githubTokenEnv)
+	fs.BoolVar(&opts.publish, "publish", false, "publish the built binary as an OCI image")
+	fs.StringVar(&opts.imageRef, "image-ref", "", "image reference to publish to, e.g. ghcr.io/awdemos/merlin:latest")
+	fs.StringVar(&registryUser, "registry-user", "", "username for the publish registry (password from $"+registryPasswordEnv+")")
+	fs.StringVar(&registryAddr, "registry-addr", "", "publish registry address (default: host of -image-ref)")
+	fs.StringVar(&opts.s3Bucket, "s3-bucket", "", "S3 bucket to upload the artifacts to, credentials from $"+awsAccessKeyEnv+" and $"+awsSecretKeyEnv)
+	fs.StringVar(&opts.s3Prefix, "s3-prefix", "", "key prefix of the uploaded artifacts, which are stored as <prefix>/<git-ref>/<file>")
+	fs.StringVar(&opts.s3Endpoint, "s3-endpoint", "", "URL of an S3-compatible store such as MinIO or R2 (default: AWS)")
+	fs.StringVar(&opts.s3Region, "s3-region", "", "region to sign S3 requests for, \"auto\" for R2 (default: $"+awsRegionEnv+" or "+defaultS3Region+")")
+	fs.BoolVar(&opts.provenance, "provenance", false, "write a SLSA provenance attestation of the built artifacts")
+	fs.StringVar(&opts.provenanceOut, "provenance-out", defaultProvenanceOut, "host path of the provenance attestation (implies -provenance)")
+	fs.BoolVar(&opts.sign, "sign", false, "sign the published image and the built artifacts with cosign, key from $"+cosignKeyEnv)
+	fs.BoolVar(&opts.signKeyless, "sign-keyless", false, "sign with a keyless OIDC identity instead of a key (implies -sign)")
+
+	if err := fs.Parse(args); err != nil {
+		return Options{}, err
+	}
+	if fs.NArg() > 0 {
+		return Options{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	// flags given on the command line, before the config file fills in
+	// the rest
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	cfg, err := loadConfig(configPath)
+	found := err == nil
+	if errors.Is(err, os.ErrNotExist) && !explicit["config"] {
+		err = nil
+	}
+	if err != nil {
+		return Options{}, fmt.Errorf("config: %w", err)
+	}
+	for name, value := range cfg.flagValues() {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return Options{}, fmt.Errorf("config: %s: %w", name, err)
+		}
+	}
+	opts.config = cfg
+	if found {
+		opts.configFile = configPath
+	}
+	if opts.aptPackages, err = parseAptPackages(aptPackages); err != nil {
+		return Options{}, err
+	}
+
+	epoch, err := readCacheEpoch(cacheEpochFile)
+	if err != nil {
+		return Options{}, fmt.Errorf("read cache epoch: %w", err)
+	}
+	opts.cachePrefix = rotatedPrefix(opts.cachePrefix, epoch)
+
+	selected, err := parseStages(stages)
+	if err != nil {
+		return Options{}, err
+	}
+	for stage, skip := range map[string]bool{
+		stageBuild:  skipBuild,
+		stageTest:   skipTest,
+		stageClippy: skipLint,
+		stageFmt:    skipFmt,
+	} {
+		if skip {
+			delete(selected, stage)
+		}
+	}
+	if len(selected) == 0 {
+		return Options{}, fmt.Errorf("no stages selected")
+	}
+	opts.stages = selected
+
+	if env, ok := os.LookupEnv(rustVersionEnv); ok && !explicit["rust-version"] {
+		opts.rustVersion = env
+	}
+	if err := validateRustVersion(opts.rustVersion); err != nil {
+		return Options{}, err
+	}
+
+	if opts.retries < 0 {
+		return Options{}, fmt.Errorf("-retries must not be negative")
+	}
+
+	if err := validateLogFormat(opts.logFormat); err != nil {
+		return Options{}, err
+	}
+	switch {
+	case quiet && verbose:
+		return Options{}, fmt.Errorf("-quiet and -verbose cannot be combined")
+	case quiet:
+		opts.logLevel = logQuiet
+		// an explicitly requested Dagger log file is still written
+		if !explicit["dagger-log"] {
+			opts.daggerLog = ""
+		}
+	case verbose:
+		opts.logLevel = logVerbose
+	default:
+		opts.logLevel = logNormal
+	}
+
+	if opts.cargoBuildArgs, err = splitArgs(cargoBuildArgs); err != nil {
+		return Options{}, fmt.Errorf("-cargo-build-args: %w", err)
+	}
+	if opts.cargoTestArgs, err = splitArgs(cargoTestArgs); err != nil {
+		return Options{}, fmt.Errorf("-cargo-test-args: %w", err)
+	}
+	opts.packages, opts.exclude = packages, exclude
+	if err := validateWorkspace(opts); err != nil {
+		return Options{}, err
+	}
+	if opts.doctests, err = parseDoctests(doctests); err != nil {
+		return Options{}, err
+	}
+	if opts.annotations, err = resolveAnnotations(annotations, os.Getenv("GITHUB_ACTIONS")); err != nil {
+		return Options{}, err
+	}
+
+	if opts.matrix, err = parseMatrix(matrix); err != nil {
+		return Options{}, err
+	}
+
+	opts.features = splitList(features)
+	if opts.featureMatrix, err = parseFeatureMatrix(featureMatrix); err != nil {
+		return Options{}, err
+	}
+
+	if opts.platforms, err = parsePlatforms(platforms); err != nil {
+		return Options{}, err
+	}
+
+	if err := validateTestRunner(opts.testRunner); err != nil {
+		return Options{}, err
+	}
+	if opts.shards < 1 {
+		return Options{}, fmt.Errorf("-shards must be at least 1, got %d", opts.shards)
+	}
+	if opts.shards > 1 {
+		// partitioning is a nextest feature
+		if explicit["test-runner"] && opts.testRunner != testRunnerNextest {
+			return Options{}, fmt.Errorf("-shards requires -test-runner=%s", testRunnerNextest)
+		}
+		if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 {
+			return Options{}, fmt.Errorf("-shards does not support -matrix or -feature-matrix")
+		}
+		opts.testRunner = testRunnerNextest
+	}
+	if isFlagSet(fs, "junit-out") {
+		opts.junit = true
+	}
+	if err := validateProfile(opts); err != nil {
+		return Options{}, err
+	}
+	if err := validateJobs(opts); err != nil {
+		return Options{}, err
+	}
+	if opts.memory, err = parseMemory(memory); err != nil {
+		return Options{}, err
+	}
+	if err := applyResourceLimits(&opts, isFlagSet(fs, "jobs")); err != nil {
+		return Options{}, err
+	}
+	if err := validateFlakyRetries(opts); err != nil {
+		return Options{}, err
+	}
+	if isFlagSet(fs, "pgo-workload") || opts.pgoRefresh {
+		opts.pgo = true
+	}
+	if opts.pgo && strings.TrimSpace(opts.pgoWorkload) == "" {
+		return Options{}, fmt.Errorf("-pgo-workload must not be empty")
+	}
+	if isFlagSet(fs, "bench-out") || opts.benchBaseline != "" {
+		opts.bench = true
+	}
+	if opts.benchThreshold < 0 {
+		return Options{}, fmt.Errorf("-bench-threshold must not be negative, got %v", opts.benchThreshold)
+	}
+
+	if severityRank(opts.auditSeverity) < 0 {
+		return Options{}, fmt.Errorf("invalid -audit-severity %q (valid: %s)", opts.auditSeverity, strings.Join(severities, ", "))
+	}
+
+	if opts.msrvVersion != "" {
+		if err := validateRustVersion(opts.msrvVersion); err != nil {
+			return Options{}, fmt.Errorf("-msrv-version: %w", err)
+		}
+		opts.msrv = true
+	}
+	if opts.udepsStrict {
+		opts.udeps = true
+	}
+	if err := validateSanitizer(opts); err != nil {
+		return Options{}, err
+	}
+
+	if err := validateSBOMFormat(opts.sbomFormat); err != nil {
+		return Options{}, err
+	}
+	if opts.sbomOut == "" {
+		opts.sbomOut = defaultSBOMOut(opts.sbomFormat)
+	}
+
+	opts.denyAllow = make(map[string]bool)
+	for category, allow := range denyAllow {
+		opts.denyAllow[category] = *allow
+	}
+
+	if opts.coverageBase != "" || isFlagSet(fs, "coverage-patch-min") {
+		opts.coverageDiff = true
+	}
+	if opts.coverageDiff {
+		opts.coverage = true
+	}
+	if err := validateCoverageDiff(opts); err != nil {
+		return Options{}, err
+	}
+	if opts.coverageMin < 0 || opts.coverageMin > 100 {
+		return Options{}, fmt.Errorf("-coverage-min must be between 0 and 100, got %v", opts.coverageMin)
+	}
+
+	opts.smokeArgs = strings.Fields(smokeArgs)
+	if opts.smoke && (!opts.enabled(stageBuild) || len(opts.platforms) > 0) {
+		return Options{}, fmt.Errorf("-smoke requires the host build stage and does not support -platforms")
+	}
+	opts.assetMarkers = splitList(assetMarkers)
+	if isFlagSet(fs, "asset-markers") || isFlagSet(fs, "asset-verify-command") {
+		opts.verifyAssets = true
+	}
+	if err := validateVerifyAssets(opts); err != nil {
+		return Options{}, err
+	}
+
+	if err := validateWebhook(opts.notifyWebhook); err != nil {
+		return Options{}, err
+	}
+
+	opts.releaseTag = releaseTag(opts.releaseTag)
+	opts.githubToken = os.Getenv(githubTokenEnv)
+	if err := opts.require("release", opts.release, validateRelease(opts)); err != nil {
+		return Options{}, err
+	}
+	if opts.release {
+		opts.tarball = true
+	}
+
+	if opts.tarball && !opts.enabled(stageBuild) {
+		return Options{}, fmt.Errorf("-tarball requires the build stage")
+	}
+	if err := validateOnlyChanged(opts); err != nil {
+		return Options{}, err
+	}
+
+	if isFlagSet(fs, "max-warnings") {
+		if opts.maxWarnings < 0 {
+			return Options{}, fmt.Errorf("-max-warnings must not be negative, got %d", opts.maxWarnings)
+		}
+		opts.warningsReport = true
+	}
+	if err := validateWarnings(opts); err != nil {
+		return Options{}, err
+	}
+
+	if err := validateSource(&opts, explicit); err != nil {
+		return Options{}, err
+	}
+	if err := validateBenchCache(opts); err != nil {
+		return Options{}, err
+	}
+	if err := validateSkipUnchanged(opts); err != nil {
+		return Options{}, err
+	}
+	if err := loadSourceFilter(&opts, splitList(strings.Join(excludePaths, ",")), splitList(strings.Join(includePaths, ","))); err != nil {
+		return Options{}, err
+	}
+	// a -git-url checkout is only available inside the engine
+	if !opts.noCache && opts.gitURL == "" {
+		if opts.lockKey, err = cacheKey(opts.source); err != nil {
+			return Options{}, fmt.Errorf("cache key: %w", err)
+		}
+	}
+
+	if err := validateSccache(opts); err != nil {
+		return Options{}, err
+	}
+	if err := validateFix(opts); err != nil {
+		return Options{}, err
+	}
+
+	if opts.env, opts.secretEnv, err = resolveEnv(envFile, env, secretEnv); err != nil {
+		return Options{}, err
+	}
+
+	opts.cargoRegistry.token = os.Getenv(cargoRegistryTokenEnv)
+	if err := opts.require("cargo registry", opts.cargoRegistry.index != "", validateCargoRegistry(opts.cargoRegistry)); err != nil {
+		return Options{}, err
+	}
+
+	if opts.config.hasBuildHooks() && (len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 || len(opts.platforms) > 0) {
+		return Options{}, fmt.Errorf("build hooks do not support -matrix, -feature-matrix or -platforms")
+	}
+	stagesSet := false
+	for _, name := range []string{"stages", "skip-build", "skip-test", "skip-lint", "skip-fmt"} {
+		stagesSet = stagesSet || isFlagSet(fs, name)
+	}
+	if err := validateMatrix(&opts, stagesSet); err != nil {
+		return Options{}, err
+	}
+
+	if err := validateTimeouts(opts); err != nil {
+		return Options{}, err
+	}
+	if err := validatePrefetch(opts); err != nil {
+		return Options{}, err
+	}
+
+	if opts.noCache && (opts.cacheExport != "" || opts.cacheImport != "") {
+		return Options{}, fmt.Errorf("-cache-export and -cache-import cannot be combined with -no-cache")
+	}
+
+	if isFlagSet(fs, "clippy-deny") || isFlagSet(fs, "clippy-allow") || isFlagSet(fs, "clippy-max-warnings") {
+		policy.deny, policy.allow = splitList(clippyDeny), splitList(clippyAllow)
+		if err := validateClippyPolicy(policy); err != nil {
+			return Options{}, err
+		}
+		if opts.clippyFix {
+			return Options{}, fmt.Errorf("-clippy-fix cannot be combined with a clippy policy")
+		}
+		opts.clippyPolicy = &policy
+	}
+
+	if err := validateWatch(opts); err != nil {
+		return Options{}, err
+	}
+
+	opts.baseRegistryAuth = pullAuth(baseRegistryUser, opts.baseImage)
+	if err := opts.require("base image pull", opts.baseImage != "", validateBaseAuth(opts, baseRegistryAnonymous)); err != nil {
+		return Options{}, err
+	}
+
+	opts.registryAuth = publishAuth(registryAddr, registryUser, opts.imageRef)
+	if err := opts.require("publish", opts.publish, validatePublish(opts)); err != nil {
+		return Options{}, err
+	}
+	if isFlagSet(fs, "provenance-out") {
+		opts.provenance = true
+	}
+	if err := validateProvenance(opts); err != nil {
+		return Options{}, err
+	}
+	if opts.signKeyless {
+		opts.sign = true
+	}
+	if err := opts.require("sign", opts.sign, validateSign(opts)); err != nil {
+		return Options{}, err
+	}
+	opts.s3Region = s3Region(opts.s3Region)
+	if err := opts.require("s3 upload", opts.s3Bucket != "", validateS3(opts)); err != nil {
+		return Options{}, err
+	}
+
+	return opts, nil
+}
+
+// isFlagSet reports whether the named flag was set on the command line or
+// by the config file, whose values are applied with fs.Set. Unlike the
+// explicit map in ParseOptions, it counts the config file's flags too.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// parseMatrix splits a comma-separated toolchain list, rejecting entries
+// that are empty, listed twice, or neither a release channel nor a valid
+// version.
+func parseMatrix(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	var toolchains []string
+	seen := make(map[string]bool)
+	for _, toolchain := range strings.Split(list, ",") {
+		toolchain = strings.TrimSpace(toolchain)
+		if toolchain == "" {
+			return nil, fmt.Errorf("matrix: empty toolchain in %q", list)
+		}
+		if seen[toolchain] {
+			return nil, fmt.Errorf("matrix: toolchain %s listed twice", toolchain)
+		}
+		if !isChannel(toolchain) {
+			if err := validateRustVersion(toolchain); err != nil {
+				return nil, fmt.Errorf("matrix: %w", err)
+			}
+		}
+		seen[toolchain] = true
+		toolchains = append(toolchains, toolchain)
+	}
+	return toolchains, nil
+}
+
+// validateRustVersion rejects toolchain versions that are not of the form
+// MAJOR.MINOR or MAJOR.MINOR.PATCH, so typos fail before an image pull.
+func validateRustVersion(version string) error {
+	if version == "" {
+		return fmt.Errorf("rust version must not be empty")
+	}
+	if !rustVersionPattern.MatchString(version) {
+		return fmt.Errorf("invalid rust version %q: expected MAJOR.MINOR or MAJOR.MINOR.PATCH", version)
+	}
+	return nil
+}
+
+// parseStages turns a comma-separated stage list into a set, rejecting
+// unknown names.
+func parseStages(list string) (map[string]bool, error) {
+	known := make(map[string]bool, len(allStages))
+	for _, stage := range allStages {
+		known[stage] = true
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown stage %q (valid stages: %s)", name, strings.Join(allStages, ", "))
+		}
+		selected[name] = true
+	}
+	return selected, nil
+}
@@ -0,0 +1,315 @@
+package pipeline
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOptionsStageSelection(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, allStages},
+		{[]string{"-stages=build,test"}, []string{stageBuild, stageTest}},
+		{[]string{"-skip-lint"}, []string{stageBuild, stageTest, stageFmt}},
+		{[]string{"-stages=fmt,test", "-skip-test"}, []string{stageFmt}},
+	}
+	for _, tt := range tests {
+		opts, err := ParseOptions(tt.args, io.Discard)
+		if err != nil {
+			t.Errorf("ParseOptions(%q): %v", tt.args, err)
+			continue
+		}
+		var got []string
+		for _, stage := range allStages {
+			if opts.enabled(stage) {
+				got = append(got, stage)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseOptions(%q) stages = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseOptionsRejectsInvalidInput(t *testing.T) {
+	for _, args := range [][]string{
+		{"-stages=build,docs"},
+		{"-stages=fmt", "-skip-fmt"},
+		{"-rust-version=1.x"},
+		{"-rust-version="},
+		{"-matrix=1.75,latest"},
+		{"extra"},
+		{"-audit-severity=severe"},
+		{"-publish"},
+		{"-publish", "-image-ref=ghcr.io/awdemos/merlin:latest", "-skip-build"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestRustVersionPrecedence(t *testing.T) {
+	t.Setenv(rustVersionEnv, "1.80")
+
+	opts, err := ParseOptions(nil, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.rustVersion != "1.80" {
+		t.Errorf("env: rustVersion = %q, want 1.80", opts.rustVersion)
+	}
+
+	opts, err = ParseOptions([]string{"-rust-version=1.77.2"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.rustVersion != "1.77.2" {
+		t.Errorf("flag: rustVersion = %q, want 1.77.2", opts.rustVersion)
+	}
+}
+
+func TestParseMatrix(t *testing.T) {
+	got, err := parseMatrix("1.70, 1.75,stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.70", "1.75", "stable"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMatrix = %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-matrix=1.70,stable,1.70"}, "toolchain 1.70 listed twice"},
+		{[]string{"-matrix=1.70,,stable"}, "empty toolchain"},
+		{[]string{"-matrix=stable,"}, "empty toolchain"},
+		{[]string{"-matrix=1.x"}, "matrix:"},
+		{[]string{"-feature-matrix=default;full;default"}, "feature set default listed twice"},
+		{[]string{"-feature-matrix=tls,full;full,tls"}, "feature set full,tls listed twice"},
+		{[]string{"-feature-matrix=default;;full"}, "empty feature set"},
+		{[]string{"-feature-matrix=default; , ;full"}, "empty feature set"},
+	} {
+		if _, err := ParseOptions(tc.args, io.Discard); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ParseOptions(%q) error = %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestMatrixFlags(t *testing.T) {
+	opts, err := ParseOptions([]string{"-matrix=1.70,stable", "-feature-matrix=default;minimal,tls"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		label, toolchain string
+		features         []string
+	}{
+		{"rust 1.70, features default", "1.70", []string{"default"}},
+		{"rust 1.70, features minimal,tls", "1.70", []string{"minimal", "tls"}},
+		{"rust stable, features default", "stable", []string{"default"}},
+		{"rust stable, features minimal,tls", "stable", []string{"minimal", "tls"}},
+	}
+	entries := matrixEntries(opts)
+	if len(entries) != len(want) {
+		t.Fatalf("%d matrix entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.label != w.label || e.toolchain != w.toolchain || !reflect.DeepEqual(e.opts.features, w.features) {
+			t.Errorf("entry %d = %q on %s with %v, want %q on %s with %v", i, e.label, e.toolchain, e.opts.features, w.label, w.toolchain, w.features)
+		}
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-matrix=stable,beta", "-platforms=linux/arm64"}, "do not support -platforms"},
+		{[]string{"-matrix=stable,beta", "-publish", "-image-ref=ghcr.io/awdemos/merlin:latest", "-registry-user=ci"}, "do not support -publish"},
+		{[]string{"-feature-matrix=full", "-strip"}, "do not support -strip"},
+		{[]string{"-feature-matrix=full", "-bench"}, "do not support -bench"},
+		{[]string{"-matrix=stable,beta", "-coverage"}, "do not support the coverage check"},
+		{[]string{"-matrix=stable,beta", "-stages=build"}, "only those"},
+	} {
+		if _, err := ParseOptions(tc.args, io.Discard); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ParseOptions(%q) error = %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestPrintMatrix(t *testing.T) {
+	entries := matrixEntries(Options{matrix: []string{"1.70", "beta", "stable"}})
+	results := map[string]error{
+		"rust beta":   errors.New("test failed"),
+		"rust stable": &cancelledError{stage: "build+test (rust stable)", failed: "build+test (rust beta)"},
+	}
+	var b strings.Builder
+	printMatrix(&b, entries, results)
+	want := `MATRIX ENTRY  RESULT
+rust 1.70     pass
+rust beta     FAIL
+rust stable   CANCELLED
+`
+	if b.String() != want {
+		t.Errorf("printMatrix printed\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestPublishCredentials(t *testing.T) {
+	t.Setenv(registryPasswordEnv, "hunter2")
+
+	opts, err := ParseOptions([]string{"-publish", "-image-ref=ghcr.io/awdemos/merlin:latest", "-registry-user=ci"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := registryAuth{address: "ghcr.io", username: "ci", password: "hunter2"}
+	if opts.registryAuth != want {
+		t.Errorf("registryAuth = %+v, want %+v", opts.registryAuth, want)
+	}
+
+	if _, err := ParseOptions([]string{"-publish", "-image-ref=ghcr.io/awdemos/merlin:latest"}, io.Discard); err == nil {
+		t.Error("publish without -registry-user succeeded, want error")
+	}
+}
+
+func TestFixGuard(t *testing.T) {
+	opts, err := ParseOptions([]string{"-clippy-fix"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fixTarget(opts); got != defaultFixOut {
+		t.Errorf("fixTarget = %q, want %q", got, defaultFixOut)
+	}
+
+	if _, err := ParseOptions([]string{"-clippy-fix", "-fix-out=.."}, io.Discard); err == nil {
+		t.Error("-fix-out over the working tree succeeded, want error")
+	}
+
+	opts, err = ParseOptions([]string{"-clippy-fix", "-fix-inplace"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fixTarget(opts); got != defaultSource {
+		t.Errorf("fixTarget with -fix-inplace = %q, want %q", got, defaultSource)
+	}
+
+	if _, err := ParseOptions([]string{"-fix-inplace"}, io.Discard); err == nil {
+		t.Error("-fix-inplace without -clippy-fix succeeded, want error")
+	}
+	if _, err := ParseOptions([]string{"-clippy-fix", "-skip-lint"}, io.Discard); err == nil {
+		t.Error("-clippy-fix without the clippy stage succeeded, want error")
+	}
+	if _, err := ParseOptions([]string{"-clippy-fix", "-fmt-fix"}, io.Discard); err == nil {
+		t.Error("-clippy-fix with -fmt-fix succeeded, want error")
+	}
+	if _, err := ParseOptions([]string{"-fmt-fix", "-skip-fmt"}, io.Discard); err == nil {
+		t.Error("-fmt-fix without the fmt stage succeeded, want error")
+	}
+}
+
+func TestGitSource(t *testing.T) {
+	opts, err := ParseOptions([]string{"-git-url=https://github.com/awdemos/mono.git", "-git-subpath=./services/merlin/"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.gitRef != defaultGitRef || opts.gitSubpath != "services/merlin" {
+		t.Errorf("gitRef, gitSubpath = %q, %q, want %q, services/merlin", opts.gitRef, opts.gitSubpath, defaultGitRef)
+	}
+
+	opts, err = ParseOptions([]string{"-git-url=https://github.com/awdemos/mono.git", "-git-subpath=/services/../merlin"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.gitSubpath != "merlin" {
+		t.Errorf("gitSubpath = %q, want merlin", opts.gitSubpath)
+	}
+
+	for _, args := range [][]string{
+		{"-git-url=https://github.com/awdemos/merlin.git", "-git-subpath=../../etc"},
+		{"-git-url=https://github.com/awdemos/merlin.git", "-git-subpath=/services/../../etc"},
+		{"-git-ref=v1.0.0"},
+		{"-git-subpath=merlin"},
+		{"-git-url=https://github.com/awdemos/merlin.git", "-source=../merlin"},
+		{"-git-url=https://github.com/awdemos/merlin.git", "-clippy-fix", "-fix-inplace"},
+		{"-git-url=https://github.com/awdemos/merlin.git", "-submodules"},
+		{"-source=pipeline/testdata", "-submodules"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestGitRefKind(t *testing.T) {
+	for _, tc := range []struct {
+		ref, kind, name string
+	}{
+		{"main", gitRefBranch, "main"},
+		{"refs/heads/release/1.x", gitRefBranch, "release/1.x"},
+		{"refs/tags/v1.2.0", gitRefTag, "v1.2.0"},
+		{"0123456789abcdef0123456789abcdef01234567", gitRefCommit, "0123456789abcdef0123456789abcdef01234567"},
+	} {
+		if kind, name := gitRefKind(tc.ref); kind != tc.kind || name != tc.name {
+			t.Errorf("gitRefKind(%q) = %s %q, want %s %q", tc.ref, kind, name, tc.kind, tc.name)
+		}
+	}
+
+	out := "1111111111111111111111111111111111111111\trefs/tags/v1.2.0\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/v1.2.0^{}\n"
+	if !hasRemoteTag(out, "v1.2.0") {
+		t.Errorf("hasRemoteTag did not find v1.2.0 in %q", out)
+	}
+	if hasRemoteTag(out, "v1.2") || hasRemoteTag("", "v1.2.0") {
+		t.Error("hasRemoteTag found a tag ls-remote did not list")
+	}
+}
+
+func TestShardsUseNextest(t *testing.T) {
+	opts, err := ParseOptions([]string{"-shards=4"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.testRunner != testRunnerNextest {
+		t.Errorf("testRunner = %q, want %q", opts.testRunner, testRunnerNextest)
+	}
+
+	for _, args := range [][]string{
+		{"-shards=0"},
+		{"-shards=2", "-test-runner=cargo"},
+		{"-shards=2", "-matrix=stable,beta"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestSBOMOutDefault(t *testing.T) {
+	opts, err := ParseOptions([]string{"-sbom", "-sbom-format=spdx-json"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.sbomOut != "./build/sbom.spdx.json" {
+		t.Errorf("sbomOut = %q, want ./build/sbom.spdx.json", opts.sbomOut)
+	}
+
+	opts, err = ParseOptions([]string{"-sbom", "-sbom-out=out/deps.json"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.sbomOut != "out/deps.json" || opts.sbomFormat != "cyclonedx-json" {
+		t.Errorf("sbomOut, sbomFormat = %q, %q", opts.sbomOut, opts.sbomFormat)
+	}
+
+	if _, err := ParseOptions([]string{"-sbom-format=spdx-tag-value"}, io.Discard); err == nil {
+		t.Error("unknown -sbom-format succeeded, want error")
+	}
+}
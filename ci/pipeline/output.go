@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// maxStageOutput bounds the output kept per stage in the run result. The
+// end of a long log is where a failure shows, so the start is dropped.
+const maxStageOutput = 64 << 10
+
+// combineStreams joins what a command wrote to stderr and stdout. Cargo
+// writes its progress and diagnostics to stderr before the command's own
+// output, e.g. the test results, goes to stdout, so stderr comes first.
+func combineStreams(stdout, stderr string) string {
+	stdout, stderr = strings.TrimSpace(stdout), strings.TrimSpace(stderr)
+	switch {
+	case stderr == "":
+		return stdout
+	case stdout == "":
+		return stderr
+	}
+	return stderr + "\n" + stdout
+}
+
+// execOutput evaluates ctr and returns both streams of its last command.
+func execOutput(ctx context.Context, ctr *dagger.Container) (string, error) {
+	stdout, stderr, err := execStreams(ctx, ctr)
+	if err != nil {
+		return "", err
+	}
+	return combineStreams(stdout, stderr), nil
+}
+
+// execStreams evaluates ctr and returns its last command's stdout and
+// stderr apart, for stages that parse stdout. Reading stderr after stdout
+// reuses the evaluated command rather than running it again.
+func execStreams(ctx context.Context, ctr *dagger.Container) (string, string, error) {
+	stdout, err := ctr.Stdout(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	stderr, err := ctr.Stderr(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return stdout, stderr, nil
+}
+
+// truncateOutput keeps the last maxStageOutput bytes of out, on a line
+// boundary where there is one.
+func truncateOutput(out string) string {
+	if len(out) <= maxStageOutput {
+		return out
+	}
+	tail := out[len(out)-maxStageOutput:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	return fmt.Sprintf("[%d bytes truncated]\n%s", len(out)-len(tail), tail)
+}
+
+// recordOutput attaches output to the last recorded run of the stage name,
+// unless its failure already supplied one.
+func (t *stageRecorder) recordOutput(name, output string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.stages) - 1; i >= 0; i-- {
+		if t.stages[i].Name == name {
+			if t.stages[i].Output == "" {
+				t.stages[i].Output = truncateOutput(strings.TrimSpace(output))
+			}
+			return
+		}
+	}
+}
+
+// stageOutput returns the output a failed stage's command left in err.
+func stageOutput(err error) string {
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		return truncateOutput(combineStreams(stageErr.stdout, stageErr.stderr))
+	}
+	return ""
+}
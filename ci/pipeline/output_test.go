@@ -0,0 +1,74 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestCombineStreams(t *testing.T) {
+	for _, tc := range []struct{ stdout, stderr, want string }{
+		{"test result: ok\n", "   Compiling merlin\n", "Compiling merlin\ntest result: ok"},
+		{"", "error: could not compile\n", "error: could not compile"},
+		{"Diff in src/lib.rs\n", "", "Diff in src/lib.rs"},
+		{"", "", ""},
+	} {
+		if got := combineStreams(tc.stdout, tc.stderr); got != tc.want {
+			t.Errorf("combineStreams(%q, %q) = %q, want %q", tc.stdout, tc.stderr, got, tc.want)
+		}
+	}
+}
+
+func TestTruncateOutputKeepsTheEnd(t *testing.T) {
+	out := strings.Repeat("compiling\n", maxStageOutput/10) + "error: the failure\n"
+	got := truncateOutput(out)
+	if len(got) > maxStageOutput+64 {
+		t.Errorf("kept %d bytes", len(got))
+	}
+	if !strings.HasPrefix(got, "[") || !strings.HasSuffix(got, "error: the failure\n") {
+		t.Errorf("truncated output starts %q and ends %q", got[:20], got[len(got)-20:])
+	}
+	if short := "ok"; truncateOutput(short) != short {
+		t.Error("short output was truncated")
+	}
+}
+
+func TestStageErrorShowsStdoutWithoutStderr(t *testing.T) {
+	err := &stageError{stage: stageFmt, exitCode: 1, stdout: "Diff in /src/src/lib.rs at line 3:\n-fn  main() {}\n+fn main() {}\n"}
+	if !strings.Contains(err.Error(), "Diff in /src/src/lib.rs") {
+		t.Errorf("fmt failure hides the diff: %q", err.Error())
+	}
+	err = &stageError{stage: stageTest, exitCode: 101, stdout: "running 3 tests", stderr: "error: test failed"}
+	if msg := err.Error(); strings.Contains(msg, "running 3 tests") || !strings.Contains(msg, "error: test failed") {
+		t.Errorf("error %q, want stderr only", msg)
+	}
+}
+
+func TestRunResultRecordsStageOutput(t *testing.T) {
+	selected := []check{
+		{name: stageClippy, run: func(context.Context, *dagger.Container) (string, error) {
+			return "    Checking merlin\n    Finished dev", nil
+		}},
+		{name: stageFmt, run: func(context.Context, *dagger.Container) (string, error) {
+			return "", &stageError{stage: stageFmt, exitCode: 1, stdout: "Diff in src/lib.rs", stderr: ""}
+		}},
+	}
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal))
+	results := runChecks(context.Background(), nil, selected, rec)
+
+	result := newRunResult(rec.snapshot(), time.Second, "", results[1].err)
+	outputs := map[string]string{}
+	for _, s := range result.Stages {
+		outputs[s.Name] = s.Output
+	}
+	if want := "Checking merlin\n    Finished dev"; outputs[stageClippy] != want {
+		t.Errorf("clippy output %q, want %q", outputs[stageClippy], want)
+	}
+	if outputs[stageFmt] != "Diff in src/lib.rs" {
+		t.Errorf("fmt output %q, want the diff", outputs[stageFmt])
+	}
+}
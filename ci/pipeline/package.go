@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"dagger.io/dagger"
+)
+
+const stagePackage = "package"
+
+// releaseDocs are copied into release tarballs when the project has them.
+var releaseDocs = []string{"README.md", "LICENSE"}
+
+// releaseName names a release archive, e.g. merlin-0.1.0-linux-amd64.
+func releaseName(m cargoManifest, platform dagger.Platform) string {
+	return fmt.Sprintf("%s-%s-%s", m.Package.Name, m.Package.Version, platformDir(platform))
+}
+
+// packageRelease stages binaries together with the project's README and
+// LICENSE and packs them into <buildDir>/<name>.tar.gz, returning the
+// archive path.
+func packageRelease(ctx context.Context, src, binaries *dagger.Directory, name string) (string, error) {
+	entries, err := src.Entries(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stagePackage, err)
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entry] = true
+	}
+	for _, doc := range releaseDocs {
+		if present[doc] {
+			binaries = binaries.WithFile(doc, src.File(doc))
+		}
+	}
+
+	staging := filepath.Join(buildDir, stagePackage, name)
+	if _, err := binaries.Export(ctx, staging); err != nil {
+		return "", fmt.Errorf("%s: %w", stagePackage, err)
+	}
+	archive := filepath.Join(buildDir, name+".tar.gz")
+	if err := packageArtifacts(staging, archive); err != nil {
+		return "", fmt.Errorf("%s: %w", stagePackage, err)
+	}
+	return archive, nil
+}
+
+// packageHostBuild packages the binary built for the engine's platform.
+func packageHostBuild(ctx context.Context, client *dagger.Client, src *dagger.Directory, rust *dagger.Container) (string, error) {
+	manifest, err := readManifest(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stagePackage, err)
+	}
+	platform, err := client.DefaultPlatform(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stagePackage, err)
+	}
+	return packageRelease(ctx, src, rust.Directory(outputDir), releaseName(manifest, platform))
+}
+
+// packageArtifacts writes a gzip-compressed tarball of srcDir to outFile.
+// Entries are stored under a top-level directory named after srcDir, so
+// the archive unpacks into a single directory. Empty directories are kept
+// and symlinks are stored as links rather than followed.
+func packageArtifacts(srcDir, outFile string) (err error) {
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	root := filepath.Base(srcDir)
+
+	err = filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(root, rel))
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
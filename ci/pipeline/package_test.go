@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPackageArtifacts(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "merlin-0.1.0-linux-amd64")
+	if err := os.MkdirAll(filepath.Join(src, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "merlin"), []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("merlin", filepath.Join(src, "merlin-latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "merlin.tar.gz")
+	if err := packageArtifacts(src, out); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+
+	got := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = hdr
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name] = string(data)
+	}
+
+	root := "merlin-0.1.0-linux-amd64/"
+	if hdr := got[root]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+		t.Errorf("missing top-level directory entry: %v", got)
+	}
+	if hdr := got[root+"empty/"]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+		t.Errorf("empty directory was dropped")
+	}
+	if hdr := got[root+"merlin"]; hdr == nil || hdr.Mode&0o111 == 0 || contents[root+"merlin"] != "binary" {
+		t.Errorf("binary entry = %+v with %q", hdr, contents[root+"merlin"])
+	}
+	if hdr := got[root+"merlin-latest"]; hdr == nil || hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "merlin" {
+		t.Errorf("symlink entry = %+v", hdr)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	m, err := parseManifest([]byte("[package]\nname = \"merlin\"\nversion = \"0.1.0\"\n\n[dependencies]\ntokio = \"1\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := releaseName(m, "linux/arm64"); got != "merlin-0.1.0-linux-arm64" {
+		t.Errorf("releaseName = %q", got)
+	}
+
+	if _, err := parseManifest([]byte("[package\n")); err == nil {
+		t.Error("parseManifest accepted invalid TOML")
+	}
+}
+
+func TestManifestRustVersion(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     string
+	}{
+		{"[package]\nname = \"merlin\"\nrust-version = \"1.70\"\n", "1.70"},
+		{"[package]\nname = \"merlin\"\nrust-version.workspace = true\n\n[workspace.package]\nrust-version = \"1.72.1\"\n", "1.72.1"},
+		{"[package]\nname = \"merlin\"\n", ""},
+	}
+	for _, tt := range tests {
+		m, err := parseManifest([]byte(tt.manifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.rustVersion(); got != tt.want {
+			t.Errorf("rustVersion(%q) = %q, want %q", tt.manifest, got, tt.want)
+		}
+	}
+}
+
+func TestManifestRegistries(t *testing.T) {
+	manifest := `[package]
+name = "merlin"
+
+[dependencies]
+tokio = "1"
+internal-auth = { version = "0.3", registry = "private" }
+
+[dev-dependencies]
+fixtures = { version = "1", registry = "testing" }
+
+[target.'cfg(unix)'.build-dependencies]
+internal-build = { version = "0.1", registry = "private" }
+
+[workspace.dependencies]
+internal-proto = { version = "2", registry = "mirror" }
+`
+	m, err := parseManifest([]byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.registries(), []string{"mirror", "private", "testing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("registries = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stagePGO = "pgo"
+	// cachePGOProfile holds the merged profile between runs.
+	cachePGOProfile = "pgo-profile"
+	pgoProfileDir   = "/pgo-profile"
+	pgoOutDir       = "/pgo-out"
+	// MERLIN_BIN names the instrumented binary the workload exercises.
+	defaultPGOWorkload = `"$MERLIN_BIN" --help`
+)
+
+// pgoOut is where the optimized binary is exported.
+var pgoOut = filepath.Join(buildDir, "pgo")
+
+// markers the PGO script prints to report whether it profiled
+const (
+	pgoProfileGenerated = "pgo: profile generated"
+	pgoProfileCached    = "pgo: using cached profile"
+)
+
+// pgoScript is the two-phase build run by runPGO. Without a cached profile,
+// or with refresh, it builds an instrumented binary, runs the workload
+// against it and merges the raw profiles into the profile cache; then it
+// rebuilds with the merged profile. The two builds use their own target
+// directories so neither invalidates the regular release build. Cargo
+// arguments such as the profile and feature selection are passed as "$@",
+// and dir is the target/ subdirectory the profile builds into.
+func pgoScript(dir string) string {
+	return strings.Join([]string{
+		`set -eu`,
+		`profile=` + pgoProfileDir + `/merged.profdata`,
+		`host=$(rustc -vV | sed -n 's/^host: //p')`,
+		`profdata="$(rustc --print sysroot)/lib/rustlib/$host/bin/llvm-profdata"`,
+		`if [ "$PGO_REFRESH" = 1 ] || [ ! -s "$profile" ]; then`,
+		`  rm -rf /pgo-raw`,
+		`  RUSTFLAGS="${RUSTFLAGS:-} -Cprofile-generate=/pgo-raw" cargo build --target-dir target/pgo-generate "$@"`,
+		`  MERLIN_BIN=target/pgo-generate/` + dir + `/merlin sh -c "$PGO_WORKLOAD"`,
+		`  "$profdata" merge -o "$profile.tmp" /pgo-raw`,
+		`  mv "$profile.tmp" "$profile"`,
+		`  echo "` + pgoProfileGenerated + `"`,
+		`else`,
+		`  echo "` + pgoProfileCached + `"`,
+		`fi`,
+		`RUSTFLAGS="${RUSTFLAGS:-} -Cprofile-use=$profile" cargo build --target-dir target/pgo-use "$@"`,
+		`install -D target/pgo-use/` + dir + `/merlin ` + pgoOutDir + `/merlin`,
+	}, "\n")
+}
+
+// pgoArgs returns the exec running pgoScript for opts.
+func pgoArgs(opts Options) []string {
+	args := append([]string{"sh", "-c", pgoScript(profileDir(cargoProfile(opts))), "sh"}, profileArgs(opts)...)
+	args = append(args, featureArgs(opts)...)
+	return append(args, lockArgs(opts)...)
+}
+
+// runPGO builds a profile-guided optimized release binary and exports it
+// to pgoOut. The merged profile is cached, so later runs only rebuild with
+// it unless opts.pgoRefresh asks for a new one, e.g. after the hot paths
+// changed.
+func runPGO(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options) (string, error) {
+	refresh := "0"
+	if opts.pgoRefresh {
+		refresh = "1"
+	}
+	built, err := syncWithRetry(ctx, rust.
+		WithExec([]string{"rustup", "component", "add", "llvm-tools-preview"}).
+		WithMountedCache(pgoProfileDir, client.CacheVolume(cacheName(opts.cachePrefix, cachePGOProfile))).
+		WithEnvVariable("PGO_WORKLOAD", opts.pgoWorkload).
+		WithEnvVariable("PGO_REFRESH", refresh).
+		WithExec(pgoArgs(opts)), opts)
+	if err != nil {
+		return "", stageFailed(stagePGO, err)
+	}
+
+	if _, err := built.Directory(pgoOutDir).Export(ctx, pgoOut); err != nil {
+		return "", fmt.Errorf("%s: export: %w", stagePGO, err)
+	}
+	stdout, stderr, err := execStreams(ctx, built)
+	if err != nil {
+		return "", stageFailed(stagePGO, err)
+	}
+	return combineStreams(stdout, stderr) + "\n" +
+		fmt.Sprintf("optimized binary exported to %s (%s)", filepath.Join(pgoOut, "merlin"), pgoProfileSource(stdout)), nil
+}
+
+// pgoProfileSource reports whether the PGO script profiled a new workload
+// run or reused the cached profile.
+func pgoProfileSource(stdout string) string {
+	switch {
+	case strings.Contains(stdout, pgoProfileGenerated):
+		return "new profile"
+	case strings.Contains(stdout, pgoProfileCached):
+		return "cached profile"
+	}
+	return "unknown profile"
+}
@@ -0,0 +1,49 @@
+package pipeline
+
+import (
+	"io"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestPGOScriptParses(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	if out, err := exec.Command("sh", "-n", "-c", pgoScript("release")).CombinedOutput(); err != nil {
+		t.Errorf("sh -n: %v\n%s", err, out)
+	}
+}
+
+func TestPGOArgs(t *testing.T) {
+	args := pgoArgs(Options{profile: "dist", features: []string{"tls"}, noDefaultFeatures: true})
+	if got, want := args[3:], []string{"sh", "--profile", "dist", "--no-default-features", "--features", "tls"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pgoArgs passes %q to the script, want %q", got, want)
+	}
+}
+
+func TestPGOProfileSource(t *testing.T) {
+	for stdout, want := range map[string]string{
+		pgoProfileGenerated + "\n": "new profile",
+		pgoProfileCached + "\n":    "cached profile",
+		"":                         "unknown profile",
+	} {
+		if got := pgoProfileSource(stdout); got != want {
+			t.Errorf("pgoProfileSource(%q) = %q, want %q", stdout, got, want)
+		}
+	}
+}
+
+func TestPGOOptions(t *testing.T) {
+	opts, err := ParseOptions([]string{"-pgo-refresh"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.pgo || opts.pgoWorkload != defaultPGOWorkload {
+		t.Errorf("pgo, pgoWorkload = %v, %q, want true, %q", opts.pgo, opts.pgoWorkload, defaultPGOWorkload)
+	}
+	if _, err := ParseOptions([]string{"-pgo-workload= "}, io.Discard); err == nil {
+		t.Error("empty -pgo-workload succeeded, want error")
+	}
+}
@@ -0,0 +1,574 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// exit codes reported by the pipeline
+const (
+	exitStageFailed = 1   // a build, test, lint or format stage failed
+	exitInternal    = 2   // the pipeline itself could not run
+	exitTimeout     = 124 // -timeout or -stage-timeout expired, as timeout(1) reports
+	exitInterrupted = 130 // SIGINT or SIGTERM, as a shell reports Ctrl-C
+)
+
+// stageError reports a stage whose container command failed, as opposed to
+// an error in the pipeline or the Dagger engine.
+type stageError struct {
+	stage    string
+	exitCode int
+	stderr   string
+	// killed is set when the command was SIGKILLed, most likely by the
+	// kernel running out of memory
+	killed bool
+	// stdout is kept for parsing, e.g. into annotations, and only printed
+	// when stderr is empty, as for the diff of a failed cargo fmt --check
+	stdout string
+}
+
+func (e *stageError) Error() string {
+	msg := fmt.Sprintf("%s failed with exit code %d", e.stage, e.exitCode)
+	if e.killed {
+		msg = fmt.Sprintf("%s killed, likely out of memory; try reducing -jobs or increasing -memory (exit code %d)", e.stage, e.exitCode)
+	}
+	if stderr := strings.TrimSpace(e.stderr); stderr != "" {
+		msg += ":\n" + stderr
+	} else if stdout := strings.TrimSpace(e.stdout); stdout != "" {
+		msg += ":\n" + stdout
+	}
+	return msg
+}
+
+// stageFailed wraps err as a stageError when it was caused by a failing
+// exec in the container, and returns it unchanged otherwise.
+func stageFailed(stage string, err error) error {
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		return &stageError{stage: stage, exitCode: execErr.ExitCode, stderr: execErr.Stderr, stdout: execErr.Stdout, killed: oomKilled(execErr.ExitCode, execErr.Stderr)}
+	}
+	return fmt.Errorf("%s: %w", stage, err)
+}
+
+// ExitCode maps an error returned by Main or Run to the process exit
+// status.
+func ExitCode(err error) int {
+	var interruptErr *interruptError
+	if errors.As(err, &interruptErr) {
+		return exitInterrupted
+	}
+	var timeoutErr *timeoutError
+	if errors.As(err, &timeoutErr) {
+		return exitTimeout
+	}
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		return exitStageFailed
+	}
+	return exitInternal
+}
+
+// rustContainer returns a container for the given toolchain and platform
+// (the host's when empty) with the project mounted at /src. A configured
+// base image stands in for the configured toolchain's image.
+func rustContainer(client *dagger.Client, src *dagger.Directory, version string, platform dagger.Platform, opts Options) *dagger.Container {
+	// get `rust` image
+	rust := toolchainContainer(client, version, platform)
+	if opts.baseImage != "" && version == opts.rustVersion {
+		rust = pullBaseImage(client, platform, opts)
+	}
+
+	// install system libraries before the sources are mounted, so that the
+	// layer survives source changes
+	rust = withAptPackages(client, rust, opts)
+
+	// mount cloned repository into `rust` image
+	rust = rust.WithDirectory("/src", src).WithWorkdir("/src")
+
+	// reuse downloaded crates and build artifacts between runs
+	if !opts.noCache {
+		rust = withCaches(client, rust, opts.cachePrefix, opts.lockKey, targetCacheKey(version, platform, opts))
+	}
+	if opts.sccache {
+		rust = withSccache(client, rust, opts)
+	}
+	if opts.cargoRegistry.index != "" {
+		rust = withCargoRegistry(client, rust, opts.cargoRegistry)
+	}
+	return withEnv(client, withJobs(rust, opts), opts.env, opts.secretEnv)
+}
+
+// Pipeline runs the stages selected by its Options. It does not connect to
+// Dagger itself: callers pass in a client, so several runs, or a caller's
+// own Dagger work, can share one engine session.
+type Pipeline struct {
+	Options Options
+	// Log receives the pipeline's events.
+	Log *slog.Logger
+	// Tracer traces each run and its stages.
+	Tracer trace.Tracer
+}
+
+// New returns a pipeline for opts that logs to stderr in the format and
+// at the level they ask for, and does not trace.
+func New(opts Options) *Pipeline {
+	return &Pipeline{
+		Options: opts,
+		Log:     newLogger(os.Stderr, opts.logFormat, opts.logLevel),
+		Tracer:  noop.NewTracerProvider().Tracer(tracerName),
+	}
+}
+
+// Run runs the stages once with client, which stays open for the caller
+// to close. The result describes the run whether or not it failed. The
+// run is bounded by -timeout, and cancelling ctx stops it the same way.
+func (p *Pipeline) Run(ctx context.Context, client *dagger.Client) (RunResult, error) {
+	// the deadline only cancels the queries in flight, so the caller can
+	// still close the client cleanly
+	ctx, cancel := withRunTimeout(ctx, p.Options)
+	defer cancel()
+	return runPipeline(ctx, client, p.Options, p.Log, p.Tracer)
+}
+
+// Watch reruns the stages whenever the host sources change, until ctx is
+// cancelled.
+func (p *Pipeline) Watch(ctx context.Context, client *dagger.Client) error {
+	return watch(ctx, client, p.Options, p.Log, p.Tracer)
+}
+
+// runPipeline runs the selected stages once, as one traced run. result is
+// filled in on the way out, failed runs included, so the returns below
+// leave it empty.
+func runPipeline(ctx context.Context, client *dagger.Client, opts Options, log *slog.Logger, tracer trace.Tracer) (result RunResult, err error) {
+	ctx, span := tracer.Start(ctx, "pipeline")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	id := runID(span)
+	log = log.With("run_id", id)
+
+	// what the stages that passed produced
+	reg := newArtifactRegistry()
+	if opts.logFile != "" {
+		reg.registerPath(artifactLog, artifactLog, opts.logFile)
+	}
+
+	// what -skip-unchanged may skip, recorded for the next run as the
+	// stages pass
+	cache := newResultCache(resultCacheFile, opts, log)
+	defer cache.save(log)
+
+	// report where the time went, including on failure
+	rec := newStageRecorder(log).withTracing(ctx, tracer).withTimeouts(opts.timeout, opts.stageTimeout).withFailFast(opts.failFast)
+	start := time.Now()
+	defer func() {
+		// an interrupted run reports what it got done, but skips the
+		// exports, which would keep the user waiting after Ctrl-C
+		stopped := interrupted(ctx) != nil
+
+		// export what this run cached even when it failed, as the next run
+		// starts from the same dependencies
+		if opts.cacheExport != "" && !stopped {
+			if size, err := exportCaches(context.Background(), client, opts); err != nil {
+				log.Warn("cache export failed", "path", opts.cacheExport, "error", err)
+			} else {
+				log.Info("exported caches", "path", opts.cacheExport, "size", formatBytes(size))
+			}
+		}
+
+		total := time.Since(start)
+		fmt.Print(formatTimings(rec.snapshot(), total))
+
+		result = newRunResult(rec.snapshot(), total, buildRef(opts), err)
+		result.Image = planImage(opts, opts.rustVersion)
+		result.RustVersion = opts.rustVersion
+		// a failed run still gets the exports of the checks that passed
+		if stopped {
+			result.Artifacts = reg.paths()
+		} else if err := reg.exportArtifacts(context.Background(), &result); err != nil {
+			log.Warn("artifact export failed", "error", err)
+		}
+		result.FlakyTests = append(result.FlakyTests, rec.flakyTests()...)
+
+		// the summary describes failed runs too, so a failure to write it
+		// fails the run but never masks the original error
+		if opts.summaryOut != "" {
+			if serr := writeSummary(opts.summaryOut, result); serr != nil {
+				serr = fmt.Errorf("write summary: %w", serr)
+				if err == nil {
+					err = serr
+				} else {
+					log.Error("write summary", "error", serr)
+				}
+			}
+		}
+
+		// a webhook failure is reported but never fails the run
+		if opts.notifyWebhook != "" {
+			if err := notify(context.Background(), opts.notifyWebhook, result); err != nil {
+				log.Warn("notify webhook", "error", err)
+			}
+		}
+	}()
+
+	defer func() {
+		// work outside any stage, e.g. resolving the sources, can also hit
+		// the run's deadline. This runs before the summary is written, so
+		// the summary reports the timeout too.
+		var timeoutErr *timeoutError
+		if err != nil && !errors.As(err, &timeoutErr) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = &timeoutError{stage: "pipeline", limit: opts.timeout, global: true}
+		}
+		// whichever stage noticed the cancellation first, the run was
+		// interrupted
+		if interruptErr := interrupted(ctx); err != nil && interruptErr != nil {
+			err = interruptErr
+		}
+	}()
+
+	annotate := func(err error) {
+		if opts.annotations {
+			writeAnnotations(os.Stdout, err, opts.gitSubpath)
+		}
+	}
+
+	// a cache that cannot be restored only makes the run slower
+	if opts.cacheImport != "" {
+		if err := importCaches(ctx, client, opts); err != nil {
+			log.Warn("cache import failed, continuing with a cold cache", "path", opts.cacheImport, "error", err)
+		} else {
+			log.Info("imported caches", "path", opts.cacheImport)
+		}
+	}
+
+	// get reference to the project
+	opts.gitRef = gitRefOrBranch(ctx, client, opts, log)
+	src := sourceDir(client, opts)
+	if err := checkCargoRegistries(ctx, src, opts.cargoRegistry); err != nil {
+		return result, err
+	}
+	if err := checkProfile(ctx, src, opts); err != nil {
+		return result, err
+	}
+
+	if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 {
+		return result, runMatrix(ctx, client, src, opts, rec)
+	}
+
+	rust := rustContainer(client, src, opts.rustVersion, "", opts)
+	// install the packages on their own, so that a failing install is not
+	// reported as a failing build
+	if len(opts.aptPackages) > 0 {
+		err := rec.measureStage(ctx, stageApt, func(ctx context.Context) error {
+			if _, err := rust.Sync(ctx); err != nil {
+				return stageFailed(stageApt, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	if err := checkPackages(ctx, rust, opts); err != nil {
+		return result, err
+	}
+	if opts.onlyChanged {
+		opts = onlyChanged(ctx, client, rust, opts, log)
+	}
+
+	// build hooks change the container every later stage starts from, so
+	// e.g. generated code is both built and checked
+	buildHooks := func(phase string) error {
+		if len(opts.config.hooks(phase)) == 0 {
+			return nil
+		}
+		return rec.measureStage(ctx, phase+" hooks", func(ctx context.Context) (err error) {
+			rust, err = runHooks(ctx, rust, phase, opts.config)
+			return err
+		})
+	}
+	if err := buildHooks(hookPreBuild); err != nil {
+		return result, err
+	}
+
+	// the stages after it start from the container holding the downloads,
+	// so prefetching also helps without cache volumes
+	if opts.prefetch {
+		err := rec.measureStage(ctx, stagePrefetch, func(ctx context.Context) (err error) {
+			rust, err = runPrefetch(ctx, rust, opts)
+			return err
+		})
+		if err != nil {
+			annotate(err)
+			return result, err
+		}
+	}
+
+	// release archives, once packaged
+	var archives []string
+
+	if opts.enabled(stageBuild) {
+		if len(opts.platforms) > 0 {
+			archives, err = runPlatformBuilds(ctx, client, src, opts, rec)
+		} else if !opts.warningsReport && cache.unchanged(stageBuild) {
+			// the binary on the host is current, and the later stages
+			// still start from the build, which the engine only runs if
+			// one of them needs it
+			rust = build(rust, opts)
+			rec.skipCached(stageBuild)
+		} else {
+			var warnings warningsReport
+			var output string
+			err = rec.measureStage(ctx, stageBuild, func(ctx context.Context) (err error) {
+				if rust, err = runBuild(ctx, rust, opts); err != nil || !opts.warningsReport {
+					return err
+				}
+				warnings, output, err = collectWarnings(ctx, rust, opts)
+				return err
+			})
+			if opts.memory > 0 && err == nil {
+				if peak, ok := peakMemory(ctx, rust); ok {
+					rec.recordPeakMemory(stageBuild, peak)
+					log.Info("build memory", "peak", formatBytes(peak), "memory", formatBytes(opts.memory))
+					if peak > opts.memory {
+						log.Warn("build used more than -memory, which the engine does not enforce", "peak", formatBytes(peak), "memory", formatBytes(opts.memory))
+					}
+				}
+			}
+			if opts.warningsReport && err == nil {
+				rec.recordOutput(stageBuild, output)
+				reg.registerPath(stageBuild, artifactReport, filepath.Join(buildDir, warningsFile))
+				log.Info("compiler warnings", "summary", warnings.String())
+			}
+			if err == nil {
+				cache.pass(stageBuild)
+				err = buildHooks(hookPostBuild)
+			}
+		}
+		if err != nil {
+			annotate(err)
+			return result, err
+		}
+		for _, path := range buildArtifacts(opts) {
+			kind := artifactBinary
+			if filepath.Base(path) == checksumsFile {
+				kind = artifactChecksums
+			}
+			reg.registerPath(stageBuild, kind, path)
+		}
+	}
+
+	// the remaining stages only read the built container, so run them
+	// side by side and report every failure rather than the first, unless
+	// -fail-fast stops the rest at the first
+	var errs []error
+	for _, res := range runChecks(ctx, rust, cache.filter(selectChecks(client, opts, rec, reg), rec), rec) {
+		if res.err != nil {
+			annotate(res.err)
+			errs = append(errs, res.err)
+			continue
+		}
+		cache.pass(res.name)
+		if path, kind := checkArtifact(res.name, opts); path != "" {
+			reg.registerPath(res.name, kind, path)
+		}
+		printCheckOutput(os.Stdout, opts.logLevel, res.label, res.output)
+	}
+	// the checks only register their container outputs, which are
+	// exported here one by one
+	if reg.pending() {
+		errs = append(errs, rec.measureStage(ctx, stageExport, func(ctx context.Context) error {
+			return reg.exportArtifacts(ctx, nil)
+		}))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return result, err
+	}
+
+	if opts.enabled(stageBuild) {
+		log.Info("application built", "binary", binaryPath(opts, ""))
+		if opts.strip && len(opts.platforms) == 0 {
+			reduction, err := measureStrip(ctx, rust, binaryPath(opts, ""), filepath.Join(buildDir, "merlin"))
+			if err != nil {
+				log.Warn("binary size unavailable", "error", err)
+			} else {
+				log.Info("stripped binary", "size", reduction.String())
+			}
+		}
+		if opts.sccache && len(opts.platforms) == 0 {
+			rate, err := sccacheHitRate(ctx, rust)
+			if err != nil {
+				log.Warn("sccache stats unavailable", "error", err)
+			} else {
+				log.Info("sccache stats", "hit_rate", rate)
+			}
+		}
+	}
+
+	// like benchmarks, the PGO workload must not compete with other stages
+	// for the CPU, or its profile would not be representative
+	if opts.pgo {
+		var summary string
+		err := rec.measureStage(ctx, stagePGO, func(ctx context.Context) (err error) {
+			summary, err = runPGO(ctx, client, rust, opts)
+			return err
+		})
+		if err != nil {
+			annotate(err)
+			return result, err
+		}
+		rec.recordOutput(stagePGO, summary)
+		reg.registerPath(stagePGO, artifactBinary, filepath.Join(pgoOut, "merlin"))
+		printCheckOutput(os.Stdout, opts.logLevel, "PGO build", summary)
+	}
+
+	// benchmarks run on their own, as anything sharing the engine with
+	// them skews the timings
+	if opts.bench {
+		var summary string
+		err := rec.measureStage(ctx, stageBench, func(ctx context.Context) (err error) {
+			summary, err = runBench(ctx, rust, opts)
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		rec.recordOutput(stageBench, summary)
+		reg.registerPath(stageBench, artifactReport, opts.benchOut)
+		printCheckOutput(os.Stdout, opts.logLevel, "Benchmarks", summary)
+	}
+
+	if opts.tarball && len(opts.platforms) == 0 {
+		err := rec.measureStage(ctx, stagePackage, func(ctx context.Context) error {
+			archive, err := packageHostBuild(ctx, client, src, rust)
+			if err == nil {
+				archives = append(archives, archive)
+				log.Info("packaged release", "path", archive)
+			}
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	for _, archive := range archives {
+		reg.registerPath(stagePackage, artifactArchive, archive)
+	}
+
+	if opts.provenance {
+		err := rec.measureStage(ctx, stageProvenance, func(ctx context.Context) error {
+			if err := writeProvenance(ctx, client, opts, releaseFiles(opts, archives), id, start); err != nil {
+				return fmt.Errorf("%s: %w", stageProvenance, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		reg.registerPath(stageProvenance, artifactProvenance, opts.provenanceOut)
+		log.Info("wrote provenance", "path", opts.provenanceOut)
+	}
+
+	// only publish once every check has passed
+	if opts.publish {
+		var sbom *dagger.File
+		if opts.sbom {
+			sbom = client.Host().File(opts.sbomOut)
+		}
+		var digest string
+		err := rec.measureStage(ctx, stagePublish, func(ctx context.Context) (err error) {
+			switch len(opts.platforms) {
+			case 0:
+				digest, err = publishImage(ctx, client, "", builtBinary(rust), sbom, opts.imageRef, opts.registryAuth)
+			case 1:
+				p := opts.platforms[0]
+				digest, err = publishImage(ctx, client, p, platformBinary(client, p), sbom, opts.imageRef, opts.registryAuth)
+			default:
+				digest, err = publishMultiArch(ctx, client, sbom, opts)
+			}
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		if len(opts.platforms) > 1 {
+			log.Info("published manifest list", "ref", digest, "platforms", len(opts.platforms))
+		} else {
+			log.Info("published image", "ref", digest)
+		}
+
+		// a signing failure fails the run, as an unsigned image would be
+		// rejected by whoever verifies it
+		if opts.sign {
+			var output string
+			files := releaseFiles(opts, archives)
+			if opts.provenance {
+				files = append(files, opts.provenanceOut)
+			}
+			err := rec.measureStage(ctx, stageSign, func(ctx context.Context) (err error) {
+				output, err = signArtifacts(ctx, client, digest, files, opts)
+				return err
+			})
+			if err != nil {
+				return result, err
+			}
+			for _, file := range files {
+				for _, suffix := range signatureSuffixes(opts.signKeyless) {
+					reg.registerPath(stageSign, artifactSignature, file+suffix)
+				}
+			}
+			if output != "" {
+				fmt.Println(output)
+			}
+			log.Info("signed image and artifacts", "ref", digest)
+		}
+	}
+
+	if opts.release {
+		err := rec.measureStage(ctx, stageRelease, func(ctx context.Context) error {
+			assets, err := stageReleaseAssets(archives)
+			if err != nil {
+				return fmt.Errorf("%s: %w", stageRelease, err)
+			}
+			if err := newGitHubClient(opts.githubRepo, opts.githubToken).createRelease(ctx, opts.releaseTag, assets); err != nil {
+				return fmt.Errorf("%s: %w", stageRelease, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		log.Info("created release", "repo", opts.githubRepo, "tag", opts.releaseTag)
+	}
+
+	// archive the build last, so it includes the signatures
+	if opts.s3Bucket != "" {
+		err := rec.measureStage(ctx, stageUpload, func(ctx context.Context) error {
+			files, err := uploadFiles(reg.paths())
+			if err != nil {
+				return fmt.Errorf("%s: %w", stageUpload, err)
+			}
+			return newS3Client(opts).uploadToS3(ctx, files)
+		})
+		if err != nil {
+			return result, err
+		}
+		log.Info("uploaded artifacts", "bucket", opts.s3Bucket)
+	}
+	return result, nil
+}
@@ -0,0 +1,17 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestMain runs the tests from the ci directory, where the command runs,
+// so the default -source is the project root just as for the CLI.
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
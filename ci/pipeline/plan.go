@@ -0,0 +1,258 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// formatPlan describes what a run with opts would do, in the order it
+// would do it, without touching Dagger.
+func formatPlan(opts Options) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	row := func(key, value string) { fmt.Fprintf(w, "%s\t%s\n", key, value) }
+
+	if opts.gitURL != "" {
+		source := opts.gitURL + "@" + opts.gitRef
+		if opts.gitSubpath != "" {
+			source += " (" + opts.gitSubpath + ")"
+		}
+		row("source", source)
+	} else {
+		source := "host directory " + opts.source
+		if opts.submodules {
+			source += " + submodules"
+		}
+		row("source", source)
+		// the defaults are always excluded, so only the additions are news
+		if defaults := len(sourceDefaultExcludes(opts)); len(opts.sourceExcludes) > defaults {
+			row("source filter", strings.Join(opts.sourceExcludes[defaults:], " "))
+		}
+	}
+	row("image", planImage(opts, opts.rustVersion))
+	if a := opts.baseRegistryAuth; a.complete() {
+		row("image pull", fmt.Sprintf("registry %s as %s", a.address, a.username))
+	}
+	if len(opts.aptPackages) > 0 {
+		row("apt packages", strings.Join(opts.aptPackages, " "))
+	}
+	if opts.cargoRegistry.index != "" {
+		row("cargo registry", opts.cargoRegistry.name+" "+opts.cargoRegistry.index)
+	}
+	for _, v := range opts.env {
+		row("env", v.name+"="+v.value)
+	}
+	for _, v := range opts.secretEnv {
+		row("env", v.name+" (secret)")
+	}
+
+	if entries := matrixEntries(opts); len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 {
+		for i, entry := range entries {
+			row(fmt.Sprintf("matrix %d", i+1), entry.label+" on "+planImage(entry.opts, entry.toolchain))
+		}
+	}
+
+	if opts.locked || len(opts.cargoBuildArgs) > 0 || len(opts.cargoTestArgs) > 0 {
+		row("build command", strings.Join(cargoBuildArgs(opts), " "))
+		row("test command", strings.Join(testArgs(opts), " "))
+	}
+	if args := workspaceArgs(opts); len(args) > 0 {
+		row("packages", strings.Join(args, " "))
+	}
+	if opts.onlyChanged {
+		row("packages", "members changed since "+opts.baseRef+" and their dependents")
+	}
+	if p := opts.clippyPolicy; p != nil && opts.enabled(stageClippy) {
+		row("clippy policy", fmt.Sprintf("deny %s, allow %s, max %d warnings", listOrNone(p.deny), listOrNone(p.allow), p.maxWarnings))
+	}
+
+	platforms := "host"
+	if len(opts.platforms) > 0 {
+		names := make([]string, len(opts.platforms))
+		for i, p := range opts.platforms {
+			names[i] = string(p)
+		}
+		platforms = strings.Join(names, ", ")
+	}
+	row("platforms", platforms)
+	if opts.benchCache {
+		row("cache benchmark", "cold then warm build under a throwaway cache prefix, instead of the stages below")
+	}
+
+	for i, stage := range planStages(opts) {
+		row(fmt.Sprintf("stage %d", i+1), stage)
+	}
+
+	if opts.jobs > 0 || opts.testThreads > 0 {
+		row("parallelism", fmt.Sprintf("jobs %s, test threads %s", countOrCPUs(opts.jobs), countOrCPUs(opts.testThreads)))
+	}
+	if opts.cpu > 0 || opts.memory > 0 {
+		row("resources", fmt.Sprintf("cpu %s, memory %s (applied as the parallelism above)", countOrNone(opts.cpu), bytesOrNone(opts.memory)))
+	}
+	if opts.timeout > 0 || opts.stageTimeout > 0 {
+		row("timeouts", fmt.Sprintf("run %s, stage %s", durationOrNone(opts.timeout), durationOrNone(opts.stageTimeout)))
+	}
+	if opts.skipUnchanged {
+		skip := "build, test, clippy and fmt when unchanged since they last passed (" + resultCacheFile + ")"
+		if opts.force {
+			skip = "nothing (-force), refreshing " + resultCacheFile
+		}
+		row("skip", skip)
+	}
+	if opts.failFast {
+		row("failures", "fail fast: the first failure cancels the concurrent stages")
+	}
+
+	if opts.noCache {
+		row("caches", "disabled")
+	} else {
+		for _, c := range planCaches(opts) {
+			row("cache", c)
+		}
+	}
+
+	publish := "disabled"
+	if opts.publish {
+		publish = fmt.Sprintf("%s (registry %s as %s)", opts.imageRef, opts.registryAuth.address, opts.registryAuth.username)
+		if len(opts.platforms) > 1 {
+			publish += fmt.Sprintf(", manifest list of %d platforms", len(opts.platforms))
+		}
+	}
+	row("publish", publish)
+	if opts.sign {
+		sign := "cosign key $" + cosignKeyEnv
+		if opts.signKeyless {
+			sign = "cosign keyless (OIDC)"
+		}
+		row("sign", sign)
+	}
+	if opts.release {
+		row("release", opts.githubRepo+" "+opts.releaseTag)
+	}
+	if opts.s3Bucket != "" {
+		c := newS3Client(opts)
+		row("upload", c.objectURL(s3Key(c.prefix, c.ref, ""))+"/")
+	}
+	w.Flush()
+	return b.String()
+}
+
+// listOrNone joins a list for the plan, or says "none".
+func listOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ",")
+}
+
+// countOrNone formats a limit for the plan, or says "none" when it is
+// disabled.
+func countOrNone(n int) string {
+	if n <= 0 {
+		return "none"
+	}
+	return strconv.Itoa(n)
+}
+
+// bytesOrNone formats a size limit for the plan, or says "none" when it is
+// disabled.
+func bytesOrNone(n int64) string {
+	if n <= 0 {
+		return "none"
+	}
+	return formatBytes(n)
+}
+
+// durationOrNone formats a deadline for the plan, or says "none" when it
+// is disabled.
+func durationOrNone(d time.Duration) string {
+	if d <= 0 {
+		return "none"
+	}
+	return d.String()
+}
+
+// planImage describes the image rustContainer would start from.
+func planImage(opts Options, toolchain string) string {
+	if opts.baseImage != "" && toolchain == opts.rustVersion {
+		return opts.baseImage
+	}
+	image := toolchainImage(toolchain)
+	if toolchain == "beta" || toolchain == "nightly" {
+		image += " + rustup " + toolchain
+	}
+	return image
+}
+
+// planStages lists the stages in the order run executes them. Checks run
+// concurrently, so they share one step.
+func planStages(opts Options) []string {
+	if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 {
+		return []string{"build+test per matrix entry (concurrent)"}
+	}
+
+	var stages []string
+	if opts.prefetch {
+		stages = append(stages, stagePrefetch)
+	}
+	if opts.enabled(stageBuild) {
+		build := stageBuild
+		if opts.strip {
+			build += " + strip"
+		}
+		if opts.warningsReport {
+			build += " + " + warningsFile
+		}
+		stages = append(stages, build)
+	}
+	// the closures are never called, so no client is needed to list them
+	var checks []string
+	for _, c := range selectChecks(nil, opts, nil, nil) {
+		checks = append(checks, c.name)
+	}
+	if len(checks) > 0 {
+		stages = append(stages, strings.Join(checks, ", ")+" (concurrent)")
+	}
+	// the checks exporting from their containers leave it to one step
+	if opts.docs || opts.musl {
+		stages = append(stages, stageExport)
+	}
+	if opts.pgo {
+		stages = append(stages, stagePGO)
+	}
+	if opts.bench {
+		stages = append(stages, stageBench)
+	}
+	if opts.tarball {
+		stages = append(stages, stagePackage)
+	}
+	if opts.provenance {
+		stages = append(stages, stageProvenance)
+	}
+	if opts.publish {
+		stages = append(stages, stagePublish)
+	}
+	if opts.sign {
+		stages = append(stages, stageSign)
+	}
+	if opts.release {
+		stages = append(stages, stageRelease)
+	}
+	if opts.s3Bucket != "" {
+		stages = append(stages, stageUpload)
+	}
+	return stages
+}
+
+// planCaches lists the cache volumes mounted into the main build
+// containers and where they are mounted.
+func planCaches(opts Options) []string {
+	var caches []string
+	for _, m := range cacheMounts(opts) {
+		caches = append(caches, m.volume+" -> "+m.dir)
+	}
+	return caches
+}
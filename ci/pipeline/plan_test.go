@@ -0,0 +1,34 @@
+package pipeline
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFormatPlan(t *testing.T) {
+	t.Setenv(registryPasswordEnv, "hunter2")
+	opts, err := ParseOptions([]string{
+		"-dry-run", "-source=pipeline/testdata/cargo", "-skip-fmt", "-audit", "-cache-prefix=pr-7",
+		"-publish", "-image-ref=ghcr.io/awdemos/merlin:pr-7", "-registry-user=ci",
+	}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"source     host directory pipeline/testdata/cargo",
+		"image      rust:1.75",
+		"platforms  host",
+		"stage 1    build",
+		"stage 2    test, doctest, clippy, audit (concurrent)",
+		"stage 3    publish",
+		"cache      pr-7-cargo-registry-ae445b8ab2db -> /usr/local/cargo/registry",
+		"cache      pr-7-cargo-git-ae445b8ab2db -> /usr/local/cargo/git",
+		"cache      pr-7-cargo-target-1.75-ae445b8ab2db -> /src/target",
+		"publish    ghcr.io/awdemos/merlin:pr-7 (registry ghcr.io as ci)",
+	}
+	if got := formatPlan(opts); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("formatPlan =\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// targetTriples maps the supported platforms to their Rust target.
+var targetTriples = map[dagger.Platform]string{
+	"linux/amd64":   "x86_64-unknown-linux-gnu",
+	"linux/arm64":   "aarch64-unknown-linux-gnu",
+	"linux/arm/v7":  "armv7-unknown-linux-gnueabihf",
+	"linux/386":     "i686-unknown-linux-gnu",
+	"linux/ppc64le": "powerpc64le-unknown-linux-gnu",
+	"linux/s390x":   "s390x-unknown-linux-gnu",
+	"linux/riscv64": "riscv64gc-unknown-linux-gnu",
+}
+
+// parsePlatforms splits a comma-separated platform list, rejecting
+// platforms without a known Rust target.
+func parsePlatforms(list string) ([]dagger.Platform, error) {
+	var platforms []dagger.Platform
+	seen := make(map[dagger.Platform]bool)
+	for _, name := range strings.Split(list, ",") {
+		p := dagger.Platform(strings.TrimSpace(name))
+		if p == "" || seen[p] {
+			continue
+		}
+		if _, ok := targetTriples[p]; !ok {
+			return nil, fmt.Errorf("unsupported platform %q (supported: %s)", p, strings.Join(supportedPlatforms(), ", "))
+		}
+		seen[p] = true
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+func supportedPlatforms() []string {
+	var names []string
+	for p := range targetTriples {
+		names = append(names, string(p))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// platformDir names the per-platform output directory, e.g. linux-arm64.
+func platformDir(p dagger.Platform) string {
+	return strings.ReplaceAll(string(p), "/", "-")
+}
+
+// buildTarget defines a release build for a Rust target triple and copies
+// the binary to the output directory.
+func buildTarget(rust *dagger.Container, triple string, opts Options) *dagger.Container {
+	return withStrip(rust.
+		WithExec([]string{"rustup", "target", "add", triple}).
+		WithExec(cargoBuildArgs(opts, "--target", triple)).
+		WithExec([]string{"install", "-D", binaryPath(opts, triple), outputDir + "/merlin"}), opts)
+}
+
+// runPlatformBuilds builds a release binary for every requested platform
+// concurrently, each in a container running on that platform, and exports
+// them to ./build/<platform>/ so they don't collide. With opts.tarball each
+// platform is also packaged into its own release archive, and the archive
+// paths are returned in platform order.
+func runPlatformBuilds(ctx context.Context, client *dagger.Client, src *dagger.Directory, opts Options, rec *stageRecorder) ([]string, error) {
+	var manifest cargoManifest
+	if opts.tarball {
+		var err error
+		if manifest, err = readManifest(ctx, src); err != nil {
+			return nil, fmt.Errorf("%s: %w", stagePackage, err)
+		}
+	}
+
+	errs := make([]error, len(opts.platforms))
+	archives := make([]string, len(opts.platforms))
+	ctx, report, release := rec.concurrent(ctx)
+	defer release()
+
+	var wg sync.WaitGroup
+	for i, p := range opts.platforms {
+		wg.Add(1)
+		go func(i int, p dagger.Platform) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					errs[i] = fmt.Errorf("%s (%s): panic: %v", stageBuild, p, r)
+				}
+			}()
+
+			name := fmt.Sprintf("%s (%s)", stageBuild, p)
+			rust := rustContainer(client, src, opts.rustVersion, p, opts)
+			out := filepath.Join(buildDir, platformDir(p))
+			errs[i] = rec.measureStage(ctx, name, func(ctx context.Context) error {
+				built, err := syncWithRetry(ctx, buildTarget(rust, targetTriples[p], opts), opts)
+				if err != nil {
+					return stageFailed(name, err)
+				}
+				if _, err := built.Directory(outputDir).Export(ctx, out); err != nil {
+					return stageFailed(name, err)
+				}
+				if err := verifyExport(ctx, built, outputDir+"/merlin", filepath.Join(out, "merlin")); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				if opts.checksums {
+					if err := writeChecksums(out); err != nil {
+						return fmt.Errorf("%s: checksums: %w", name, err)
+					}
+				}
+				if opts.tarball {
+					archive, err := packageRelease(ctx, src, built.Directory(outputDir), releaseName(manifest, p))
+					if err != nil {
+						return err
+					}
+					archives[i] = archive
+					rec.log.Info("packaged release", "platform", p, "path", archive)
+				}
+				if opts.strip {
+					reduction, err := measureStrip(ctx, built, binaryPath(opts, targetTriples[p]), filepath.Join(out, "merlin"))
+					if err != nil {
+						rec.log.Warn("binary size unavailable", "platform", p, "error", err)
+					} else {
+						rec.log.Info("stripped binary", "platform", p, "size", reduction.String())
+					}
+				}
+				rec.log.Info("exported binary", "platform", p, "path", out)
+				return nil
+			})
+			report(name, errs[i])
+		}(i, p)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if !opts.tarball {
+		return nil, nil
+	}
+	return archives, nil
+}
@@ -0,0 +1,29 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestParsePlatforms(t *testing.T) {
+	got, err := parsePlatforms("linux/amd64, linux/arm64,linux/amd64,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dagger.Platform{"linux/amd64", "linux/arm64"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePlatforms = %v, want %v", got, want)
+	}
+
+	if _, err := parsePlatforms("linux/amd64,windows/amd64"); err == nil {
+		t.Error("parsePlatforms accepted windows/amd64")
+	}
+}
+
+func TestPlatformDir(t *testing.T) {
+	if got := platformDir("linux/arm/v7"); got != "linux-arm-v7" {
+		t.Errorf("platformDir = %q, want linux-arm-v7", got)
+	}
+}
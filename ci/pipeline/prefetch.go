@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"dagger.io/dagger"
+)
+
+const stagePrefetch = "prefetch"
+
+// fetchArgs downloads every dependency of the workspace into the registry
+// cache.
+func fetchArgs(opts Options) []string {
+	return append([]string{"cargo", "fetch"}, lockArgs(opts)...)
+}
+
+// prefetchTestArgs compiles the test targets without running them, which
+// also builds the dependencies the tests share with the debug build. There
+// is no --no-run for cargo build, so the test command is reused.
+func prefetchTestArgs(opts Options) []string {
+	args := cargoTestArgs(opts)
+	for i, arg := range args {
+		if arg == "--" {
+			return append(append(append([]string(nil), args[:i]...), "--no-run"), args[i:]...)
+		}
+	}
+	return append(args, "--no-run")
+}
+
+// validatePrefetch rejects the builds prefetch does not run before.
+func validatePrefetch(opts Options) error {
+	if opts.prefetch && (len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 || len(opts.platforms) > 0) {
+		return fmt.Errorf("-prefetch does not support -matrix, -feature-matrix or -platforms")
+	}
+	return nil
+}
+
+// runPrefetch downloads the dependencies, retrying network failures on
+// their own, and then compiles the test targets, so that the build and
+// test stages start from warm caches. Compiling is skipped when the test
+// stage won't run.
+func runPrefetch(ctx context.Context, rust *dagger.Container, opts Options) (*dagger.Container, error) {
+	fetched, err := syncWithRetry(ctx, rust.WithExec(fetchArgs(opts)), opts)
+	if err != nil {
+		return nil, stageFailed(stagePrefetch, err)
+	}
+	if !opts.enabled(stageTest) {
+		return fetched, nil
+	}
+	compiled, err := fetched.WithExec(prefetchTestArgs(opts)).Sync(ctx)
+	if err != nil {
+		return nil, stageFailed(stagePrefetch, err)
+	}
+	return compiled, nil
+}
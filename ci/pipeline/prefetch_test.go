@@ -0,0 +1,28 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPrefetchArgs(t *testing.T) {
+	opts, err := ParseOptions([]string{"-prefetch", "-locked", "-cargo-test-args=-- --test-threads=1"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fetchArgs(opts), []string{"cargo", "fetch", "--locked"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fetchArgs = %q, want %q", got, want)
+	}
+	want := []string{"cargo", "test", "--lib", "--bins", "--tests", "--locked", "--no-run", "--", "--test-threads=1"}
+	if got := prefetchTestArgs(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("prefetchTestArgs = %q, want %q", got, want)
+	}
+	if got := planStages(opts); got[0] != stagePrefetch {
+		t.Errorf("planStages = %q, want %s first", got, stagePrefetch)
+	}
+
+	if _, err := ParseOptions([]string{"-prefetch", "-matrix=1.70,stable"}, io.Discard); err == nil {
+		t.Error("-prefetch with -matrix succeeded, want error")
+	}
+}
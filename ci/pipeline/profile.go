@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// defaultProfile is the cargo profile the pipeline builds with.
+const defaultProfile = "release"
+
+// builtinProfiles are the cargo profiles that exist without a [profile.*]
+// table in Cargo.toml, each with the target/ subdirectory it builds into.
+var builtinProfiles = map[string]string{
+	"dev":     "debug",
+	"test":    "debug",
+	"release": "release",
+	"bench":   "release",
+}
+
+// profileNamePattern is what cargo accepts as a profile name.
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// cargoProfile returns the profile opts builds with. Options not parsed
+// from flags leave it empty, which means the default.
+func cargoProfile(opts Options) string {
+	if opts.profile == "" {
+		return defaultProfile
+	}
+	return opts.profile
+}
+
+// profileArgs selects the cargo profile in opts, keeping the familiar
+// --release for the default.
+func profileArgs(opts Options) []string {
+	if profile := cargoProfile(opts); profile != defaultProfile {
+		return []string{"--profile", profile}
+	}
+	return []string{"--release"}
+}
+
+// profileDir returns the target/ subdirectory a profile builds into: the
+// built-in profiles use debug or release, custom ones their own name.
+func profileDir(profile string) string {
+	if dir, ok := builtinProfiles[profile]; ok {
+		return dir
+	}
+	return profile
+}
+
+// binaryPath returns the built binary relative to the project root, under
+// target/<triple>/ when cross-compiling for triple.
+func binaryPath(opts Options, triple string) string {
+	dir := "target/"
+	if triple != "" {
+		dir += triple + "/"
+	}
+	return dir + profileDir(cargoProfile(opts)) + "/merlin"
+}
+
+// validateProfile rejects names cargo would not accept. "debug" is
+// reserved by cargo for the target/debug directory of the dev profile.
+func validateProfile(opts Options) error {
+	if !profileNamePattern.MatchString(opts.profile) {
+		return fmt.Errorf("invalid -profile %q", opts.profile)
+	}
+	if opts.profile == "debug" {
+		return fmt.Errorf("-profile debug is reserved by cargo; use -profile dev")
+	}
+	return nil
+}
+
+// checkProfile fails when the project's Cargo.toml does not define the
+// custom profile in opts, before any build is attempted.
+func checkProfile(ctx context.Context, src *dagger.Directory, opts Options) error {
+	profile := cargoProfile(opts)
+	if _, ok := builtinProfiles[profile]; ok {
+		return nil
+	}
+	manifest, err := readManifest(ctx, src)
+	if err != nil {
+		return err
+	}
+	return missingProfile(manifest, profile)
+}
+
+// missingProfile reports a custom profile that manifest does not define.
+func missingProfile(manifest cargoManifest, profile string) error {
+	if _, ok := manifest.Profile[profile]; ok {
+		return nil
+	}
+	defined := sortedKeys(manifest.Profile)
+	if len(defined) == 0 {
+		return fmt.Errorf("Cargo.toml defines no [profile.%s]", profile)
+	}
+	return fmt.Errorf("Cargo.toml defines no [profile.%s] (defined: %s)", profile, strings.Join(defined, ", "))
+}
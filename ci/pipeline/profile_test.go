@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+	tests := []struct {
+		profile string
+		args    []string
+		binary  string
+	}{
+		{"release", []string{"--release"}, "target/release/merlin"},
+		{"dev", []string{"--profile", "dev"}, "target/debug/merlin"},
+		{"bench", []string{"--profile", "bench"}, "target/release/merlin"},
+		{"dist", []string{"--profile", "dist"}, "target/dist/merlin"},
+	}
+	for _, tt := range tests {
+		opts, err := ParseOptions([]string{"-profile=" + tt.profile}, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := profileArgs(opts); !reflect.DeepEqual(got, tt.args) {
+			t.Errorf("profileArgs(%s) = %q, want %q", tt.profile, got, tt.args)
+		}
+		if got := binaryPath(opts, ""); got != tt.binary {
+			t.Errorf("binaryPath(%s) = %q, want %q", tt.profile, got, tt.binary)
+		}
+	}
+
+	opts := Options{profile: "dist"}
+	if got, want := binaryPath(opts, "aarch64-unknown-linux-gnu"), "target/aarch64-unknown-linux-gnu/dist/merlin"; got != want {
+		t.Errorf("binaryPath with a target = %q, want %q", got, want)
+	}
+
+	for _, args := range [][]string{{"-profile="}, {"-profile=debug"}, {"-profile=dist;rm"}} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestMissingProfile(t *testing.T) {
+	manifest, err := parseManifest([]byte("[package]\nname = \"merlin\"\n\n[profile.dist]\ninherits = \"release\"\nlto = true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := missingProfile(manifest, "dist"); err != nil {
+		t.Errorf("missingProfile(dist): %v", err)
+	}
+	if err := missingProfile(manifest, "ci"); err == nil {
+		t.Error("missingProfile(ci) succeeded, want error")
+	}
+}
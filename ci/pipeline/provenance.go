@@ -0,0 +1,272 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageProvenance = "provenance"
+	// defaultProvenanceOut is where -provenance writes the attestation.
+	defaultProvenanceOut = "./build/provenance.json"
+)
+
+// in-toto and SLSA identifiers of the attestation
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	provenanceBuildType = "https://github.com/awdemos/merlin/tree/main/ci#dagger-build/v1"
+	// localBuilderID identifies the pipeline when it does not run on
+	// GitHub Actions, whose workflow identifies it there
+	localBuilderID = "https://github.com/awdemos/merlin/tree/main/ci"
+)
+
+// Material is an input of the build and its digests, keyed by algorithm
+// such as sha256 or gitCommit.
+type Material struct {
+	URI    string
+	Digest map[string]string
+}
+
+// Subject is a built artifact and its SHA-256 digest.
+type Subject struct {
+	Name   string
+	SHA256 string
+}
+
+// BuildMeta describes one build, for buildProvenance.
+type BuildMeta struct {
+	BuilderID    string
+	InvocationID string
+	Source       Material
+	BaseImage    Material
+	Command      []string
+	Features     []string
+	Subjects     []Subject
+	StartedOn    time.Time
+	FinishedOn   time.Time
+}
+
+// provenance statement, in the SLSA v1 schema
+type (
+	provenanceStatement struct {
+		Type          string              `json:"_type"`
+		Subject       []provenanceSubject `json:"subject"`
+		PredicateType string              `json:"predicateType"`
+		Predicate     provenancePredicate `json:"predicate"`
+	}
+	provenanceSubject struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	}
+	provenancePredicate struct {
+		BuildDefinition struct {
+			BuildType            string                `json:"buildType"`
+			ExternalParameters   map[string]any        `json:"externalParameters"`
+			ResolvedDependencies []provenanceReference `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+			Metadata struct {
+				InvocationID string `json:"invocationId,omitempty"`
+				StartedOn    string `json:"startedOn"`
+				FinishedOn   string `json:"finishedOn"`
+			} `json:"metadata"`
+		} `json:"runDetails"`
+	}
+	provenanceReference struct {
+		URI    string            `json:"uri"`
+		Digest map[string]string `json:"digest,omitempty"`
+	}
+)
+
+// buildProvenance assembles the in-toto statement carrying the SLSA
+// provenance of a build. Subjects are listed by name.
+func buildProvenance(meta BuildMeta) ([]byte, error) {
+	if meta.BuilderID == "" {
+		return nil, errors.New("provenance: no builder identity")
+	}
+	if len(meta.Subjects) == 0 {
+		return nil, errors.New("provenance: no artifacts to attest")
+	}
+
+	st := provenanceStatement{Type: inTotoStatementType, PredicateType: slsaProvenanceType}
+	subjects := append([]Subject(nil), meta.Subjects...)
+	sort.Slice(subjects, func(i, j int) bool { return subjects[i].Name < subjects[j].Name })
+	for _, s := range subjects {
+		st.Subject = append(st.Subject, provenanceSubject{Name: s.Name, Digest: map[string]string{"sha256": s.SHA256}})
+	}
+
+	def := &st.Predicate.BuildDefinition
+	def.BuildType = provenanceBuildType
+	def.ExternalParameters = map[string]any{
+		"source":  meta.Source.URI,
+		"command": meta.Command,
+	}
+	if len(meta.Features) > 0 {
+		def.ExternalParameters["features"] = meta.Features
+	}
+	for _, m := range []Material{meta.Source, meta.BaseImage} {
+		if m.URI != "" {
+			def.ResolvedDependencies = append(def.ResolvedDependencies, provenanceReference{URI: m.URI, Digest: m.Digest})
+		}
+	}
+
+	run := &st.Predicate.RunDetails
+	run.Builder.ID = meta.BuilderID
+	run.Metadata.InvocationID = meta.InvocationID
+	run.Metadata.StartedOn = meta.StartedOn.UTC().Format(time.RFC3339)
+	run.Metadata.FinishedOn = meta.FinishedOn.UTC().Format(time.RFC3339)
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// builderID identifies who ran the build: the GitHub Actions workflow, or
+// the pipeline itself outside of it.
+func builderID() string {
+	if ref := os.Getenv("GITHUB_WORKFLOW_REF"); ref != "" {
+		return "https://github.com/" + ref
+	}
+	return localBuilderID
+}
+
+// localCommit resolves the commit checked out in the git working tree at
+// dir, following HEAD through loose and packed refs.
+func localCommit(dir string) (string, error) {
+	gitDir := filepath.Join(dir, ".git")
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	ref, ok := strings.CutPrefix(strings.TrimSpace(string(head)), "ref: ")
+	if !ok {
+		return strings.TrimSpace(string(head)), nil
+	}
+	if data, err := os.ReadFile(filepath.Join(gitDir, filepath.FromSlash(ref))); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	packed, err := os.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", ref, err)
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		if commit, name, ok := strings.Cut(strings.TrimSpace(line), " "); ok && name == ref {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("resolve %s: not found", ref)
+}
+
+// sourceMaterial describes the built sources and the commit they are at.
+func sourceMaterial(ctx context.Context, client *dagger.Client, opts Options) (Material, error) {
+	if opts.gitURL != "" {
+		commit, err := gitRef(client.Git(opts.gitURL), opts.gitRef).Commit(ctx)
+		if err != nil {
+			return Material{}, fmt.Errorf("resolve %s@%s: %w", opts.gitURL, opts.gitRef, err)
+		}
+		return Material{URI: "git+" + opts.gitURL + "@" + opts.gitRef, Digest: map[string]string{"gitCommit": commit}}, nil
+	}
+
+	dir, err := filepath.Abs(opts.source)
+	if err != nil {
+		return Material{}, err
+	}
+	commit, err := localCommit(dir)
+	if err != nil {
+		return Material{}, fmt.Errorf("resolve the commit of %s: %w", dir, err)
+	}
+	uri := "git+file://" + filepath.ToSlash(dir)
+	if ref := buildRef(opts); ref != "" && ref != commit {
+		uri += "@" + ref
+	}
+	return Material{URI: uri, Digest: map[string]string{"gitCommit": commit}}, nil
+}
+
+// imageMaterial describes the image the build started from, resolved to
+// the digest the engine pulled.
+func imageMaterial(ctx context.Context, client *dagger.Client, opts Options) (Material, error) {
+	image := buildImage(opts)
+	var ctr *dagger.Container
+	if opts.baseImage != "" {
+		ctr = pullBaseImage(client, "", opts)
+	} else {
+		ctr = client.Container().From(image)
+	}
+	ref, err := ctr.ImageRef(ctx)
+	if err != nil {
+		return Material{}, fmt.Errorf("resolve %s: %w", image, err)
+	}
+	name, digest, ok := strings.Cut(ref, "@sha256:")
+	if !ok {
+		return Material{}, fmt.Errorf("resolve %s: no digest in %s", image, ref)
+	}
+	return Material{URI: "oci://" + name, Digest: map[string]string{"sha256": digest}}, nil
+}
+
+// subjects digests the built files, named as they are uploaded.
+func subjects(files []string) ([]Subject, error) {
+	var out []Subject
+	for _, file := range files {
+		sum, err := sha256File(file)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Subject{Name: uploadName(file), SHA256: sum})
+	}
+	return out, nil
+}
+
+// writeProvenance resolves the build's materials, digests files and writes
+// the attestation to opts.provenanceOut.
+func writeProvenance(ctx context.Context, client *dagger.Client, opts Options, files []string, invocationID string, started time.Time) error {
+	source, err := sourceMaterial(ctx, client, opts)
+	if err != nil {
+		return err
+	}
+	image, err := imageMaterial(ctx, client, opts)
+	if err != nil {
+		return err
+	}
+	subs, err := subjects(files)
+	if err != nil {
+		return err
+	}
+	data, err := buildProvenance(BuildMeta{
+		BuilderID:    builderID(),
+		InvocationID: invocationID,
+		Source:       source,
+		BaseImage:    image,
+		Command:      cargoBuildArgs(opts),
+		Features:     opts.features,
+		Subjects:     subs,
+		StartedOn:    started,
+		FinishedOn:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeReport(opts.provenanceOut, data)
+}
+
+// validateProvenance checks that there is a build to attest.
+func validateProvenance(opts Options) error {
+	if opts.provenance && !opts.enabled(stageBuild) {
+		return fmt.Errorf("-provenance requires the build stage")
+	}
+	return nil
+}
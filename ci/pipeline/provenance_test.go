@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildProvenance(t *testing.T) {
+	started := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	data, err := buildProvenance(BuildMeta{
+		BuilderID:    "https://github.com/awdemos/merlin/.github/workflows/ci.yml@refs/heads/main",
+		InvocationID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		Source:       Material{URI: "git+https://github.com/awdemos/merlin.git@main", Digest: map[string]string{"gitCommit": "4d89438a"}},
+		BaseImage:    Material{URI: "oci://docker.io/library/rust:1.75", Digest: map[string]string{"sha256": "aaaa"}},
+		Command:      []string{"cargo", "build", "--release"},
+		Subjects: []Subject{
+			{Name: "merlin-0.1.0-linux-amd64.tar.gz", SHA256: "cccc"},
+			{Name: "merlin", SHA256: "bbbb"},
+		},
+		StartedOn:  started,
+		FinishedOn: started.Add(90 * time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"_type": "https://in-toto.io/Statement/v1",
+		"subject": []any{
+			map[string]any{"name": "merlin", "digest": map[string]any{"sha256": "bbbb"}},
+			map[string]any{"name": "merlin-0.1.0-linux-amd64.tar.gz", "digest": map[string]any{"sha256": "cccc"}},
+		},
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate": map[string]any{
+			"buildDefinition": map[string]any{
+				"buildType": provenanceBuildType,
+				"externalParameters": map[string]any{
+					"source":  "git+https://github.com/awdemos/merlin.git@main",
+					"command": []any{"cargo", "build", "--release"},
+				},
+				"resolvedDependencies": []any{
+					map[string]any{"uri": "git+https://github.com/awdemos/merlin.git@main", "digest": map[string]any{"gitCommit": "4d89438a"}},
+					map[string]any{"uri": "oci://docker.io/library/rust:1.75", "digest": map[string]any{"sha256": "aaaa"}},
+				},
+			},
+			"runDetails": map[string]any{
+				"builder": map[string]any{"id": "https://github.com/awdemos/merlin/.github/workflows/ci.yml@refs/heads/main"},
+				"metadata": map[string]any{
+					"invocationId": "4bf92f3577b34da6a3ce929d0e0e4736",
+					"startedOn":    "2024-03-01T12:00:00Z",
+					"finishedOn":   "2024-03-01T12:01:30Z",
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildProvenance =\n%s", data)
+	}
+
+	if _, err := buildProvenance(BuildMeta{BuilderID: localBuilderID}); err == nil {
+		t.Error("buildProvenance without subjects succeeded, want error")
+	}
+}
+
+func TestLocalCommit(t *testing.T) {
+	const commit = "4d89438a1f6f0d3c1e9c9d7b3f0c8e2a5b6d7e8f"
+	dir := t.TempDir()
+	write := func(name, data string) {
+		t.Helper()
+		path := filepath.Join(dir, ".git", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("HEAD", "ref: refs/heads/main\n")
+	write("packed-refs", "# pack-refs with: peeled fully-peeled sorted\n"+commit+" refs/heads/main\n")
+	if got, err := localCommit(dir); err != nil || got != commit {
+		t.Errorf("localCommit(packed) = %q, %v", got, err)
+	}
+
+	write("refs/heads/main", "0123456789abcdef0123456789abcdef01234567\n")
+	if got, err := localCommit(dir); err != nil || got != "0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("localCommit(loose) = %q, %v", got, err)
+	}
+
+	write("HEAD", commit+"\n")
+	if got, err := localCommit(dir); err != nil || got != commit {
+		t.Errorf("localCommit(detached) = %q, %v", got, err)
+	}
+}
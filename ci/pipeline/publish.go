@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"dagger.io/dagger"
+)
+
+const stagePublish = "publish"
+
+// runtimeImage is the base of the published image (see runtimeContainer).
+const runtimeImage = "debian:bookworm-slim"
+
+// publishImage packages binary, and sbom unless nil, into a minimal runtime
+// image for platform (the host's when empty) and pushes it to ref using
+// auth, returning the published reference including its digest.
+func publishImage(ctx context.Context, client *dagger.Client, platform dagger.Platform, binary, sbom *dagger.File, ref string, auth registryAuth) (string, error) {
+	digest, err := auth.apply(client, runtimeImageFor(client, platform, binary, sbom)).Publish(ctx, ref)
+	if err != nil {
+		return "", stageFailed(stagePublish, err)
+	}
+	return digest, nil
+}
+
+// runtimeImageFor returns the image published for binary on platform.
+func runtimeImageFor(client *dagger.Client, platform dagger.Platform, binary, sbom *dagger.File) *dagger.Container {
+	image := runtimeContainer(client, platform, binary).
+		WithEntrypoint([]string{runtimeBinaryPath})
+	if sbom != nil {
+		image = withSBOM(image, sbom)
+	}
+	return image
+}
+
+// builtBinary returns the release binary from a container built by build.
+func builtBinary(rust *dagger.Container) *dagger.File {
+	return rust.File(outputDir + "/merlin")
+}
+
+// publishAuth resolves the push credentials, defaulting the registry
+// address to the host of the image reference.
+func publishAuth(addr, user, ref string) registryAuth {
+	if addr == "" && ref != "" {
+		addr = registryHost(ref)
+	}
+	return registryAuth{address: addr, username: user, password: os.Getenv(registryPasswordEnv)}
+}
+
+// validatePublish checks that a publish request can be satisfied.
+func validatePublish(opts Options) error {
+	if !opts.publish {
+		return nil
+	}
+	if opts.imageRef == "" {
+		return fmt.Errorf("-publish requires -image-ref")
+	}
+	if !opts.enabled(stageBuild) {
+		return fmt.Errorf("-publish requires the build stage")
+	}
+	if !opts.registryAuth.complete() {
+		return fmt.Errorf("-publish requires registry credentials: set -registry-user and $%s", registryPasswordEnv)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	stageRelease   = "release"
+	githubTokenEnv = "GITHUB_TOKEN"
+	githubAPI      = "https://api.github.com"
+)
+
+// releaseDir collects the assets of a GitHub release and their checksums.
+var releaseDir = filepath.Join(buildDir, stageRelease)
+
+// githubClient is the subset of the GitHub REST API used to publish
+// releases.
+type githubClient struct {
+	api   string // base URL, githubAPI outside tests
+	repo  string // owner/name
+	token string
+	http  *http.Client
+}
+
+// newGitHubClient returns a client for repo authenticating with token.
+func newGitHubClient(repo, token string) *githubClient {
+	return &githubClient{api: githubAPI, repo: repo, token: token, http: &http.Client{Timeout: 5 * time.Minute}}
+}
+
+// isPrerelease reports whether tag names a release candidate or beta.
+func isPrerelease(tag string) bool {
+	return strings.Contains(tag, "-rc") || strings.Contains(tag, "-beta")
+}
+
+// releaseTag returns the tag to release: -release-tag if set, or the tag
+// GitHub Actions is building.
+func releaseTag(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	if os.Getenv("GITHUB_REF_TYPE") == "tag" {
+		return os.Getenv("GITHUB_REF_NAME")
+	}
+	return ""
+}
+
+// stageReleaseAssets copies the release archives into releaseDir next to a
+// SHA256SUMS covering them, and returns the paths of every asset.
+func stageReleaseAssets(archives []string) ([]string, error) {
+	if err := os.RemoveAll(releaseDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(releaseDir, 0o755); err != nil {
+		return nil, err
+	}
+	var assets []string
+	for _, archive := range archives {
+		data, err := os.ReadFile(archive)
+		if err != nil {
+			return nil, err
+		}
+		asset := filepath.Join(releaseDir, filepath.Base(archive))
+		if err := os.WriteFile(asset, data, 0o644); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	if err := writeChecksums(releaseDir); err != nil {
+		return nil, err
+	}
+	return append(assets, filepath.Join(releaseDir, checksumsFile)), nil
+}
+
+// createRelease creates a release for tag and uploads each asset under its
+// base name.
+func (c *githubClient) createRelease(ctx context.Context, tag string, assets []string) error {
+	body, err := json.Marshal(map[string]any{
+		"tag_name":   tag,
+		"name":       tag,
+		"prerelease": isPrerelease(tag),
+	})
+	if err != nil {
+		return err
+	}
+
+	var release struct {
+		UploadURL string `json:"upload_url"`
+	}
+	endpoint := fmt.Sprintf("%s/repos/%s/releases", c.api, c.repo)
+	if err := c.do(ctx, endpoint, "application/json", bytes.NewReader(body), int64(len(body)), &release); err != nil {
+		return fmt.Errorf("create release %s: %w", tag, err)
+	}
+
+	// upload_url is a URI template ending in {?name,label}
+	uploadURL, _, _ := strings.Cut(release.UploadURL, "{")
+	for _, asset := range assets {
+		if err := c.upload(ctx, uploadURL, asset); err != nil {
+			return fmt.Errorf("upload %s: %w", filepath.Base(asset), err)
+		}
+	}
+	return nil
+}
+
+// upload attaches the file at path to the release behind uploadURL.
+func (c *githubClient) upload(ctx context.Context, uploadURL, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	endpoint := uploadURL + "?name=" + url.QueryEscape(filepath.Base(path))
+	return c.do(ctx, endpoint, "application/octet-stream", f, info.Size(), nil)
+}
+
+// do POSTs body to endpoint and decodes the JSON response into out unless
+// it is nil.
+func (c *githubClient) do(ctx context.Context, endpoint, contentType string, body io.Reader, size int64, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// githubRepoPattern matches an owner/name repository.
+var githubRepoPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// validateRelease checks that a release can be created.
+func validateRelease(opts Options) error {
+	if !opts.release {
+		return nil
+	}
+	if opts.releaseTag == "" {
+		return fmt.Errorf("-release requires -release-tag (or a tag build on GitHub Actions)")
+	}
+	if !githubRepoPattern.MatchString(opts.githubRepo) {
+		return fmt.Errorf("-release requires -github-repo in owner/name form, got %q", opts.githubRepo)
+	}
+	if opts.githubToken == "" {
+		return fmt.Errorf("-release requires $%s", githubTokenEnv)
+	}
+	if !opts.enabled(stageBuild) {
+		return fmt.Errorf("-release requires the build stage")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIsPrerelease(t *testing.T) {
+	for tag, want := range map[string]bool{
+		"v1.2.0":        false,
+		"v1.2.0-rc.1":   true,
+		"v1.2.0-beta":   true,
+		"v1.2.0-alpha1": false,
+	} {
+		if got := isPrerelease(tag); got != want {
+			t.Errorf("isPrerelease(%q) = %v, want %v", tag, got, want)
+		}
+	}
+}
+
+func TestCreateRelease(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		created  map[string]any
+		uploaded = make(map[string]string)
+	)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/repos/awdemos/merlin/releases":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"upload_url": srv.URL + "/uploads/1/assets{?name,label}"})
+		case "/uploads/1/assets":
+			data, _ := io.ReadAll(r.Body)
+			uploaded[r.URL.Query().Get("name")] = string(data)
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "{}")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	asset := filepath.Join(dir, "merlin-0.1.0-linux-amd64.tar.gz")
+	if err := os.WriteFile(asset, []byte("archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	gh := newGitHubClient("awdemos/merlin", "s3cret")
+	gh.api = srv.URL
+	if err := gh.createRelease(context.Background(), "v0.1.0-rc.1", []string{asset}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{"tag_name": "v0.1.0-rc.1", "name": "v0.1.0-rc.1", "prerelease": true}
+	if !reflect.DeepEqual(created, want) {
+		t.Errorf("release request = %v, want %v", created, want)
+	}
+	if got := uploaded["merlin-0.1.0-linux-amd64.tar.gz"]; got != "archive" {
+		t.Errorf("uploaded assets = %v", uploaded)
+	}
+
+	gh.token = "wrong"
+	if err := gh.createRelease(context.Background(), "v0.1.0", nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("createRelease with a bad token = %v, want a 401 error", err)
+	}
+}
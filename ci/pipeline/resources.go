@@ -0,0 +1,123 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// memoryPerJob is what one rustc process of a release build is budgeted,
+// for capping -jobs by -memory. Large crates take more, most take less.
+const memoryPerJob = 2 << 30
+
+// exitKilled is the status a shell reports for a command killed by
+// SIGKILL, which is how the kernel's OOM killer stops a process.
+const exitKilled = 137
+
+// peakMemoryFile is where the build leaves the peak memory use of its
+// cgroup, when the kernel reports it (cgroup v2, Linux 5.19 or later).
+const peakMemoryFile = "/tmp/merlin-peak-memory"
+
+// memoryPattern matches a -memory value: a number of bytes with an
+// optional binary unit, e.g. 512m, 4g or 6GiB.
+var memoryPattern = regexp.MustCompile(`^(?i)(\d+)\s*([kmgt]?)(i?b)?$`)
+
+// parseMemory parses a -memory value into bytes. The empty string is 0,
+// which disables the limit.
+func parseMemory(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	m := memoryPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid -memory %q (want e.g. 512m or 4g)", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -memory %q: %w", s, err)
+	}
+	shift := strings.Index("kmgt", strings.ToLower(m[2])) + 1
+	if m[2] == "" {
+		shift = 0
+	}
+	return n << (10 * shift), nil
+}
+
+// applyResourceLimits turns -cpu and -memory into cargo parallelism. The
+// engine cannot limit a container's CPUs or memory, so the pipeline keeps
+// cargo within them instead: without -jobs, cargo gets one job per -cpu,
+// capped at one per memoryPerJob of -memory, and without -test-threads the
+// tests get one thread per -cpu. An explicit -jobs always wins.
+func applyResourceLimits(opts *Options, jobsSet bool) error {
+	if opts.cpu < 0 {
+		return fmt.Errorf("-cpu must not be negative, got %d", opts.cpu)
+	}
+	if opts.cpu > 0 && opts.testThreads == 0 {
+		opts.testThreads = opts.cpu
+	}
+	if jobsSet {
+		return nil
+	}
+	if opts.cpu > 0 {
+		opts.jobs = opts.cpu
+	}
+	if opts.memory > 0 {
+		// without -cpu cargo runs one job per CPU, and the engine mostly
+		// runs on this host, so a budget above that changes nothing
+		budget := int(max(1, opts.memory/memoryPerJob))
+		jobs := opts.jobs
+		if jobs == 0 {
+			jobs = runtime.NumCPU()
+		}
+		if budget < jobs {
+			opts.jobs = budget
+		}
+	}
+	return nil
+}
+
+// oomKilled reports whether a failed command was killed by SIGKILL, either
+// itself or one of the compiler processes cargo ran.
+func oomKilled(exitCode int, stderr string) bool {
+	return exitCode == exitKilled || strings.Contains(stderr, "SIGKILL")
+}
+
+// withPeakMemory wraps the command in args so that it records the peak
+// memory of its cgroup in peakMemoryFile, keeping its exit status.
+func withPeakMemory(args []string) []string {
+	script := `"$@"; status=$?; cat /sys/fs/cgroup/memory.peak > ` + peakMemoryFile + ` 2>/dev/null; exit $status`
+	return append([]string{"sh", "-c", script, "sh"}, args...)
+}
+
+// peakMemory reads what withPeakMemory recorded in the built container,
+// reporting false when the kernel did not provide it.
+func peakMemory(ctx context.Context, rust *dagger.Container) (int64, bool) {
+	out, err := rust.File(peakMemoryFile).Contents(ctx)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// recordPeakMemory attaches the peak memory use to the last recorded run
+// of the stage name.
+func (t *stageRecorder) recordPeakMemory(name string, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.stages) - 1; i >= 0; i-- {
+		if t.stages[i].Name == name {
+			t.stages[i].PeakMemory = bytes
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	for in, want := range map[string]int64{
+		"":       0,
+		"1024":   1024,
+		"512m":   512 << 20,
+		"4g":     4 << 30,
+		"6GiB":   6 << 30,
+		"2 GB":   2 << 30,
+		"1t":     1 << 40,
+		"64k":    64 << 10,
+		"  8G  ": 8 << 30,
+	} {
+		got, err := parseMemory(in)
+		if err != nil || got != want {
+			t.Errorf("parseMemory(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"lots", "4x", "-1g", "1.5g"} {
+		if _, err := parseMemory(in); err == nil {
+			t.Errorf("parseMemory(%q) accepted", in)
+		}
+	}
+}
+
+func TestApplyResourceLimits(t *testing.T) {
+	for _, tc := range []struct {
+		args              []string
+		jobs, testThreads int
+	}{
+		{[]string{"-cpu=8"}, 8, 8},
+		// 6 GiB fits three 2 GiB jobs
+		{[]string{"-cpu=8", "-memory=6g"}, 3, 8},
+		{[]string{"-cpu=2", "-memory=1g"}, 1, 2},
+		{[]string{"-cpu=4", "-memory=64g"}, 4, 4},
+		{[]string{"-memory=1024g"}, 0, 0},
+		// explicit values win
+		{[]string{"-cpu=8", "-memory=2g", "-jobs=6", "-test-threads=2"}, 6, 2},
+	} {
+		opts, err := ParseOptions(append([]string{"-no-cache"}, tc.args...), io.Discard)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if opts.jobs != tc.jobs || opts.testThreads != tc.testThreads {
+			t.Errorf("%v: jobs %d, test threads %d, want %d, %d", tc.args, opts.jobs, opts.testThreads, tc.jobs, tc.testThreads)
+		}
+	}
+	if _, err := ParseOptions([]string{"-no-cache", "-cpu=-1"}, io.Discard); err == nil {
+		t.Error("negative -cpu accepted")
+	}
+}
+
+func TestStageFailedReportsOOMKill(t *testing.T) {
+	for _, tc := range []struct {
+		exitCode int
+		stderr   string
+		killed   bool
+	}{
+		{137, "", true},
+		{101, "error: could not compile `merlin`\nCaused by:\n  process didn't exit successfully: `rustc ...` (signal: 9, SIGKILL: kill)", true},
+		{101, "error[E0308]: mismatched types", false},
+	} {
+		err := &stageError{stage: stageBuild, exitCode: tc.exitCode, stderr: tc.stderr, killed: oomKilled(tc.exitCode, tc.stderr)}
+		got := strings.HasPrefix(err.Error(), "build killed, likely out of memory; try reducing -jobs or increasing -memory")
+		if got != tc.killed {
+			t.Errorf("exit %d: %q", tc.exitCode, err.Error())
+		}
+	}
+}
+
+func TestWithPeakMemoryKeepsTheCommand(t *testing.T) {
+	args := withPeakMemory([]string{"cargo", "build", "--release"})
+	if args[0] != "sh" || !strings.Contains(args[2], peakMemoryFile) || !strings.Contains(args[2], "exit $status") {
+		t.Errorf("wrapper %q", args[:3])
+	}
+	if got := strings.Join(args[3:], " "); got != "sh cargo build --release" {
+		t.Errorf("wrapped command %q", got)
+	}
+}
@@ -0,0 +1,301 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// resultCacheFile records, per stage, the inputs of its last passing run
+// for -skip-unchanged. Like cacheEpochFile it lives in the ci directory.
+const resultCacheFile = ".merlin-cache.json"
+
+// skippableStages are the stages -skip-unchanged may skip, each with the
+// files beyond the sources that it depends on.
+var skippableStages = map[string][]string{
+	stageBuild:  nil,
+	stageTest:   nil,
+	stageClippy: {"clippy.toml", ".clippy.toml"},
+	stageFmt:    {"rustfmt.toml", ".rustfmt.toml"},
+}
+
+// resultRecord is what a passing stage leaves in the result cache.
+type resultRecord struct {
+	Inputs string `json:"inputs"`
+	// Output is the digest of the exported binary, for the build stage,
+	// which can only be skipped while that binary is still on the host
+	Output string `json:"output,omitempty"`
+}
+
+// resultCache decides which stages -skip-unchanged skips, and records the
+// stages that pass. A nil cache skips nothing.
+type resultCache struct {
+	path   string
+	force  bool
+	stored map[string]resultRecord // from the last runs
+	inputs map[string]string       // hashed for this run
+	passed map[string]resultRecord
+}
+
+// newResultCache loads the record at path and hashes the inputs of the
+// skippable stages opts enables. It returns nil without -skip-unchanged.
+// An unreadable record or source only means nothing is skipped.
+func newResultCache(path string, opts Options, log *slog.Logger) *resultCache {
+	if !opts.skipUnchanged {
+		return nil
+	}
+	c := &resultCache{path: path, force: opts.force, stored: map[string]resultRecord{}, inputs: map[string]string{}, passed: map[string]resultRecord{}}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &c.stored); err != nil {
+			log.Warn("ignoring unreadable result cache", "path", path, "error", err)
+			c.stored = map[string]resultRecord{}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Warn("ignoring unreadable result cache", "path", path, "error", err)
+	}
+
+	sources, err := hashSources(opts.source, opts.sourceExcludes)
+	if err != nil {
+		log.Warn("cannot hash the sources, running every stage", "error", err)
+		return c
+	}
+	for stage, extra := range skippableStages {
+		if !opts.enabled(stage) {
+			continue
+		}
+		inputs, err := stageInputs(opts, stage, sources, extra)
+		if err != nil {
+			log.Warn("cannot hash the stage inputs, running it", "stage", stage, "error", err)
+			continue
+		}
+		c.inputs[stage] = inputs
+	}
+	return c
+}
+
+// unchanged reports whether stage can be skipped: its inputs match those of
+// its last passing run and -force is not set.
+func (c *resultCache) unchanged(stage string) bool {
+	if c == nil || c.force {
+		return false
+	}
+	inputs, ok := c.inputs[stage]
+	stored, found := c.stored[stage]
+	if !ok || !found || stored.Inputs != inputs {
+		return false
+	}
+	if stage == stageBuild {
+		digest, err := sha256File(filepath.Join(buildDir, "merlin"))
+		return err == nil && digest == stored.Output
+	}
+	return true
+}
+
+// pass records that stage passed with this run's inputs.
+func (c *resultCache) pass(stage string) {
+	if c == nil {
+		return
+	}
+	inputs, ok := c.inputs[stage]
+	if !ok {
+		return
+	}
+	record := resultRecord{Inputs: inputs}
+	if stage == stageBuild {
+		digest, err := sha256File(filepath.Join(buildDir, "merlin"))
+		if err != nil {
+			return
+		}
+		record.Output = digest
+	}
+	c.passed[stage] = record
+}
+
+// save writes the records of the stages that passed over the stored ones.
+// A stage that failed keeps the record of its last success, which its
+// current inputs no longer match.
+func (c *resultCache) save(log *slog.Logger) {
+	if c == nil || len(c.passed) == 0 {
+		return
+	}
+	for stage, record := range c.passed {
+		c.stored[stage] = record
+	}
+	data, err := json.MarshalIndent(c.stored, "", "  ")
+	if err == nil {
+		err = os.WriteFile(c.path, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		log.Warn("result cache not saved", "path", c.path, "error", err)
+	}
+}
+
+// filter drops the checks whose inputs are unchanged, recording each as
+// skipped with rec.
+func (c *resultCache) filter(checks []check, rec *stageRecorder) []check {
+	var run []check
+	for _, ch := range checks {
+		if c.unchanged(ch.name) {
+			rec.skipCached(ch.name)
+			continue
+		}
+		run = append(run, ch)
+	}
+	return run
+}
+
+// stageOnlyInput reports whether the file at rel, relative to -source, is
+// an input of a single skippable stage, which stageInputs hashes for that
+// stage alone.
+func stageOnlyInput(rel string) bool {
+	for _, extra := range skippableStages {
+		for _, name := range extra {
+			if rel == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hashSources hashes the name and contents of every file under source that
+// is uploaded to the pipeline, as filtered by excludes, since any of them
+// may be read by the build or the tests: include_str! assets, build.rs
+// inputs, fixtures. Symlinks are hashed by their target, as they are
+// uploaded.
+func hashSources(source string, excludes []string) (string, error) {
+	var files []string
+	err := filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == source {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if sourceDirExcluded(rel, excludes) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !sourceExcluded(rel, excludes) && !stageOnlyInput(rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, rel := range files {
+		if target, err := os.Readlink(filepath.Join(source, rel)); err == nil {
+			fmt.Fprintf(h, "%s -> %s\n", rel, target)
+			continue
+		}
+		if err := hashFile(h, source, rel); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile adds the name and contents of the file at rel under root to h.
+// A missing file is hashed as absent, so creating it changes the hash.
+func hashFile(h io.Writer, root, rel string) error {
+	f, err := os.Open(filepath.Join(root, rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(h, "%s absent\n", filepath.ToSlash(rel))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// length-prefix each file so moving bytes between them changes the hash
+	fmt.Fprintf(h, "%s %d\n", filepath.ToSlash(rel), info.Size())
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// stageInputs hashes what stage's outcome depends on: the sources, its own
+// configuration files and the image and command it runs. The image is the
+// -base-image reference when one is given, as planImage resolves it.
+func stageInputs(opts Options, stage, sources string, extra []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\nsources %s\nimage %s\n", stage, sources, planImage(opts, opts.rustVersion))
+	fmt.Fprintf(h, "apt %s\n", strings.Join(opts.aptPackages, " "))
+	for _, v := range opts.env {
+		fmt.Fprintf(h, "env %s=%s\n", v.name, v.value)
+	}
+	fmt.Fprintf(h, "command %q\n", stageCommand(opts, stage))
+	for _, phase := range []string{hookPreBuild, hookPostBuild, hookPreTest, hookPostTest} {
+		for _, hook := range opts.config.hooks(phase) {
+			fmt.Fprintf(h, "hook %s %q\n", phase, hook.Command)
+		}
+	}
+	for _, name := range extra {
+		if err := hashFile(h, opts.source, name); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stageCommand describes the command stage runs, so changing its flags
+// reruns it.
+func stageCommand(opts Options, stage string) []string {
+	switch stage {
+	case stageBuild:
+		return append(cargoBuildArgs(opts), fmt.Sprintf("strip=%t", opts.strip))
+	case stageTest:
+		return append(testArgs(opts), fmt.Sprintf("shards=%d junit=%t doctests=%t", opts.shards, opts.junit, opts.doctests))
+	case stageClippy:
+		cmd := append([]string{"cargo", "clippy"}, lockArgs(opts)...)
+		if p := opts.clippyPolicy; p != nil {
+			cmd = append(cmd, fmt.Sprintf("deny=%s allow=%s max=%d", strings.Join(p.deny, ","), strings.Join(p.allow, ","), p.maxWarnings))
+		}
+		return append(cmd, fmt.Sprintf("fix=%t", opts.clippyFix))
+	case stageFmt:
+		return []string{"cargo", "fmt", fmt.Sprintf("fix=%t", opts.fmtFix)}
+	}
+	return nil
+}
+
+// validateSkipUnchanged rejects -skip-unchanged where the sources cannot be
+// hashed on the host, and -force without it.
+func validateSkipUnchanged(opts Options) error {
+	if opts.force && !opts.skipUnchanged {
+		return fmt.Errorf("-force requires -skip-unchanged")
+	}
+	if !opts.skipUnchanged {
+		return nil
+	}
+	if opts.gitURL != "" {
+		return fmt.Errorf("-skip-unchanged hashes the host -source, so it cannot be combined with -git-url")
+	}
+	if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 || len(opts.platforms) > 0 {
+		return fmt.Errorf("-skip-unchanged applies to a host build, not -matrix, -feature-matrix or -platforms")
+	}
+	// a skipped build never runs, so neither could the hooks after it, and
+	// the checks would start from a container without their changes
+	if len(opts.config.hooks(hookPostBuild)) > 0 {
+		return fmt.Errorf("-skip-unchanged cannot skip the build when %s hooks are configured", hookPostBuild)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestResultCacheSkipsUnchangedStages(t *testing.T) {
+	source := writeTree(t, map[string]string{
+		"Cargo.toml":         "[package]\nname = \"merlin\"\n",
+		"src/main.rs":        "fn main() {}\n",
+		"target/debug/junk":  "ignored",
+		"docs/guide.md":      "not uploaded",
+		"assets/index.html":  "<html></html>",
+		".cargo/config.toml": "[build]\n",
+	})
+	record := filepath.Join(t.TempDir(), resultCacheFile)
+	log := newLogger(io.Discard, logFormatText, logNormal)
+	parse := func(extra ...string) Options {
+		t.Helper()
+		opts, err := ParseOptions(append([]string{"-no-cache", "-source=" + source, "-skip-unchanged", "-stages=test,clippy,fmt", "-exclude-paths=docs"}, extra...), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts
+	}
+
+	first := newResultCache(record, parse(), log)
+	for _, stage := range []string{stageTest, stageClippy, stageFmt} {
+		if first.unchanged(stage) {
+			t.Errorf("%s skipped without a record", stage)
+		}
+		first.pass(stage)
+	}
+	first.save(log)
+
+	if c := newResultCache(record, parse(), log); !c.unchanged(stageTest) || !c.unchanged(stageFmt) {
+		t.Error("unchanged stages not skipped")
+	}
+	if c := newResultCache(record, parse("-force"), log); c.unchanged(stageTest) {
+		t.Error("-force skipped a stage")
+	}
+	if c := newResultCache(record, parse("-locked"), log); c.unchanged(stageTest) {
+		t.Error("changing the test command skipped the test stage")
+	}
+
+	// files left out of the upload do not matter
+	writeTreeAt(t, source, map[string]string{"docs/guide.md": "edited", "target/debug/junk": "rebuilt"})
+	if c := newResultCache(record, parse(), log); !c.unchanged(stageClippy) {
+		t.Error("editing an excluded file reran clippy")
+	}
+
+	// rustfmt.toml is an input of fmt only
+	writeTreeAt(t, source, map[string]string{"rustfmt.toml": "max_width = 80\n"})
+	c := newResultCache(record, parse(), log)
+	if c.unchanged(stageFmt) {
+		t.Error("fmt skipped after rustfmt.toml changed")
+	}
+	if !c.unchanged(stageTest) {
+		t.Error("test reran after rustfmt.toml changed")
+	}
+
+	writeTreeAt(t, source, map[string]string{".cargo/config.toml": "[build]\nrustflags = []\n"})
+	if c := newResultCache(record, parse(), log); c.unchanged(stageTest) {
+		t.Error("test skipped after .cargo/config.toml changed")
+	}
+
+	// an include_str! asset is as much an input as the code including it
+	writeTreeAt(t, source, map[string]string{"assets/index.html": "<html>v2</html>"})
+	if c := newResultCache(record, parse(), log); c.unchanged(stageTest) {
+		t.Error("test skipped after an uploaded asset changed")
+	}
+}
+
+func TestResultCacheFilterMarksSkippedChecks(t *testing.T) {
+	source := writeTree(t, map[string]string{"Cargo.toml": "[package]\n", "src/lib.rs": ""})
+	record := filepath.Join(t.TempDir(), resultCacheFile)
+	log := newLogger(io.Discard, logFormatText, logNormal)
+	opts, err := ParseOptions([]string{"-no-cache", "-source=" + source, "-skip-unchanged"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := newResultCache(record, opts, log)
+	first.pass(stageClippy)
+	first.save(log)
+
+	ok := func(context.Context, *dagger.Container) (string, error) { return "ok", nil }
+	rec := newStageRecorder(log)
+	got := newResultCache(record, opts, log).filter([]check{{name: stageTest, run: ok}, {name: stageClippy, run: ok}}, rec)
+	if len(got) != 1 || got[0].name != stageTest {
+		t.Fatalf("filter kept %v, want only test", got)
+	}
+
+	result := newRunResult(rec.snapshot(), time.Second, "", nil)
+	if len(result.Stages) != 1 || result.Stages[0].Status != statusCached {
+		t.Errorf("stages %+v, want clippy %s", result.Stages, statusCached)
+	}
+	if !strings.Contains(formatTimings(rec.snapshot(), time.Second), "skipped (cached)") {
+		t.Error("timings do not mark the skipped stage")
+	}
+}
+
+func TestValidateSkipUnchanged(t *testing.T) {
+	for _, args := range [][]string{
+		{"-force"},
+		{"-skip-unchanged", "-git-url=https://github.com/awdemos/merlin.git"},
+		{"-skip-unchanged", "-matrix=1.75,stable"},
+	} {
+		if _, err := ParseOptions(append([]string{"-no-cache"}, args...), io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestResultCacheHooks(t *testing.T) {
+	source := writeTree(t, map[string]string{"Cargo.toml": "[package]\n", "src/lib.rs": ""})
+	dir := t.TempDir()
+	config := func(hooks string) string {
+		t.Helper()
+		path := filepath.Join(dir, "merlin-ci.yaml")
+		writeTreeAt(t, dir, map[string]string{"merlin-ci.yaml": "hooks:\n" + hooks})
+		return path
+	}
+	parse := func(config string) (Options, error) {
+		return ParseOptions([]string{"-no-cache", "-source=" + source, "-skip-unchanged", "-config=" + config}, io.Discard)
+	}
+
+	if _, err := parse(config("  post_build: [strip target/release/merlin]\n")); err == nil {
+		t.Error("-skip-unchanged with post_build hooks succeeded, want error")
+	}
+
+	record := filepath.Join(t.TempDir(), resultCacheFile)
+	log := newLogger(io.Discard, logFormatText, logNormal)
+	opts, err := parse(config("  pre_test: [make fixtures]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := newResultCache(record, opts, log)
+	first.pass(stageTest)
+	first.save(log)
+
+	if opts, err = parse(config("  pre_test: [make fixtures-v2]\n")); err != nil {
+		t.Fatal(err)
+	}
+	if newResultCache(record, opts, log).unchanged(stageTest) {
+		t.Error("test skipped after its pre_test hook changed")
+	}
+}
+
+func TestResultCacheBaseImage(t *testing.T) {
+	source := writeTree(t, map[string]string{"Cargo.toml": "[package]\n", "src/lib.rs": ""})
+	record := filepath.Join(t.TempDir(), resultCacheFile)
+	log := newLogger(io.Discard, logFormatText, logNormal)
+	parse := func(args ...string) Options {
+		t.Helper()
+		opts, err := ParseOptions(append([]string{"-no-cache", "-source=" + source, "-skip-unchanged"}, args...), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts
+	}
+
+	first := newResultCache(record, parse("-base-image=awdemos/rust-native:1.75"), log)
+	first.pass(stageTest)
+	first.save(log)
+
+	if !newResultCache(record, parse("-base-image=awdemos/rust-native:1.75"), log).unchanged(stageTest) {
+		t.Error("test reran with the same -base-image")
+	}
+	for _, args := range [][]string{{"-base-image=awdemos/rust-native:1.76"}, nil} {
+		if newResultCache(record, parse(args...), log).unchanged(stageTest) {
+			t.Errorf("test skipped with %q after a run on awdemos/rust-native:1.75", args)
+		}
+	}
+}
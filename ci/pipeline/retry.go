@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// retry calls fn until it succeeds, it has been called attempts times, or
+// it fails with an error none of the retryable predicates accept. The wait
+// between attempts starts at backoff and doubles each time, and ends early
+// with ctx's error when ctx is done. With no predicates nothing is retried.
+func retry(ctx context.Context, attempts int, backoff time.Duration, fn func() error, retryable ...func(error) bool) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= attempts || !anyMatch(err, retryable) {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func anyMatch(err error, predicates []func(error) bool) bool {
+	for _, p := range predicates {
+		if p(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// transientMarkers are substrings of errors caused by the network rather
+// than the build: failed image pulls and cargo's download failures.
+var transientMarkers = []string{
+	"spurious network error",
+	"failed to download",
+	"failed to fetch",
+	"failed to get `",
+	"unable to update registry",
+	"could not resolve host",
+	"couldn't resolve host",
+	"temporary failure in name resolution",
+	"connection reset by peer",
+	"connection refused",
+	"i/o timeout",
+	"tls handshake timeout",
+	"operation timed out",
+	"failed to resolve source metadata",
+	"too many requests",
+	"service unavailable",
+	"bad gateway",
+}
+
+// isTransient reports whether err looks like a network failure worth
+// retrying. For a failed exec only its stderr is considered, so a compile
+// error is never mistaken for a transient failure.
+func isTransient(err error) bool {
+	msg := err.Error()
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		msg = execErr.Stderr
+	}
+	msg = strings.ToLower(msg)
+	for _, marker := range transientMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
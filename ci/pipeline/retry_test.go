@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+	permanent := errors.New("error[E0308]: mismatched types")
+
+	tests := []struct {
+		name      string
+		errs      []error
+		attempts  int
+		wantCalls int
+		wantErr   error
+	}{
+		{"succeeds first time", []error{nil}, 3, 1, nil},
+		{"recovers from transient errors", []error{transient, transient, nil}, 3, 3, nil},
+		{"gives up after attempts", []error{transient, transient, transient, nil}, 3, 3, transient},
+		{"does not retry permanent errors", []error{permanent, nil}, 3, 1, permanent},
+		{"single attempt", []error{transient, nil}, 1, 1, transient},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := retry(context.Background(), tt.attempts, 0, func() error {
+			calls++
+			return tt.errs[calls-1]
+		}, isTransient)
+		if !errors.Is(err, tt.wantErr) || calls != tt.wantCalls {
+			t.Errorf("%s: got (%v, %d calls), want (%v, %d calls)", tt.name, err, calls, tt.wantErr, tt.wantCalls)
+		}
+	}
+}
+
+func TestRetryWithoutPredicates(t *testing.T) {
+	calls := 0
+	_ = retry(context.Background(), 3, 0, func() error {
+		calls++
+		return errors.New("connection reset by peer")
+	})
+	if calls != 1 {
+		t.Errorf("retried %d times without a predicate", calls-1)
+	}
+}
+
+func TestRetryStopsWaitingOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	err := retry(ctx, 3, time.Hour, func() error {
+		calls++
+		cancel()
+		return errors.New("connection reset by peer")
+	}, isTransient)
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("got (%v, %d calls), want (context canceled, 1 call)", err, calls)
+	}
+	if time.Since(start) > time.Minute {
+		t.Error("retry kept waiting after cancellation")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, err := range []error{
+		errors.New("failed to resolve source metadata for docker.io/library/rust:1.75: i/o timeout"),
+		fmt.Errorf("build: %w", errors.New("429 Too Many Requests")),
+	} {
+		if !isTransient(err) {
+			t.Errorf("isTransient(%q) = false", err)
+		}
+	}
+	if isTransient(errors.New("error: could not compile `merlin`")) {
+		t.Error("a compile error was classified as transient")
+	}
+}
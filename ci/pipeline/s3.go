@@ -0,0 +1,281 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	stageUpload = "upload"
+
+	awsAccessKeyEnv    = "AWS_ACCESS_KEY_ID"
+	awsSecretKeyEnv    = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenEnv = "AWS_SESSION_TOKEN"
+	awsRegionEnv       = "AWS_REGION"
+
+	defaultS3Region = "us-east-1"
+)
+
+// s3Client uploads objects to one bucket of an S3-compatible store with
+// requests signed by AWS Signature Version 4. Objects are addressed
+// path-style, which AWS, MinIO and R2 all accept.
+type s3Client struct {
+	endpoint     string // scheme and host, e.g. https://s3.us-east-1.amazonaws.com
+	region       string
+	bucket       string
+	prefix       string // objects are keyed <prefix>/<ref>/<file>
+	ref          string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+	out          io.Writer // where object URLs are printed
+	now          func() time.Time
+}
+
+// newS3Client returns a client for the bucket in opts with the credentials
+// from the environment. An empty endpoint means AWS itself.
+func newS3Client(opts Options) *s3Client {
+	endpoint := opts.s3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + opts.s3Region + ".amazonaws.com"
+	}
+	return &s3Client{
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		region:       opts.s3Region,
+		bucket:       opts.s3Bucket,
+		prefix:       opts.s3Prefix,
+		ref:          s3RefSegment(opts),
+		accessKey:    os.Getenv(awsAccessKeyEnv),
+		secretKey:    os.Getenv(awsSecretKeyEnv),
+		sessionToken: os.Getenv(awsSessionTokenEnv),
+		http:         &http.Client{Timeout: 5 * time.Minute},
+		out:          os.Stdout,
+		now:          time.Now,
+	}
+}
+
+// s3Region returns the region to sign for: -s3-region if set, else
+// $AWS_REGION, else us-east-1. R2 expects "auto".
+func s3Region(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	if region := os.Getenv(awsRegionEnv); region != "" {
+		return region
+	}
+	return defaultS3Region
+}
+
+// validateS3 checks that the artifacts can be uploaded.
+func validateS3(opts Options) error {
+	if opts.s3Bucket == "" {
+		return nil
+	}
+	if os.Getenv(awsAccessKeyEnv) == "" || os.Getenv(awsSecretKeyEnv) == "" {
+		return fmt.Errorf("-s3-bucket requires $%s and $%s", awsAccessKeyEnv, awsSecretKeyEnv)
+	}
+	if opts.s3Endpoint != "" {
+		u, err := url.Parse(opts.s3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("-s3-endpoint must be an http(s) URL, got %q", opts.s3Endpoint)
+		}
+	}
+	if !opts.enabled(stageBuild) {
+		return fmt.Errorf("-s3-bucket requires the build stage")
+	}
+	return nil
+}
+
+// s3RefSegment returns the git ref objects are keyed under: the -git-ref
+// name of a remote build, else the branch or commit checked out in -source.
+func s3RefSegment(opts Options) string {
+	_, ref := gitRefKind(opts.gitRef)
+	if opts.gitURL == "" {
+		ref = buildRef(opts)
+	}
+	if ref == "" {
+		return "unknown"
+	}
+	return ref
+}
+
+// s3Key returns the key of the object for a file named name, as
+// <prefix>/<git-ref>/<name>.
+func s3Key(prefix, ref, name string) string {
+	return strings.TrimPrefix(path.Join(prefix, ref, name), "/")
+}
+
+// uploadName names an artifact in the bucket. Files under ./build keep
+// their path below it, as e.g. each platform's binary is called merlin.
+func uploadName(file string) string {
+	if rel, err := filepath.Rel(buildDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(file)
+}
+
+// uploadFiles expands the artifact paths, some of which are directories
+// of reports, into the files to upload.
+func uploadFiles(artifacts []string) ([]string, error) {
+	var files []string
+	for _, artifact := range artifacts {
+		err := filepath.WalkDir(artifact, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// uploadToS3 uploads each file under <prefix>/<ref>/ and prints the URL of
+// every object it creates.
+func (c *s3Client) uploadToS3(ctx context.Context, files []string) error {
+	for _, file := range files {
+		key := s3Key(c.prefix, c.ref, uploadName(file))
+		if err := c.put(ctx, key, file); err != nil {
+			return fmt.Errorf("%s: %s: %w", stageUpload, key, err)
+		}
+		fmt.Fprintln(c.out, c.objectURL(key))
+	}
+	return nil
+}
+
+// objectURL returns the path-style URL of the object at key.
+func (c *s3Client) objectURL(key string) string {
+	return c.endpoint + "/" + s3EscapePath(c.bucket+"/"+key)
+}
+
+// put uploads the file at file to key.
+func (c *s3Client) put(ctx context.Context, key, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the payload hash is part of the signature, so the file is read twice
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(key), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.sign(req, hex.EncodeToString(h.Sum(nil)))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// sign adds the Signature Version 4 headers for a request whose body
+// hashes to payloadHash.
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	// every x-amz-* header is signed, along with the host
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := sortedKeys(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath percent-encodes every byte of p but the unreserved
+// characters and the slashes between segments, as Signature Version 4
+// expects of the canonical path.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
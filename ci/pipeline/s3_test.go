@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3Key(t *testing.T) {
+	tests := []struct {
+		prefix, ref, file, want string
+	}{
+		{"builds", "main", "build/merlin", "builds/main/merlin"},
+		{"", "feature/tls", "build/linux-arm64/merlin", "feature/tls/linux-arm64/merlin"},
+		{"builds/", "main", "junit.xml", "builds/main/junit.xml"},
+	}
+	for _, tt := range tests {
+		if got := s3Key(tt.prefix, tt.ref, uploadName(tt.file)); got != tt.want {
+			t.Errorf("s3Key(%q, %q, %q) = %q, want %q", tt.prefix, tt.ref, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestS3EscapePath(t *testing.T) {
+	if got, want := s3EscapePath("bucket/a b+c/merlin~1.tar.gz"), "bucket/a%20b%2Bc/merlin~1.tar.gz"; got != want {
+		t.Errorf("s3EscapePath = %q, want %q", got, want)
+	}
+}
+
+func TestUploadToS3(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "merlin")
+	if err := os.WriteFile(file, []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotPath, gotAuth, gotHash string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("method = %s, want PUT", r.Method)
+		}
+		gotPath, gotAuth, gotHash = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	t.Setenv(awsAccessKeyEnv, "AKIDEXAMPLE")
+	t.Setenv(awsSecretKeyEnv, "secret")
+	c := newS3Client(Options{s3Endpoint: srv.URL, s3Region: "auto", s3Bucket: "artifacts", s3Prefix: "merlin", gitURL: "x", gitRef: "main"})
+	var out bytes.Buffer
+	c.out = &out
+	c.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	if err := c.uploadToS3(context.Background(), []string{file}); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/artifacts/merlin/main/merlin" {
+		t.Errorf("path = %q", gotPath)
+	}
+	if string(gotBody) != "binary" {
+		t.Errorf("body = %q", gotBody)
+	}
+	if gotHash != sha256Hex("binary") {
+		t.Errorf("payload hash = %q", gotHash)
+	}
+	const scope = "Credential=AKIDEXAMPLE/20240102/auto/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 "+scope) {
+		t.Errorf("Authorization = %q", gotAuth)
+	}
+	if got, want := strings.TrimSpace(out.String()), srv.URL+"/artifacts/merlin/main/merlin"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+	})
+	if err := c.uploadToS3(context.Background(), []string{file}); err == nil {
+		t.Error("upload succeeded against a failing store")
+	}
+}
+
+func TestValidateS3(t *testing.T) {
+	t.Setenv(awsAccessKeyEnv, "")
+	if _, err := ParseOptions([]string{"-s3-bucket=artifacts"}, io.Discard); err == nil {
+		t.Error("-s3-bucket without credentials succeeded, want error")
+	}
+	t.Setenv(awsAccessKeyEnv, "AKIDEXAMPLE")
+	t.Setenv(awsSecretKeyEnv, "secret")
+	t.Setenv(awsRegionEnv, "")
+	if _, err := ParseOptions([]string{"-s3-bucket=artifacts", "-s3-endpoint=minio:9000"}, io.Discard); err == nil {
+		t.Error("-s3-endpoint without a scheme succeeded, want error")
+	}
+	opts, err := ParseOptions([]string{"-s3-bucket=artifacts", "-s3-endpoint=http://minio:9000"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.s3Region != defaultS3Region {
+		t.Errorf("s3Region = %q, want %q", opts.s3Region, defaultS3Region)
+	}
+}
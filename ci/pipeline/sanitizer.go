@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageSanitizer = "sanitizer"
+
+// sanitizers are the -sanitizer values, each the name rustc's
+// -Zsanitizer takes.
+var sanitizers = []string{"address", "thread", "leak"}
+
+// sanitizerPlatforms are the engine platforms rustc supports all of
+// sanitizers on.
+var sanitizerPlatforms = []dagger.Platform{"linux/amd64", "linux/arm64"}
+
+// sanitizerReportPattern matches the first line of a sanitizer report, e.g.
+// "==42==ERROR: AddressSanitizer: heap-buffer-overflow on address ..." or
+// "WARNING: ThreadSanitizer: data race (pid=42)".
+var sanitizerReportPattern = regexp.MustCompile(`^(?:==\d+==)?(?:ERROR|WARNING): (\w+Sanitizer): (.+)$`)
+
+// sanitizerReport is one finding a sanitizer printed.
+type sanitizerReport struct {
+	tool    string
+	summary string
+}
+
+func (r sanitizerReport) String() string {
+	return r.tool + ": " + r.summary
+}
+
+// parseSanitizerReports returns the reports in the output of a sanitized
+// test run, in the order they were printed. The reports go to stderr,
+// which cargo test passes through from the test binaries.
+func parseSanitizerReports(output string) []sanitizerReport {
+	var reports []sanitizerReport
+	for _, line := range strings.Split(output, "\n") {
+		m := sanitizerReportPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		summary := strings.TrimSpace(m[2])
+		// ThreadSanitizer ends its headline with the pid, which only
+		// makes equal reports look different
+		if i := strings.Index(summary, " (pid="); i >= 0 {
+			summary = summary[:i]
+		}
+		reports = append(reports, sanitizerReport{tool: m[1], summary: summary})
+	}
+	return reports
+}
+
+// formatSanitizerReports lists the reports one per line under a count, so
+// they stand out from the test output beneath.
+func formatSanitizerReports(reports []sanitizerReport) string {
+	noun := "reports"
+	if len(reports) == 1 {
+		noun = "report"
+	}
+	lines := []string{fmt.Sprintf("%d sanitizer %s:", len(reports), noun)}
+	for _, r := range reports {
+		lines = append(lines, "  "+r.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sanitizerArgs returns the test command for the sanitizer build of
+// target: the regular test command on nightly, rebuilding the standard
+// library with the sanitizer too, which rustc requires to instrument it.
+// Passing --target keeps RUSTFLAGS off the build scripts and proc macros,
+// which run on the host uninstrumented.
+func sanitizerArgs(opts Options, target string) []string {
+	args := []string{"cargo", "+nightly", "test", "-Zbuild-std", "--target", target}
+	return append(args, cargoTestArgs(opts)[2:]...)
+}
+
+// sanitizerTarget returns the Rust target of the engine's platform, which
+// the sanitized tests are built for and run on.
+func sanitizerTarget(ctx context.Context, client *dagger.Client) (string, error) {
+	platform, err := client.DefaultPlatform(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range sanitizerPlatforms {
+		if p == platform {
+			return targetTriples[p], nil
+		}
+	}
+	return "", fmt.Errorf("the sanitizers are not supported on the engine's platform %s", platform)
+}
+
+// runSanitizer runs the tests under opts.sanitizer. Like udeps it needs a
+// nightly compiler, and -Zbuild-std needs the standard library's sources,
+// so it runs in a nightly container of its own rather than the pinned
+// toolchain's, with a target directory of its own per sanitizer. Any
+// sanitizer report fails the stage, even when every test passed, since
+// a leak or data race does not always fail the test it happens in.
+func runSanitizer(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options) (string, error) {
+	target, err := sanitizerTarget(ctx, client)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", stageSanitizer, err)
+	}
+	flags := "-Zsanitizer=" + opts.sanitizer
+	nightly := rustContainer(client, containerSources(rust), "nightly", "", opts).
+		WithExec([]string{"rustup", "component", "add", "rust-src", "--toolchain", "nightly"}).
+		WithEnvVariable("RUSTFLAGS", flags).
+		WithEnvVariable("RUSTDOCFLAGS", flags).
+		WithEnvVariable("CARGO_TARGET_DIR", "target/sanitizer-"+opts.sanitizer)
+
+	out, err := execOutput(ctx, nightly.WithExec(sanitizerArgs(opts, target)))
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		out = combineStreams(execErr.Stdout, execErr.Stderr)
+	} else if err != nil {
+		return "", stageFailed(stageSanitizer, err)
+	}
+
+	if reports := parseSanitizerReports(out); len(reports) > 0 {
+		exitCode := 1
+		if execErr != nil {
+			exitCode = execErr.ExitCode
+		}
+		return "", &stageError{stage: stageSanitizer, exitCode: exitCode, stderr: formatSanitizerReports(reports), stdout: out}
+	}
+	if execErr != nil {
+		return "", stageFailed(stageSanitizer, err)
+	}
+	return out + "\nno " + opts.sanitizer + " sanitizer reports", nil
+}
+
+// validateSanitizer checks the -sanitizer value. The sanitized tests run
+// on the engine's platform only.
+func validateSanitizer(opts Options) error {
+	if opts.sanitizer == "" {
+		return nil
+	}
+	valid := false
+	for _, s := range sanitizers {
+		valid = valid || s == opts.sanitizer
+	}
+	if !valid {
+		return fmt.Errorf("invalid -sanitizer %q (want one of %s)", opts.sanitizer, strings.Join(sanitizers, ", "))
+	}
+	if len(opts.platforms) > 0 {
+		return fmt.Errorf("-sanitizer runs the tests on the engine's platform and does not support -platforms")
+	}
+	return nil
+}
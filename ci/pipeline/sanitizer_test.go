@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSanitizerReports(t *testing.T) {
+	output := `running 3 tests
+=================================================================
+==1234==ERROR: AddressSanitizer: heap-buffer-overflow on address 0x602000000014 at pc 0x55d0c3a1 bp 0x7ffd sp 0x7ffd
+READ of size 4 at 0x602000000014 thread T1
+SUMMARY: AddressSanitizer: heap-buffer-overflow src/router.rs:42:9 in merlin::router::pick
+==================
+WARNING: ThreadSanitizer: data race (pid=77)
+  Write of size 8 at 0x7b0400000000 by thread T2:
+==1234==ERROR: LeakSanitizer: detected memory leaks
+test result: ok. 3 passed; 0 failed`
+
+	got := parseSanitizerReports(output)
+	want := []sanitizerReport{
+		{"AddressSanitizer", "heap-buffer-overflow on address 0x602000000014 at pc 0x55d0c3a1 bp 0x7ffd sp 0x7ffd"},
+		{"ThreadSanitizer", "data race"},
+		{"LeakSanitizer", "detected memory leaks"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseSanitizerReports = %v, want %v", got, want)
+	}
+	if got := parseSanitizerReports("test result: ok. 3 passed; 0 failed"); len(got) != 0 {
+		t.Errorf("clean run reported %v", got)
+	}
+
+	msg := formatSanitizerReports(want[1:2])
+	if msg != "1 sanitizer report:\n  ThreadSanitizer: data race" {
+		t.Errorf("formatSanitizerReports = %q", msg)
+	}
+}
+
+func TestSanitizerArgs(t *testing.T) {
+	opts, err := ParseOptions([]string{"-sanitizer=thread", "-locked", "-test-threads=2"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(sanitizerArgs(opts, "x86_64-unknown-linux-gnu"), " ")
+	want := "cargo +nightly test -Zbuild-std --target x86_64-unknown-linux-gnu --lib --bins --tests --locked -- --test-threads 2"
+	if got != want {
+		t.Errorf("sanitizerArgs = %q, want %q", got, want)
+	}
+
+	if plan := formatPlan(opts); !strings.Contains(plan, stageSanitizer) {
+		t.Errorf("plan does not run %s:\n%s", stageSanitizer, plan)
+	}
+}
+
+func TestSanitizerValidation(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-sanitizer=memory"}, `invalid -sanitizer "memory"`},
+		{[]string{"-sanitizer=address", "-platforms=linux/arm64"}, "does not support -platforms"},
+	} {
+		if _, err := ParseOptions(tc.args, io.Discard); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ParseOptions(%q) error = %v, want %q", tc.args, err, tc.want)
+		}
+	}
+	if _, err := ParseOptions([]string{"-sanitizer=leak"}, io.Discard); err != nil {
+		t.Errorf("-sanitizer=leak: %v", err)
+	}
+}
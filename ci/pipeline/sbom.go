@@ -0,0 +1,63 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageSBOM = "sbom"
+
+// syftImage generates the SBOM from the Cargo.lock in the sources.
+const syftImage = "anchore/syft:v0.98.0"
+
+// SBOM formats accepted by -sbom-format, mapped to their file extension
+var sbomFormats = map[string]string{
+	"cyclonedx-json": ".cdx.json",
+	"spdx-json":      ".spdx.json",
+}
+
+// defaultSBOMOut returns the host path of the SBOM for format.
+func defaultSBOMOut(format string) string {
+	return "./build/sbom" + sbomFormats[format]
+}
+
+// sbomImagePath is where a published image carries its SBOM. The path is
+// also recorded in the sbomLabel image label.
+const (
+	sbomImagePath = "/usr/share/doc/merlin/sbom.json"
+	sbomLabel     = "io.github.awdemos.merlin.sbom"
+)
+
+// validateSBOMFormat checks the -sbom-format flag.
+func validateSBOMFormat(format string) error {
+	if _, ok := sbomFormats[format]; !ok {
+		return fmt.Errorf("invalid -sbom-format %q (valid: %s)", format, strings.Join(sortedKeys(sbomFormats), ", "))
+	}
+	return nil
+}
+
+// generateSBOM catalogs the crate dependencies of the sources in rust and
+// exports the SBOM in format to out.
+func generateSBOM(ctx context.Context, client *dagger.Client, rust *dagger.Container, format, out string) (string, error) {
+	sbom, err := client.Container().From(syftImage).
+		WithMountedDirectory("/src", containerSources(rust)).
+		WithExec([]string{"/syft", "dir:/src", "-o", format}, dagger.ContainerWithExecOpts{SkipEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", stageFailed(stageSBOM, err)
+	}
+
+	if err := writeReport(out, []byte(sbom)); err != nil {
+		return "", fmt.Errorf("%s: %w", stageSBOM, err)
+	}
+	return fmt.Sprintf("%s SBOM written to %s", format, out), nil
+}
+
+// withSBOM adds the SBOM to a runtime image and labels the image with its
+// location.
+func withSBOM(image *dagger.Container, sbom *dagger.File) *dagger.Container {
+	return image.WithFile(sbomImagePath, sbom).WithLabel(sbomLabel, sbomImagePath)
+}
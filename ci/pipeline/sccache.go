@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// sccache backends selectable with -sccache-backend
+const (
+	sccacheLocal = "local"
+	sccacheS3    = "s3"
+	sccacheRedis = "redis"
+)
+
+const (
+	cacheSccache    = "sccache"
+	sccacheDir      = "/sccache"
+	sccacheStats    = "/sccache-stats.txt"
+	sccacheRedisEnv = "SCCACHE_REDIS"
+)
+
+// sccacheS3Secrets are passed from the host to the S3 backend when set.
+var sccacheS3Secrets = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"}
+
+// validateSccache checks that the selected sccache backend is configured.
+func validateSccache(opts Options) error {
+	if !opts.sccache {
+		return nil
+	}
+	if len(opts.platforms) > 0 {
+		// the sccache binary is built for the host platform
+		return fmt.Errorf("-sccache does not support -platforms builds")
+	}
+	switch opts.sccacheBackend {
+	case sccacheLocal:
+	case sccacheS3:
+		if opts.sccacheBucket == "" {
+			return fmt.Errorf("-sccache-backend=s3 requires -sccache-bucket")
+		}
+	case sccacheRedis:
+		if os.Getenv(sccacheRedisEnv) == "" {
+			return fmt.Errorf("-sccache-backend=redis requires $%s", sccacheRedisEnv)
+		}
+	default:
+		return fmt.Errorf("invalid -sccache-backend %q (valid: %s, %s, %s)", opts.sccacheBackend, sccacheLocal, sccacheS3, sccacheRedis)
+	}
+	return nil
+}
+
+// withSccache wraps rustc in sccache with the configured backend. The
+// target cache still skips crates that are up to date; sccache serves the
+// compilations it can't, such as after a toolchain or feature change that
+// starts a fresh target volume. Incremental compilation is disabled because
+// sccache cannot cache it and would otherwise store nothing.
+func withSccache(client *dagger.Client, rust *dagger.Container, opts Options) *dagger.Container {
+	rust = withCargoTool(client, rust, "sccache").
+		WithEnvVariable("RUSTC_WRAPPER", "sccache").
+		WithEnvVariable("CARGO_INCREMENTAL", "0")
+
+	switch opts.sccacheBackend {
+	case sccacheS3:
+		rust = rust.WithEnvVariable("SCCACHE_BUCKET", opts.sccacheBucket)
+		if opts.sccacheRegion != "" {
+			rust = rust.WithEnvVariable("SCCACHE_REGION", opts.sccacheRegion)
+		}
+		if opts.sccacheEndpoint != "" {
+			rust = rust.WithEnvVariable("SCCACHE_ENDPOINT", opts.sccacheEndpoint)
+		}
+		for _, name := range sccacheS3Secrets {
+			if value := os.Getenv(name); value != "" {
+				rust = rust.WithSecretVariable(name, client.SetSecret("sccache-"+name, value))
+			}
+		}
+	case sccacheRedis:
+		rust = rust.WithSecretVariable(sccacheRedisEnv, client.SetSecret("sccache-redis", os.Getenv(sccacheRedisEnv)))
+	default:
+		rust = rust.
+			WithMountedCache(sccacheDir, client.CacheVolume(cacheName(opts.cachePrefix, cacheSccache))).
+			WithEnvVariable("SCCACHE_DIR", sccacheDir)
+	}
+	return rust
+}
+
+// withSccacheStats runs args and then records sccache's statistics in
+// sccacheStats. The sccache server only lives as long as the exec that
+// started it, so the statistics must be read in the same exec.
+func withSccacheStats(args []string) []string {
+	return append([]string{"sh", "-c", `"$@" && sccache --show-stats > ` + sccacheStats, "sh"}, args...)
+}
+
+// sccacheHitRatePattern matches the overall hit rate in `sccache
+// --show-stats`, e.g. `Cache hits rate                    87.50 %`.
+var sccacheHitRatePattern = regexp.MustCompile(`(?m)^Cache hits rate\s+(.+?)\s*$`)
+
+// parseSccacheHitRate returns the overall cache hit rate from sccache's
+// statistics, or "" if it is missing.
+func parseSccacheHitRate(stats string) string {
+	m := sccacheHitRatePattern.FindStringSubmatch(stats)
+	if m == nil {
+		return ""
+	}
+	return strings.ReplaceAll(m[1], " ", "")
+}
+
+// sccacheHitRate reads the hit rate recorded by a build run through
+// withSccacheStats.
+func sccacheHitRate(ctx context.Context, built *dagger.Container) (string, error) {
+	stats, err := built.File(sccacheStats).Contents(ctx)
+	if err != nil {
+		return "", fmt.Errorf("read sccache stats: %w", err)
+	}
+	if rate := parseSccacheHitRate(stats); rate != "" {
+		return rate, nil
+	}
+	return "", fmt.Errorf("no hit rate in sccache stats")
+}
@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"io"
+	"testing"
+)
+
+func TestParseSccacheHitRate(t *testing.T) {
+	const stats = `Compile requests                    142
+Compile requests executed           120
+Cache hits                          105
+Cache hits (Rust)                   105
+Cache misses                         15
+Cache misses (Rust)                  15
+Cache hits rate                   87.50 %
+Cache hits rate (Rust)            87.50 %
+Cache location                  Local disk: "/sccache"
+`
+	if got := parseSccacheHitRate(stats); got != "87.50%" {
+		t.Errorf("parseSccacheHitRate = %q, want 87.50%%", got)
+	}
+	if got := parseSccacheHitRate("Compile requests 0\n"); got != "" {
+		t.Errorf("parseSccacheHitRate without a rate = %q, want empty", got)
+	}
+}
+
+func TestSccacheBackendOptions(t *testing.T) {
+	if _, err := ParseOptions([]string{"-sccache"}, io.Discard); err != nil {
+		t.Errorf("local sccache: %v", err)
+	}
+	if _, err := ParseOptions([]string{"-sccache", "-sccache-backend=s3", "-sccache-bucket=merlin-sccache"}, io.Discard); err != nil {
+		t.Errorf("s3 sccache: %v", err)
+	}
+
+	t.Setenv(sccacheRedisEnv, "")
+	for _, args := range [][]string{
+		{"-sccache", "-sccache-backend=s3"},
+		{"-sccache", "-sccache-backend=redis"},
+		{"-sccache", "-sccache-backend=gcs"},
+		{"-sccache", "-platforms=linux/arm64"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// shardResult is the outcome of one slice of a sharded test run.
+type shardResult struct {
+	index    int // 1-based, as nextest numbers partitions
+	duration time.Duration
+	report   junitTestsuites
+	output   string
+	err      error
+}
+
+// shardLabel names shard i of n in stage names and reports.
+func shardLabel(i, n int) string {
+	return fmt.Sprintf("shard %d/%d", i, n)
+}
+
+// runShardedTests splits the test run across opts.shards containers with
+// nextest's count partitioning, prints each shard's duration and merges
+// their JUnit reports when -junit is set. It also returns the tests that
+// passed on a retry in any shard.
+func runShardedTests(ctx context.Context, rust *dagger.Container, opts Options) (string, []FlakyTest, error) {
+	n := opts.shards
+	results := make([]shardResult, n)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stage := fmt.Sprintf("%s (%s)", stageTest, shardLabel(i, n))
+			start := time.Now()
+			data, output, err := nextestRun(ctx, rust, opts, stage, "--partition", fmt.Sprintf("count:%d/%d", i, n))
+
+			res := shardResult{index: i, duration: time.Since(start), output: output, err: err}
+			if data != "" {
+				report, reportErr := parseJUnit([]byte(data))
+				if reportErr != nil && err == nil {
+					res.err = fmt.Errorf("%s: junit report: %w", stage, reportErr)
+				}
+				res.report = report
+			}
+			results[i-1] = res
+		}(i)
+	}
+	wg.Wait()
+
+	printShards(os.Stdout, results)
+
+	merged := mergeShardReports(results)
+	flaky := junitFlaky(merged)
+	if opts.junit {
+		if err := writeJUnit(merged, opts.junitOut); err != nil {
+			return "", nil, fmt.Errorf("%s: junit report: %w", stageTest, err)
+		}
+	}
+
+	var errs []error
+	for _, res := range results {
+		if res.err != nil {
+			errs = append(errs, res.err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return "", flaky, err
+	}
+
+	var out string
+	for _, res := range results {
+		out += shardLabel(res.index, n) + ":\n" + res.output + "\n"
+	}
+	out += fmt.Sprintf("%d tests, %d failed, %d ignored across %d shards",
+		merged.Tests, merged.Failures, merged.Skipped, n)
+	if opts.junit {
+		out += " (JUnit report written to " + opts.junitOut + ")"
+	}
+	return out, flaky, nil
+}
+
+// mergeShardReports combines the shards' reports into one, suffixing each
+// testsuite with its shard since every shard runs the same test binaries.
+func mergeShardReports(results []shardResult) junitTestsuites {
+	var merged junitTestsuites
+	for _, res := range results {
+		for _, suite := range res.report.Suites {
+			suite.Name = fmt.Sprintf("%s (%s)", suite.Name, shardLabel(res.index, len(results)))
+			merged.Suites = append(merged.Suites, suite)
+		}
+		merged.Tests += res.report.Tests
+		merged.Failures += res.report.Failures
+		merged.Skipped += res.report.Skipped
+	}
+	return merged
+}
+
+// printShards prints one row per shard so an unbalanced split stands out.
+func printShards(w io.Writer, results []shardResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHARD\tTESTS\tFAILED\tDURATION\tRESULT")
+	for _, res := range results {
+		result := "pass"
+		if res.err != nil {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", shardLabel(res.index, len(results)),
+			res.report.Tests, res.report.Failures, res.duration.Round(time.Millisecond), result)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,38 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeShardReports(t *testing.T) {
+	results := []shardResult{
+		{index: 1, report: junitTestsuites{Tests: 2, Suites: []junitTestsuite{{Name: "merlin", Tests: 2}}}},
+		{index: 2, report: junitTestsuites{Tests: 3, Failures: 1, Skipped: 1, Suites: []junitTestsuite{{Name: "merlin", Tests: 3}}}},
+	}
+	merged := mergeShardReports(results)
+	if merged.Tests != 5 || merged.Failures != 1 || merged.Skipped != 1 {
+		t.Errorf("tests, failures, skipped = %d, %d, %d, want 5, 1, 1", merged.Tests, merged.Failures, merged.Skipped)
+	}
+	if len(merged.Suites) != 2 || merged.Suites[0].Name != "merlin (shard 1/2)" || merged.Suites[1].Name != "merlin (shard 2/2)" {
+		t.Errorf("suites = %+v", merged.Suites)
+	}
+}
+
+func TestPrintShards(t *testing.T) {
+	var b strings.Builder
+	printShards(&b, []shardResult{
+		{index: 1, duration: 1500 * time.Millisecond, report: junitTestsuites{Tests: 4}},
+		{index: 2, duration: 9 * time.Second, report: junitTestsuites{Tests: 5, Failures: 1}, err: errors.New("boom")},
+	})
+	want := []string{
+		"SHARD      TESTS  FAILED  DURATION  RESULT",
+		"shard 1/2  4      0       1.5s      pass",
+		"shard 2/2  5      1       9s        FAIL",
+	}
+	if got := strings.Split(strings.TrimSpace(b.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("printShards =\n%s\nwant\n%s", b.String(), strings.Join(want, "\n"))
+	}
+}
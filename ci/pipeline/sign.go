@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageSign = "sign"
+
+// cosignImage runs cosign. Its entrypoint is cosign and it has no shell.
+const cosignImage = "gcr.io/projectsigstore/cosign:v2.2.2"
+
+// environment variables holding the signing key and its password
+const (
+	cosignKeyEnv      = "COSIGN_KEY"
+	cosignPasswordEnv = "COSIGN_PASSWORD"
+)
+
+// keylessTokenEnvs are passed through to cosign for keyless signing: the
+// variables GitHub Actions provides for requesting an OIDC token, and an
+// explicitly supplied token.
+var keylessTokenEnvs = []string{"ACTIONS_ID_TOKEN_REQUEST_URL", "ACTIONS_ID_TOKEN_REQUEST_TOKEN", "SIGSTORE_ID_TOKEN"}
+
+// paths in the cosign container
+const (
+	cosignKeyPath    = "/cosign/cosign.key"
+	cosignDockerDir  = "/cosign/docker"
+	cosignBlobDir    = "/blobs"
+	cosignSigDir     = "/signatures"
+	cosignSigSuffix  = ".sig"
+	cosignCertSuffix = ".pem"
+)
+
+// validateSign checks that signing can run after the publish.
+func validateSign(opts Options) error {
+	if !opts.sign {
+		return nil
+	}
+	if !opts.publish {
+		return fmt.Errorf("-sign requires -publish")
+	}
+	if !opts.signKeyless && os.Getenv(cosignKeyEnv) == "" {
+		return fmt.Errorf("-sign requires a private key in $%s, or -sign-keyless", cosignKeyEnv)
+	}
+	return nil
+}
+
+// releaseFiles lists the host files that are signed and attested: the
+// exported binaries, their checksums and the release archives.
+func releaseFiles(opts Options, archives []string) []string {
+	var files []string
+	if opts.enabled(stageBuild) {
+		files = append(files, buildArtifacts(opts)...)
+	}
+	if opts.pgo {
+		files = append(files, filepath.Join(pgoOut, "merlin"))
+	}
+	return append(files, archives...)
+}
+
+// signatureSuffixes returns the suffixes of the files written next to each
+// signed file: its signature, and the certificate when keyless.
+func signatureSuffixes(keyless bool) []string {
+	if keyless {
+		return []string{cosignSigSuffix, cosignCertSuffix}
+	}
+	return []string{cosignSigSuffix}
+}
+
+// dockerConfig returns a Docker config.json authenticating to the
+// registry, which is how cosign finds push credentials for signatures.
+func dockerConfig(auth registryAuth) string {
+	creds := base64.StdEncoding.EncodeToString([]byte(auth.username + ":" + auth.password))
+	data, _ := json.Marshal(map[string]any{
+		"auths": map[string]any{auth.address: map[string]string{"auth": creds}},
+	})
+	return string(data)
+}
+
+// cosignContainer returns a cosign container holding the signing key, or
+// the OIDC token variables when keyless, and registry credentials. All of
+// them only reach the engine as secrets.
+func cosignContainer(client *dagger.Client, opts Options) *dagger.Container {
+	ctr := client.Container().From(cosignImage).
+		WithMountedSecret(cosignDockerDir+"/config.json", client.SetSecret("cosign-docker-config", dockerConfig(opts.registryAuth))).
+		WithEnvVariable("DOCKER_CONFIG", cosignDockerDir)
+	if opts.signKeyless {
+		for _, name := range keylessTokenEnvs {
+			if value := os.Getenv(name); value != "" {
+				ctr = ctr.WithSecretVariable(name, client.SetSecret("cosign-"+name, value))
+			}
+		}
+		return ctr
+	}
+
+	ctr = ctr.WithMountedSecret(cosignKeyPath, client.SetSecret("cosign-key", os.Getenv(cosignKeyEnv)))
+	// cosign prompts for the password unless the variable is set, even
+	// to an empty one for an unencrypted key
+	if password := os.Getenv(cosignPasswordEnv); password != "" {
+		return ctr.WithSecretVariable(cosignPasswordEnv, client.SetSecret("cosign-password", password))
+	}
+	return ctr.WithEnvVariable(cosignPasswordEnv, "")
+}
+
+// cosignSignArgs returns the arguments, after the cosign entrypoint, that
+// sign the image digest.
+func cosignSignArgs(digest string, keyless bool) []string {
+	args := []string{"sign", "--yes"}
+	if !keyless {
+		args = append(args, "--key", cosignKeyPath)
+	}
+	return append(args, digest)
+}
+
+// cosignSignBlobArgs returns the arguments signing the blob into a
+// detached signature at sig, and for keyless signing its certificate.
+func cosignSignBlobArgs(blob, sig string, keyless bool) []string {
+	args := []string{"sign-blob", "--yes", "--output-signature", sig + cosignSigSuffix}
+	if keyless {
+		args = append(args, "--output-certificate", sig+cosignCertSuffix)
+	} else {
+		args = append(args, "--key", cosignKeyPath)
+	}
+	return append(args, blob)
+}
+
+// cosignSigPath is where the signature of the i-th file is written, less
+// its suffix.
+func cosignSigPath(i int) string {
+	return fmt.Sprintf("%s/%d", cosignSigDir, i)
+}
+
+// signArtifacts signs the published image by digest and every file in
+// files, writing each file's detached signature next to it, and returns
+// cosign's output.
+func signArtifacts(ctx context.Context, client *dagger.Client, digest string, files []string, opts Options) (string, error) {
+	// cosign reports what it signed and where on stderr, and each exec
+	// only keeps its own
+	var output []string
+	exec := func(ctr *dagger.Container, args []string) (*dagger.Container, error) {
+		ctr = ctr.WithExec(args)
+		stderr, err := ctr.Stderr(ctx)
+		if err != nil {
+			return nil, stageFailed(stageSign, err)
+		}
+		if stderr = strings.TrimSpace(stderr); stderr != "" {
+			output = append(output, stderr)
+		}
+		return ctr, nil
+	}
+
+	ctr, err := exec(cosignContainer(client, opts), cosignSignArgs(digest, opts.signKeyless))
+	if err != nil {
+		return "", err
+	}
+	// files are mounted by index, as e.g. the PGO binary shares its name
+	// with the regular one. cosign does not create the directory it
+	// writes the signatures to, and its image has no shell to do it.
+	ctr = ctr.WithDirectory(cosignSigDir, client.Directory())
+	for i, file := range files {
+		blob := fmt.Sprintf("%s/%d/%s", cosignBlobDir, i, filepath.Base(file))
+		ctr, err = exec(ctr.WithMountedFile(blob, client.Host().File(file)),
+			cosignSignBlobArgs(blob, cosignSigPath(i), opts.signKeyless))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for i, file := range files {
+		for _, suffix := range signatureSuffixes(opts.signKeyless) {
+			sig := cosignSigPath(i) + suffix
+			if _, err := ctr.File(sig).Export(ctx, file+suffix); err != nil {
+				return "", fmt.Errorf("%s: export %s: %w", stageSign, file+suffix, err)
+			}
+		}
+	}
+	return strings.Join(output, "\n"), nil
+}
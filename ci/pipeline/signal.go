@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptError reports a run cancelled by a signal.
+type interruptError struct {
+	signal os.Signal
+}
+
+func (e *interruptError) Error() string {
+	return fmt.Sprintf("interrupted by %s", e.signal)
+}
+
+// withSignals returns a context cancelled on the first SIGINT or SIGTERM,
+// with an interruptError as its cause, so the stages in flight abort and
+// the caller can still close the Dagger client and report the run. A
+// second signal exits at once, after calling beforeExit unless it is nil.
+// stop releases the handler.
+func withSignals(ctx context.Context, beforeExit func()) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			cancel(&interruptError{signal: sig})
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			if beforeExit != nil {
+				beforeExit()
+			}
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// interrupted returns the interruptError that cancelled ctx, or nil.
+func interrupted(ctx context.Context) *interruptError {
+	var interruptErr *interruptError
+	if errors.As(context.Cause(ctx), &interruptErr) {
+		return interruptErr
+	}
+	return nil
+}
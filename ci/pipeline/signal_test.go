@@ -0,0 +1,40 @@
+package pipeline
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithSignals(t *testing.T) {
+	ctx, stop := withSignals(context.Background(), nil)
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled by SIGTERM")
+	}
+	interruptErr := interrupted(ctx)
+	if interruptErr == nil {
+		t.Fatalf("cause = %v, want an interruptError", context.Cause(ctx))
+	}
+	if got := ExitCode(interruptErr); got != exitInterrupted {
+		t.Errorf("ExitCode = %d, want %d", got, exitInterrupted)
+	}
+	if got := newRunResult(nil, time.Second, "", interruptErr).Status; got != statusInterrupted {
+		t.Errorf("status = %q, want %q", got, statusInterrupted)
+	}
+}
+
+func TestStopReleasesSignals(t *testing.T) {
+	ctx, stop := withSignals(context.Background(), nil)
+	stop()
+	if interrupted(ctx) != nil {
+		t.Error("stop reported an interrupt")
+	}
+}
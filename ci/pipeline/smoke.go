@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	stageSmoke        = "smoke"
+	defaultSmokeArgs  = "--version"
+	runtimeBinaryPath = "/usr/local/bin/merlin"
+)
+
+// runtimeContainer returns the minimal image the binary ships in. It
+// matches the Debian release of the rust build images so the binary's
+// glibc is available, plus the TLS libraries it links against. The image
+// is for platform, or the host's when empty.
+func runtimeContainer(client *dagger.Client, platform dagger.Platform, binary *dagger.File) *dagger.Container {
+	return client.Container(dagger.ContainerOpts{Platform: platform}).From(runtimeImage).
+		WithExec([]string{"sh", "-c", "apt-get update && apt-get install -y --no-install-recommends ca-certificates libssl3 && rm -rf /var/lib/apt/lists/*"}).
+		WithFile(runtimeBinaryPath, binary, dagger.ContainerWithFileOpts{Permissions: 0o755})
+}
+
+// runSmokeTest runs the release binary with args in the runtime image, so
+// a binary that builds but cannot start, e.g. because of a missing shared
+// library, fails the pipeline.
+func runSmokeTest(ctx context.Context, client *dagger.Client, rust *dagger.Container, args []string) (string, error) {
+	stdout, stderr, err := execStreams(ctx, runtimeContainer(client, "", builtBinary(rust)).
+		WithExec(append([]string{runtimeBinaryPath}, args...)))
+	if err != nil {
+		return "", stageFailed(stageSmoke, err)
+	}
+
+	out := fmt.Sprintf("merlin %s exited 0\nstdout:\n%s", strings.Join(args, " "), stdout)
+	if strings.TrimSpace(stderr) != "" {
+		out += "\nstderr:\n" + stderr
+	}
+	return out, nil
+}
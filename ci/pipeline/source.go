@@ -0,0 +1,183 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const defaultGitRef = "main"
+
+// gitImage runs git for -submodules.
+const gitImage = "alpine/git:2.43.0"
+
+// sourceDir returns the project to build: a ref of the -git-url repository
+// when one is given, and the -source host directory otherwise. The engine
+// checks out a ref's submodules along with it; a host directory only
+// includes them with -submodules, or when they were initialized on the
+// host. The host directory is uploaded without the -exclude-paths.
+func sourceDir(client *dagger.Client, opts Options) *dagger.Directory {
+	if opts.gitURL == "" {
+		src := client.Host().Directory(opts.source, dagger.HostDirectoryOpts{Exclude: opts.sourceExcludes})
+		if opts.submodules {
+			src = withSubmodules(client, src)
+		}
+		return src
+	}
+	tree := gitRef(client.Git(opts.gitURL), opts.gitRef).Tree()
+	if opts.gitSubpath != "" {
+		tree = tree.Directory(opts.gitSubpath)
+	}
+	return tree
+}
+
+// withSubmodules checks out the submodules of src, a working tree
+// including its .git directory, at the commits it records.
+func withSubmodules(client *dagger.Client, src *dagger.Directory) *dagger.Directory {
+	// the host's files are owned by another user, which git refuses to
+	// work with unless the directory is marked safe
+	return client.Container().
+		From(gitImage).
+		WithDirectory("/src", src).
+		WithWorkdir("/src").
+		WithExec(
+			[]string{"git", "-c", "safe.directory=*", "submodule", "update", "--init", "--recursive"},
+			dagger.ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		Directory("/src")
+}
+
+// commitPattern matches a full commit hash.
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// The kinds of -git-ref, each fetched its own way.
+const (
+	gitRefBranch = "branch"
+	gitRefTag    = "tag"
+	gitRefCommit = "commit"
+)
+
+// gitRefKind returns what ref names and the name to fetch it by: a full
+// commit hash, refs/tags/<name> or refs/heads/<name>. Any other name is
+// taken as a branch; resolveGitRef qualifies it first when it is a tag.
+func gitRefKind(ref string) (kind, name string) {
+	switch {
+	case commitPattern.MatchString(ref):
+		return gitRefCommit, ref
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return gitRefTag, strings.TrimPrefix(ref, "refs/tags/")
+	}
+	return gitRefBranch, strings.TrimPrefix(ref, "refs/heads/")
+}
+
+// gitRef resolves ref in repo.
+func gitRef(repo *dagger.GitRepository, ref string) *dagger.GitRef {
+	switch kind, name := gitRefKind(ref); kind {
+	case gitRefCommit:
+		return repo.Commit(name)
+	case gitRefTag:
+		return repo.Tag(name)
+	default:
+		return repo.Branch(name)
+	}
+}
+
+// resolveGitRef returns opts.gitRef as refs/tags/<name> when it is a bare
+// name the -git-url repository has a tag of, and unchanged otherwise. The
+// engine fetches a bare name as a branch only, so a tag such as v1.2.0
+// would not be found. The lookup runs git ls-remote in a git container,
+// named for the time so the engine does not reuse an earlier answer.
+func resolveGitRef(ctx context.Context, client *dagger.Client, opts Options) (string, error) {
+	if opts.gitURL == "" || strings.HasPrefix(opts.gitRef, "refs/") || commitPattern.MatchString(opts.gitRef) {
+		return opts.gitRef, nil
+	}
+	out, err := client.Container().
+		From(gitImage).
+		WithEnvVariable("MERLIN_LS_REMOTE_AT", time.Now().UTC().Format(time.RFC3339Nano)).
+		WithExec(
+			[]string{"git", "ls-remote", "--tags", opts.gitURL, "refs/tags/" + opts.gitRef},
+			dagger.ContainerWithExecOpts{SkipEntrypoint: true},
+		).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	if hasRemoteTag(out, opts.gitRef) {
+		return "refs/tags/" + opts.gitRef, nil
+	}
+	return opts.gitRef, nil
+}
+
+// gitRefOrBranch returns resolveGitRef's answer, falling back to fetching
+// opts.gitRef as a branch when the tags cannot be listed, e.g. because the
+// container has no credentials for the repository.
+func gitRefOrBranch(ctx context.Context, client *dagger.Client, opts Options, log *slog.Logger) string {
+	ref, err := resolveGitRef(ctx, client, opts)
+	if err != nil {
+		log.Warn("could not list the tags of -git-url, fetching -git-ref as a branch", "ref", opts.gitRef, "error", err)
+		return opts.gitRef
+	}
+	return ref
+}
+
+// hasRemoteTag reports whether git ls-remote output lists the tag name,
+// annotated tags appearing once more with the ^{} suffix.
+func hasRemoteTag(out, name string) bool {
+	for _, line := range strings.Split(out, "\n") {
+		_, ref, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if ok && strings.TrimSuffix(ref, "^{}") == "refs/tags/"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSource checks the git source flags and normalizes the subpath to
+// a path relative to the repository root.
+func validateSource(opts *Options, explicit map[string]bool) error {
+	if opts.gitURL == "" {
+		for _, name := range []string{"git-ref", "git-subpath"} {
+			if explicit[name] {
+				return fmt.Errorf("-%s requires -git-url", name)
+			}
+		}
+		if opts.submodules {
+			if _, err := os.Stat(filepath.Join(opts.source, ".git")); err != nil {
+				return fmt.Errorf("-submodules requires -source to be the root of a git working tree: %w", err)
+			}
+		}
+		return nil
+	}
+	if explicit["source"] {
+		return fmt.Errorf("-source and -git-url cannot be combined")
+	}
+	if opts.submodules {
+		return fmt.Errorf("-submodules applies to -source: -git-url checkouts always include submodules")
+	}
+	if opts.gitRef == "" {
+		return fmt.Errorf("-git-ref must not be empty")
+	}
+
+	// a leading slash means the repository root, but .. must not leave it
+	subpath := path.Clean(strings.TrimLeft(strings.TrimSpace(opts.gitSubpath), "/"))
+	if subpath == ".." || strings.HasPrefix(subpath, "../") {
+		return fmt.Errorf("-git-subpath %q is outside the repository", opts.gitSubpath)
+	}
+	if subpath == "." {
+		subpath = ""
+	}
+	opts.gitSubpath = subpath
+
+	if opts.fixInplace {
+		return fmt.Errorf("-fix-inplace requires a host -source, not -git-url")
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// buildDir is the host directory build artifacts are exported to.
+const buildDir = "./build"
+
+// outputDir holds the build artifacts in the container. It lives outside
+// target/ because target/ may be a cache mount, which cannot be exported.
+const outputDir = "/out"
+
+// build defines the release build. Nothing runs until the returned
+// container is evaluated.
+func build(rust *dagger.Container, opts Options) *dagger.Container {
+	// define the application build, then copy the binary out of target/ in
+	// a step chained on the build so the copy always reflects the current
+	// sources rather than whatever the cache held
+	args := cargoBuildArgs(opts)
+	if opts.sccache {
+		args = withSccacheStats(args)
+	}
+	if opts.memory > 0 {
+		args = withPeakMemory(args)
+	}
+	return withStrip(rust.
+		WithExec(args).
+		WithExec([]string{"install", "-D", binaryPath(opts, ""), outputDir + "/merlin"}), opts)
+}
+
+// syncWithRetry evaluates ctr, which pulls the base image and downloads
+// dependencies, retrying network failures as configured in opts.
+func syncWithRetry(ctx context.Context, ctr *dagger.Container, opts Options) (*dagger.Container, error) {
+	var synced *dagger.Container
+	err := retry(ctx, opts.retries+1, opts.retryBackoff, func() (err error) {
+		synced, err = ctr.Sync(ctx)
+		return err
+	}, isTransient)
+	return synced, err
+}
+
+// runBuild compiles the release binary and exports it to the host. The
+// returned container holds the built workspace.
+func runBuild(ctx context.Context, rust *dagger.Container, opts Options) (*dagger.Container, error) {
+	rust, err := syncWithRetry(ctx, build(rust, opts), opts)
+	if err != nil {
+		return nil, stageFailed(stageBuild, err)
+	}
+
+	// get reference to build output directory in container
+	output := rust.Directory(outputDir)
+
+	// write contents of container build output directory to the host
+	if _, err := output.Export(ctx, buildDir); err != nil {
+		return nil, stageFailed(stageBuild, err)
+	}
+	if err := verifyExport(ctx, rust, outputDir+"/merlin", filepath.Join(buildDir, "merlin")); err != nil {
+		return nil, fmt.Errorf("%s: %w", stageBuild, err)
+	}
+	if opts.checksums {
+		if err := writeChecksums(buildDir); err != nil {
+			return nil, fmt.Errorf("%s: checksums: %w", stageBuild, err)
+		}
+	}
+	return rust, nil
+}
+
+// runTests runs the test suite and returns its output, along with the
+// tests that only passed when retried as -flaky-retries allows.
+func runTests(ctx context.Context, rust *dagger.Container, opts Options) (string, []FlakyTest, error) {
+	ran := rust.WithExec(testArgs(opts))
+	if opts.flakyRetries == 0 {
+		out, err := execOutput(ctx, ran)
+		if err != nil {
+			return "", nil, stageFailed(stageTest, err)
+		}
+		return out, nil, nil
+	}
+	stdout, stderr, err := execStreams(ctx, ran)
+	if opts.testRunner == testRunnerNextest {
+		return nextestOutcome(stdout, stderr, err)
+	}
+
+	if err == nil {
+		return combineStreams(stdout, stderr), nil, nil
+	}
+	// the first run's output still shows what failed before the reruns
+	var out string
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		out = combineStreams(execErr.Stdout, execErr.Stderr)
+	}
+	flaky, err := retryFailedTests(ctx, rust, opts, err)
+	if err != nil {
+		return "", flaky, err
+	}
+	return out, flaky, nil
+}
+
+// nextestOutcome returns the output of a nextest run with retries, which
+// nextest does on its own, and the flaky tests it reported on stderr. A
+// failed run still reports the tests that passed on a retry.
+func nextestOutcome(stdout, stderr string, err error) (string, []FlakyTest, error) {
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		return "", nextestFlaky(execErr.Stderr), stageFailed(stageTest, err)
+	} else if err != nil {
+		return "", nil, stageFailed(stageTest, err)
+	}
+	return combineStreams(stdout, stderr), nextestFlaky(stderr), nil
+}
+
+// runClippy lints the project, treating every warning as an error.
+func runClippy(ctx context.Context, rust *dagger.Container, opts Options) (string, error) {
+	args := append(append([]string{"cargo", "clippy"}, lockArgs(opts)...), "--", "-D", "warnings")
+	out, err := execOutput(ctx, rust.WithExec(args))
+	if err != nil {
+		return "", stageFailed(stageClippy, err)
+	}
+	return out, nil
+}
+
+// runFmt checks that the sources are formatted. A failure reports the diff
+// cargo fmt prints to stdout.
+func runFmt(ctx context.Context, rust *dagger.Container) (string, error) {
+	out, err := execOutput(ctx, rust.WithExec([]string{"cargo", "fmt", "--check"}))
+	if err != nil {
+		return "", stageFailed(stageFmt, err)
+	}
+	return out, nil
+}
+
+// checkFunc runs a check stage against the built container.
+type checkFunc func(ctx context.Context, rust *dagger.Container) (string, error)
+
+// check is a stage that only inspects the built container, so it can run
+// alongside the other checks.
+type check struct {
+	name  string
+	label string
+	run   checkFunc
+}
+
+// selectChecks returns the enabled independent stages in the order their
+// output is printed. The test stage records its flaky tests with rec,
+// which may be nil when the checks are only listed.
+func selectChecks(client *dagger.Client, opts Options, rec *stageRecorder, reg *artifactRegistry) []check {
+	runner := func(ctx context.Context, rust *dagger.Container) (string, error) {
+		var (
+			out   string
+			flaky []FlakyTest
+			err   error
+		)
+		switch {
+		case opts.shards > 1:
+			out, flaky, err = runShardedTests(ctx, rust, opts)
+		case opts.junit && opts.testRunner == testRunnerNextest:
+			out, flaky, err = runNextestJUnit(ctx, rust, opts)
+		case opts.junit:
+			out, err = runJUnitTests(ctx, rust, opts)
+		default:
+			out, flaky, err = runTests(ctx, rust, opts)
+		}
+		rec.recordFlaky(flaky...)
+		if err == nil && len(flaky) > 0 {
+			out = strings.TrimRight(out, "\n") + "\n" + formatFlaky(flaky)
+		}
+		return out, err
+	}
+	tests := func(ctx context.Context, rust *dagger.Container) (string, error) {
+		rust, err := runHooks(ctx, withTestRunner(client, rust, opts), hookPreTest, opts.config)
+		if err != nil {
+			return "", err
+		}
+		out, err := runner(ctx, rust)
+		if err != nil {
+			return "", err
+		}
+		// post_test hooks start from the container the tests ran in, so
+		// files the test run wrote are not visible to them
+		if _, err := runHooks(ctx, rust, hookPostTest, opts.config); err != nil {
+			return "", err
+		}
+		return out, nil
+	}
+
+	clippy := func(ctx context.Context, rust *dagger.Container) (string, error) {
+		if opts.clippyFix {
+			return runClippyFix(ctx, rust, opts)
+		}
+		if opts.clippyPolicy != nil {
+			return runClippyPolicy(ctx, rust, *opts.clippyPolicy, lockArgs(opts)...)
+		}
+		return runClippy(ctx, rust, opts)
+	}
+	format := func(ctx context.Context, rust *dagger.Container) (string, error) {
+		if opts.fmtFix {
+			return runFmtFix(ctx, rust, opts)
+		}
+		return runFmt(ctx, rust)
+	}
+
+	var selected []check
+	for _, c := range []check{
+		{name: stageTest, label: "Tests output", run: tests},
+		{name: stageClippy, label: "Clippy output", run: clippy},
+		{name: stageFmt, label: "Format check output", run: format},
+	} {
+		if opts.enabled(c.name) {
+			selected = append(selected, c)
+		}
+		// the doc examples belong to the test stage, but report on their own
+		if c.name == stageTest && opts.enabled(stageTest) && opts.doctests {
+			selected = append(selected, check{name: stageDoctest, label: "Doctests output", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+				return runDocTests(ctx, rust, opts)
+			}})
+		}
+	}
+
+	if opts.verifyLock {
+		selected = append(selected, check{name: stageVerifyLock, label: "Lockfile check", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runVerifyLock(ctx, sourceDir(client, opts), rust)
+		}})
+	}
+	if opts.audit {
+		selected = append(selected, check{name: stageAudit, label: "Audit summary", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runAudit(ctx, client, rust, opts.auditSeverity)
+		}})
+	}
+	if opts.musl {
+		selected = append(selected, check{name: stageMusl, label: "Static build", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runMuslBuild(ctx, client, rust, opts, reg)
+		}})
+	}
+	if opts.integration {
+		selected = append(selected, check{name: stageIntegration, label: "Integration tests output", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runIntegrationTests(ctx, client, rust, opts)
+		}})
+	}
+	if opts.msrv {
+		selected = append(selected, check{name: stageMSRV, label: "MSRV", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runMSRV(ctx, client, rust, opts.msrvVersion, opts)
+		}})
+	}
+	if opts.udeps {
+		selected = append(selected, check{name: stageUdeps, label: "Unused dependencies", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runUdeps(ctx, client, rust, opts)
+		}})
+	}
+	if opts.sanitizer != "" {
+		selected = append(selected, check{name: stageSanitizer, label: "Sanitizer", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runSanitizer(ctx, client, rust, opts)
+		}})
+	}
+	if opts.sbom {
+		selected = append(selected, check{name: stageSBOM, label: "SBOM", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return generateSBOM(ctx, client, rust, opts.sbomFormat, opts.sbomOut)
+		}})
+	}
+	if opts.deny {
+		selected = append(selected, check{name: stageDeny, label: "Deny summary", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runDeny(ctx, client, rust, opts.denyAllow)
+		}})
+	}
+	if opts.smoke {
+		selected = append(selected, check{name: stageSmoke, label: "Smoke test", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runSmokeTest(ctx, client, rust, opts.smokeArgs)
+		}})
+	}
+	if opts.verifyAssets {
+		selected = append(selected, check{name: stageVerifyAssets, label: "Asset check", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runVerifyAssets(ctx, client, rust, opts)
+		}})
+	}
+	if opts.docs {
+		selected = append(selected, check{name: stageDocs, label: "Docs", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			return runDoc(ctx, rust, opts, reg)
+		}})
+	}
+	if opts.coverage {
+		selected = append(selected, check{name: stageCoverage, label: "Coverage", run: func(ctx context.Context, rust *dagger.Container) (string, error) {
+			if opts.coverageDiff {
+				return runCoverageDiff(ctx, client, rust, opts)
+			}
+			return runCoverage(ctx, client, rust, opts.coverageOut, opts.coverageMin)
+		}})
+	}
+	return selected
+}
+
+// checkResult is the outcome of a single check.
+type checkResult struct {
+	check
+	output string
+	err    error
+}
+
+// runChecks runs the given checks concurrently, each measured by rec, and
+// waits for all of them, returning their results in input order. A
+// panicking check is reported as a failure of that check instead of taking
+// down the others. Under -fail-fast the first failure cancels the rest.
+func runChecks(ctx context.Context, rust *dagger.Container, selected []check, rec *stageRecorder) []checkResult {
+	results := make([]checkResult, len(selected))
+	ctx, report, release := rec.concurrent(ctx)
+	defer release()
+
+	var wg sync.WaitGroup
+	for i, c := range selected {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			results[i].check = c
+			results[i].err = rec.measureStage(ctx, c.name, func(ctx context.Context) (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						err = fmt.Errorf("%s: panic: %v", c.name, r)
+					}
+				}()
+				results[i].output, err = c.run(ctx, rust)
+				return err
+			})
+			if results[i].err == nil {
+				rec.recordOutput(c.name, results[i].output)
+			}
+			report(c.name, results[i].err)
+		}(i, c)
+	}
+	wg.Wait()
+
+	return results
+}
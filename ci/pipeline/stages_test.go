@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestRunChecksReportsEveryFailure(t *testing.T) {
+	boom := errors.New("boom")
+	selected := []check{
+		{name: "ok", run: func(context.Context, *dagger.Container) (string, error) { return "fine", nil }},
+		{name: "fails", run: func(context.Context, *dagger.Container) (string, error) { return "", boom }},
+		{name: "panics", run: func(context.Context, *dagger.Container) (string, error) { panic("oops") }},
+	}
+
+	results := runChecks(context.Background(), nil, selected, newStageRecorder(newLogger(io.Discard, logFormatText, logNormal)))
+	if len(results) != len(selected) {
+		t.Fatalf("got %d results, want %d", len(results), len(selected))
+	}
+	for i, res := range results {
+		if res.name != selected[i].name {
+			t.Errorf("result %d is %q, want %q", i, res.name, selected[i].name)
+		}
+	}
+	if results[0].err != nil || results[0].output != "fine" {
+		t.Errorf("ok check: got (%q, %v)", results[0].output, results[0].err)
+	}
+	if !errors.Is(results[1].err, boom) {
+		t.Errorf("failing check: got %v, want %v", results[1].err, boom)
+	}
+	if results[2].check.name != "panics" || results[2].err == nil || !strings.Contains(results[2].err.Error(), "panic: oops") {
+		t.Errorf("panicking check: got %v", results[2].err)
+	}
+}
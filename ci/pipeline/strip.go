@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"dagger.io/dagger"
+)
+
+// stripArgs removes the symbols from the copy of the binary in the output
+// directory. The binary under target/ keeps them, which is what the
+// reduction is measured against.
+var stripArgs = []string{"strip", outputDir + "/merlin"}
+
+// withStrip chains the strip on a build when opts.strip is set, so the
+// checksums, archives and published image all see the stripped binary.
+func withStrip(ctr *dagger.Container, opts Options) *dagger.Container {
+	if !opts.strip {
+		return ctr
+	}
+	return ctr.WithExec(stripArgs)
+}
+
+// sizeReduction compares a binary's size before and after stripping.
+type sizeReduction struct {
+	before, after int64
+}
+
+// percent returns how much smaller the stripped binary is, in percent.
+func (r sizeReduction) percent() float64 {
+	if r.before == 0 {
+		return 0
+	}
+	return float64(r.before-r.after) / float64(r.before) * 100
+}
+
+func (r sizeReduction) String() string {
+	return fmt.Sprintf("%s -> %s (-%.1f%%)", formatBytes(r.before), formatBytes(r.after), r.percent())
+}
+
+// measureStrip exports the unstripped binary at unstripped in the built
+// container to a temporary file and compares its size with the stripped
+// binary already exported to exported.
+func measureStrip(ctx context.Context, built *dagger.Container, unstripped, exported string) (sizeReduction, error) {
+	tmp, err := os.MkdirTemp("", "merlin-strip-")
+	if err != nil {
+		return sizeReduction{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "merlin")
+	if _, err := built.File(unstripped).Export(ctx, path); err != nil {
+		return sizeReduction{}, fmt.Errorf("export unstripped binary: %w", err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		return sizeReduction{}, err
+	}
+	after, err := os.Stat(exported)
+	if err != nil {
+		return sizeReduction{}, err
+	}
+	return sizeReduction{before: before.Size(), after: after.Size()}, nil
+}
@@ -0,0 +1,16 @@
+package pipeline
+
+import "testing"
+
+func TestSizeReduction(t *testing.T) {
+	r := sizeReduction{before: 12 << 20, after: 3 << 20}
+	if got := r.percent(); got != 75 {
+		t.Errorf("percent = %v, want 75", got)
+	}
+	if got, want := r.String(), "12.0 MiB -> 3.0 MiB (-75.0%)"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+	if got := (sizeReduction{}).percent(); got != 0 {
+		t.Errorf("percent of an empty binary = %v, want 0", got)
+	}
+}
@@ -0,0 +1,172 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// run and stage statuses reported in results
+const (
+	statusPassed   = "passed"
+	statusFailed   = "failed"
+	statusTimedOut = "timed_out"
+	// statusInterrupted is a run stopped by SIGINT or SIGTERM
+	statusInterrupted = "interrupted"
+	// statusCancelled is a stage -fail-fast stopped after another failed
+	statusCancelled = "cancelled"
+	// statusCached is a stage -skip-unchanged skipped
+	statusCached = "skipped_cached"
+)
+
+// RunResult summarizes a pipeline run. It is what -summary-out writes and
+// what notifications are rendered from.
+type RunResult struct {
+	Status      string        `json:"status"`                 // statusPassed, statusFailed, statusTimedOut or statusInterrupted
+	Ref         string        `json:"ref,omitempty"`          // git ref built, if known
+	Image       string        `json:"image,omitempty"`        // image the build ran in
+	RustVersion string        `json:"rust_version,omitempty"` // toolchain selected
+	Duration    time.Duration `json:"-"`                      // wall-clock time of the run
+	Stages      []StageResult `json:"stages"`                 // in the order they finished
+	Artifacts   []string      `json:"artifacts"`              // host paths written by passing stages
+	FlakyTests  []FlakyTest   `json:"flaky_tests,omitempty"`  // tests that passed on a retry
+	Error       string        `json:"error,omitempty"`        // why the run failed, if it did
+}
+
+// StageResult is the outcome of one stage of a run.
+type StageResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"-"`
+	// ExitCode is the exit status of the failing container command, and 0
+	// when the stage passed or failed outside a container.
+	ExitCode int `json:"exit_code"`
+	// Output is the stage's stderr followed by its stdout, ending with the
+	// last 64 KiB
+	Output string `json:"output,omitempty"`
+	// PeakMemoryBytes is the build's peak memory use with -memory, where
+	// the kernel reports it
+	PeakMemoryBytes int64 `json:"peak_memory_bytes,omitempty"`
+}
+
+// MarshalJSON encodes the duration in seconds, as the webhook does.
+func (r RunResult) MarshalJSON() ([]byte, error) {
+	type plain RunResult
+	return json.Marshal(struct {
+		plain
+		DurationSeconds float64 `json:"duration_seconds"`
+	}{plain(r), r.Duration.Seconds()})
+}
+
+// MarshalJSON encodes the duration in seconds, as the webhook does.
+func (s StageResult) MarshalJSON() ([]byte, error) {
+	type plain StageResult
+	return json.Marshal(struct {
+		plain
+		DurationSeconds float64 `json:"duration_seconds"`
+	}{plain(s), s.Duration.Seconds()})
+}
+
+// newRunResult builds the result of a run from its recorded stages and the
+// error it returned.
+func newRunResult(stages []stageTiming, total time.Duration, ref string, err error) RunResult {
+	result := RunResult{Status: statusPassed, Ref: ref, Duration: total, Stages: []StageResult{}, Artifacts: []string{}}
+	var timeoutErr *timeoutError
+	if err != nil {
+		result.Status = statusFailed
+		var interruptErr *interruptError
+		switch {
+		case errors.As(err, &timeoutErr):
+			result.Status = statusTimedOut
+		case errors.As(err, &interruptErr):
+			result.Status = statusInterrupted
+		}
+		result.Error = err.Error()
+	}
+	for _, s := range stages {
+		status := statusPassed
+		switch {
+		case s.TimedOut:
+			status = statusTimedOut
+		case s.Cancelled:
+			status = statusCancelled
+		case s.Cached:
+			status = statusCached
+		case s.Failed:
+			status = statusFailed
+		}
+		result.Stages = append(result.Stages, StageResult{Name: s.Name, Status: status, Duration: s.Duration, ExitCode: s.ExitCode, Output: s.Output, PeakMemoryBytes: s.PeakMemory})
+	}
+	return result
+}
+
+// stageExitCode returns the exit status of the container command behind
+// err, or 0 when there is none.
+func stageExitCode(err error) int {
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		return stageErr.exitCode
+	}
+	return 0
+}
+
+// buildArtifacts lists the binaries a passing build exported.
+func buildArtifacts(opts Options) []string {
+	dirs := []string{buildDir}
+	if len(opts.platforms) > 0 {
+		dirs = dirs[:0]
+		for _, p := range opts.platforms {
+			dirs = append(dirs, filepath.Join(buildDir, platformDir(p)))
+		}
+	}
+
+	var paths []string
+	for _, dir := range dirs {
+		paths = append(paths, filepath.Join(dir, "merlin"))
+		if opts.checksums {
+			paths = append(paths, filepath.Join(dir, checksumsFile))
+		}
+	}
+	return paths
+}
+
+// checkArtifact returns the host path a passing check wrote and its kind,
+// or "" for checks that only report or register their own artifacts.
+func checkArtifact(name string, opts Options) (string, string) {
+	switch name {
+	case stageTest:
+		if opts.junit {
+			return opts.junitOut, artifactReport
+		}
+	case stageDoctest:
+		if opts.junit {
+			return docTestJUnitOut(opts), artifactReport
+		}
+	case stageClippy:
+		if opts.clippyFix {
+			return fixTarget(opts), artifactSources
+		}
+	case stageFmt:
+		if opts.fmtFix {
+			return fixTarget(opts), artifactSources
+		}
+	case stageSBOM:
+		return opts.sbomOut, artifactReport
+	case stageDeny:
+		return denyOut, artifactReport
+	case stageCoverage:
+		return opts.coverageOut, artifactReport
+	}
+	return "", ""
+}
+
+// writeSummary writes result as JSON to path.
+func writeSummary(path string, result RunResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode summary: %w", err)
+	}
+	return writeReport(path, append(data, '\n'))
+}
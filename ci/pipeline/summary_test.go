@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestWriteSummary(t *testing.T) {
+	stageErr := &stageError{stage: stageTest, exitCode: 101, stderr: "1 test failed"}
+	result := newRunResult([]stageTiming{
+		{Name: stageBuild, Duration: 90 * time.Second},
+		{Name: stageTest, Duration: 1500 * time.Millisecond, Failed: true, ExitCode: stageExitCode(stageErr)},
+		{Name: stageAudit, Duration: time.Second, Failed: true, ExitCode: stageExitCode(fmt.Errorf("audit: %w", os.ErrNotExist))},
+	}, 2*time.Minute, "main", stageErr)
+	result.Image = "rust:1.75"
+	result.RustVersion = "1.75"
+	result.Artifacts = append(result.Artifacts, "build/merlin")
+
+	path := filepath.Join(t.TempDir(), "out", "summary.json")
+	if err := writeSummary(path, result); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"status":           "failed",
+		"ref":              "main",
+		"image":            "rust:1.75",
+		"rust_version":     "1.75",
+		"duration_seconds": 120.0,
+		"stages": []any{
+			map[string]any{"name": "build", "status": "passed", "duration_seconds": 90.0, "exit_code": 0.0},
+			map[string]any{"name": "test", "status": "failed", "duration_seconds": 1.5, "exit_code": 101.0},
+			map[string]any{"name": "audit", "status": "failed", "duration_seconds": 1.0, "exit_code": 0.0},
+		},
+		"artifacts": []any{"build/merlin"},
+		"error":     "test failed with exit code 101:\n1 test failed",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestEmptySummary(t *testing.T) {
+	data, err := json.Marshal(newRunResult(nil, 0, "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"status":"passed","stages":[],"artifacts":[],"duration_seconds":0}`
+	if string(data) != want {
+		t.Errorf("summary = %s, want %s", data, want)
+	}
+}
+
+func TestBuildArtifacts(t *testing.T) {
+	if got, want := buildArtifacts(Options{}), []string{"build/merlin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("buildArtifacts(host) = %v, want %v", got, want)
+	}
+
+	opts := Options{platforms: []dagger.Platform{"linux/amd64", "linux/arm64"}, checksums: true}
+	want := []string{
+		"build/linux-amd64/merlin", "build/linux-amd64/SHA256SUMS",
+		"build/linux-arm64/merlin", "build/linux-arm64/SHA256SUMS",
+	}
+	if got := buildArtifacts(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildArtifacts(platforms) = %v, want %v", got, want)
+	}
+}
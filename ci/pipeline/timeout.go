@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// timeoutError reports a stage cut short by -stage-timeout, or a stage in
+// flight when the whole run hit -timeout.
+type timeoutError struct {
+	stage string
+	limit time.Duration
+	// global is set when the run's deadline rather than the stage's expired
+	global bool
+}
+
+func (e *timeoutError) Error() string {
+	if e.global {
+		return fmt.Sprintf("%s timed out: the run exceeded -timeout=%s", e.stage, e.limit)
+	}
+	return fmt.Sprintf("%s timed out after %s", e.stage, e.limit)
+}
+
+// validateTimeouts rejects negative deadlines; zero disables one.
+func validateTimeouts(opts Options) error {
+	if opts.timeout < 0 {
+		return fmt.Errorf("-timeout must not be negative, got %s", opts.timeout)
+	}
+	if opts.stageTimeout < 0 {
+		return fmt.Errorf("-stage-timeout must not be negative, got %s", opts.stageTimeout)
+	}
+	return nil
+}
+
+// withRunTimeout bounds ctx by -timeout, if set.
+func withRunTimeout(ctx context.Context, opts Options) (context.Context, context.CancelFunc) {
+	if opts.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, opts.timeout)
+}
+
+// withTimeouts makes measureStage bound each stage by stage and report
+// stages that outlive the run's deadline against run.
+func (t *stageRecorder) withTimeouts(run, stage time.Duration) *stageRecorder {
+	t.runTimeout = run
+	t.stageTimeout = stage
+	return t
+}
+
+// measureStage is measure for stages that take a context. fn gets ctx
+// bounded by the recorder's stage timeout, and an error caused by either
+// deadline expiring is returned as a timeoutError naming the stage, and one
+// caused by -fail-fast cancelling its group as a cancelledError. The
+// cancelled context is what stops the stage's in-flight Dagger queries.
+func (t *stageRecorder) measureStage(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	return t.measure(name, func() error {
+		stageCtx, cancel := ctx, context.CancelFunc(func() {})
+		if t.stageTimeout > 0 {
+			stageCtx, cancel = context.WithTimeout(ctx, t.stageTimeout)
+		}
+		defer cancel()
+
+		err := fn(stageCtx)
+		if err == nil {
+			return nil
+		}
+		if cancelled := failedFast(ctx, name); cancelled != nil {
+			return cancelled
+		}
+		if !errors.Is(stageCtx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return &timeoutError{stage: name, limit: t.runTimeout, global: true}
+		}
+		return &timeoutError{stage: name, limit: t.stageTimeout}
+	})
+}
@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestRunChecksReportsStageTimeouts(t *testing.T) {
+	hang := func(ctx context.Context, _ *dagger.Container) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	selected := []check{
+		{name: "quick", run: func(context.Context, *dagger.Container) (string, error) { return "done", nil }},
+		{name: "hangs", run: hang},
+	}
+
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal)).withTimeouts(0, 20*time.Millisecond)
+	results := runChecks(context.Background(), nil, selected, rec)
+
+	if results[0].err != nil {
+		t.Errorf("quick check: %v", results[0].err)
+	}
+	var timeoutErr *timeoutError
+	if !errors.As(results[1].err, &timeoutErr) || timeoutErr.stage != "hangs" || timeoutErr.global {
+		t.Fatalf("hanging check: got %v, want a stage timeout", results[1].err)
+	}
+	if got := ExitCode(results[1].err); got != exitTimeout {
+		t.Errorf("exit code %d, want %d", got, exitTimeout)
+	}
+
+	result := newRunResult(rec.snapshot(), time.Second, "", results[1].err)
+	if result.Status != statusTimedOut {
+		t.Errorf("run status %q, want %q", result.Status, statusTimedOut)
+	}
+	statuses := map[string]string{}
+	for _, s := range result.Stages {
+		statuses[s.Name] = s.Status
+	}
+	if statuses["quick"] != statusPassed || statuses["hangs"] != statusTimedOut {
+		t.Errorf("stage statuses %v", statuses)
+	}
+}
+
+func TestMeasureStageReportsRunTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal)).withTimeouts(time.Minute, time.Hour)
+	err := rec.measureStage(ctx, stageBuild, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	var timeoutErr *timeoutError
+	if !errors.As(err, &timeoutErr) || !timeoutErr.global {
+		t.Fatalf("got %v, want a run timeout", err)
+	}
+	if want := "build timed out: the run exceeded -timeout=1m0s"; err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
+
+func TestMeasureStageKeepsOtherErrors(t *testing.T) {
+	boom := errors.New("boom")
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal)).withTimeouts(0, time.Hour)
+	err := rec.measureStage(context.Background(), stageTest, func(context.Context) error { return boom })
+	if !errors.Is(err, boom) {
+		t.Errorf("got %v, want %v", err, boom)
+	}
+	if got := rec.snapshot()[0]; got.TimedOut || !got.Failed {
+		t.Errorf("recorded %+v", got)
+	}
+}
+
+func TestParseOptionsRejectsNegativeTimeouts(t *testing.T) {
+	for _, args := range [][]string{{"-timeout=-1s"}, {"-stage-timeout=-1m"}} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
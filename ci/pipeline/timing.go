@@ -0,0 +1,153 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// stageTiming is how long one stage took and whether it failed.
+type stageTiming struct {
+	Name     string
+	Duration time.Duration
+	Failed   bool
+	TimedOut bool // failed by running out of time
+	// Cancelled is set when -fail-fast stopped the stage after another
+	// failed; Failed is set too
+	Cancelled bool
+	// Cached is set when -skip-unchanged skipped the stage
+	Cached   bool
+	ExitCode int // see StageResult
+	// Output is what the stage's command wrote to stderr and stdout, when
+	// known; see recordOutput
+	Output string
+	// PeakMemory is the most memory the stage's command used, in bytes,
+	// when known; see recordPeakMemory
+	PeakMemory int64
+}
+
+// stageRecorder logs stage lifecycle events, traces each stage as a span
+// and records stage durations in the order stages complete. It is safe for
+// concurrent use, so concurrently running stages each record their own
+// elapsed time.
+type stageRecorder struct {
+	log    *slog.Logger
+	tracer trace.Tracer
+	parent context.Context // holds the span stage spans are children of
+
+	// deadlines applied by measureStage; zero means none
+	runTimeout   time.Duration
+	stageTimeout time.Duration
+	failFast     bool // see withFailFast
+
+	mu     sync.Mutex
+	stages []stageTiming
+	flaky  []FlakyTest // see recordFlaky
+}
+
+// newStageRecorder returns a recorder logging to log that does not trace.
+func newStageRecorder(log *slog.Logger) *stageRecorder {
+	return &stageRecorder{log: log, tracer: noop.NewTracerProvider().Tracer(tracerName), parent: context.Background()}
+}
+
+// withTracing makes the recorder trace stages with tracer as children of
+// the span in ctx.
+func (t *stageRecorder) withTracing(ctx context.Context, tracer trace.Tracer) *stageRecorder {
+	t.tracer = tracer
+	t.parent = ctx
+	return t
+}
+
+// measure runs fn as the stage name, logging its start and outcome and
+// recording its duration whether or not it fails.
+func (t *stageRecorder) measure(name string, fn func() error) error {
+	_, span := t.tracer.Start(t.parent, name, trace.WithAttributes(attribute.String("merlin.stage", name)))
+	defer span.End()
+
+	t.log.Info("stage started", "stage", name)
+	start := time.Now()
+	err := fn()
+	d := time.Since(start)
+
+	t.mu.Lock()
+	var (
+		timeoutErr   *timeoutError
+		cancelledErr *cancelledError
+	)
+	cancelled := errors.As(err, &cancelledErr)
+	t.stages = append(t.stages, stageTiming{Name: name, Duration: d, Failed: err != nil, TimedOut: errors.As(err, &timeoutErr), Cancelled: cancelled, ExitCode: stageExitCode(err), Output: stageOutput(err)})
+	t.mu.Unlock()
+
+	span.SetAttributes(attribute.Int64("merlin.stage.duration_ms", d.Milliseconds()))
+	if cancelled {
+		span.SetAttributes(attribute.String("merlin.stage.status", "cancelled"))
+		t.log.Warn("stage finished", "stage", name, "status", "cancelled", "duration", d, "error", err)
+	} else if err != nil {
+		span.SetAttributes(attribute.String("merlin.stage.status", "failed"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		t.log.Error("stage finished", "stage", name, "status", "failed", "duration", d, "error", err)
+	} else {
+		span.SetAttributes(attribute.String("merlin.stage.status", "passed"))
+		span.SetStatus(codes.Ok, "")
+		t.log.Info("stage finished", "stage", name, "status", "passed", "duration", d)
+	}
+	return err
+}
+
+// skipCached records name as skipped by -skip-unchanged, taking no time.
+func (t *stageRecorder) skipCached(name string) {
+	t.log.Info("stage skipped", "stage", name, "reason", "inputs unchanged since it last passed")
+	t.mu.Lock()
+	t.stages = append(t.stages, stageTiming{Name: name, Cached: true})
+	t.mu.Unlock()
+}
+
+// snapshot returns a copy of the recorded timings.
+func (t *stageRecorder) snapshot() []stageTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]stageTiming(nil), t.stages...)
+}
+
+// formatTimings renders the timings as a table, slowest stage first,
+// followed by the total wall-clock time of the run. Concurrent stages
+// overlap, so the total can be less than the sum of the rows.
+func formatTimings(stages []stageTiming, total time.Duration) string {
+	sorted := append([]stageTiming(nil), stages...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Duration > sorted[j].Duration
+	})
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tDURATION\tRESULT")
+	for _, s := range sorted {
+		result := "pass"
+		switch {
+		case s.TimedOut:
+			result = "TIMEOUT"
+		case s.Cancelled:
+			result = "CANCELLED"
+		case s.Cached:
+			result = "skipped (cached)"
+		case s.Failed:
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.Duration.Round(time.Millisecond), result)
+	}
+	fmt.Fprintf(w, "total\t%s\n", total.Round(time.Millisecond))
+	w.Flush()
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTimingsMeasure(t *testing.T) {
+	tm := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal))
+	boom := errors.New("boom")
+
+	if err := tm.measure("fails", func() error { return boom }); !errors.Is(err, boom) {
+		t.Errorf("measure returned %v, want %v", err, boom)
+	}
+	if err := tm.measure("ok", func() error { return nil }); err != nil {
+		t.Errorf("measure returned %v", err)
+	}
+
+	got := tm.snapshot()
+	if len(got) != 2 || got[0].Name != "fails" || got[1].Name != "ok" {
+		t.Errorf("snapshot = %+v, want fails then ok", got)
+	}
+}
+
+func TestFormatTimingsSortsSlowestFirst(t *testing.T) {
+	out := formatTimings([]stageTiming{
+		{Name: "fmt", Duration: 2 * time.Second},
+		{Name: "build", Duration: 90 * time.Second},
+		{Name: "clippy", Duration: 30 * time.Second},
+	}, 2*time.Minute)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	var names []string
+	for _, line := range lines {
+		names = append(names, strings.Fields(line)[0])
+	}
+	if got := strings.Join(names, ","); got != "STAGE,build,clippy,fmt,total" {
+		t.Errorf("row order = %s\n%s", got, out)
+	}
+	if !strings.Contains(lines[1], "1m30s") || !strings.Contains(lines[4], "2m0s") {
+		t.Errorf("unexpected durations:\n%s", out)
+	}
+}
+
+func TestMeasureTracesStages(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer(tracerName)
+	ctx, root := tracer.Start(context.Background(), "pipeline")
+
+	rec := newStageRecorder(newLogger(io.Discard, logFormatText, logNormal)).withTracing(ctx, tracer)
+	rec.measure(stageBuild, func() error { return nil })
+	rec.measure(stageTest, func() error { return errors.New("boom") })
+	root.End()
+
+	ended := spans.Ended()
+	if len(ended) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(ended))
+	}
+	for i, want := range []struct {
+		name string
+		code codes.Code
+	}{{stageBuild, codes.Ok}, {stageTest, codes.Error}} {
+		span := ended[i]
+		if span.Name() != want.name || span.Status().Code != want.code {
+			t.Errorf("span %d = %s (%v), want %s (%v)", i, span.Name(), span.Status().Code, want.name, want.code)
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("span %s is not a child of the pipeline span", span.Name())
+		}
+	}
+	if got := runID(root); got != root.SpanContext().TraceID().String() {
+		t.Errorf("runID = %q, want the trace ID", got)
+	}
+}
+
+func TestFormatTimingsResults(t *testing.T) {
+	out := formatTimings([]stageTiming{
+		{Name: "build", Duration: 90 * time.Second},
+		{Name: "test", Duration: 30 * time.Second, Failed: true},
+	}, 2*time.Minute)
+
+	want := "STAGE  DURATION  RESULT\n" +
+		"build  1m30s     pass\n" +
+		"test   30s       FAIL\n" +
+		"total  2m0s\n"
+	if out != want {
+		t.Errorf("formatTimings =\n%q\nwant\n%q", out, want)
+	}
+}
@@ -0,0 +1,43 @@
+package pipeline
+
+import (
+	"dagger.io/dagger"
+)
+
+// release channels accepted wherever a toolchain version is
+var channels = []string{"stable", "beta", "nightly"}
+
+// isChannel reports whether toolchain names a release channel rather than
+// a pinned version.
+func isChannel(toolchain string) bool {
+	for _, ch := range channels {
+		if toolchain == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// toolchainContainer returns a rust container for a pinned version or a
+// release channel, running on platform (the host's when empty). The
+// official images are only tagged by version, so channels are installed
+// with rustup on top of the latest image.
+func toolchainContainer(client *dagger.Client, toolchain string, platform dagger.Platform) *dagger.Container {
+	ctr := client.Container(dagger.ContainerOpts{Platform: platform}).From(toolchainImage(toolchain))
+	switch toolchain {
+	case "beta", "nightly":
+		return ctr.
+			WithExec([]string{"rustup", "toolchain", "install", toolchain, "--profile", "minimal"}).
+			WithEnvVariable("RUSTUP_TOOLCHAIN", toolchain)
+	default:
+		return ctr
+	}
+}
+
+// toolchainImage returns the image toolchainContainer starts from.
+func toolchainImage(toolchain string) string {
+	if isChannel(toolchain) {
+		return "rust:latest"
+	}
+	return "rust:" + toolchain
+}
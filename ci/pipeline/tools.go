@@ -0,0 +1,23 @@
+package pipeline
+
+import (
+	"dagger.io/dagger"
+)
+
+// toolImage builds the cargo subcommands used by optional stages. It tracks
+// the latest stable release because these tools routinely need a newer
+// compiler than the one the project pins.
+const toolImage = "rust:latest"
+
+// cargoBinDir is where cargo installs binaries in the rust images.
+const cargoBinDir = "/usr/local/cargo/bin"
+
+// withCargoTool installs crate in a container of its own and copies the
+// resulting binary into rust. Installing it separately keeps the (slow)
+// install cached by Dagger independently of the project sources.
+func withCargoTool(client *dagger.Client, rust *dagger.Container, crate string) *dagger.Container {
+	bin := cargoBinDir + "/" + crate
+	tool := client.Container().From(toolImage).
+		WithExec([]string{"cargo", "install", "--locked", crate})
+	return rust.WithFile(bin, tool.File(bin))
+}
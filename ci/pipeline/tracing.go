@@ -0,0 +1,63 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName names the pipeline's tracer and its service in traces.
+const tracerName = "merlin-ci"
+
+// otlpEndpointEnvs enable tracing when any of them is set. The exporter
+// reads them, and the other OTEL_EXPORTER_OTLP_* variables, itself.
+var otlpEndpointEnvs = []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"}
+
+// setupTracing returns a tracer exporting spans over OTLP/HTTP and a
+// function flushing them, or a no-op tracer when no endpoint is configured.
+func setupTracing(ctx context.Context) (trace.Tracer, func(context.Context) error, error) {
+	if !tracingEnabled() {
+		return noop.NewTracerProvider().Tracer(tracerName), func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(tracerName))),
+	)
+	return provider.Tracer(tracerName), provider.Shutdown, nil
+}
+
+// tracingEnabled reports whether an OTLP endpoint is configured.
+func tracingEnabled() bool {
+	for _, name := range otlpEndpointEnvs {
+		if os.Getenv(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// runID identifies the run in logs: the trace ID of span when it is
+// recorded, so logs and traces can be joined, and a random ID otherwise.
+func runID(span trace.Span) string {
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
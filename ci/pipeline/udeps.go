@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const stageUdeps = "udeps"
+
+// udepsKinds are the dependency tables cargo udeps reports on, in the
+// order they are listed.
+var udepsKinds = []string{"normal", "development", "build"}
+
+// udepsReport is the subset of `cargo udeps --output json` listing the
+// unused dependencies, keyed by package id.
+type udepsReport struct {
+	Success    bool `json:"success"`
+	UnusedDeps map[string]struct {
+		Normal      []string `json:"normal"`
+		Development []string `json:"development"`
+		Build       []string `json:"build"`
+	} `json:"unused_deps"`
+}
+
+// unusedDeps maps a crate to its unused dependencies, each suffixed with
+// the table it is declared in unless that is [dependencies].
+type unusedDeps map[string][]string
+
+// parseUdeps reads cargo udeps' JSON report.
+func parseUdeps(output string) (unusedDeps, error) {
+	var report udepsReport
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		return nil, fmt.Errorf("parse cargo udeps output: %w", err)
+	}
+	unused := unusedDeps{}
+	for id, deps := range report.UnusedDeps {
+		var names []string
+		for i, kind := range [][]string{deps.Normal, deps.Development, deps.Build} {
+			for _, name := range kind {
+				if udepsKinds[i] != "normal" {
+					name += " (" + udepsKinds[i] + ")"
+				}
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			unused[packageName(id)] = names
+		}
+	}
+	return unused, nil
+}
+
+// packageName returns the crate name of a cargo package id, which is
+// `name version (source)` before Rust 1.77 and `source#name@version`
+// since.
+func packageName(id string) string {
+	if _, spec, ok := strings.Cut(id, "#"); ok {
+		name, _, _ := strings.Cut(spec, "@")
+		return name
+	}
+	name, _, _ := strings.Cut(id, " ")
+	return name
+}
+
+// String lists the unused dependencies one crate per line.
+func (u unusedDeps) String() string {
+	if len(u) == 0 {
+		return "no unused dependencies"
+	}
+	var b strings.Builder
+	for _, crate := range sortedKeys(u) {
+		fmt.Fprintf(&b, "%s: %s\n", crate, strings.Join(u[crate], ", "))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// udepsArgs runs cargo udeps on every target, so dependencies only the
+// tests or benches use are not reported as unused.
+func udepsArgs(opts Options) []string {
+	return append(append([]string{"cargo", "+nightly", "udeps", "--all-targets", "--output", "json"}, lockArgs(opts)...), workspaceArgs(opts)...)
+}
+
+// runUdeps lists the unused dependencies with cargo udeps. It needs a
+// nightly compiler, so it runs in a nightly container of its own rather
+// than the pinned toolchain's. They only fail the stage when strict.
+func runUdeps(ctx context.Context, client *dagger.Client, rust *dagger.Container, opts Options) (string, error) {
+	nightly := withCargoTool(client, rustContainer(client, containerSources(rust), "nightly", "", opts), "cargo-udeps")
+
+	// cargo udeps exits non-zero when it finds unused dependencies, with
+	// the report still on stdout
+	out, stderr, err := execStreams(ctx, nightly.WithExec(udepsArgs(opts)))
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		out, stderr = execErr.Stdout, execErr.Stderr
+	} else if err != nil {
+		return "", stageFailed(stageUdeps, err)
+	}
+
+	unused, perr := parseUdeps(out)
+	if perr != nil {
+		if err != nil {
+			// it failed before reporting, e.g. because the build broke
+			return "", stageFailed(stageUdeps, err)
+		}
+		return "", fmt.Errorf("%s: %w", stageUdeps, perr)
+	}
+	if len(unused) > 0 && opts.udepsStrict {
+		return "", &stageError{stage: stageUdeps, exitCode: 1, stderr: "unused dependencies:\n" + unused.String()}
+	}
+	// stdout is the JSON report, listed by unused.String
+	return combineStreams(unused.String(), stderr), nil
+}
@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+const udepsOutput = `{"success":false,"unused_deps":{
+"merlin 0.1.0 (path+file:///src)":{"manifest_path":"/src/Cargo.toml","normal":["anyhow","lazy_static"],"development":["mockall"],"build":[]},
+"path+file:///src/crates/core#merlin-core@0.1.0":{"manifest_path":"/src/crates/core/Cargo.toml","normal":[],"development":[],"build":["cc"]},
+"path+file:///src/crates/cli#merlin-cli@0.1.0":{"manifest_path":"/src/crates/cli/Cargo.toml","normal":[],"development":[],"build":[]}
+},"note":"Note: They might be false-positive."}`
+
+func TestParseUdeps(t *testing.T) {
+	unused, err := parseUdeps(udepsOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := unusedDeps{
+		"merlin":      {"anyhow", "lazy_static", "mockall (development)"},
+		"merlin-core": {"cc (build)"},
+	}
+	if !reflect.DeepEqual(unused, want) {
+		t.Errorf("parseUdeps = %v, want %v", unused, want)
+	}
+	if got, want := unused.String(), "merlin: anyhow, lazy_static, mockall (development)\nmerlin-core: cc (build)"; got != want {
+		t.Errorf("String() =\n%s\nwant\n%s", got, want)
+	}
+
+	clean, err := parseUdeps(`{"success":true,"unused_deps":{}}`)
+	if err != nil || clean.String() != "no unused dependencies" {
+		t.Errorf("clean report: %v, %q", err, clean.String())
+	}
+	if _, err := parseUdeps("error: could not compile `merlin`"); err == nil {
+		t.Error("parseUdeps accepted non-JSON output")
+	}
+}
+
+func TestUdepsOptions(t *testing.T) {
+	opts, err := ParseOptions([]string{"-udeps-strict"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.udeps {
+		t.Error("-udeps-strict does not imply -udeps")
+	}
+	var names []string
+	for _, c := range selectChecks(nil, opts, nil, nil) {
+		names = append(names, c.name)
+	}
+	if names[len(names)-1] != stageUdeps {
+		t.Errorf("checks = %v, want udeps selected", names)
+	}
+	if args := udepsArgs(opts); !reflect.DeepEqual(args[:3], []string{"cargo", "+nightly", "udeps"}) {
+		t.Errorf("udepsArgs = %v", args)
+	}
+}
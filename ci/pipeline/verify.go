@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// verifyExport hashes the file at path in ctr with sha256sum and checks
+// that the copy exported to dest on the host matches it, catching an
+// Export that left a truncated or empty file behind.
+func verifyExport(ctx context.Context, ctr *dagger.Container, path, dest string) error {
+	out, err := ctr.WithExec([]string{"sha256sum", path}).Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("hash %s in the container: %w", path, err)
+	}
+	want, _, _ := strings.Cut(strings.TrimSpace(out), " ")
+	return checkDigest(dest, want)
+}
+
+// checkDigest fails unless the SHA-256 digest of the file at path is want.
+func checkDigest(path, want string) error {
+	got, err := sha256File(path)
+	if err != nil {
+		return fmt.Errorf("hash exported %s: %w", path, err)
+	}
+	if got != want {
+		return fmt.Errorf("exported %s does not match the container: sha256 %s on the host, %s in the container", path, got, want)
+	}
+	return nil
+}
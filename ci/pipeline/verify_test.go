@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "merlin")
+	if err := os.WriteFile(path, []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// sha256 of "binary"
+	const sum = "9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd"
+	if err := checkDigest(path, sum); err != nil {
+		t.Errorf("checkDigest with the right sum: %v", err)
+	}
+
+	// a truncated export
+	if err := os.WriteFile(path, nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := checkDigest(path, sum)
+	if err == nil {
+		t.Fatal("checkDigest of an empty file succeeded, want error")
+	}
+	const empty = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if !strings.Contains(err.Error(), sum) || !strings.Contains(err.Error(), empty) {
+		t.Errorf("error %q does not name both hashes", err)
+	}
+}
@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// warningsFile is the report -warnings-report writes to the build directory.
+const warningsFile = "warnings.json"
+
+// warningsReport is the compiler warnings of one build, as written to
+// warnings.json.
+type warningsReport struct {
+	Total    int            `json:"total"`
+	ByLint   map[string]int `json:"by_lint"`
+	Warnings []reportedLint `json:"warnings"`
+	rendered []string       // as cargo printed them, for failing the build
+}
+
+// reportedLint is one warning in warnings.json.
+type reportedLint struct {
+	Lint    string `json:"lint"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// newWarningsReport counts lints by name.
+func newWarningsReport(lints []Lint) warningsReport {
+	r := warningsReport{ByLint: map[string]int{}, Warnings: []reportedLint{}}
+	for _, l := range lints {
+		r.Total++
+		r.ByLint[l.Name]++
+		r.Warnings = append(r.Warnings, reportedLint{Lint: l.Name, File: l.File, Line: l.Line, Column: l.Col, Message: l.Message})
+		r.rendered = append(r.rendered, l.Rendered)
+	}
+	return r
+}
+
+// String summarizes the report, most frequent lint first.
+func (r warningsReport) String() string {
+	if r.Total == 0 {
+		return "no compiler warnings"
+	}
+	// stable on the sorted names, so ties stay alphabetical
+	names := sortedKeys(r.ByLint)
+	sort.SliceStable(names, func(i, j int) bool { return r.ByLint[names[i]] > r.ByLint[names[j]] })
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf("%s %d", name, r.ByLint[name])
+	}
+	return fmt.Sprintf("%d compiler warnings: %s", r.Total, strings.Join(counts, ", "))
+}
+
+// warningsArgs reruns the release build for its JSON messages. The build
+// is already fresh by then, and cargo replays the warnings it cached
+// instead of compiling again.
+func warningsArgs(opts Options) []string {
+	return append(cargoBuildArgs(opts), "--message-format=json")
+}
+
+// collectWarnings writes the warnings of the build in built to
+// warnings.json in the build directory, and fails the build when there
+// are more than opts.maxWarnings of them. A negative budget never fails.
+// It also returns the build's output: cargo's stderr and the report's
+// summary, which stands in for the JSON messages on stdout.
+func collectWarnings(ctx context.Context, built *dagger.Container, opts Options) (warningsReport, string, error) {
+	out, cargoStderr, err := execStreams(ctx, built.WithExec(warningsArgs(opts)))
+	if err != nil {
+		return warningsReport{}, "", stageFailed(stageBuild, err)
+	}
+	lints, err := parseWarnings(out)
+	if err != nil {
+		return warningsReport{}, "", fmt.Errorf("%s: %w", stageBuild, err)
+	}
+
+	report := newWarningsReport(lints)
+	output := combineStreams(report.String(), cargoStderr)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return report, output, err
+	}
+	if err := writeReport(filepath.Join(buildDir, warningsFile), append(data, '\n')); err != nil {
+		return report, output, fmt.Errorf("%s: write %s: %w", stageBuild, warningsFile, err)
+	}
+
+	if opts.maxWarnings >= 0 && report.Total > opts.maxWarnings {
+		// rendered as cargo prints them, so they also turn into annotations
+		stderr := strings.Join(report.rendered, "") + report.String() +
+			fmt.Sprintf("\n%d warnings exceed -max-warnings=%d", report.Total, opts.maxWarnings)
+		return report, output, &stageError{stage: stageBuild, exitCode: 1, stderr: stderr, stdout: cargoStderr}
+	}
+	return report, output, nil
+}
+
+// validateWarnings checks that the report has a host build to read.
+func validateWarnings(opts Options) error {
+	if !opts.warningsReport {
+		return nil
+	}
+	if !opts.enabled(stageBuild) || len(opts.platforms) > 0 {
+		return fmt.Errorf("-warnings-report and -max-warnings require the host build stage and do not support -platforms")
+	}
+	if len(opts.matrix) > 0 || len(opts.featureMatrix) > 0 {
+		return fmt.Errorf("-warnings-report and -max-warnings cannot be combined with a matrix")
+	}
+	return nil
+}
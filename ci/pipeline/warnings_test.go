@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestNewWarningsReport(t *testing.T) {
+	data, err := os.ReadFile("pipeline/testdata/build.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lints, err := parseWarnings(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := newWarningsReport(lints)
+	if report.Total != 3 {
+		t.Errorf("Total = %d, want 3", report.Total)
+	}
+	if want := map[string]int{"unused_variables": 2, "dead_code": 1}; !reflect.DeepEqual(report.ByLint, want) {
+		t.Errorf("ByLint = %v, want %v", report.ByLint, want)
+	}
+	first := reportedLint{Lint: "unused_variables", File: "src/server.rs", Line: 18, Column: 9, Message: "unused variable: `port`"}
+	if report.Warnings[0] != first {
+		t.Errorf("Warnings[0] = %+v, want %+v", report.Warnings[0], first)
+	}
+	if got, want := report.String(), "3 compiler warnings: unused_variables 2, dead_code 1"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := newWarningsReport(nil).String(); got != "no compiler warnings" {
+		t.Errorf("empty report: %q", got)
+	}
+}
+
+func TestWarningsArgs(t *testing.T) {
+	args := warningsArgs(Options{locked: true})
+	if args[len(args)-1] != "--message-format=json" {
+		t.Errorf("warningsArgs = %v", args)
+	}
+	if !reflect.DeepEqual(args[:len(args)-1], cargoBuildArgs(Options{locked: true})) {
+		t.Errorf("warningsArgs %v does not rerun the build %v", args, cargoBuildArgs(Options{locked: true}))
+	}
+}
+
+func TestMaxWarningsImpliesReport(t *testing.T) {
+	opts, err := ParseOptions([]string{"-max-warnings=0"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.warningsReport || opts.maxWarnings != 0 {
+		t.Errorf("warningsReport = %v, maxWarnings = %d", opts.warningsReport, opts.maxWarnings)
+	}
+	if opts, _ := ParseOptions(nil, io.Discard); opts.warningsReport || opts.maxWarnings >= 0 {
+		t.Errorf("default enables the report: %v, %d", opts.warningsReport, opts.maxWarnings)
+	}
+	for _, args := range [][]string{{"-max-warnings=-2"}, {"-warnings-report", "-skip-build"}, {"-warnings-report", "-platforms=linux/amd64,linux/arm64"}} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
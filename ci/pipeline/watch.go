@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/fsnotify/fsnotify"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// watchDebounce is how long the sources must be quiet before a rerun, so
+// that an editor saving several files, or saving via a temporary file,
+// triggers one run.
+const watchDebounce = 300 * time.Millisecond
+
+// watchedFile reports whether a change to path should rerun the pipeline.
+func watchedFile(path string) bool {
+	switch filepath.Base(path) {
+	case "Cargo.toml", "Cargo.lock":
+		return true
+	}
+	return filepath.Ext(path) == ".rs"
+}
+
+// skipWatchDir reports whether a directory holds no sources worth
+// watching: build output and hidden directories such as .git.
+func skipWatchDir(name string) bool {
+	return name == "target" || (strings.HasPrefix(name, ".") && name != ".")
+}
+
+// watchExcludes returns the -source paths -watch ignores: those left out of
+// the upload, which no run would see, and the -fix-out directory, where
+// -clippy-fix and -fmt-fix export sources that would otherwise trigger
+// the next run, forever.
+func watchExcludes(opts Options) []string {
+	excludes := opts.sourceExcludes
+	if rel, ok := sourcePath(opts.source, opts.fixOut); ok {
+		excludes = append(append([]string(nil), excludes...), rel)
+	}
+	return excludes
+}
+
+// watchedDir reports whether the directory path under source may hold
+// sources worth watching.
+func watchedDir(source, path string, excludes []string) bool {
+	if path == source {
+		return true
+	}
+	if skipWatchDir(filepath.Base(path)) {
+		return false
+	}
+	rel, ok := sourcePath(source, path)
+	return !ok || !sourceDirExcluded(rel, excludes)
+}
+
+// addWatchDirs watches root, a directory under source, and every directory
+// below it that may hold sources. fsnotify does not watch recursively.
+func addWatchDirs(w *fsnotify.Watcher, source, root string, excludes []string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && !watchedDir(source, path, excludes) {
+			return filepath.SkipDir
+		}
+		return w.Add(path)
+	})
+}
+
+// debounce waits for the first path on changes, then keeps collecting
+// until none has arrived for quiet, and returns the distinct paths sorted.
+// It returns ctx's error when ctx is done first.
+func debounce(ctx context.Context, changes <-chan string, quiet time.Duration) ([]string, error) {
+	changed := make(map[string]bool)
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case path := <-changes:
+			changed[path] = true
+			timer = time.After(quiet)
+		case <-timer:
+			return sortedKeys(changed), nil
+		}
+	}
+}
+
+// printWatchBanner separates the output of consecutive runs.
+func printWatchBanner(w io.Writer, run int, changed []string) {
+	reason := "initial run"
+	if len(changed) > 0 {
+		reason = strings.Join(changed, ", ") + " changed"
+		if len(changed) > 3 {
+			reason = fmt.Sprintf("%s and %d more changed", strings.Join(changed[:3], ", "), len(changed)-3)
+		}
+	}
+	fmt.Fprintf(w, "\n==== run %d: %s ====\n\n", run, reason)
+}
+
+// watch runs the pipeline, then reruns it whenever a source file under
+// opts.source changes, until interrupted. Every run shares the client and
+// its cache volumes, so reruns only rebuild what changed. A failing run is
+// reported and watching continues.
+func watch(ctx context.Context, client *dagger.Client, opts Options, log *slog.Logger, tracer trace.Tracer) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch: %w", err)
+	}
+	defer w.Close()
+	excludes := watchExcludes(opts)
+	if err := addWatchDirs(w, opts.source, opts.source, excludes); err != nil {
+		return fmt.Errorf("watch %s: %w", opts.source, err)
+	}
+
+	// forward relevant changes, watching directories as they appear
+	changes := make(chan string)
+	go func() {
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if event.Has(fsnotify.Create) {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() && watchedDir(opts.source, event.Name, excludes) {
+						if err := addWatchDirs(w, opts.source, event.Name, excludes); err != nil {
+							log.Warn("watch new directory", "path", event.Name, "error", err)
+						}
+						continue
+					}
+				}
+				if event.Has(fsnotify.Chmod) || !watchedFile(event.Name) {
+					continue
+				}
+				rel, err := filepath.Rel(opts.source, event.Name)
+				if err != nil {
+					rel = event.Name
+				} else if sourceExcluded(filepath.ToSlash(rel), excludes) {
+					continue
+				}
+				select {
+				case changes <- rel:
+				case <-ctx.Done():
+					return
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warn("watch", "error", err)
+			}
+		}
+	}()
+
+	var changed []string
+	for run := 1; ; run++ {
+		printWatchBanner(os.Stdout, run, changed)
+
+		// a manifest or lockfile change rotates the caches
+		if !opts.noCache {
+			if opts.lockKey, err = cacheKey(opts.source); err != nil {
+				log.Error("cache key", "error", err)
+			}
+		}
+		// -timeout bounds each run, not the whole session
+		runCtx, cancel := withRunTimeout(ctx, opts)
+		_, err := runPipeline(runCtx, client, opts, log, tracer)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		fmt.Fprintln(os.Stdout, "watching for changes, press Ctrl-C to stop")
+		if changed, err = debounce(ctx, changes, watchDebounce); err != nil {
+			break
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		log.Info("stopped watching")
+		return nil
+	}
+	return ctx.Err()
+}
+
+// validateWatch rejects -watch with a source that cannot change under it
+// and with stages that should not repeat on every save.
+func validateWatch(opts Options) error {
+	if !opts.watch {
+		return nil
+	}
+	if opts.gitURL != "" {
+		return fmt.Errorf("-watch requires a host -source, not -git-url")
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{{"-publish", opts.publish}, {"-release", opts.release}, {"-fix-inplace", opts.fixInplace}} {
+		if f.set {
+			return fmt.Errorf("-watch cannot be combined with %s", f.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestWatchedFile(t *testing.T) {
+	for path, want := range map[string]bool{
+		"src/main.rs":         true,
+		"Cargo.toml":          true,
+		"crates/x/Cargo.lock": true,
+		"README.md":           false,
+		"src/main.rs~":        false,
+		"ci/build/merlin":     false,
+	} {
+		if got := watchedFile(path); got != want {
+			t.Errorf("watchedFile(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	changes := make(chan string)
+	go func() {
+		for _, path := range []string{"src/lib.rs", "src/main.rs", "src/lib.rs"} {
+			changes <- path
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	got, err := debounce(context.Background(), changes, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"src/lib.rs", "src/main.rs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("debounce = %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := debounce(ctx, changes, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("debounce after cancel = %v, want context.Canceled", err)
+	}
+}
+
+func TestPrintWatchBanner(t *testing.T) {
+	var b strings.Builder
+	printWatchBanner(&b, 1, nil)
+	printWatchBanner(&b, 2, []string{"a.rs", "b.rs", "c.rs", "d.rs", "e.rs"})
+	want := "\n==== run 1: initial run ====\n\n\n==== run 2: a.rs, b.rs, c.rs and 2 more changed ====\n\n"
+	if b.String() != want {
+		t.Errorf("banners = %q, want %q", b.String(), want)
+	}
+}
+
+func TestValidateWatch(t *testing.T) {
+	if _, err := ParseOptions([]string{"-watch", "-skip-build"}, io.Discard); err != nil {
+		t.Errorf("-watch: %v", err)
+	}
+	for _, args := range [][]string{
+		{"-watch", "-git-url=https://github.com/awdemos/merlin.git"},
+		{"-watch", "-clippy-fix", "-fix-inplace"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestAddWatchDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"src/bin", "target/release", ".git/objects", "crates/core/src"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := addWatchDirs(w, root, root, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, path := range w.WatchList() {
+		rel, _ := filepath.Rel(root, path)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+	want := []string{".", "crates", "crates/core", "crates/core/src", "src", "src/bin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("watched %v, want %v", got, want)
+	}
+}
+
+func TestAddWatchDirsExcludes(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"src", "docs/api", "ci/build/fixed/src", "fixed/src", "fixtures/keep"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := Options{
+		source:         root,
+		sourceExcludes: []string{"target", "ci/build", "docs", "fixtures", "!fixtures/keep"},
+		fixOut:         filepath.Join(root, "fixed"),
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := addWatchDirs(w, root, root, watchExcludes(opts)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, path := range w.WatchList() {
+		rel, _ := filepath.Rel(root, path)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+	// the -fix-out exports must not rerun the pipeline
+	want := []string{".", "ci", "fixtures", "fixtures/keep", "src"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("watched %v, want %v", got, want)
+	}
+}
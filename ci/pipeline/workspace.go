@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// workspaceArgs selects the workspace members to build and test. Without
+// any selection cargo uses the default members.
+func workspaceArgs(opts Options) []string {
+	var args []string
+	for _, p := range opts.packages {
+		args = append(args, "-p", p)
+	}
+	if opts.workspace {
+		args = append(args, "--workspace")
+	}
+	for _, p := range opts.exclude {
+		args = append(args, "--exclude", p)
+	}
+	return args
+}
+
+// validateWorkspace checks the combination of member selection flags.
+func validateWorkspace(opts Options) error {
+	if len(opts.packages) > 0 && opts.workspace {
+		return fmt.Errorf("-package and -workspace cannot be combined")
+	}
+	if len(opts.exclude) > 0 && !opts.workspace {
+		return fmt.Errorf("-exclude requires -workspace")
+	}
+	return nil
+}
+
+// workspaceMembers returns the names of the workspace members listed by
+// `cargo metadata --no-deps`, which lists nothing else.
+func workspaceMembers(metadata string) ([]string, error) {
+	var m struct {
+		Packages []struct {
+			Name string `json:"name"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal([]byte(metadata), &m); err != nil {
+		return nil, fmt.Errorf("parse cargo metadata: %w", err)
+	}
+	var names []string
+	for _, p := range m.Packages {
+		names = append(names, p.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// cargoMetadata returns `cargo metadata --no-deps` for the project in rust.
+func cargoMetadata(ctx context.Context, rust *dagger.Container) (string, error) {
+	out, err := rust.WithExec([]string{"cargo", "metadata", "--format-version", "1", "--no-deps"}).Stdout(ctx)
+	if err != nil {
+		return "", stageFailed("cargo metadata", err)
+	}
+	return out, nil
+}
+
+// unknownPackages reports the requested packages that are not members.
+func unknownPackages(requested, members []string) error {
+	known := make(map[string]bool, len(members))
+	for _, m := range members {
+		known[m] = true
+	}
+	var unknown []string
+	for _, p := range requested {
+		if !known[p] {
+			unknown = append(unknown, p)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	return fmt.Errorf("no workspace member named %s (members: %s)", strings.Join(unknown, ", "), strings.Join(members, ", "))
+}
+
+// checkPackages fails early when -package or -exclude names a crate that
+// is not in the workspace, rather than after cargo resolved everything.
+func checkPackages(ctx context.Context, rust *dagger.Container, opts Options) error {
+	requested := append(append([]string(nil), opts.packages...), opts.exclude...)
+	if len(requested) == 0 {
+		return nil
+	}
+	out, err := cargoMetadata(ctx, rust)
+	if err != nil {
+		return err
+	}
+	members, err := workspaceMembers(out)
+	if err != nil {
+		return err
+	}
+	return unknownPackages(requested, members)
+}
@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestWorkspaceArgs(t *testing.T) {
+	opts, err := ParseOptions([]string{"-package=merlin", "-package=merlin-router"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"cargo", "build", "--release", "-p", "merlin", "-p", "merlin-router"}
+	if got := cargoBuildArgs(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("cargoBuildArgs = %q, want %q", got, want)
+	}
+
+	opts, err = ParseOptions([]string{"-workspace", "-exclude=xtask"}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"cargo", "test", "--workspace", "--exclude", "xtask", "--lib", "--bins", "--tests"}
+	if got := cargoTestArgs(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("cargoTestArgs = %q, want %q", got, want)
+	}
+
+	if got := workspaceArgs(Options{}); got != nil {
+		t.Errorf("workspaceArgs without a selection = %q, want the default members", got)
+	}
+
+	for _, args := range [][]string{
+		{"-package=merlin", "-workspace"},
+		{"-exclude=xtask"},
+	} {
+		if _, err := ParseOptions(args, io.Discard); err == nil {
+			t.Errorf("ParseOptions(%v) succeeded, want error", args)
+		}
+	}
+}
+
+func TestWorkspaceMembers(t *testing.T) {
+	const metadata = `{"packages":[{"name":"merlin-router","id":"path+file:///src/router#0.1.0"},{"name":"merlin","id":"path+file:///src#0.1.0"}],"workspace_members":["path+file:///src#0.1.0","path+file:///src/router#0.1.0"],"version":1}`
+	members, err := workspaceMembers(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"merlin", "merlin-router"}; !reflect.DeepEqual(members, want) {
+		t.Errorf("workspaceMembers = %q, want %q", members, want)
+	}
+
+	if err := unknownPackages([]string{"merlin-router"}, members); err != nil {
+		t.Errorf("unknownPackages(member) = %v", err)
+	}
+	err = unknownPackages([]string{"merlin-ruoter"}, members)
+	if want := "no workspace member named merlin-ruoter (members: merlin, merlin-router)"; err == nil || err.Error() != want {
+		t.Errorf("unknownPackages(typo) = %v, want %q", err, want)
+	}
+}